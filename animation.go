@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"math"
+	"sync"
+)
+
+// Operations able to keep every animation frame
+var animationOperations = map[string]bool{"resize": true, "thumbnail": true}
+
+type FrameFunc func(index int, frame *image.Paletted) (*image.Paletted, error)
+
+// processFrames applies fn to every animation frame, running at most
+// limit frames at the same time so a single animated image cannot
+// take over all the available threads. No more frames are scheduled
+// once a frame fails.
+func processFrames(frames []*image.Paletted, limit int, fn FrameFunc) ([]*image.Paletted, error) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+
+	results := make([]*image.Paletted, len(frames))
+	slots := make(chan struct{}, limit)
+
+	for i, frame := range frames {
+		slots <- struct{}{}
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+		wg.Add(1)
+
+		go func(i int, frame *image.Paletted) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			out, err := fn(i, frame)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+				return
+			}
+			results[i] = out
+		}(i, frame)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// isAnimated reports whether the image is an animated GIF, APNG or WebP.
+// Animated images are processed by libvips as their first frame only.
+func isAnimated(buf []byte) bool {
+	switch {
+	case bytes.HasPrefix(buf, []byte("GIF8")):
+		return bytes.Contains(buf, []byte("NETSCAPE2.0"))
+	case bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+		return hasPNGChunk(buf, "acTL")
+	case len(buf) > 20 && string(buf[0:4]) == "RIFF" && string(buf[8:16]) == "WEBPVP8X":
+		return buf[20]&0x02 != 0
+	}
+	return false
+}
+
+// hasPNGChunk looks for the chunk type before the image data chunks.
+func hasPNGChunk(buf []byte, chunk string) bool {
+	for pos := 8; pos+8 <= len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[pos : pos+4]))
+		name := string(buf[pos+4 : pos+8])
+		if name == chunk {
+			return true
+		}
+		if name == "IDAT" || length < 0 {
+			return false
+		}
+		pos += 12 + length
+	}
+	return false
+}
+
+// animatedOperation returns the operation preserving the animation frames
+// for the requested operation, failing if the output cannot hold them.
+func animatedOperation(name string, buf []byte, o ImageOptions) (Operation, error) {
+	if animationOperations[name] == false {
+		return nil, NewError("The preserveanimation param is only supported by resize and thumbnail", BadRequest)
+	}
+	if bytes.HasPrefix(buf, []byte("GIF8")) == false {
+		return nil, NewError("Only animated GIF frames can be preserved by this build", NotImplemented)
+	}
+	if o.Type != "" && o.Type != gifImageType && o.Type != autoImageType {
+		return nil, NewError("Output image format cannot hold animation frames: "+o.Type, BadRequest)
+	}
+	return ResizeAnimation, nil
+}
+
+// ResizeAnimation scales every GIF frame to fit within the requested
+// width and height, or to the exact size if force is defined, keeping
+// the frame delays, disposal methods and loop count.
+func ResizeAnimation(buf []byte, o ImageOptions) (Image, error) {
+	if o.Width == 0 && o.Height == 0 {
+		return Image{}, NewError("Missing required param: height or width", BadRequest)
+	}
+
+	animation, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return Image{}, err
+	}
+
+	width, height := animationSize(animation.Config.Width, animation.Config.Height, o)
+	sx := float64(width) / float64(animation.Config.Width)
+	sy := float64(height) / float64(animation.Config.Height)
+	canvas := image.Rect(0, 0, width, height)
+
+	frames, err := processFrames(animation.Image, o.MaxFrameConcurrency, func(index int, frame *image.Paletted) (*image.Paletted, error) {
+		return scaleFrame(frame, sx, sy, canvas), nil
+	})
+	if err != nil {
+		return Image{}, err
+	}
+
+	animation.Image = frames
+	animation.Config.Width, animation.Config.Height = width, height
+
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, animation); err != nil {
+		return Image{}, err
+	}
+	return Image{Body: out.Bytes(), Mime: "image/gif"}, nil
+}
+
+// animationSize returns the output size, deriving a missing dimension
+// from the aspect ratio.
+func animationSize(width, height int, o ImageOptions) (int, int) {
+	factor := math.Inf(1)
+	if o.Width > 0 {
+		factor = float64(o.Width) / float64(width)
+	}
+	if o.Height > 0 {
+		factor = math.Min(factor, float64(o.Height)/float64(height))
+	}
+	if o.Force && o.Width > 0 && o.Height > 0 {
+		return o.Width, o.Height
+	}
+	return clampInt(int(float64(width)*factor+0.5), 1, math.MaxInt32), clampInt(int(float64(height)*factor+0.5), 1, math.MaxInt32)
+}
+
+// scaleFrame scales the frame and its position within the canvas using
+// nearest neighbor sampling, so the frame palette and transparency hold.
+func scaleFrame(frame *image.Paletted, sx, sy float64, canvas image.Rectangle) *image.Paletted {
+	b := frame.Bounds()
+	area := image.Rect(
+		int(float64(b.Min.X)*sx), int(float64(b.Min.Y)*sy),
+		int(math.Ceil(float64(b.Max.X)*sx)), int(math.Ceil(float64(b.Max.Y)*sy)),
+	).Intersect(canvas)
+	if area.Empty() {
+		area = image.Rect(0, 0, 1, 1)
+	}
+
+	out := image.NewPaletted(area, frame.Palette)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		srcY := clampInt(int((float64(y)+0.5)/sy), b.Min.Y, b.Max.Y-1)
+		for x := area.Min.X; x < area.Max.X; x++ {
+			srcX := clampInt(int((float64(x)+0.5)/sx), b.Min.X, b.Max.X-1)
+			out.SetColorIndex(x, y, frame.ColorIndexAt(srcX, srcY))
+		}
+	}
+	return out
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessFramesBoundedConcurrency(t *testing.T) {
+	frames := make([]*image.Paletted, 12)
+	for i := range frames {
+		frames[i] = image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9)
+	}
+
+	var mutex sync.Mutex
+	var running, peak int
+
+	out, err := processFrames(frames, 3, func(i int, frame *image.Paletted) (*image.Paletted, error) {
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return frame, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(frames) {
+		t.Fatalf("Invalid number of frames: %d", len(out))
+	}
+	for i := range frames {
+		if out[i] != frames[i] {
+			t.Fatalf("Frame %d is out of order", i)
+		}
+	}
+	if peak > 3 {
+		t.Fatalf("Frame concurrency limit exceeded: %d", peak)
+	}
+}
+
+func TestProcessFramesError(t *testing.T) {
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9),
+		image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9),
+	}
+
+	_, err := processFrames(frames, 2, func(i int, frame *image.Paletted) (*image.Paletted, error) {
+		if i == 1 {
+			return nil, errors.New("oops")
+		}
+		return frame, nil
+	})
+	if err == nil || err.Error() != "oops" {
+		t.Fatalf("Expected frame error, got: %v", err)
+	}
+
+	// Frames after the failed one are not processed
+	frames = append(frames, frames...)
+	var calls int32
+	processFrames(frames, 1, func(i int, frame *image.Paletted) (*image.Paletted, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("oops")
+	})
+	if calls != 1 {
+		t.Errorf("No frames must be scheduled after an error: %d", calls)
+	}
+}
+
+func animatedPNG(t *testing.T) []byte {
+	buf, err := ioutil.ReadFile("fixtures/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert an acTL chunk right after the IHDR chunk
+	chunk := []byte("acTL\x00\x00\x00\x02\x00\x00\x00\x00")
+	actl := make([]byte, 4, 4+len(chunk)+4)
+	binary.BigEndian.PutUint32(actl, uint32(len(chunk)-4))
+	actl = append(actl, chunk...)
+	actl = append(actl, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(actl[len(actl)-4:], crc32.ChecksumIEEE(chunk))
+
+	ihdrEnd := 8 + 12 + 13
+	return append(append(append([]byte{}, buf[:ihdrEnd]...), actl...), buf[ihdrEnd:]...)
+}
+
+func TestIsAnimated(t *testing.T) {
+	still, _ := ioutil.ReadFile("fixtures/test.png")
+	jpeg, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	cases := []struct {
+		buf      []byte
+		expected bool
+	}{
+		{animatedPNG(t), true},
+		{still, false},
+		{jpeg, false},
+		{[]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00!\xff\x0bNETSCAPE2.0"), true},
+		{[]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), false},
+		{[]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x02\x00\x00\x00"), true},
+		{[]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x10\x00\x00\x00"), false},
+	}
+
+	for i, test := range cases {
+		if isAnimated(test.buf) != test.expected {
+			t.Errorf("Invalid animation detection for case %d", i)
+		}
+	}
+}
+
+func TestAnimatedImageModes(t *testing.T) {
+	buf := animatedPNG(t)
+
+	cases := []struct {
+		strict bool
+		query  string
+		status int
+	}{
+		{false, "?width=100", 200},
+		{true, "?width=100", 422},
+		{true, "?width=100&frame=0", 200},
+		{false, "?width=100&frame=2", 422},
+	}
+
+	for _, test := range cases {
+		ts := testServer(optionsController(Resize, ServerOptions{StrictAnimation: test.strict}))
+		res, err := http.Post(ts.URL+test.query, "image/png", bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s (strict: %v): %d", test.query, test.strict, res.StatusCode)
+		}
+	}
+}
+
+func animatedGIF(t *testing.T) []byte {
+	animation := &gif.GIF{LoopCount: 3}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette.Plan9)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i * 50)
+		}
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, (i+1)*10)
+		animation.Disposal = append(animation.Disposal, gif.DisposalBackground)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPreserveAnimation(t *testing.T) {
+	LoadSources(ServerOptions{})
+	ts := httptest.NewServer(NewServerMux(ServerOptions{}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/resize?width=20&preserveanimation=true", "image/gif", bytes.NewReader(animatedGIF(t)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/gif" {
+		t.Fatalf("Invalid response: %s %s", res.Status, res.Header.Get("Content-Type"))
+	}
+
+	animation, err := gif.DecodeAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(animation.Image) != 3 || animation.LoopCount != 3 {
+		t.Fatalf("Invalid animation: %d frames, loop count %d", len(animation.Image), animation.LoopCount)
+	}
+	if animation.Config.Width != 20 || animation.Config.Height != 10 {
+		t.Errorf("Invalid animation size: %dx%d", animation.Config.Width, animation.Config.Height)
+	}
+	for i, delay := range animation.Delay {
+		if delay != (i+1)*10 || animation.Disposal[i] != gif.DisposalBackground {
+			t.Errorf("Invalid frame %d delay or disposal: %d", i, delay)
+		}
+		if animation.Image[i].Pix[0] != uint8(i*50) {
+			t.Errorf("Invalid frame %d content", i)
+		}
+	}
+}
+
+func TestGIFFirstFrame(t *testing.T) {
+	LoadSources(ServerOptions{})
+	ts := httptest.NewServer(NewServerMux(ServerOptions{}))
+	defer ts.Close()
+
+	var static bytes.Buffer
+	if err := gif.Encode(&static, image.NewPaletted(image.Rect(0, 0, 40, 20), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without preserveanimation, GIF images are processed as their first frame
+	cases := []struct {
+		path   string
+		buf    []byte
+		status int
+	}{
+		{"/resize?width=20", static.Bytes(), 200},
+		{"/resize?width=20", animatedGIF(t), 200},
+		{"/resize?width=20&frame=0", animatedGIF(t), 200},
+		{"/resize?width=20&frame=2", animatedGIF(t), 422},
+	}
+
+	for _, test := range cases {
+		res, err := http.Post(ts.URL+test.path, "image/gif", bytes.NewReader(test.buf))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.path, res.StatusCode)
+		}
+	}
+}
+
+func TestPreserveAnimationErrors(t *testing.T) {
+	LoadSources(ServerOptions{})
+	ts := httptest.NewServer(NewServerMux(ServerOptions{}))
+	defer ts.Close()
+
+	cases := []struct {
+		path   string
+		buf    []byte
+		status int
+	}{
+		{"/resize?width=20&preserveanimation=true&type=jpeg", animatedGIF(t), 400},
+		{"/crop?width=20&preserveanimation=true", animatedGIF(t), 400},
+		{"/resize?preserveanimation=true", animatedGIF(t), 400},
+		{"/resize?width=20&preserveanimation=true", animatedPNG(t), 501},
+	}
+
+	for _, test := range cases {
+		res, err := http.Post(ts.URL+test.path, "image/gif", bytes.NewReader(test.buf))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.path, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// autoColor computes the color from the image itself
+const autoColor = "auto"
+
+// isValidAutoColor reports if the value is auto or an RGB color.
+func isValidAutoColor(value string) bool {
+	if value == autoColor {
+		return true
+	}
+	_, ok := parseRGBColor(value)
+	return ok
+}
+
+// parseRGBColor parses an RGB decimal color, such as 255,200,50, or an
+// hex one, with or without the leading #, such as #ffc832.
+func parseRGBColor(value string) (color.NRGBA, bool) {
+	value = strings.TrimSpace(value)
+	if hex := strings.TrimPrefix(value, "#"); len(hex) == 6 && strings.Contains(value, ",") == false {
+		rgb, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, true
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return color.NRGBA{}, false
+	}
+	var rgb [3]uint8
+	for i, part := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			return color.NRGBA{}, false
+		}
+		rgb[i] = uint8(n)
+	}
+	return color.NRGBA{rgb[0], rgb[1], rgb[2], 255}, true
+}
+
+// backgroundColor resolves the background param for the given image.
+func backgroundColor(img *image.NRGBA, value string) color.NRGBA {
+	if value == autoColor {
+		return dominantColor(img)
+	}
+	c, _ := parseRGBColor(value)
+	return c
+}
+
+// applyBackground flattens the transparency of the source image over the
+// background color before processing, so output types without alpha
+// channel, such as JPEG, do not get the libvips default black background.
+// Output types with transparency keep it, unless flatten is requested.
+// The flattened image is returned as lossless PNG, keeping the input type.
+func applyBackground(buf []byte, o ImageOptions) ([]byte, ImageOptions, error) {
+	if o.Background == "" || hasAlpha(buf) == false {
+		return buf, o, nil
+	}
+	if out := keepImageType(buf, o); isTransparentType(out.Type) && o.Flatten == false {
+		return buf, o, nil
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return nil, o, err
+	}
+	flattened, err := encodeRaster(flattenBackground(img, backgroundColor(img, o.Background)), ImageOptions{})
+	if err != nil {
+		return nil, o, err
+	}
+	return flattened.Body, keepImageType(buf, o), nil
+}
+
+// resizeWithBackground resizes the image to fit, then pads it to the
+// requested size, flattening any transparency over the background color
+// instead of the libvips default black.
+func resizeWithBackground(buf []byte, opts bimg.Options, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+	background := backgroundColor(img, o.Background)
+
+	opts.Embed = false
+	opts.Type = bimg.PNG
+	resized, err := Process(buf, opts)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img, err = decodeRaster(resized.Body)
+	if err != nil {
+		return Image{}, err
+	}
+
+	width, height := o.Width, o.Height
+	if width == 0 || width < img.Bounds().Dx() {
+		width = img.Bounds().Dx()
+	}
+	if height == 0 || height < img.Bounds().Dy() {
+		height = img.Bounds().Dy()
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+	offset := image.Pt((width-img.Bounds().Dx())/2, (height-img.Bounds().Dy())/2)
+	draw.Draw(canvas, img.Bounds().Add(offset), img, img.Bounds().Min, draw.Over)
+
+	return encodeRaster(canvas, keepImageType(buf, o))
+}
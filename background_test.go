@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"testing"
+)
+
+// stripedPNG returns a 200x100 image, mostly red with a blue stripe.
+func stripedPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			c := color.NRGBA{220, 30, 40, 255}
+			if x >= 150 {
+				c = color.NRGBA{20, 40, 230, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return encodeTestPNG(t, img)
+}
+
+func TestDominantColor(t *testing.T) {
+	img, err := decodeRaster(stripedPNG(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := dominantColor(img); c != (color.NRGBA{220, 30, 40, 255}) {
+		t.Errorf("Invalid dominant color: %v", c)
+	}
+
+	if c := dominantColor(image.NewNRGBA(image.Rect(0, 0, 10, 10))); c != (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("Transparent images must default to white: %v", c)
+	}
+}
+
+func TestResizeAutoBackground(t *testing.T) {
+	image, err := Resize(stripedPNG(t), ImageOptions{Width: 200, Height: 200, NoCrop: true, Background: "auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/png" {
+		t.Fatalf("Invalid image type: %s", image.Mime)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 200 {
+		t.Fatalf("Invalid image size: %v", img.Bounds())
+	}
+
+	// The letterbox bars match the dominant color
+	for _, y := range []int{5, 195} {
+		if c := img.NRGBAAt(100, y); c != (color.NRGBA{220, 30, 40, 255}) {
+			t.Errorf("Invalid bar color at %d: %v", y, c)
+		}
+	}
+	if c := img.NRGBAAt(175, 100); c.B < 200 {
+		t.Errorf("The image must be kept within the bars: %v", c)
+	}
+}
+
+func TestResizeColorBackground(t *testing.T) {
+	image, err := Resize(stripedPNG(t), ImageOptions{Width: 200, Height: 200, NoCrop: true, Background: "0,255,0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.NRGBAAt(100, 5); c != (color.NRGBA{0, 255, 0, 255}) {
+		t.Errorf("Invalid bar color: %v", c)
+	}
+}
+
+func TestValidateBackgroundParam(t *testing.T) {
+	for _, value := range []string{"auto", "255,255,255", "0, 10, 20", "#0a0b0c", "0A0B0C"} {
+		if err := validateParams(url.Values{"background": []string{value}}); err != nil {
+			t.Errorf("Valid background rejected: %s", value)
+		}
+	}
+	for _, value := range []string{"dominant", "255,255", "256,0,0", "red", "#0a0b0", "#zzzzzz"} {
+		if err := validateParams(url.Values{"background": []string{value}}); err == nil {
+			t.Errorf("Invalid background accepted: %s", value)
+		}
+	}
+}
+
+// translucentPNG returns a 10x10 image of 50% transparent red.
+func translucentPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{255, 0, 0, 128})
+	}
+	return encodeTestPNG(t, img)
+}
+
+func TestApplyBackground(t *testing.T) {
+	buf := translucentPNG(t)
+
+	flattened, opts, err := applyBackground(buf, ImageOptions{Background: "0,0,255", Type: "jpeg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Type != "jpeg" {
+		t.Errorf("Invalid output type: %s", opts.Type)
+	}
+	img, _ := decodeRaster(flattened)
+	if c := img.NRGBAAt(5, 5); c.A != 255 || math.Abs(float64(c.R)-128) > 1 || c.G != 0 || math.Abs(float64(c.B)-127) > 1 {
+		t.Errorf("Invalid flattened pixel: %v", c)
+	}
+
+	// Output types with transparency keep it, unless flatten is requested
+	if out, _, _ := applyBackground(buf, ImageOptions{Background: "0,0,255"}); bytes.Equal(out, buf) == false {
+		t.Error("PNG output must not be flattened")
+	}
+	flattened, opts, _ = applyBackground(buf, ImageOptions{Background: "#0000ff", Flatten: true})
+	img, _ = decodeRaster(flattened)
+	if c := img.NRGBAAt(5, 5); opts.Type != "png" || c.A != 255 || math.Abs(float64(c.B)-127) > 1 {
+		t.Errorf("Invalid flattened pixel: %v (type: %s)", c, opts.Type)
+	}
+
+	if out, _, _ := applyBackground(stripedPNG(t), ImageOptions{Background: "0,0,255", Type: "jpeg"}); bytes.Equal(out, stripedPNG(t)) == false {
+		t.Error("Images without alpha channel must not be flattened")
+	}
+}
+
+func TestParseRGBColor(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected color.NRGBA
+		ok       bool
+	}{
+		{"255,200,50", color.NRGBA{255, 200, 50, 255}, true},
+		{" 0, 0 ,1", color.NRGBA{0, 0, 1, 255}, true},
+		{"#ffc832", color.NRGBA{255, 200, 50, 255}, true},
+		{"FFC832", color.NRGBA{255, 200, 50, 255}, true},
+		{"#fc3", color.NRGBA{}, false},
+		{"#ggc832", color.NRGBA{}, false},
+		{"256,0,0", color.NRGBA{}, false},
+		{"1,2", color.NRGBA{}, false},
+		{"red", color.NRGBA{}, false},
+	}
+
+	for _, test := range cases {
+		if c, ok := parseRGBColor(test.value); c != test.expected || ok != test.ok {
+			t.Errorf("Invalid color for %q: %v (%v)", test.value, c, ok)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxBatchRenditions  = 10
+	batchReportFilename = "report.json"
+	batchFailuresHeader = "X-Imaginary-Batch-Failures"
+)
+
+// BatchRendition is a single batch output, defined as a JSON object with
+// the operation name, its params and the optional ZIP entry name.
+type BatchRendition struct {
+	Name      string                 `json:"name"`
+	Operation string                 `json:"operation"`
+	Params    map[string]interface{} `json:"params"`
+}
+
+// BatchResult reports the outcome of a rendition in the ZIP report.
+type BatchResult struct {
+	Name      string `json:"name"`
+	Operation string `json:"operation"`
+	File      string `json:"file,omitempty"`
+	Size      int    `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BatchReport struct {
+	Renditions []BatchResult `json:"renditions"`
+	Failures   int           `json:"failures"`
+}
+
+func parseBatchRenditions(value string) ([]BatchRendition, error) {
+	var renditions []BatchRendition
+	if err := json.Unmarshal([]byte(value), &renditions); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("at least one rendition is required")
+	}
+	if len(renditions) > maxBatchRenditions {
+		return nil, fmt.Errorf("max %d renditions are allowed", maxBatchRenditions)
+	}
+
+	names := make(map[string]bool)
+	for i, rendition := range renditions {
+		if _, ok := pipelineOperations[rendition.Operation]; !ok {
+			return nil, fmt.Errorf("unsupported operation: %s", rendition.Operation)
+		}
+
+		// Entries are named by the operation, unless explicitly named
+		name := sanitizeFilename(coalesceString(rendition.Name, rendition.Operation))
+		if name == "" || names[name] {
+			name = rendition.Operation + "-" + strconv.Itoa(i+1)
+		}
+		names[name] = true
+		renditions[i].Name = name
+	}
+	return renditions, nil
+}
+
+// batchOperation returns the operation applying every rendition to the
+// image, packed in a ZIP archive with a report of the renditions. Failed
+// renditions are reported instead of failing the whole batch.
+func batchOperation(o ServerOptions) Operation {
+	return func(buf []byte, opts ImageOptions) (Image, error) {
+		renditions, err := parseBatchRenditions(opts.Operations)
+		if err != nil {
+			return Image{}, NewError("Invalid batch renditions: "+err.Error(), BadRequest)
+		}
+
+		images := make([]Image, len(renditions))
+		report := BatchReport{Renditions: make([]BatchResult, len(renditions))}
+
+		limit := o.MaxBatchConcurrency
+		if limit < 1 {
+			limit = 1
+		}
+		slots := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+
+		for i, rendition := range renditions {
+			slots <- struct{}{}
+			wg.Add(1)
+
+			go func(i int, rendition BatchRendition) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				result := BatchResult{Name: rendition.Name, Operation: rendition.Operation}
+				image, err := runRendition(buf, rendition, opts, o)
+				if err != nil {
+					result.Error = err.Error()
+				} else {
+					result.File = rendition.Name + "." + imageExtension(image.Mime)
+					result.Size = len(image.Body)
+				}
+				images[i], report.Renditions[i] = image, result
+			}(i, rendition)
+		}
+		wg.Wait()
+
+		for _, result := range report.Renditions {
+			if result.Error != "" {
+				report.Failures++
+			}
+		}
+		if report.Failures == len(renditions) {
+			return Image{}, fmt.Errorf("every rendition failed: %s", report.Renditions[0].Error)
+		}
+
+		body, err := zipRenditions(images, report)
+		if err != nil {
+			return Image{}, err
+		}
+
+		image := Image{Body: body, Mime: "application/zip"}
+		if report.Failures > 0 {
+			image.Headers = map[string]string{batchFailuresHeader: strconv.Itoa(report.Failures)}
+		}
+		return image, nil
+	}
+}
+
+// runRendition applies the rendition operation to the image, with the
+// default watermark, if any. The output type of the batch applies to the
+// renditions without explicit type.
+func runRendition(buf []byte, rendition BatchRendition, o ImageOptions, server ServerOptions) (Image, error) {
+	query := url.Values{}
+	for key, value := range rendition.Params {
+		query.Set(key, fmt.Sprint(value))
+	}
+	if err := validateParams(query); err != nil {
+		return Image{}, err
+	}
+
+	opts, err := withServerLimits(buf, withServerSettings(readParams(query), o))
+	if err != nil {
+		return Image{}, err
+	}
+	if opts.Type == "" {
+		opts.Type = o.Type
+	}
+	if opts.Type != "" && isOutputTypeSupported(opts.Type) == false {
+		return Image{}, NewError(ErrOutputFormat.Message+" (got: "+opts.Type+")", BadRequest)
+	}
+
+	opts = withDefaultWatermarkSettings(opts, server)
+	return pipelineOperations[rendition.Operation].Run(buf, opts)
+}
+
+// zipRenditions packs the successful renditions and the report.
+func zipRenditions(images []Image, report BatchReport) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	for i, result := range report.Renditions {
+		if result.Error != "" {
+			continue
+		}
+		entry, err := archive.Create(result.File)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := entry.Write(images[i].Body); err != nil {
+			return nil, err
+		}
+	}
+
+	entry, err := archive.Create(batchReportFilename)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.MarshalIndent(report, "", "  ")
+	if _, err := entry.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
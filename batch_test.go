@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseBatchRenditions(t *testing.T) {
+	renditions, err := parseBatchRenditions(`[
+		{"operation": "thumbnail", "params": {"width": 100}},
+		{"name": "medium", "operation": "resize", "params": {"width": 500}},
+		{"operation": "resize", "params": {"width": 800}},
+		{"name": "medium", "operation": "resize", "params": {"width": 900}}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"thumbnail", "medium", "resize", "resize-4"} {
+		if renditions[i].Name != name {
+			t.Errorf("Invalid rendition name: %s != %s", renditions[i].Name, name)
+		}
+	}
+
+	for _, value := range []string{"", "[]", `[{"operation": "info"}]`, "{}"} {
+		if _, err := parseBatchRenditions(value); err == nil {
+			t.Errorf("Invalid renditions must be rejected: %s", value)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ts := testServer(controller(batchOperation(ServerOptions{MaxBatchConcurrency: 2})))
+	defer ts.Close()
+
+	renditions := `[
+		{"operation": "thumbnail", "params": {"width": 100, "height": 50}},
+		{"name": "large", "operation": "resize", "params": {"width": 150, "type": "png"}},
+		{"name": "broken", "operation": "rotate", "params": {}}
+	]`
+	query := url.Values{"operations": {renditions}}
+	res, err := http.Post(ts.URL+"?"+query.Encode(), "image/png", bytes.NewReader(halfBlackPNG(t)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "application/zip" {
+		t.Errorf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+	if res.Header.Get(batchFailuresHeader) != "1" {
+		t.Errorf("Invalid failures header: %s", res.Header.Get(batchFailuresHeader))
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string][]byte)
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		entries[file.Name], _ = ioutil.ReadAll(reader)
+		reader.Close()
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Invalid number of entries: %d", len(entries))
+	}
+	if err := assertSize(entries["thumbnail.png"], 100, 50); err != nil {
+		t.Error(err)
+	}
+	if err := assertSize(entries["large.png"], 150, 75); err != nil {
+		t.Error(err)
+	}
+
+	var report BatchReport
+	if err := json.Unmarshal(entries[batchReportFilename], &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Failures != 1 || report.Renditions[2].Name != "broken" || report.Renditions[2].Error == "" {
+		t.Errorf("Invalid report: %+v", report)
+	}
+}
+
+func TestBatchFailure(t *testing.T) {
+	ts := testServer(controller(batchOperation(ServerOptions{})))
+	defer ts.Close()
+
+	query := url.Values{"operations": {`[{"operation": "rotate", "params": {}}]`}}
+	res, err := http.Post(ts.URL+"?"+query.Encode(), "image/png", bytes.NewReader(halfBlackPNG(t)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 400 {
+		t.Errorf("Batches without successful renditions must fail: %s", res.Status)
+	}
+}
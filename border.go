@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+)
+
+const removedBorderHeader = "X-Imaginary-Removed-Border"
+
+// Min share of pixels of a row or column which must match the border
+// color, so dust or scan noise does not stop the detection
+const borderMatchRatio = 0.98
+
+// BorderInsets is the size, in pixels, of the border removed from each side.
+type BorderInsets struct {
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+	Left   int `json:"left"`
+}
+
+// RemoveBorder crops a solid border of the given color, or the corners
+// color if auto, from each side independently. The removed size per side
+// is reported in the X-Imaginary-Removed-Border response header.
+func RemoveBorder(buf []byte, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	border := borderColor(img, o.Tolerance)
+	if o.BorderColor != "" && o.BorderColor != autoColor {
+		border, _ = parseRGBColor(o.BorderColor)
+	}
+
+	insets := detectBorder(img, border, o.Tolerance)
+	bounds := img.Bounds()
+	area := image.Rect(bounds.Min.X+insets.Left, bounds.Min.Y+insets.Top, bounds.Max.X-insets.Right, bounds.Max.Y-insets.Bottom)
+
+	image, err := encodeRaster(img.SubImage(area), keepImageType(buf, o))
+	if err != nil {
+		return Image{}, err
+	}
+
+	header, _ := json.Marshal(insets)
+	image.Headers = map[string]string{removedBorderHeader: string(header)}
+	return image, nil
+}
+
+// borderColor returns the corner color matching most of the other
+// corners, preferring the top left one on ties.
+func borderColor(img *image.NRGBA, tolerance int) color.NRGBA {
+	b := img.Bounds()
+	corners := []color.NRGBA{
+		img.NRGBAAt(b.Min.X, b.Min.Y),
+		img.NRGBAAt(b.Max.X-1, b.Min.Y),
+		img.NRGBAAt(b.Max.X-1, b.Max.Y-1),
+		img.NRGBAAt(b.Min.X, b.Max.Y-1),
+	}
+
+	best, matches := corners[0], -1
+	for _, corner := range corners {
+		count := 0
+		for _, other := range corners {
+			if colorMatches(corner, other, tolerance) {
+				count++
+			}
+		}
+		if count > matches {
+			best, matches = corner, count
+		}
+	}
+	return best
+}
+
+// detectBorder measures the border on each side, scanning inwards until
+// a row or column does not match the border color. Images made only of
+// the border color are left untouched.
+func detectBorder(img *image.NRGBA, border color.NRGBA, tolerance int) BorderInsets {
+	b := img.Bounds()
+	row := func(y, x0, x1 int) bool {
+		return lineMatches(img, border, tolerance, x1-x0, func(i int) (int, int) { return x0 + i, y })
+	}
+	column := func(x, y0, y1 int) bool {
+		return lineMatches(img, border, tolerance, y1-y0, func(i int) (int, int) { return x, y0 + i })
+	}
+
+	insets := BorderInsets{}
+	for b.Min.Y+insets.Top < b.Max.Y && row(b.Min.Y+insets.Top, b.Min.X, b.Max.X) {
+		insets.Top++
+	}
+	if b.Min.Y+insets.Top == b.Max.Y {
+		return BorderInsets{}
+	}
+	for row(b.Max.Y-1-insets.Bottom, b.Min.X, b.Max.X) {
+		insets.Bottom++
+	}
+
+	top, bottom := b.Min.Y+insets.Top, b.Max.Y-insets.Bottom
+	for b.Min.X+insets.Left < b.Max.X && column(b.Min.X+insets.Left, top, bottom) {
+		insets.Left++
+	}
+	if b.Min.X+insets.Left == b.Max.X {
+		return BorderInsets{}
+	}
+	for column(b.Max.X-1-insets.Right, top, bottom) {
+		insets.Right++
+	}
+	return insets
+}
+
+func lineMatches(img *image.NRGBA, border color.NRGBA, tolerance, length int, point func(int) (int, int)) bool {
+	misses := 0
+	maxMisses := int(float64(length) * (1 - borderMatchRatio))
+	for i := 0; i < length; i++ {
+		if !colorMatches(img.NRGBAAt(point(i)), border, tolerance) {
+			misses++
+			if misses > maxMisses {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func colorMatches(a, b color.NRGBA, tolerance int) bool {
+	return absInt(int(a.R)-int(b.R)) <= tolerance &&
+		absInt(int(a.G)-int(b.G)) <= tolerance &&
+		absInt(int(a.B)-int(b.B)) <= tolerance
+}
+
+func absInt(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
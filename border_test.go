@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// borderedPNG returns a gray 100x80 image with asymmetric black borders:
+// 10px top, 0px right, 25px bottom and 5px left, with scan noise.
+func borderedPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 105, 115))
+	for y := 0; y < 115; y++ {
+		for x := 0; x < 105; x++ {
+			c := color.NRGBA{6, 4, 8, 255}
+			if y >= 10 && y < 90 && x >= 5 {
+				c = color.NRGBA{128, 140, 150, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	// Dust on the bottom border
+	img.SetNRGBA(50, 100, color.NRGBA{255, 255, 255, 255})
+
+	return encodeTestPNG(t, img)
+}
+
+func TestRemoveBorder(t *testing.T) {
+	image, err := RemoveBorder(borderedPNG(t), ImageOptions{Tolerance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var insets BorderInsets
+	if err := json.Unmarshal([]byte(image.Headers[removedBorderHeader]), &insets); err != nil {
+		t.Fatal(err)
+	}
+	if insets != (BorderInsets{Top: 10, Right: 0, Bottom: 25, Left: 5}) {
+		t.Errorf("Invalid removed border: %#v", insets)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 80 {
+		t.Fatalf("Invalid image size: %v", img.Bounds())
+	}
+	if c := img.NRGBAAt(0, 0); c != (color.NRGBA{128, 140, 150, 255}) {
+		t.Errorf("The border must be fully removed: %v", c)
+	}
+}
+
+func TestRemoveBorderColor(t *testing.T) {
+	// Without tolerance the noisy black border does not match
+	image, err := RemoveBorder(borderedPNG(t), ImageOptions{BorderColor: "0,0,0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Headers[removedBorderHeader] != `{"top":0,"right":0,"bottom":0,"left":0}` {
+		t.Errorf("Invalid removed border: %s", image.Headers[removedBorderHeader])
+	}
+
+	image, err = RemoveBorder(borderedPNG(t), ImageOptions{BorderColor: "0,0,0", Tolerance: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Headers[removedBorderHeader] != `{"top":10,"right":0,"bottom":25,"left":5}` {
+		t.Errorf("Invalid removed border: %s", image.Headers[removedBorderHeader])
+	}
+}
+
+func TestRemoveBorderUniformImage(t *testing.T) {
+	image, err := RemoveBorder(encodeTestPNG(t, image.NewNRGBA(image.Rect(0, 0, 20, 20))), ImageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertSize(image.Body, 20, 20); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveBorderHeader(t *testing.T) {
+	ts := testServer(controller(RemoveBorder))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?tolerance=10", "image/png", bytes.NewReader(borderedPNG(t)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get(removedBorderHeader) != `{"top":10,"right":0,"bottom":25,"left":5}` {
+		t.Errorf("Invalid removed border header: %s", res.Header.Get(removedBorderHeader))
+	}
+}
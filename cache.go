@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Params which define where the image comes from or how the request is
+// served, instead of the processed output
+var cacheIgnoredParams = []string{"key", "url", "file", "deadline", "fetchtimeout", "sign", "errorimage"}
+
+// Params making the output differ on every request, such as random seeds
+var cacheRandomParams = []string{"seed"}
+
+// ImageCache keeps processed images in memory, keyed by the source image
+// content and the requested operation and params, evicting the least
+// recently used entries once the cached images exceed the max size.
+type ImageCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int64
+	maxSize int64
+	hits    int64
+	misses  int64
+}
+
+type cacheEntry struct {
+	key   string
+	image Image
+}
+
+// CacheStats reports the cache usage, with sizes in bytes.
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"maxSize"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func NewImageCache(maxSize int64) *ImageCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &ImageCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		maxSize: maxSize,
+	}
+}
+
+func (c *ImageCache) Get(key string) (Image, bool) {
+	if c == nil || key == "" {
+		return Image{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return Image{}, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).image, true
+}
+
+// Set stores the image, unless it alone exceeds the max cache size.
+func (c *ImageCache) Set(key string, image Image) {
+	size := int64(len(image.Body))
+	if c == nil || key == "" || size > c.maxSize {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, image: image})
+	c.size += size
+}
+
+func (c *ImageCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.image.Body))
+}
+
+// Len returns the number of cached images.
+func (c *ImageCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+func (c *ImageCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{
+		Entries: len(c.entries),
+		Size:    c.size,
+		MaxSize: c.maxSize,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+// imageCacheKey identifies a processed image by the SHA-256 hash of the
+// source image, the endpoint path and its sorted query params.
+// Negotiated output types depend on the request headers, and randomized
+// outputs on nothing at all, so neither is cacheable.
+func imageCacheKey(buf []byte, path string, query url.Values) string {
+	if parseImageTypeName(query.Get("type")) == autoImageType || parseImageTypeName(query.Get("format")) == autoImageType {
+		return ""
+	}
+	for _, key := range cacheRandomParams {
+		if query.Get(key) != "" {
+			return ""
+		}
+	}
+
+	params := url.Values{}
+	for key, values := range query {
+		if len(values) > 0 && values[0] != "" {
+			params[key] = values
+		}
+	}
+	for _, key := range cacheIgnoredParams {
+		params.Del(key)
+	}
+
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]) + path + "?" + params.Encode()
+}
+
+// requestCacheKey returns the cache key of the request source image, for
+// the params resolved by profiles and rules and the resolved output type,
+// since each image source can default to a different one. Source images
+// over maxSourceSize bytes, if defined, are not hashed, bounding the cost
+// for large uploads, and processed uncached.
+func requestCacheKey(r *http.Request, buf []byte, query url.Values, outputType string, maxSourceSize int64) string {
+	if isDefaultImage(r) || (maxSourceSize > 0 && int64(len(buf)) > maxSourceSize) {
+		return ""
+	}
+	if outputType != "" {
+		resolved := url.Values{}
+		for key, values := range query {
+			resolved[key] = values
+		}
+		resolved.Set("type", outputType)
+		query = resolved
+	}
+	return imageCacheKey(buf, r.URL.Path, query)
+}
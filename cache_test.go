@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestImageCacheEviction(t *testing.T) {
+	cache := NewImageCache(10)
+	cache.Set("a", Image{Body: []byte("aaaa"), Mime: "image/png"})
+	cache.Set("b", Image{Body: []byte("bbbb"), Mime: "image/png"})
+
+	// Reading an entry makes it the most recently used one
+	cache.Get("a")
+	cache.Set("c", Image{Body: []byte("cccc"), Mime: "image/png"})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("The least recently used entry must be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok || cache.Len() != 2 {
+		t.Error("Invalid cache entries")
+	}
+
+	cache.Set("large", Image{Body: make([]byte, 11)})
+	if _, ok := cache.Get("large"); ok || cache.Len() != 2 {
+		t.Error("Images larger than the cache must not be stored")
+	}
+
+	var disabled *ImageCache = NewImageCache(0)
+	disabled.Set("a", Image{})
+	if _, ok := disabled.Get("a"); ok {
+		t.Error("A disabled cache must not store images")
+	}
+}
+
+func TestImageCacheKey(t *testing.T) {
+	buf := []byte("image")
+	key := imageCacheKey(buf, "/resize", url.Values{"w": {"100"}, "h": {"50"}})
+	if key == "" {
+		t.Fatal("Missing cache key")
+	}
+
+	same := []url.Values{
+		{"h": {"50"}, "w": {"100"}},
+		{"w": {"100"}, "h": {"50"}, "file": {"image.jpg"}, "key": {"secret"}},
+		{"w": {"100"}, "h": {"50"}, "quality": {""}},
+	}
+	for _, query := range same {
+		if other := imageCacheKey(buf, "/resize", query); other != key {
+			t.Errorf("Equivalent params must share the cache key: %v", query)
+		}
+	}
+
+	different := []string{
+		imageCacheKey([]byte("other"), "/resize", url.Values{"w": {"100"}, "h": {"50"}}),
+		imageCacheKey(buf, "/crop", url.Values{"w": {"100"}, "h": {"50"}}),
+		imageCacheKey(buf, "/resize", url.Values{"w": {"100"}, "h": {"60"}}),
+	}
+	for _, other := range different {
+		if other == key {
+			t.Error("Different images, operations or params must not share the cache key")
+		}
+	}
+
+	for _, query := range []url.Values{{"seed": {"42"}}, {"type": {"auto"}}} {
+		if key := imageCacheKey(buf, "/resize", query); key != "" {
+			t.Errorf("Non-deterministic outputs must not be cached: %v", query)
+		}
+	}
+}
+
+func TestImageCacheStats(t *testing.T) {
+	opts := ServerOptions{Cache: NewImageCache(1024 * 1024 * 10)}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	for i := 0; i < 2; i++ {
+		res, err := http.Post(ts.URL+"/resize?width=300", "image/jpeg", bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/cache/stats")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+
+	var stats CacheStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Size == 0 {
+		t.Errorf("Invalid cache stats: %#v", stats)
+	}
+}
+
+func TestUploadCache(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	large := int64(len(buf))
+
+	cases := []struct {
+		maxSourceSize int64
+		uploads       [][2]string
+		hits          int64
+	}{
+		// Identical uploads hit the cache whatever the params order
+		{0, [][2]string{{"large.jpg", "width=300&type=png"}, {"large.jpg", "type=png&width=300"}}, 1},
+		{0, [][2]string{{"large.jpg", "width=300"}, {"imaginary.jpg", "width=300"}, {"large.jpg", "width=200"}}, 0},
+		// Uploads over the hashed size are processed uncached
+		{large, [][2]string{{"large.jpg", "width=300"}, {"large.jpg", "width=300"}}, 1},
+		{large - 1, [][2]string{{"large.jpg", "width=300"}, {"large.jpg", "width=300"}}, 0},
+	}
+
+	for _, test := range cases {
+		opts := ServerOptions{Cache: NewImageCache(1024 * 1024 * 10), CacheMaxSourceSize: test.maxSourceSize}
+		LoadSources(opts)
+		ts := httptest.NewServer(NewServerMux(opts))
+
+		for _, upload := range test.uploads {
+			body, _ := ioutil.ReadFile("fixtures/" + upload[0])
+			res, err := http.Post(ts.URL+"/resize?"+upload[1], "image/jpeg", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal("Cannot perform the request")
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Fatalf("Invalid response status: %s", res.Status)
+			}
+		}
+		ts.Close()
+
+		if hits := opts.Cache.Stats().Hits; hits != test.hits {
+			t.Errorf("Invalid cache hits for %v (max source size: %d): %d", test.uploads, test.maxSourceSize, hits)
+		}
+	}
+}
+
+func TestCacheResolvedParams(t *testing.T) {
+	types, err := ParseSourceDefaultTypes("fs=png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles := Profiles{"inline": {"width": "100", "encoding": "base64"}}
+	opts := ServerOptions{Mount: "fixtures", SourceDefaultTypes: types, Profiles: profiles, Cache: NewImageCache(1024 * 1024 * 10)}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	get := func(path string) *http.Response {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		return res
+	}
+
+	// The same image read from different sources defaults to different types
+	res := get("/resize?width=300&file=large.jpg")
+	res.Body.Close()
+	if res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid file source type: %s", res.Header.Get("Content-Type"))
+	}
+	res, err = http.Post(ts.URL+"/resize?width=300", "image/jpeg", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Upload must not be served the cached file source type: %s", res.Header.Get("Content-Type"))
+	}
+
+	// Hits honor the profile params and reply the same headers
+	for i := 0; i < 2; i++ {
+		res := get("/resize?profile=inline&file=large.jpg")
+		var image Base64Image
+		err := json.NewDecoder(res.Body).Decode(&image)
+		res.Body.Close()
+		if err != nil || image.ContentType != "image/png" || image.Width != 100 {
+			t.Fatalf("Invalid profile encoding on request %d: %v", i, err)
+		}
+		if res.Header.Get(operationsHeader) == "" {
+			t.Errorf("Missing %s header on request %d", operationsHeader, i)
+		}
+	}
+	if hits := opts.Cache.Stats().Hits; hits != 1 {
+		t.Errorf("Invalid cache hits: %d", hits)
+	}
+}
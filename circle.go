@@ -0,0 +1,105 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Circle crops the image to a square, covering the requested size, and
+// masks it with a circle, optionally surrounded by a border ring. The
+// output is PNG, unless WebP is requested, to keep the transparency, or
+// another type flattened over the background color.
+func Circle(buf []byte, o ImageOptions) (Image, error) {
+	if o.Type != "" && isTransparentType(o.Type) == false && o.Background == "" {
+		return Image{}, NewError("Circle output image type must support transparency (png or webp), or define a background color", BadRequest)
+	}
+
+	size := circleSize(buf, o)
+	if size == 0 {
+		return Image{}, NewError("Cannot read the image size", BadRequest)
+	}
+	if o.BorderWidth*2 >= size {
+		return Image{}, NewError("Invalid borderwidth param: must be lower than half the image size", BadRequest)
+	}
+
+	opts := BimgOptions(o)
+	opts.Width, opts.Height = size, size
+	opts.Crop = true
+	opts.Gravity = cropGravity(buf, o.Gravity, size, size)
+	opts.Enlarge = true
+	opts.Type = bimg.PNG
+	square, err := Process(buf, opts)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img, err := decodeRaster(square.Body)
+	if err != nil {
+		return Image{}, err
+	}
+
+	ring := color.NRGBA{255, 255, 255, 255}
+	if o.BorderColor == autoColor {
+		ring = dominantColor(img)
+	} else if o.BorderColor != "" {
+		ring, _ = parseRGBColor(o.BorderColor)
+	}
+
+	maskCircle(img, o.BorderWidth, ring)
+	if o.Type != "" && isTransparentType(o.Type) == false {
+		img = flattenBackground(img, backgroundColor(img, o.Background))
+	}
+
+	if o.Type == "" {
+		o.Type = "png"
+	}
+	return encodeRaster(img, o)
+}
+
+// circleSize returns the square side: the smallest requested dimension,
+// or the smallest image dimension if none is requested.
+func circleSize(buf []byte, o ImageOptions) int {
+	if o.Width > 0 && (o.Height == 0 || o.Width < o.Height) {
+		return o.Width
+	}
+	if o.Height > 0 {
+		return o.Height
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return 0
+	}
+	if size.Width < size.Height {
+		return size.Width
+	}
+	return size.Height
+}
+
+// maskCircle makes transparent the pixels outside the inscribed circle,
+// antialiasing the edge, and paints the inner border ring.
+func maskCircle(img *image.NRGBA, borderWidth int, ring color.NRGBA) {
+	bounds := img.Bounds()
+	radius := float64(bounds.Dx()) / 2
+	inner := radius - float64(borderWidth)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dx := float64(x-bounds.Min.X) + 0.5 - radius
+			dy := float64(y-bounds.Min.Y) + 0.5 - radius
+			distance := math.Sqrt(dx*dx + dy*dy)
+
+			if borderWidth > 0 {
+				blendPixel(img, x, y, ring, clampUnit(distance-inner+0.5))
+			}
+			i := img.PixOffset(x, y)
+			img.Pix[i+3] = uint8(float64(img.Pix[i+3]) * clampUnit(radius-distance+0.5))
+		}
+	}
+}
+
+func clampUnit(value float64) float64 {
+	return math.Max(0, math.Min(1, value))
+}
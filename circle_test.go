@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestCircle(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, err := Circle(buf, ImageOptions{Width: 100, Height: 120})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/png" {
+		t.Fatalf("Invalid image type: %s", image.Mime)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 100 {
+		t.Fatalf("Invalid image size: %v", img.Bounds())
+	}
+
+	for _, corner := range [][2]int{{0, 0}, {99, 0}, {0, 99}, {99, 99}, {10, 10}} {
+		if c := img.NRGBAAt(corner[0], corner[1]); c.A != 0 {
+			t.Errorf("Corner pixel must be transparent: %v %v", corner, c)
+		}
+	}
+	if c := img.NRGBAAt(50, 50); c.A != 255 {
+		t.Errorf("Center pixel must be opaque: %v", c)
+	}
+}
+
+func TestCircleBorder(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, err := Circle(buf, ImageOptions{Width: 100, BorderWidth: 5, BorderColor: "255,0,0", Type: "webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/webp" {
+		t.Fatalf("Invalid image type: %s", image.Mime)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.NRGBAAt(50, 2); c.R != 255 || c.G != 0 || c.B != 0 || c.A != 255 {
+		t.Errorf("Invalid border ring pixel: %v", c)
+	}
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Errorf("Corner pixel must be transparent: %v", c)
+	}
+}
+
+func TestCircleInvalidParams(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	if _, err := Circle(buf, ImageOptions{Width: 100, Type: "jpeg"}); err == nil {
+		t.Error("Output image types without transparency must be rejected")
+	}
+	if _, err := Circle(buf, ImageOptions{Width: 100, BorderWidth: 50}); err == nil {
+		t.Error("Border rings covering the image must be rejected")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"strings"
+)
+
+// CMYK JPEG handling modes
+const (
+	CMYKAdobe   = "adobe"
+	CMYKInvert  = "invert"
+	CMYKLibvips = "libvips"
+)
+
+const jpegMarkerAPP14 = 0xee
+
+var adobeHeader = []byte("Adobe")
+
+// adobeSegment is the APP14 segment marking the CMYK channels as stored
+// inverted, with no color transform.
+var adobeSegment = []byte{0xff, jpegMarkerAPP14, 0x00, 0x0e, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+// ParseCMYKMode parses the CMYK JPEG handling mode, defaulting to adobe.
+func ParseCMYKMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "":
+		return CMYKAdobe, nil
+	case CMYKAdobe, CMYKInvert, CMYKLibvips:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid CMYK JPEG mode: %s", value)
+	}
+}
+
+// jpegCMYK reports whether the JPEG frame has four color components, and
+// whether the image has the Adobe APP14 marker.
+func jpegCMYK(buf []byte) (cmyk bool, adobe bool) {
+	segments, _ := splitJPEGSegments(buf)
+	for _, segment := range segments {
+		marker := segment[1]
+		if marker == jpegMarkerAPP14 && bytes.HasPrefix(segment[4:], adobeHeader) {
+			adobe = true
+		}
+		// SOF markers, except DHT, JPG and DAC which share the range
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc && len(segment) > 9 {
+			cmyk = segment[9] == 4
+		}
+	}
+	return cmyk, adobe
+}
+
+// convertCMYK converts CMYK JPEG images to RGB JPEG, since libvips ignores
+// the Adobe APP14 marker and their colors come out inverted. In adobe mode
+// only images with the marker are converted, while in invert mode every
+// CMYK image is handled as Adobe inverted. Other images are returned as is.
+func convertCMYK(buf []byte, mode string) ([]byte, error) {
+	if mode == CMYKLibvips {
+		return buf, nil
+	}
+
+	cmyk, adobe := jpegCMYK(buf)
+	if !cmyk || (!adobe && mode != CMYKInvert) {
+		return buf, nil
+	}
+	if !adobe {
+		buf = append(append(append([]byte{}, buf[:2]...), adobeSegment...), buf[2:]...)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, NewError("Cannot convert the CMYK JPEG image: "+err.Error(), Unsupported)
+	}
+
+	out := &bytes.Buffer{}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 100}); err != nil {
+		return nil, NewError("Cannot convert the CMYK JPEG image: "+err.Error(), Unsupported)
+	}
+	return keepJPEGMetadata(out.Bytes(), buf), nil
+}
+
+// keepJPEGMetadata copies the EXIF and XMP segments of the source image,
+// so the orientation is still applied. The ICC profile is not kept, since
+// it describes the CMYK channels.
+func keepJPEGMetadata(buf, source []byte) []byte {
+	segments, _ := splitJPEGSegments(source)
+
+	out := append([]byte{}, buf[:2]...)
+	for _, segment := range segments {
+		if segment[1] == jpegMarkerAPP1 {
+			out = append(out, segment...)
+		}
+	}
+	return append(out, buf[2:]...)
+}
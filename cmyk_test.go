@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"testing"
+)
+
+// cmykJPEG builds a baseline JPEG with four unsubsampled components filled
+// with the given channel values, as stored in the file. Every block only
+// has a DC coefficient, coded with a 4 bit code per size category.
+func cmykJPEG(width, height int, stored [4]byte, segments ...[]byte) []byte {
+	out := []byte{0xff, 0xd8}
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+
+	dqt := []byte{0xff, 0xdb, 0x00, 0x43, 0x00}
+	out = append(out, append(dqt, bytes.Repeat([]byte{1}, 64)...)...)
+
+	out = append(out, 0xff, 0xc0, 0x00, 0x14, 0x08, byte(height>>8), byte(height), byte(width>>8), byte(width), 0x04)
+	for id := byte(1); id <= 4; id++ {
+		out = append(out, id, 0x11, 0x00)
+	}
+
+	dc := []byte{0xff, 0xc4, 0x00, 0x1f, 0x00}
+	dc = append(dc, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	out = append(out, append(dc, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)...)
+	ac := []byte{0xff, 0xc4, 0x00, 0x14, 0x10, 1}
+	out = append(out, append(ac, make([]byte, 15+1)...)...)
+
+	out = append(out, 0xff, 0xda, 0x00, 0x0e, 0x04)
+	for id := byte(1); id <= 4; id++ {
+		out = append(out, id, 0x00)
+	}
+	out = append(out, 0x00, 0x3f, 0x00)
+
+	var bits []bool
+	write := func(value, size int) {
+		for i := size - 1; i >= 0; i-- {
+			bits = append(bits, value>>uint(i)&1 == 1)
+		}
+	}
+
+	var previous [4]int
+	blocks := ((width + 7) / 8) * ((height + 7) / 8)
+	for i := 0; i < blocks; i++ {
+		for c := 0; c < 4; c++ {
+			value := 8 * (int(stored[c]) - 128)
+			diff := value - previous[c]
+			previous[c] = value
+
+			size := 0
+			for magnitude := absInt(diff); magnitude > 0; magnitude >>= 1 {
+				size++
+			}
+			write(size, 4)
+			if diff < 0 {
+				diff += 1<<uint(size) - 1
+			}
+			write(diff, size)
+			// End of block
+			write(0, 1)
+		}
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, true)
+	}
+
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		out = append(out, b)
+		if b == 0xff {
+			out = append(out, 0x00)
+		}
+	}
+	return append(out, 0xff, 0xd9)
+}
+
+func decodeRGBAt(t *testing.T, buf []byte) color.NRGBA {
+	img, err := jpeg.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("Cannot decode the converted image: %s", err)
+	}
+	return color.NRGBAModel.Convert(img.At(1, 1)).(color.NRGBA)
+}
+
+func isRed(c color.NRGBA) bool {
+	return c.R > 230 && c.G < 25 && c.B < 25
+}
+
+func TestConvertCMYKAdobe(t *testing.T) {
+	// Adobe stores the red ink values (C=0, M=Y=100%, K=0) inverted
+	buf := cmykJPEG(16, 8, [4]byte{255, 0, 0, 255}, adobeSegment)
+
+	out, err := convertCMYK(buf, CMYKAdobe)
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if cmyk, _ := jpegCMYK(out); cmyk {
+		t.Fatal("The converted image must be RGB")
+	}
+	if c := decodeRGBAt(t, out); !isRed(c) {
+		t.Errorf("Invalid converted color: %v", c)
+	}
+
+	img, _ := jpeg.DecodeConfig(bytes.NewReader(out))
+	if img.Width != 16 || img.Height != 8 {
+		t.Errorf("Invalid converted size: %dx%d", img.Width, img.Height)
+	}
+}
+
+func TestConvertCMYKWithoutMarker(t *testing.T) {
+	buf := cmykJPEG(8, 8, [4]byte{255, 0, 0, 255})
+
+	out, err := convertCMYK(buf, CMYKAdobe)
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if !bytes.Equal(out, buf) {
+		t.Error("CMYK images without Adobe marker must be left to libvips")
+	}
+
+	out, err = convertCMYK(buf, CMYKInvert)
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if c := decodeRGBAt(t, out); !isRed(c) {
+		t.Errorf("Invalid converted color: %v", c)
+	}
+}
+
+func TestConvertCMYKLibvips(t *testing.T) {
+	buf := cmykJPEG(8, 8, [4]byte{255, 0, 0, 255}, adobeSegment)
+
+	out, err := convertCMYK(buf, CMYKLibvips)
+	if err != nil || !bytes.Equal(out, buf) {
+		t.Error("CMYK images must be left to libvips")
+	}
+}
+
+func TestConvertCMYKKeepsMetadata(t *testing.T) {
+	exif := append([]byte{0xff, jpegMarkerAPP1, 0x00, 0x10}, append(exifHeader, "MM\x00\x2a\x00\x00\x00\x08"...)...)
+	buf := cmykJPEG(8, 8, [4]byte{255, 0, 0, 255}, adobeSegment, exif)
+
+	out, err := convertCMYK(buf, CMYKAdobe)
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if !bytes.Contains(out, exif) {
+		t.Error("The EXIF segment must be kept")
+	}
+}
+
+func TestConvertCMYKSkipsRGB(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+
+	out, err := convertCMYK(buf, CMYKInvert)
+	if err != nil || !bytes.Equal(out, buf) {
+		t.Error("RGB images must be returned as is")
+	}
+}
+
+func TestParseCMYKMode(t *testing.T) {
+	cases := map[string]string{"": CMYKAdobe, "adobe": CMYKAdobe, " Invert ": CMYKInvert, "libvips": CMYKLibvips}
+	for value, expected := range cases {
+		if mode, err := ParseCMYKMode(value); err != nil || mode != expected {
+			t.Errorf("Invalid mode for %q: %s", value, mode)
+		}
+	}
+
+	if _, err := ParseCMYKMode("rgb"); err == nil {
+		t.Error("Invalid modes must be rejected")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// Bits kept per channel when grouping similar colors
+const dominantColorBits = 4
+
+// Max number of pixels sampled to find the dominant color
+const dominantColorSamples = 65536
+
+const defaultPaletteColors = 5
+
+// Background used for images without visible pixels
+var transparentBackground = color.NRGBA{255, 255, 255, 255}
+
+type paletteColor struct {
+	color color.NRGBA
+	count int
+}
+
+type PaletteColor struct {
+	Hex        string  `json:"hex"`
+	Percentage float64 `json:"percentage"`
+}
+
+type ImagePalette struct {
+	Colors       []PaletteColor `json:"colors"`
+	Background   string         `json:"background"`
+	Transparency float64        `json:"transparency"`
+}
+
+// dominantColor returns the mean color of the most populated group of
+// similar colors, or white if no pixel is visible.
+func dominantColor(img *image.NRGBA) color.NRGBA {
+	palette, _ := colorPalette(img)
+	if len(palette) == 0 {
+		return transparentBackground
+	}
+	return palette[0].color
+}
+
+// colorPalette groups a sample of the pixels by similar colors, returning
+// the mean color of each group, sorted by the number of pixels, and the
+// number of sampled pixels. Mostly transparent pixels are ignored.
+func colorPalette(img *image.NRGBA) ([]paletteColor, int) {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	bounds := img.Bounds()
+	step := int(math.Ceil(math.Sqrt(float64(bounds.Dx()*bounds.Dy()) / dominantColorSamples)))
+	if step < 1 {
+		step = 1
+	}
+
+	shift := uint(8 - dominantColorBits)
+	buckets := make(map[int]*bucket)
+	order := []*bucket{}
+	samples := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			samples++
+			c := img.NRGBAAt(x, y)
+			if c.A < 128 {
+				continue
+			}
+
+			key := int(c.R>>shift)<<(2*dominantColorBits) | int(c.G>>shift)<<dominantColorBits | int(c.B>>shift)
+			group, ok := buckets[key]
+			if !ok {
+				group = &bucket{}
+				buckets[key] = group
+				order = append(order, group)
+			}
+			group.count++
+			group.r += int(c.R)
+			group.g += int(c.G)
+			group.b += int(c.B)
+		}
+	}
+
+	palette := make([]paletteColor, len(order))
+	for i, group := range order {
+		palette[i] = paletteColor{
+			color: color.NRGBA{uint8(group.r / group.count), uint8(group.g / group.count), uint8(group.b / group.count), 255},
+			count: group.count,
+		}
+	}
+	sort.SliceStable(palette, func(i, j int) bool {
+		return palette[i].count > palette[j].count
+	})
+	return palette, samples
+}
+
+// Colors replies with the dominant colors of the image, as a percentage of
+// its visible pixels, and the background color used by background=auto.
+func Colors(buf []byte, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	count := o.Colors
+	if count == 0 {
+		count = defaultPaletteColors
+	}
+
+	palette, samples := colorPalette(img)
+	visible := 0
+	for _, c := range palette {
+		visible += c.count
+	}
+	if len(palette) > count {
+		palette = palette[:count]
+	}
+
+	result := ImagePalette{
+		Colors:       []PaletteColor{},
+		Background:   hexColor(transparentBackground),
+		Transparency: percentage(samples-visible, samples),
+	}
+	for _, c := range palette {
+		result.Colors = append(result.Colors, PaletteColor{hexColor(c.color), percentage(c.count, visible)})
+	}
+	if len(palette) > 0 {
+		result.Background = hexColor(palette[0].color)
+	}
+
+	body, _ := json.Marshal(result)
+	return Image{Body: body, Mime: "application/json"}, nil
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// percentage returns the ratio as a percentage rounded to one decimal.
+func percentage(value, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(value)*1000/float64(total)) / 10
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func readPalette(t *testing.T, buf []byte, o ImageOptions) ImagePalette {
+	img, err := Colors(buf, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Mime != "application/json" {
+		t.Fatalf("Invalid mime type: %s", img.Mime)
+	}
+
+	palette := ImagePalette{}
+	if err := json.Unmarshal(img.Body, &palette); err != nil {
+		t.Fatal(err)
+	}
+	return palette
+}
+
+func TestColors(t *testing.T) {
+	palette := readPalette(t, stripedPNG(t), ImageOptions{})
+	if len(palette.Colors) != 2 {
+		t.Fatalf("Invalid number of colors: %v", palette.Colors)
+	}
+	if c := palette.Colors[0]; c.Hex != "#dc1e28" || c.Percentage != 75 {
+		t.Errorf("Invalid dominant color: %v", c)
+	}
+	if c := palette.Colors[1]; c.Hex != "#1428e6" || c.Percentage != 25 {
+		t.Errorf("Invalid second color: %v", c)
+	}
+	if palette.Background != "#dc1e28" || palette.Transparency != 0 {
+		t.Errorf("Invalid background: %s (%v)", palette.Background, palette.Transparency)
+	}
+
+	palette = readPalette(t, stripedPNG(t), ImageOptions{Colors: 1})
+	if len(palette.Colors) != 1 || palette.Colors[0].Percentage != 75 {
+		t.Errorf("Invalid limited palette: %v", palette.Colors)
+	}
+}
+
+func TestColorsSingleColor(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	palette := readPalette(t, encodeTestPNG(t, img), ImageOptions{})
+	if len(palette.Colors) != 1 || palette.Colors[0] != (PaletteColor{"#ffffff", 100}) {
+		t.Errorf("Invalid palette: %v", palette.Colors)
+	}
+}
+
+func TestColorsTransparent(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 50, 50))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 10})
+
+	palette := readPalette(t, encodeTestPNG(t, img), ImageOptions{})
+	if len(palette.Colors) != 0 {
+		t.Errorf("Transparent images must have no colors: %v", palette.Colors)
+	}
+	if palette.Background != "#ffffff" || palette.Transparency != 100 {
+		t.Errorf("Invalid background: %s (%v)", palette.Background, palette.Transparency)
+	}
+}
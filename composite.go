@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"net/http"
+)
+
+// compositeController composites the overlay image over the base image,
+// both uploaded as the base and overlay fields of a multipart form.
+func compositeController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source, ok := MatchSource(r).(MultiImageSource)
+		if !ok {
+			ErrorReply(w, NewError("Missing base and overlay images, both must be uploaded as multipart/form-data fields", BadRequest))
+			return
+		}
+
+		// Uploads over the max body memory are mapped from disk
+		r, spool := withBodySpool(r)
+		defer spool.Close()
+
+		images, err := source.GetImages(r)
+		if e, ok := err.(Error); ok {
+			ErrorReply(w, e)
+			return
+		}
+		if err != nil {
+			ErrorReply(w, NewError(err.Error(), BadRequest))
+			return
+		}
+
+		for _, name := range []string{"base", "overlay"} {
+			if len(images[name]) == 0 {
+				ErrorReply(w, NewError("Missing required param: "+name, BadRequest))
+				return
+			}
+			if err := o.AllowedHashes.Check(images[name]); err != nil {
+				ErrorReply(w, err.(Error))
+				return
+			}
+		}
+
+		opts := readParams(r.URL.Query())
+		if opts.Type != "" && isOutputTypeSupported(opts.Type) == false {
+			ErrorReply(w, ErrOutputFormat)
+			return
+		}
+
+		image, err := Composite(images["base"], images["overlay"], opts)
+		if e, ok := err.(Error); ok {
+			ErrorReply(w, e)
+			return
+		}
+		if err != nil {
+			ErrorReply(w, NewError("Error while processing the image: "+err.Error(), BadRequest))
+			return
+		}
+
+		writeImage(w, r, image, opts)
+	}
+}
+
+// Composite draws the overlay image over the base image, with its top
+// left corner at the top and left offsets.
+func Composite(buf, overlay []byte, o ImageOptions) (Image, error) {
+	base, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	mark, err := decodeRaster(overlay)
+	if err != nil {
+		return Image{}, NewError("Cannot decode the overlay image: "+err.Error(), BadRequest)
+	}
+
+	opacity := float64(o.Opacity)
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+
+	origin := image.Pt(o.Left, o.Top)
+	if origin.In(base.Bounds()) == false {
+		return Image{}, NewError("Invalid top, left params: overlay out of the base image bounds", BadRequest)
+	}
+
+	area := image.Rectangle{origin, origin.Add(mark.Bounds().Size())}
+	draw.DrawMask(base, area, mark, mark.Bounds().Min, image.NewUniform(colorAlpha(opacity)), image.ZP, draw.Over)
+
+	return encodeRaster(base, keepImageType(buf, o))
+}
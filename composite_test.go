@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func solidPNG(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+	return encodeTestPNG(t, img)
+}
+
+func compositeRequest(t *testing.T, url string, files map[string][]byte) *http.Response {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for name, buf := range files {
+		part, _ := form.CreateFormFile(name, name+".png")
+		part.Write(buf)
+	}
+	form.Close()
+
+	res, err := http.Post(url, form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	return res
+}
+
+func TestComposite(t *testing.T) {
+	opts := ServerOptions{}
+	LoadSources(opts)
+
+	ts := httptest.NewServer(validateImage(Middleware(compositeController(opts), opts), opts))
+	defer ts.Close()
+
+	res := compositeRequest(t, ts.URL+"?top=20&left=30", map[string][]byte{
+		"base":    solidPNG(t, 100, 100, color.White),
+		"overlay": solidPNG(t, 10, 10, color.NRGBA{255, 0, 0, 255}),
+	})
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 100 || size.Y != 100 {
+		t.Fatalf("Invalid image size: %dx%d", size.X, size.Y)
+	}
+
+	cases := []struct {
+		x, y    int
+		overlay bool
+	}{
+		{30, 20, true},
+		{39, 29, true},
+		{29, 20, false},
+		{40, 30, false},
+		{5, 5, false},
+	}
+	for _, c := range cases {
+		r, g, b, _ := img.At(c.x, c.y).RGBA()
+		red := r>>8 == 255 && g>>8 == 0 && b>>8 == 0
+		if red != c.overlay {
+			t.Errorf("Invalid pixel at %d,%d: %d,%d,%d", c.x, c.y, r>>8, g>>8, b>>8)
+		}
+	}
+}
+
+func TestCompositeMissingOverlay(t *testing.T) {
+	opts := ServerOptions{}
+	LoadSources(opts)
+
+	ts := httptest.NewServer(validateImage(Middleware(compositeController(opts), opts), opts))
+	defer ts.Close()
+
+	res := compositeRequest(t, ts.URL, map[string][]byte{
+		"base": solidPNG(t, 100, 100, color.White),
+	})
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
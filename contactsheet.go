@@ -0,0 +1,173 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxContactSheetSources  = 64
+	defaultContactSheetCols = 4
+	defaultThumbSize        = 150
+	maxThumbSize            = 1024
+)
+
+var placeholderColor = color.NRGBA{200, 200, 200, 255}
+
+type contactSheetCell struct {
+	source string
+	query  url.Values
+}
+
+// contactSheetController composes a grid of thumbnails from multiple
+// url or file sources, fetched concurrently. Sources which cannot be
+// fetched or processed are rendered as placeholder cells.
+func contactSheetController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		cells := contactSheetCells(query)
+		if len(cells) == 0 {
+			ErrorReply(w, ErrMissingImageSource)
+			return
+		}
+		if len(cells) > maxContactSheetSources {
+			ErrorReply(w, NewError("Too many sources, max allowed: "+strconv.Itoa(maxContactSheetSources), BadRequest))
+			return
+		}
+		// Remote URL cells must be enabled as for GET requests
+		if len(query["url"]) > 0 && o.EnableURLSource == false {
+			ErrorReply(w, ErrURLSourceDisabled)
+			return
+		}
+
+		cols := parseInt(query.Get("cols"))
+		if cols == 0 {
+			cols = defaultContactSheetCols
+		}
+		if cols > len(cells) {
+			cols = len(cells)
+		}
+
+		size := parseInt(query.Get("thumbsize"))
+		if size == 0 {
+			size = defaultThumbSize
+		}
+		if size > maxThumbSize {
+			ErrorReply(w, NewError("Invalid thumbsize param, max allowed: "+strconv.Itoa(maxThumbSize), BadRequest))
+			return
+		}
+
+		opts := readParams(query)
+		if opts.Type == "" {
+			opts.Type = "jpeg"
+		}
+		if ImageType(opts.Type) == bimg.UNKNOWN {
+			ErrorReply(w, ErrOutputFormat)
+			return
+		}
+
+		labels := parseBool(query.Get("labels"))
+		sheet := composeContactSheet(r, cells, cols, size, labels, o.AllowedHashes)
+
+		image, err := encodeRaster(sheet, opts)
+		if err != nil {
+			ErrorReply(w, NewError("Error while processing the image: "+err.Error(), BadRequest))
+			return
+		}
+
+		w.Header().Set("Content-Type", image.Mime)
+		w.Write(image.Body)
+	}
+}
+
+func contactSheetCells(query url.Values) []contactSheetCell {
+	cells := []contactSheetCell{}
+	for _, key := range []string{"url", "file"} {
+		for _, source := range query[key] {
+			cells = append(cells, contactSheetCell{source, url.Values{key: []string{source}}})
+		}
+	}
+	return cells
+}
+
+func composeContactSheet(r *http.Request, cells []contactSheetCell, cols, size int, labels bool, hashes ImageHashes) *image.NRGBA {
+	rows := (len(cells) + cols - 1) / cols
+	sheet := image.NewNRGBA(image.Rect(0, 0, cols*size, rows*size))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.ZP, draw.Src)
+
+	var wg sync.WaitGroup
+	for i, cell := range cells {
+		wg.Add(1)
+		go func(i int, cell contactSheetCell) {
+			defer wg.Done()
+
+			origin := image.Pt((i%cols)*size, (i/cols)*size)
+			area := image.Rectangle{origin, origin.Add(image.Pt(size, size))}
+
+			thumb, err := contactSheetThumbnail(r, cell, size, labels, hashes)
+			if err != nil {
+				debug("contact sheet placeholder for %s: %s", cell.source, err)
+				draw.Draw(sheet, area, image.NewUniform(placeholderColor), image.ZP, draw.Src)
+				return
+			}
+
+			// Cells never overlap, so concurrent draws are safe
+			draw.Draw(sheet, area, thumb, image.ZP, draw.Src)
+		}(i, cell)
+	}
+	wg.Wait()
+
+	return sheet
+}
+
+func contactSheetThumbnail(r *http.Request, cell contactSheetCell, size int, labels bool, hashes ImageHashes) (*image.NRGBA, error) {
+	req := &http.Request{
+		Method: "GET",
+		Header: r.Header,
+		URL:    &url.URL{Path: r.URL.Path, RawQuery: cell.query.Encode()},
+	}
+
+	source := MatchSource(req)
+	if source == nil {
+		return nil, ErrMissingImageSource
+	}
+
+	buf, err := source.GetImage(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := hashes.Check(buf); err != nil {
+		return nil, err
+	}
+
+	opts := bimg.Options{
+		Width:  size,
+		Height: size,
+		Crop:   true,
+		Type:   bimg.PNG,
+	}
+	if labels {
+		opts.Watermark = bimg.Watermark{
+			Text:        path.Base(cell.source),
+			Width:       size,
+			Font:        "sans 10",
+			Opacity:     1,
+			NoReplicate: true,
+			Background:  bimg.Color{255, 255, 255},
+		}
+	}
+
+	thumb, err := Process(buf, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRaster(thumb.Body)
+}
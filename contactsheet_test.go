@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContactSheet(t *testing.T) {
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true}
+	LoadSources(opts)
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	ts := httptest.NewServer(validateImage(Middleware(contactSheetController(opts), opts), opts))
+	defer ts.Close()
+
+	url := ts.URL + "?cols=2&thumbsize=100&type=png" +
+		"&url=" + tsImage.URL + "/a.jpg" +
+		"&url=" + tsImage.URL + "/b.jpg" +
+		"&url=" + tsImage.URL + "/missing.jpg" +
+		"&url=" + tsImage.URL + "/c.jpg"
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	sheet, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := sheet.Bounds().Size()
+	if size.X != 200 || size.Y != 200 {
+		t.Fatalf("Invalid contact sheet size: %dx%d", size.X, size.Y)
+	}
+
+	// Third cell (bottom left) must be a placeholder
+	for _, point := range [][2]int{{10, 110}, {50, 150}, {90, 190}} {
+		r, g, b, _ := sheet.At(point[0], point[1]).RGBA()
+		if r>>8 != uint32(placeholderColor.R) || g>>8 != uint32(placeholderColor.G) || b>>8 != uint32(placeholderColor.B) {
+			t.Fatalf("Missing source must be rendered as placeholder: %d,%d,%d", r>>8, g>>8, b>>8)
+		}
+	}
+
+	// Other cells must contain the image
+	r, g, b, _ := sheet.At(150, 150).RGBA()
+	if r>>8 == uint32(placeholderColor.R) && g>>8 == uint32(placeholderColor.G) && b>>8 == uint32(placeholderColor.B) {
+		t.Fatal("Valid source must not be rendered as placeholder")
+	}
+}
+
+func TestContactSheetURLSourceDisabled(t *testing.T) {
+	fetched := 0
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	// Even if registered, URL cells are rejected by servers not enabling them
+	LoadSources(ServerOptions{EnableURLSource: true, AllowPrivateIPs: true})
+	ts := httptest.NewServer(http.HandlerFunc(contactSheetController(ServerOptions{})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?url=" + tsImage.URL + "/a.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 405 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+	if fetched != 0 {
+		t.Errorf("Remote image fetched %d times", fetched)
+	}
+}
+
+func TestContactSheetMissingSources(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(contactSheetController(ServerOptions{})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?cols=2")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
@@ -1,11 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"gopkg.in/h2non/bimg.v0"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
+// Max image size to encode as base64, since it inflates the payload by a third
+const maxBase64Bytes = 1024 * 1024 * 5
+
+// Response header with the output image size in bytes, before any encoding
+const outputSizeHeader = "X-Output-Size"
+
+type Base64Image struct {
+	Data        string `json:"data"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
 func indexController(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		ErrorReply(w, ErrNotFound)
@@ -17,22 +36,87 @@ func indexController(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-func healthController(w http.ResponseWriter, r *http.Request) {
-	health := GetHealthStats()
-	body, _ := json.Marshal(health)
+// healthController replies the server diagnostics, with a 503 status
+// once the libvips memory exceeds the max allowed one.
+func healthController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := GetHealthStats(o.MaxVipsMemory)
+		body, _ := json.Marshal(health)
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	}
+}
+
+// livenessController only replies whether the server is up, without
+// reading any diagnostics.
+func livenessController(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
+
+func cacheStatsController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := json.Marshal(o.Cache.Stats())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+func readyController(w http.ResponseWriter, r *http.Request) {
+	if err := CheckReadiness(); err != nil {
+		ErrorReply(w, NewError("Image processing is not available: "+err.Error(), Unavailable))
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(body)
+	w.Write([]byte(`{"ready":true}`))
 }
 
 func imageController(o ServerOptions, operation Operation) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		deadline, err := requestDeadline(req, o.RequestDeadline)
+		if err != nil {
+			ErrorReply(w, err.(Error))
+			return
+		}
+		if deadline > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), deadline)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+
 		var imageSource = MatchSource(req)
 		if imageSource == nil {
 			ErrorReply(w, ErrMissingImageSource)
 			return
 		}
 
+		req, spool := withBodySpool(req)
+		defer spool.Close()
+
 		buf, err := imageSource.GetImage(req)
+		if (err == ErrSourceNotFound || err == ErrObjectNotFound) && len(o.DefaultImage) > 0 {
+			buf, err = o.DefaultImage, nil
+			req = withDefaultImage(req)
+			w = withDefaultStatus(w, o.DefaultImageStatus)
+		}
+		// Source images failing to load for any other reason are replaced by
+		// the fallback image, or the original error is replied
+		if err != nil && req.Method == "GET" {
+			if fallback, name := fallbackImage(req, o); len(fallback) > 0 {
+				debug("serving the fallback image: %v", err)
+				buf, err = fallback, nil
+				req = withDefaultImage(req)
+				w.Header().Set(fallbackImageHeader, name)
+			}
+		}
+		if e, ok := err.(Error); ok {
+			ErrorReply(w, e)
+			return
+		}
 		if err != nil {
 			ErrorReply(w, NewError(err.Error(), BadRequest))
 			return
@@ -43,33 +127,339 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 			return
 		}
 
-		imageHandler(w, req, buf, operation)
+		imageHandler(w, withImageSource(req, imageSource), buf, operation, o)
 	}
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation Operation) {
-	mimeType := http.DetectContentType(buf)
-	if IsImageMimeTypeSupported(mimeType) == false {
+// imageHandler is agnostic of the image source: every operation must be
+// applied identically to payload, file system and remote URL images.
+func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation Operation, o ServerOptions) {
+	defer o.Pressure.Begin()()
+
+	if err := o.AllowedHashes.Check(buf); err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	// The cache is keyed by the source image as received
+	source := buf
+
+	// Icons are processed from the frame matching the requested width, or the largest one
+	mimeType := DetectContentType(buf)
+	if isICO(mimeType) {
+		icon, err := extractICO(buf, parseInt(r.URL.Query().Get("width")))
+		if err != nil {
+			ErrorReply(w, err.(Error))
+			return
+		}
+		buf, mimeType = icon, DetectContentType(icon)
+	}
+
+	// GIF images libvips cannot load are still accepted as animations whose
+	// frames are preserved, which is checked once the request params are known
+	if IsImageMimeTypeSupported(mimeType) == false && mimeType != "image/gif" {
 		ErrorReply(w, ErrUnsupportedMedia)
 		return
 	}
 
-	opts := readParams(r.URL.Query())
-	if opts.Type != "" && ImageType(opts.Type) == 0 {
-		ErrorReply(w, ErrOutputFormat)
+	// Multi-page images are checked and processed from the requested page
+	buf, err := selectPage(buf, r.URL.Query().Get("page"))
+	if err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	// Checked from the headers, before decoding the image
+	if err := checkPixelLimit(buf, o.MaxPixels); err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	// CMYK JPEG images are converted to RGB honoring the Adobe inversion,
+	// once the dimensions are known to be within the limit
+	if mimeType == "image/jpeg" {
+		rgb, err := convertCMYK(buf, o.CMYKMode)
+		if err != nil {
+			ErrorReply(w, err.(Error))
+			return
+		}
+		buf = rgb
+	}
+
+	if err := checkDecodeTimeout(r.Context(), o.DecodeTimeout, buf); err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	query, err := applyProfile(o.Profiles, r.URL.Query())
+	if err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	query = applyRules(o.Rules, query, buf)
+	if err := validateParams(query); err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+
+	preserveAnimation := parseBool(query.Get("preserveanimation")) && isAnimated(buf)
+	if mimeType == "image/gif" && preserveAnimation == false && IsImageMimeTypeSupported(mimeType) == false {
+		ErrorReply(w, ErrUnsupportedMedia)
+		return
+	}
+
+	if isAnimated(buf) && preserveAnimation == false {
+		if o.StrictAnimation && query.Get("frame") == "" {
+			ErrorReply(w, ErrAnimatedImage)
+			return
+		}
+		if query.Get("frame") != "" && query.Get("frame") != "0" {
+			ErrorReply(w, ErrUnsupportedFrame)
+			return
+		}
+	}
+
+	opts := readParams(query)
+	opts.MaxFrameConcurrency = o.MaxFrameConcurrency
+	opts.StrictDimensions = o.StrictDimensions
+	opts.LUTDir = o.LUTDir
+	opts.ICCDir = o.ICCDir
+	opts.WatermarkDir = o.WatermarkDir
+	opts.Source = RequestImageKey(r)
+	opts.MaxQualityAttempts = o.MaxQualityAttempts
+	opts.MaxPixels = o.MaxPixels
+	opts.MaxUpscale = o.MaxUpscale
+	opts.RejectUpscale = o.RejectUpscale
+	opts.QualityScale = o.QualityScale
+	opts = withDefaultWatermarkSettings(opts, o)
+	opts, err = withServerLimits(buf, opts)
+	if err != nil {
+		ErrorReply(w, err.(Error))
+		return
+	}
+	dpr := appliedDPR(query, opts)
+
+	// Outputs over the max size are re-encoded with a lower quality, if requested
+	if o.MaxOutputBytes > 0 && opts.ReduceOnOverflow && (opts.MaxBytes == 0 || opts.MaxBytes > o.MaxOutputBytes) {
+		opts.MaxBytes = o.MaxOutputBytes
+	}
+
+	if scan, fallback := resolveScan(opts.Scan); fallback {
+		w.Header().Add("Warning", `199 imaginary "`+opts.Scan+` scan unsupported, image encoded as `+scan+`"`)
+		opts.Scan = scan
+	}
+
+	if opts.Encoding != "" && opts.Encoding != "base64" {
+		ErrorReply(w, NewError("Unsupported encoding: "+opts.Encoding, BadRequest))
+		return
+	}
+
+	if preserveAnimation {
+		Operation, err = animatedOperation(strings.TrimPrefix(r.URL.Path, "/"), buf, opts)
+		if err != nil {
+			ErrorReply(w, err.(Error))
+			return
+		}
+		// The animated operations always output GIF
+		opts.Type = ""
+	} else if opts.Type == "" {
+		opts.Type = o.SourceDefaultTypes[RequestImageSourceType(r)]
+		if opts.Type == "" && o.AutoFormat {
+			opts.Type = autoImageType
+		}
+	}
+
+	negotiated := opts.Type == autoImageType
+	if negotiated {
+		opts.Type = negotiateImageType(r, buf, o.FormatPreference)
+		addVary(w, "Accept")
+	}
+
+	if opts.Type != "" && isEncoderMissing(opts.Type) {
+		fallback, ok := downgradeImageType(o.FormatFallback)
+		if !ok {
+			ErrorReply(w, NewError("Output image format not supported by this build: "+opts.Type, NotImplemented))
+			return
+		}
+		w.Header().Add("Warning", `199 imaginary "`+opts.Type+` encoder unavailable, image encoded as `+fallback+`"`)
+		opts.Type = fallback
+	}
+
+	if opts.Type != "" && isOutputTypeSupported(opts.Type) == false {
+		ErrorReply(w, NewError(ErrOutputFormat.Message+" (got: "+opts.Type+")", BadRequest))
+		return
+	}
+
+	// Identical source images processed with the same resolved params are
+	// served from the cache, but for stamps resolved at processing time
+	var cacheKey string
+	if o.Cache != nil && r.URL.Path != "/stamp" && !negotiated {
+		cacheKey = requestCacheKey(r, source, query, opts.Type, o.CacheMaxSourceSize)
+	}
+	if image, ok := o.Cache.Get(cacheKey); ok {
+		replyImage(w, r, image, query, opts, o)
 		return
 	}
 
-	image, err := Operation.Run(buf, opts)
+	// Cached images are served as is under pressure, only the processed ones are lowered
+	opts, lowered := o.Pressure.Lower(opts)
+	if lowered {
+		w.Header().Add("Warning", pressureWarning(opts))
+	}
+
+	// The source ICC profile is read before any conversion, so it can be
+	// embedded again in the output, or stripped
+	profile := extractICCProfile(buf)
+
+	// Once the output type is known, since the oriented and flattened images are PNG
+	if preserveAnimation == false {
+		buf, opts, err = applyOrientation(buf, opts)
+		if err != nil {
+			ErrorReply(w, NewError("Error while orienting the image: "+err.Error(), BadRequest))
+			return
+		}
+		if opts.StripICC && o.SRGB && profile != nil {
+			var converted bool
+			buf, opts, converted, err = convertToSRGB(buf, profile, opts)
+			if err != nil {
+				ErrorReply(w, NewError("Error while converting the image to sRGB: "+err.Error(), BadRequest))
+				return
+			}
+			// Stripping the profile would alter the colors
+			if !converted {
+				w.Header().Add("Warning", `199 imaginary "ICC profile cannot be converted to sRGB, profile preserved"`)
+				opts.StripICC = false
+			}
+		}
+		buf, opts, err = applyBackground(buf, opts)
+		if err != nil {
+			ErrorReply(w, NewError("Error while flattening the image: "+err.Error(), BadRequest))
+			return
+		}
+	}
+
+	format := opts.Type
+	if format == "" {
+		format = bimg.DetermineImageTypeName(buf)
+	}
+	timeout := o.OperationTimeouts.For(strings.TrimPrefix(r.URL.Path, "/"), format)
+
+	image, err := runWithTimeout(r.Context(), timeout, func() (Image, error) {
+		image, err := Operation.Run(buf, opts)
+		if err != nil {
+			return image, err
+		}
+		rounded, err := applyRoundedCorners(image, opts)
+		rounded.Headers, rounded.Operations = image.Headers, image.Operations
+		if err != nil {
+			return rounded, err
+		}
+		return applyICCProfile(rounded, profile, opts)
+	})
+	if err == ErrProcessingTimeout {
+		ErrorReply(w, ErrProcessingTimeout)
+		return
+	}
 	if err != nil {
 		ErrorReply(w, NewError("Error while processing the image: "+err.Error(), BadRequest))
 		return
 	}
+	if o.MaxOutputBytes > 0 && len(image.Body) > o.MaxOutputBytes {
+		ErrorReply(w, ErrOutputTooLarge)
+		return
+	}
+	if opts.DPR > 0 {
+		image.Headers = withHeader(image.Headers, contentDPRHeader, formatDPR(dpr))
+	}
+
+	// Images with lowered quality must not outlive the load, and
+	// negotiated ones depend on the request headers
+	if !lowered && !negotiated {
+		// Cached images outlive the request spool, which passthrough
+		// images can still reference
+		cached := image
+		cached.Body = requestBodySpool(r).detach(image.Body)
+		o.Cache.Set(cacheKey, cached)
+	}
+	replyImage(w, r, image, query, opts, o)
+}
+
+// replyImage writes the processed image, either just processed or cached,
+// with the same headers.
+func replyImage(w http.ResponseWriter, r *http.Request, image Image, query url.Values, opts ImageOptions, o ServerOptions) {
+	if opts.MaxBytes > 0 && len(image.Body) > opts.MaxBytes && isQualityAware(image.Mime) {
+		w.Header().Add("Warning", `199 imaginary "output exceeds maxbytes at the lowest quality, the smallest output is returned"`)
+	}
+	setOperationsHeader(w, appliedOperations(strings.TrimPrefix(r.URL.Path, "/"), query, image, opts, o))
+	writeImage(w, r, image, opts)
+}
+
+// withHeader returns a copy of the image headers with the given header.
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	out := map[string]string{key: value}
+	for k, v := range headers {
+		if k != key {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func writeImage(w http.ResponseWriter, r *http.Request, image Image, opts ImageOptions) {
+	for key, value := range image.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set(outputSizeHeader, strconv.Itoa(len(image.Body)))
+
+	if opts.Encoding == "base64" && strings.HasPrefix(image.Mime, "image/") {
+		base64Reply(w, image)
+		return
+	}
+
+	if opts.Attachment {
+		filename := attachmentFilename(opts.Filename, RequestImageKey(r), image.Mime)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	}
+
+	// The preview precedes the full image in the same response
+	if opts.ProgressivePreview && strings.HasPrefix(image.Mime, "image/") {
+		preview, err := previewImage(image)
+		if err != nil {
+			ErrorReply(w, NewError("Cannot create the image preview: "+err.Error(), InternalError))
+			return
+		}
+		previewReply(w, preview, image)
+		return
+	}
 
 	w.Header().Set("Content-Type", image.Mime)
 	w.Write(image.Body)
 }
 
+func base64Reply(w http.ResponseWriter, image Image) {
+	if len(image.Body) > maxBase64Bytes {
+		ErrorReply(w, NewError("Image too large to be encoded as base64", TooLarge))
+		return
+	}
+
+	size, err := bimg.Size(image.Body)
+	if err != nil {
+		ErrorReply(w, NewError("Cannot read the image size: "+err.Error(), InternalError))
+		return
+	}
+
+	body, _ := json.Marshal(Base64Image{
+		Data:        base64.StdEncoding.EncodeToString(image.Body),
+		ContentType: image.Mime,
+		Width:       size.Width,
+		Height:      size.Height,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
 func formController(w http.ResponseWriter, r *http.Request) {
 	operations := []struct {
 		name   string
@@ -89,6 +479,7 @@ func formController(w http.ResponseWriter, r *http.Request) {
 		{"Color space (black&white)", "resize", "width=400&height=300&colorspace=bw"},
 		{"Add watermark", "watermark", "textwidth=100&text=Hello&font=sans%2012&opacity=0.5&color=255,200,50"},
 		{"Convert format", "convert", "type=png"},
+		{"Invert alpha", "invert", "invert=alpha"},
 		{"Image metadata", "info", ""},
 	}
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+const fallbackImageHeader = "X-Imaginary-Fallback"
+
+func withDefaultImage(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), defaultImageContextKey, true))
+}
+
+// isDefaultImage reports whether the request is served with the default
+// or the fallback image, since the source image could not be loaded.
+func isDefaultImage(req *http.Request) bool {
+	value, _ := req.Context().Value(defaultImageContextKey).(bool)
+	return value
+}
+
+// defaultStatusWriter replies with the given status unless another one is
+// explicitly written, as with errors processing the default image.
+type defaultStatusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func withDefaultStatus(w http.ResponseWriter, status int) http.ResponseWriter {
+	if status == 0 || status == http.StatusOK {
+		return w
+	}
+	return &defaultStatusWriter{ResponseWriter: w, status: status}
+}
+
+func (w *defaultStatusWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *defaultStatusWriter) Write(buf []byte) (int, error) {
+	if w.wroteHeader == false {
+		w.WriteHeader(w.status)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// fallbackImage loads the image processed instead of a source image which
+// failed to load: the errorimage param URL, if any and it can be fetched,
+// or otherwise the -fallback-image one. It also returns which one is used.
+func fallbackImage(r *http.Request, o ServerOptions) ([]byte, string) {
+	if value := r.URL.Query().Get("errorimage"); value != "" {
+		buf, err := fetchURLImage(r, value)
+		if err == nil && IsImageMimeTypeSupported(DetectContentType(buf)) {
+			return buf, "errorimage"
+		}
+		debug("cannot load the error image %s: %v", value, err)
+	}
+	if len(o.FallbackImage) > 0 {
+		return o.FallbackImage, "fallback-image"
+	}
+	return nil, ""
+}
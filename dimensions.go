@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// Response header reporting the device pixel ratio of the output image
+const contentDPRHeader = "Content-DPR"
+
+// readImageDimensions reads the image dimensions from the image headers
+// (PNG IHDR, GIF screen descriptor, JPEG SOF or WebP frame header),
+// without decoding the image pixels.
+func readImageDimensions(buf []byte) (int, int, bool) {
+	if width, height, ok := readWebpDimensions(buf); ok {
+		return width, height, true
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
+
+// sourceDimensions reads the image dimensions from the headers, falling
+// back to libvips for formats without a header parser.
+func sourceDimensions(buf []byte) (int, int, bool) {
+	if width, height, ok := readImageDimensions(buf); ok {
+		return width, height, true
+	}
+
+	size, err := bimg.NewImage(buf).Size()
+	if err != nil {
+		return 0, 0, false
+	}
+	return size.Width, size.Height, true
+}
+
+func readWebpDimensions(buf []byte) (int, int, bool) {
+	if len(buf) < 30 || string(buf[0:4]) != "RIFF" || string(buf[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+
+	switch string(buf[12:16]) {
+	case "VP8 ":
+		// Lossy: frame tag and start code precede the 14 bit dimensions
+		if buf[23] != 0x9d || buf[24] != 0x01 || buf[25] != 0x2a {
+			return 0, 0, false
+		}
+		width := int(binary.LittleEndian.Uint16(buf[26:28]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(buf[28:30]) & 0x3fff)
+		return width, height, true
+	case "VP8L":
+		// Lossless: signature byte followed by 14 bit dimensions minus one
+		if buf[20] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(buf[21:25])
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1, true
+	case "VP8X":
+		// Extended: 24 bit canvas dimensions minus one
+		width := int(buf[24]) | int(buf[25])<<8 | int(buf[26])<<16
+		height := int(buf[27]) | int(buf[28])<<8 | int(buf[29])<<16
+		return width + 1, height + 1, true
+	}
+
+	return 0, 0, false
+}
+
+// checkPixelLimit protects against decompression bombs: small files
+// declaring huge dimensions which would decode into enormous bitmaps.
+func checkPixelLimit(buf []byte, maxPixels int) error {
+	if maxPixels <= 0 {
+		return nil
+	}
+
+	width, height, ok := readImageDimensions(buf)
+	if !ok {
+		return nil
+	}
+
+	if int64(width)*int64(height) > int64(maxPixels) {
+		return ErrTooManyPixels
+	}
+	return nil
+}
+
+// limitUpscale caps the requested output dimensions and zoom factor to the
+// source dimensions times the max upscale factor, scaling both dimensions
+// by the same ratio to keep the requested aspect ratio. In reject mode, an
+// error is returned instead.
+func limitUpscale(buf []byte, opts ImageOptions, factor float64, reject bool) (ImageOptions, error) {
+	if factor <= 0 {
+		return opts, nil
+	}
+
+	width, height, ok := sourceDimensions(buf)
+	if !ok {
+		return opts, nil
+	}
+
+	ratio := 1.0
+	if maxWidth := float64(width) * factor; opts.Width > 0 && float64(opts.Width) > maxWidth {
+		ratio = math.Min(ratio, maxWidth/float64(opts.Width))
+	}
+	if maxHeight := float64(height) * factor; opts.Height > 0 && float64(opts.Height) > maxHeight {
+		ratio = math.Min(ratio, maxHeight/float64(opts.Height))
+	}
+	exceedsZoom := opts.Factor > 0 && float64(opts.Factor) > factor
+
+	if ratio == 1 && exceedsZoom == false {
+		return opts, nil
+	}
+	if reject {
+		return opts, ErrUpscaleLimit
+	}
+
+	opts.Width = int(math.Floor(float64(opts.Width) * ratio))
+	opts.Height = int(math.Floor(float64(opts.Height) * ratio))
+	if exceedsZoom {
+		opts.Factor = int(factor)
+	}
+	return opts, nil
+}
+
+// appliedDPR returns the ratio of the output dimensions to the logical
+// ones requested by the client, which is lower than the dpr param if the
+// dimensions were limited. The returned ratio is rounded to two decimals.
+func appliedDPR(query url.Values, opts ImageOptions) float64 {
+	dpr := opts.DPR
+	if width := parseInt(query.Get("width")); width > 0 {
+		dpr = math.Min(dpr, float64(opts.Width)/float64(width))
+	}
+	if height := parseInt(query.Get("height")); height > 0 {
+		dpr = math.Min(dpr, float64(opts.Height)/float64(height))
+	}
+	return math.Floor(dpr*100+0.5) / 100
+}
+
+func formatDPR(dpr float64) string {
+	return strconv.FormatFloat(dpr, 'f', -1, 64)
+}
+
+// bytesPerChannel returns the decoded sample size of the image: 2 bytes
+// for 16-bit color spaces or PNG images, otherwise 1.
+func bytesPerChannel(buf []byte, space string) int {
+	if space == "rgb16" || space == "grey16" {
+		return 2
+	}
+	if bimg.DetermineImageType(buf) == bimg.PNG && len(buf) > 24 && buf[24] == 16 {
+		return 2
+	}
+	return 1
+}
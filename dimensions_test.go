@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	ihdr[8], ihdr[9] = 8, 2
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestReadImageDimensions(t *testing.T) {
+	gif := []byte("GIF89a\x10\x27\x10\x27\x00\x00\x00")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00\xff\xc0\x00\x11\x08\x27\x10\x4e\x20\x03\x01\x22\x00\x02\x11\x01\x03\x11\x01\xff\xd9")
+	vp8x := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x00\x00\x00\x00\x0f\x27\x00\x0f\x27\x00")
+	vp8l := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f\x63\xc0\xf9\x00\x00\x00\x00\x00\x00")
+	large, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	cases := []struct {
+		buf    []byte
+		width  int
+		height int
+	}{
+		{pngHeader(100000, 50000), 100000, 50000},
+		{gif, 10000, 10000},
+		{jpeg, 20000, 10000},
+		{vp8x, 10000, 10000},
+		{vp8l, 100, 1000},
+		{large, 1920, 1080},
+	}
+
+	for i, test := range cases {
+		width, height, ok := readImageDimensions(test.buf)
+		if !ok || width != test.width || height != test.height {
+			t.Errorf("Invalid dimensions for case %d: %dx%d", i, width, height)
+		}
+	}
+
+	if _, _, ok := readImageDimensions([]byte("RIFF\x00\x00\x00\x00WEBP")); ok {
+		t.Error("Truncated image headers must not be read")
+	}
+}
+
+func TestCheckPixelLimit(t *testing.T) {
+	bomb := pngHeader(100000, 100000)
+
+	if err := checkPixelLimit(bomb, 0); err != nil {
+		t.Fatal("Disabled limit must not reject images")
+	}
+	if err := checkPixelLimit(bomb, 1000*1000); err != ErrTooManyPixels {
+		t.Fatalf("Image should be rejected: %v", err)
+	}
+	if err := checkPixelLimit(pngHeader(100, 100), 1000*1000); err != nil {
+		t.Fatalf("Image should be allowed: %v", err)
+	}
+}
+
+func TestPixelLimitRejectsBeforeDecode(t *testing.T) {
+	ts := testServer(optionsController(Resize, ServerOptions{MaxPixels: 1000 * 1000}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=100", "image/png", bytes.NewReader(pngHeader(100000, 100000)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 413 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestLimitUpscale(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	cases := []struct {
+		opts     ImageOptions
+		expected ImageOptions
+	}{
+		{ImageOptions{Width: 19200}, ImageOptions{Width: 3840}},
+		{ImageOptions{Width: 19200, Height: 1080}, ImageOptions{Width: 3840, Height: 216}},
+		{ImageOptions{Width: 1000, Height: 10800}, ImageOptions{Width: 200, Height: 2160}},
+		{ImageOptions{Width: 3000, Height: 2000}, ImageOptions{Width: 3000, Height: 2000}},
+		{ImageOptions{Factor: 10}, ImageOptions{Factor: 2}},
+	}
+
+	for _, test := range cases {
+		opts, err := limitUpscale(buf, test.opts, 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opts.Width != test.expected.Width || opts.Height != test.expected.Height || opts.Factor != test.expected.Factor {
+			t.Errorf("Invalid clamped dimensions: %dx%d (factor %d)", opts.Width, opts.Height, opts.Factor)
+		}
+	}
+
+	if _, err := limitUpscale(buf, ImageOptions{Width: 19200}, 2, true); err != ErrUpscaleLimit {
+		t.Errorf("Upscale beyond the limit must be rejected: %v", err)
+	}
+	if opts, _ := limitUpscale(buf, ImageOptions{Width: 19200}, 0, true); opts.Width != 19200 {
+		t.Error("Disabled limit must not change the dimensions")
+	}
+}
+
+func TestUpscaleClamped(t *testing.T) {
+	buf := encodeTestPNG(t, image.NewNRGBA(image.Rect(0, 0, 40, 20)))
+
+	ts := testServer(optionsController(Enlarge, ServerOptions{MaxUpscale: 2}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=400&height=200", "image/png", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if err := assertSize(body, 80, 40); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAppliedDPR(t *testing.T) {
+	cases := []struct {
+		query    url.Values
+		opts     ImageOptions
+		expected float64
+	}{
+		{url.Values{"width": {"300"}}, ImageOptions{Width: 600, DPR: 2}, 2},
+		{url.Values{"width": {"333"}}, ImageOptions{Width: 500, DPR: 1.5}, 1.5},
+		{url.Values{"width": {"300"}, "height": {"200"}}, ImageOptions{Width: 800, Height: 533, DPR: 3}, 2.67},
+		{url.Values{"height": {"30"}}, ImageOptions{Height: 40, DPR: 4}, 1.33},
+		{url.Values{}, ImageOptions{DPR: 2}, 2},
+	}
+
+	for _, test := range cases {
+		if dpr := appliedDPR(test.query, test.opts); dpr != test.expected {
+			t.Errorf("Invalid DPR for %v: %v != %v", test.query, dpr, test.expected)
+		}
+	}
+}
+
+func TestContentDPR(t *testing.T) {
+	buf := encodeTestPNG(t, image.NewNRGBA(image.Rect(0, 0, 40, 20)))
+
+	ts := testServer(optionsController(Enlarge, ServerOptions{MaxUpscale: 2}))
+	defer ts.Close()
+
+	// The 120x60 output is clamped to 80x40, the max upscale of the image
+	res, err := http.Post(ts.URL+"?width=30&height=15&dpr=4", "image/png", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if dpr := res.Header.Get("Content-DPR"); dpr != "2.67" {
+		t.Errorf("Invalid Content-DPR header: %s", dpr)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if err := assertSize(body, 80, 40); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInfoMemoryEstimate(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, err := Info(buf, ImageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info ImageInfo
+	if err := json.Unmarshal(image.Body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != len(buf) {
+		t.Errorf("Invalid image size: %d", info.Size)
+	}
+	if expected := int64(1920 * 1080 * info.Channels); info.Memory != expected || info.Channels == 0 {
+		t.Errorf("Invalid memory estimate: %d != %d", info.Memory, expected)
+	}
+}
+
+func TestBytesPerChannel(t *testing.T) {
+	deep := &bytes.Buffer{}
+	png.Encode(deep, image.NewNRGBA64(image.Rect(0, 0, 2, 2)))
+	if n := bytesPerChannel(deep.Bytes(), "srgb"); n != 2 {
+		t.Errorf("16-bit PNG images must use 2 bytes per channel: %d", n)
+	}
+
+	buf, _ := ioutil.ReadFile("fixtures/test.png")
+	if n := bytesPerChannel(buf, "srgb"); n != 1 {
+		t.Errorf("8-bit PNG images must use 1 byte per channel: %d", n)
+	}
+	if n := bytesPerChannel(buf, "rgb16"); n != 2 {
+		t.Errorf("16-bit color spaces must use 2 bytes per channel: %d", n)
+	}
+}
@@ -14,6 +14,13 @@ const (
 	Unauthorized
 	InternalError
 	NotFound
+	TooManyRequests
+	TooLarge
+	Timeout
+	Unprocessable
+	NotImplemented
+	Forbidden
+	BadGateway
 )
 
 var (
@@ -21,17 +28,38 @@ var (
 	ErrInvalidApiKey      = NewError("Invalid or missing API key", Unauthorized)
 	ErrMethodNotAllowed   = NewError("Method not allowed", NotAllowed)
 	ErrUnsupportedMedia   = NewError("Unsupported media type", Unsupported)
-	ErrOutputFormat       = NewError("Unsupported output image format", BadRequest)
+	ErrOutputFormat       = NewError("Unsupported output image format. Supported formats: jpeg, png, webp, tiff, gif", BadRequest)
 	ErrEmptyBody          = NewError("Empty image", BadRequest)
 	ErrMissingParamFile   = NewError("Missing required param: file", BadRequest)
 	ErrInvalidFilePath    = NewError("Invalid file path", BadRequest)
+	ErrSourceNotFound     = NewError("Source image not found", BadRequest)
 	ErrInvalidImageURL    = NewError("Invalid image URL", BadRequest)
+	ErrOriginNotAllowed   = NewError("Image URL origin not allowed", Forbidden)
+	ErrImageNotAllowed    = NewError("Image content not allowed", Forbidden)
+	ErrURLSourceDisabled  = NewError("Remote URL image sources are not enabled", NotAllowed)
 	ErrMissingImageSource = NewError("Cannot process the image due to missing or invalid params", BadRequest)
+	ErrTooManyRequests    = NewError("Too many requests, try again later", TooManyRequests)
+	ErrProcessingTimeout  = NewError("Image processing timeout exceeded", Timeout)
+	ErrDecodeTimeout      = NewError("Image decoding timeout exceeded", Unprocessable)
+	ErrSourceTimeout      = NewError("Remote image fetch timeout exceeded", Timeout)
+	ErrTooManyPixels      = NewError("Image dimensions exceed the max allowed pixels", TooLarge)
+	ErrUploadsDisabled    = NewError("Image uploads are disabled", NotAllowed)
+	ErrBodyTooLarge       = NewError("Request body exceeds the max allowed size", TooLarge)
+	ErrIncompleteBody     = NewError("Incomplete request body, fewer bytes than declared were received", BadRequest)
+	ErrUpscaleLimit       = NewError("Requested dimensions exceed the max upscale factor of the source image", BadRequest)
+	ErrAnimatedImage      = NewError("Animated images are not supported, define frame=0 to process the first frame only", Unprocessable)
+	ErrUnsupportedFrame   = NewError("Only the first animation frame (frame=0) can be processed", Unprocessable)
+	ErrInvalidSignature   = NewError("Invalid or missing URL signature", Forbidden)
+	ErrOutputTooLarge     = NewError("Output image exceeds the max allowed size", TooLarge)
+	ErrInvalidS3Object    = NewError("Invalid s3 param: must be bucket/key", BadRequest)
+	ErrObjectNotFound     = NewError("Source object not found", NotFound)
+	ErrObjectAccessDenied = NewError("Access to the source object denied by the object storage", BadGateway)
 )
 
 type Error struct {
-	Message string `json:"message,omitempty"`
-	Code    uint8  `json:"code"`
+	Message   string `json:"message,omitempty"`
+	Code      uint8  `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
 func (e Error) JSON() []byte {
@@ -62,17 +90,41 @@ func (e Error) HTTPCode() int {
 	if e.Code == NotFound {
 		return http.StatusNotFound
 	}
+	if e.Code == TooManyRequests {
+		return http.StatusTooManyRequests
+	}
+	if e.Code == TooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	if e.Code == Timeout {
+		return http.StatusGatewayTimeout
+	}
+	if e.Code == Unprocessable {
+		return http.StatusUnprocessableEntity
+	}
+	if e.Code == NotImplemented {
+		return http.StatusNotImplemented
+	}
+	if e.Code == Forbidden {
+		return http.StatusForbidden
+	}
+	if e.Code == BadGateway {
+		return http.StatusBadGateway
+	}
 	return http.StatusServiceUnavailable
 }
 
 func NewError(err string, code uint8) Error {
 	err = strings.Replace(err, "\n", "", -1)
-	return Error{err, code}
+	return Error{Message: err, Code: code}
 }
 
 func ErrorReply(w http.ResponseWriter, err Error) error {
+	reply := err
+	reply.RequestID = w.Header().Get(requestIDHeader)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.HTTPCode())
-	w.Write(err.JSON())
+	w.Write(reply.JSON())
 	return err
 }
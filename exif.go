@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Max number of values serialized per EXIF tag, skipping larger arrays
+const maxExifValues = 16
+
+// exifTagNames maps the IFD0 and EXIF IFD tags to their names. Unknown
+// tags are named by their hexadecimal code.
+var exifTagNames = map[uint16]string{
+	0x010e: "ImageDescription",
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa402: "ExposureMode",
+	0xa403: "WhiteBalance",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+}
+
+const (
+	exifGPSLatitudeRef  = 0x0001
+	exifGPSLatitude     = 0x0002
+	exifGPSLongitudeRef = 0x0003
+	exifGPSLongitude    = 0x0004
+	exifGPSAltitudeRef  = 0x0005
+	exifGPSAltitude     = 0x0006
+)
+
+// ImageExif holds the EXIF tags by name, and the GPS position if any.
+type ImageExif map[string]interface{}
+
+type ExifGPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// readExif returns the EXIF tags of JPEG images, omitting the GPS position
+// if stripGPS is enabled. Images without EXIF, or with corrupt EXIF, have
+// no or partial tags, since unreadable directories are skipped.
+func readExif(buf []byte, stripGPS bool) ImageExif {
+	exif := ImageExif{}
+
+	segments, _ := splitJPEGSegments(buf)
+	for _, segment := range segments {
+		if segment[1] != jpegMarkerAPP1 || bytes.HasPrefix(segment[4:], exifHeader) == false {
+			continue
+		}
+
+		tiff := segment[4+len(exifHeader):]
+		if len(tiff) < 8 {
+			return exif
+		}
+
+		var order binary.ByteOrder
+		switch string(tiff[0:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return exif
+		}
+
+		ifd0 := readExifIFD(tiff, order, int(order.Uint32(tiff[4:8])))
+		for tag, value := range ifd0 {
+			if tag == exifTagExifIFD {
+				if offset, ok := value.(int); ok {
+					addExifTags(exif, readExifIFD(tiff, order, offset))
+				}
+				continue
+			}
+			if tag == exifTagGPSIFD {
+				if offset, ok := value.(int); ok && stripGPS == false {
+					if gps, ok := readExifGPS(readExifIFD(tiff, order, offset)); ok {
+						exif["GPS"] = gps
+					}
+				}
+				continue
+			}
+			addExifTags(exif, map[uint16]interface{}{tag: value})
+		}
+		return exif
+	}
+
+	return exif
+}
+
+func addExifTags(exif ImageExif, tags map[uint16]interface{}) {
+	for tag, value := range tags {
+		if tag == exifTagInteropIFD || tag == exifTagThumbnail {
+			continue
+		}
+		name, ok := exifTagNames[tag]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", tag)
+		}
+		exif[name] = value
+	}
+}
+
+// readExifIFD reads the ASCII, integer and rational tags of the IFD.
+// Entries out of the EXIF bounds are skipped.
+func readExifIFD(tiff []byte, order binary.ByteOrder, offset int) map[uint16]interface{} {
+	tags := make(map[uint16]interface{})
+	if offset < 8 || offset+2 > len(tiff) {
+		return tags
+	}
+
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		pos := offset + 2 + i*12
+		if pos+12 > len(tiff) {
+			break
+		}
+
+		tag := order.Uint16(tiff[pos : pos+2])
+		kind := order.Uint16(tiff[pos+2 : pos+4])
+		n := int(order.Uint32(tiff[pos+4 : pos+8]))
+		size := exifTypeSizes[kind]
+		if size == 0 || n <= 0 || n > len(tiff)/size {
+			continue
+		}
+
+		data := tiff[pos+8 : pos+12]
+		if size*n > 4 {
+			start := int(order.Uint32(data))
+			if start < 0 || start+size*n > len(tiff) {
+				continue
+			}
+			data = tiff[start : start+size*n]
+		}
+
+		if value, ok := exifValue(data, order, kind, n); ok {
+			tags[tag] = value
+		}
+	}
+	return tags
+}
+
+// exifValue decodes the tag data. Single values are returned as is, and
+// multiple ones as a list, while undefined and large data is skipped.
+func exifValue(data []byte, order binary.ByteOrder, kind uint16, n int) (interface{}, bool) {
+	if kind == 2 {
+		return strings.TrimSpace(strings.TrimRight(string(data[:n]), "\x00")), true
+	}
+	if n > maxExifValues {
+		return nil, false
+	}
+
+	values := []interface{}{}
+	for i := 0; i < n; i++ {
+		var value interface{}
+		switch kind {
+		case 1:
+			value = int(data[i])
+		case 3:
+			value = int(order.Uint16(data[i*2:]))
+		case 4:
+			value = int(order.Uint32(data[i*4:]))
+		case 8:
+			value = int(int16(order.Uint16(data[i*2:])))
+		case 9:
+			value = int(int32(order.Uint32(data[i*4:])))
+		case 5, 10:
+			numerator, denominator := float64(order.Uint32(data[i*8:])), float64(order.Uint32(data[i*8+4:]))
+			if kind == 10 {
+				numerator, denominator = float64(int32(order.Uint32(data[i*8:]))), float64(int32(order.Uint32(data[i*8+4:])))
+			}
+			if denominator == 0 {
+				return nil, false
+			}
+			value = numerator / denominator
+		default:
+			return nil, false
+		}
+		values = append(values, value)
+	}
+
+	if len(values) == 1 {
+		return values[0], true
+	}
+	return values, true
+}
+
+// readExifGPS converts the GPS IFD degrees, minutes and seconds into
+// signed decimal coordinates.
+func readExifGPS(tags map[uint16]interface{}) (ExifGPS, bool) {
+	latitude, ok := exifCoordinate(tags[exifGPSLatitude], tags[exifGPSLatitudeRef], "S")
+	if !ok {
+		return ExifGPS{}, false
+	}
+	longitude, ok := exifCoordinate(tags[exifGPSLongitude], tags[exifGPSLongitudeRef], "W")
+	if !ok {
+		return ExifGPS{}, false
+	}
+
+	gps := ExifGPS{Latitude: latitude, Longitude: longitude}
+	if altitude, ok := tags[exifGPSAltitude].(float64); ok {
+		// Altitude reference 1 stands for below the sea level
+		if ref, ok := tags[exifGPSAltitudeRef].(int); ok && ref == 1 {
+			altitude = -altitude
+		}
+		gps.Altitude = &altitude
+	}
+	return gps, true
+}
+
+func exifCoordinate(value, ref interface{}, negative string) (float64, bool) {
+	parts, ok := value.([]interface{})
+	if !ok || len(parts) != 3 {
+		return 0, false
+	}
+
+	coordinate := 0.0
+	for i, scale := range []float64{1, 60, 3600} {
+		part, ok := parts[i].(float64)
+		if !ok {
+			return 0, false
+		}
+		coordinate += part / scale
+	}
+	if ref == negative {
+		coordinate = -coordinate
+	}
+	return coordinate, true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+type exifEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	data  []byte
+}
+
+func exifASCII(tag uint16, value string) exifEntry {
+	return exifEntry{tag, 2, uint32(len(value) + 1), append([]byte(value), 0)}
+}
+
+func exifShort(tag uint16, value uint16) exifEntry {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint16(data, value)
+	return exifEntry{tag, 3, 1, data}
+}
+
+func exifRationals(tag uint16, values ...uint32) exifEntry {
+	data := &bytes.Buffer{}
+	binary.Write(data, binary.LittleEndian, values)
+	return exifEntry{tag, 5, uint32(len(values) / 2), data.Bytes()}
+}
+
+func exifIFDSize(entries []exifEntry) int {
+	size := 2 + len(entries)*12 + 4
+	for _, entry := range entries {
+		if len(entry.data) > 4 {
+			size += len(entry.data)
+		}
+	}
+	return size
+}
+
+// writeExifIFD writes the IFD at the offset, followed by its data
+func writeExifIFD(tiff *bytes.Buffer, entries []exifEntry, offset int) {
+	order := binary.LittleEndian
+	data := offset + 2 + len(entries)*12 + 4
+	values := &bytes.Buffer{}
+
+	binary.Write(tiff, order, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(tiff, order, []uint16{entry.tag, entry.kind})
+		binary.Write(tiff, order, entry.count)
+		if len(entry.data) > 4 {
+			binary.Write(tiff, order, uint32(data+values.Len()))
+			values.Write(entry.data)
+		} else {
+			tiff.Write(append(entry.data, make([]byte, 4-len(entry.data))...))
+		}
+	}
+	binary.Write(tiff, order, uint32(0))
+	tiff.Write(values.Bytes())
+}
+
+// exifSegmentJPEG injects an EXIF segment whose IFD0 links the given EXIF
+// and GPS directories.
+func exifSegmentJPEG(ifd0, exif, gps []exifEntry) []byte {
+	offset := 8 + exifIFDSize(ifd0) + 12*2
+	pointer := func(tag uint16, entries []exifEntry) {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, uint32(offset))
+		ifd0 = append(ifd0, exifEntry{tag, 4, 1, data})
+		offset += exifIFDSize(entries)
+	}
+	pointer(exifTagExifIFD, exif)
+	pointer(exifTagGPSIFD, gps)
+
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, binary.LittleEndian, []uint16{42, 8, 0})
+	writeExifIFD(tiff, ifd0, 8)
+	writeExifIFD(tiff, exif, tiff.Len())
+	writeExifIFD(tiff, gps, tiff.Len())
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, noisyJPEG(8, 8)[2:]...)
+}
+
+func cameraJPEG() []byte {
+	return exifSegmentJPEG(
+		[]exifEntry{exifASCII(0x010f, "Canon"), exifASCII(0x0110, "EOS 5D"), exifShort(0x0112, 6)},
+		[]exifEntry{exifASCII(0x9003, "2016:05:21 10:30:00"), exifRationals(0x829d, 28, 10)},
+		[]exifEntry{
+			exifASCII(exifGPSLatitudeRef, "N"),
+			exifRationals(exifGPSLatitude, 40, 1, 25, 1, 3000, 100),
+			exifASCII(exifGPSLongitudeRef, "W"),
+			exifRationals(exifGPSLongitude, 3, 1, 42, 1, 0, 1),
+		},
+	)
+}
+
+func TestReadExif(t *testing.T) {
+	exif := readExif(cameraJPEG(), false)
+	expected := map[string]interface{}{
+		"Make":             "Canon",
+		"Model":            "EOS 5D",
+		"Orientation":      6,
+		"DateTimeOriginal": "2016:05:21 10:30:00",
+		"FNumber":          2.8,
+	}
+	for name, value := range expected {
+		if exif[name] != value {
+			t.Errorf("Invalid %s tag: %v", name, exif[name])
+		}
+	}
+
+	gps, ok := exif["GPS"].(ExifGPS)
+	if !ok {
+		t.Fatalf("Missing GPS position: %v", exif)
+	}
+	if gps.Latitude < 40.425 || gps.Latitude > 40.426 || gps.Longitude != -3.7 || gps.Altitude != nil {
+		t.Errorf("Invalid GPS position: %+v", gps)
+	}
+
+	if _, ok := readExif(cameraJPEG(), true)["GPS"]; ok {
+		t.Error("GPS position must be omitted if stripgps is enabled")
+	}
+}
+
+func TestReadExifMissingOrCorrupt(t *testing.T) {
+	if exif := readExif(noisyJPEG(8, 8), false); exif == nil || len(exif) != 0 {
+		t.Errorf("Images without EXIF must have no tags: %v", exif)
+	}
+	body, _ := json.Marshal(readExif(stripedPNG(t), false))
+	if string(body) != "{}" {
+		t.Errorf("Images without EXIF must be serialized as an empty object: %s", body)
+	}
+
+	// Scramble the EXIF directories, keeping the TIFF header valid
+	buf := cameraJPEG()
+	length := int(binary.BigEndian.Uint16(buf[4:6]))
+	random := rand.New(rand.NewSource(1))
+	for attempt := 0; attempt < 100; attempt++ {
+		corrupt := append([]byte{}, buf...)
+		for i := 22; i < 4+length; i++ {
+			if random.Intn(4) == 0 {
+				corrupt[i] = byte(random.Intn(256))
+			}
+		}
+		if exif := readExif(corrupt, false); exif == nil {
+			t.Fatal("Corrupt EXIF images must return an object")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxFilenameLength = 128
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// attachmentFilename returns the Content-Disposition filename, using the
+// explicit filename if present, otherwise the source key base name with
+// the output image extension.
+func attachmentFilename(filename, key, mime string) string {
+	if filename = sanitizeFilename(filename); filename != "" {
+		return filename
+	}
+
+	ext := imageExtension(mime)
+	name := sanitizeFilename(key)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "" {
+		name = "image"
+	}
+
+	return name + "." + ext
+}
+
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, "._")
+	if len(name) > maxFilenameLength {
+		name = name[:maxFilenameLength]
+	}
+	return name
+}
+
+func imageExtension(mime string) string {
+	ext := ExtractImageTypeFromMime(mime)
+	if ext == "jpeg" {
+		return "jpg"
+	}
+	if isICO(mime) {
+		return icoImageType
+	}
+	return ext
+}
+
+// isResourceName reports whether the name can safely select a file from a
+// configured directory, rejecting path separators and hidden files.
+func isResourceName(name string) bool {
+	return name != "" && name == filepath.Base(name) && strings.HasPrefix(name, ".") == false && strings.ContainsAny(name, "/\\") == false
+}
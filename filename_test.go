@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAttachmentFilename(t *testing.T) {
+	cases := []struct {
+		filename string
+		key      string
+		mime     string
+		expected string
+	}{
+		{"", "photos/cat.png", "image/jpeg", "cat.jpg"},
+		{"", "/bucket/thumbs/dog.JPG", "image/webp", "dog.webp"},
+		{"", "../../etc/passwd", "image/png", "passwd.png"},
+		{"", "my photo (1).jpeg", "image/png", "my_photo_1_.png"},
+		{"", "", "image/jpeg", "image.jpg"},
+		{"", "/", "image/jpeg", "image.jpg"},
+		{"custom.jpg", "photos/cat.png", "image/png", "custom.jpg"},
+		{"../evil\"name.png", "cat.png", "image/png", "evil_name.png"},
+	}
+
+	for _, test := range cases {
+		filename := attachmentFilename(test.filename, test.key, test.mime)
+		if filename != test.expected {
+			t.Errorf("Invalid filename for %s: %s != %s", test.key, filename, test.expected)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"sort"
+)
+
+const (
+	gifImageType     = "gif"
+	defaultGIFDepth  = 8
+	defaultGIFEffort = 7
+	// Max pixels sampled to build the median cut palette
+	maxPaletteSamples = 1 << 16
+)
+
+// isOutputTypeSupported reports whether the image type can be encoded,
+// either by libvips or by the built-in GIF and ICO encoders.
+func isOutputTypeSupported(name string) bool {
+	return name == gifImageType || name == icoImageType || ImageType(name) != 0
+}
+
+// runGIF runs the operation with PNG output, then encodes the result as
+// GIF, since libvips cannot save GIF images.
+func (o Operation) runGIF(buf []byte, opts ImageOptions) (Image, error) {
+	opts.Type = "png"
+	image, err := o(buf, opts)
+	if err != nil {
+		return image, err
+	}
+
+	img, err := png.Decode(bytes.NewReader(image.Body))
+	if err != nil {
+		return Image{}, err
+	}
+
+	body, err := encodeGIF(img, opts)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: "image/gif", Headers: image.Headers, Operations: image.Operations}, nil
+}
+
+// encodeGIF quantizes the image to a palette of 2^bitdepth colors and
+// encodes it as GIF. Higher effort builds an adaptive palette from more
+// pixel samples; dither scales the Floyd-Steinberg error diffusion.
+func encodeGIF(img image.Image, o ImageOptions) ([]byte, error) {
+	depth := o.BitDepth
+	if depth == 0 {
+		depth = defaultGIFDepth
+	}
+	effort := o.Effort
+	if effort == 0 {
+		effort = defaultGIFEffort
+	}
+
+	src := toNRGBA(img)
+	transparent := hasTransparentPixels(src)
+
+	colors := 1 << uint(depth)
+	if transparent {
+		colors--
+	}
+	pal := buildPalette(src, colors, effort)
+	if transparent {
+		pal = append(pal, color.NRGBA{})
+	}
+
+	out := image.NewPaletted(src.Bounds(), pal)
+	ditherImage(out, src, o.Dither, transparent)
+
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, out, &gif.Options{NumColors: len(pal)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hasTransparentPixels(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] < 128 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildPalette returns a fixed web-safe palette for low effort levels,
+// otherwise a median cut palette of the sampled image colors.
+func buildPalette(img *image.NRGBA, colors, effort int) color.Palette {
+	if effort <= 3 {
+		return reducePalette(palette.WebSafe, colors)
+	}
+
+	// Sample one of every stride pixels, all of them at max effort, up to
+	// the max samples on large images
+	stride := 11 - effort
+	if pixels := len(img.Pix) / 4; pixels/stride > maxPaletteSamples {
+		stride = (pixels + maxPaletteSamples - 1) / maxPaletteSamples
+	}
+	var samples [][3]uint8
+	for i := 0; i < len(img.Pix); i += 4 * stride {
+		if img.Pix[i+3] >= 128 {
+			samples = append(samples, [3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]})
+		}
+	}
+	if len(samples) == 0 {
+		return color.Palette{color.NRGBA{0, 0, 0, 255}}
+	}
+
+	boxes := []colorBox{newColorBox(samples)}
+	for len(boxes) < colors {
+		index := widestBox(boxes)
+		if index < 0 {
+			break
+		}
+		box := boxes[index]
+		sort.Slice(box.pixels, func(i, j int) bool { return box.pixels[i][box.channel] < box.pixels[j][box.channel] })
+		half := len(box.pixels) / 2
+		boxes[index] = newColorBox(box.pixels[:half])
+		boxes = append(boxes, newColorBox(box.pixels[half:]))
+	}
+
+	pal := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [3]int
+		for _, c := range box.pixels {
+			sum[0], sum[1], sum[2] = sum[0]+int(c[0]), sum[1]+int(c[1]), sum[2]+int(c[2])
+		}
+		n := len(box.pixels)
+		pal = append(pal, color.NRGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 255})
+	}
+	return pal
+}
+
+// colorBox is a median cut box of sampled colors, with the channel of
+// the largest range, computed once when the box is created.
+type colorBox struct {
+	pixels  [][3]uint8
+	channel int
+	width   int
+}
+
+func newColorBox(pixels [][3]uint8) colorBox {
+	box := colorBox{pixels: pixels}
+	if len(pixels) < 2 {
+		return box
+	}
+	for c := 0; c < 3; c++ {
+		low, high := uint8(255), uint8(0)
+		for _, px := range pixels {
+			if px[c] < low {
+				low = px[c]
+			}
+			if px[c] > high {
+				high = px[c]
+			}
+		}
+		if int(high-low) > box.width {
+			box.channel, box.width = c, int(high-low)
+		}
+	}
+	return box
+}
+
+// widestBox returns the splittable box with the largest channel range.
+func widestBox(boxes []colorBox) int {
+	index, widest := -1, 0
+	for i, box := range boxes {
+		if box.width > widest {
+			index, widest = i, box.width
+		}
+	}
+	return index
+}
+
+func reducePalette(pal color.Palette, colors int) color.Palette {
+	if colors >= len(pal) {
+		return append(color.Palette{}, pal...)
+	}
+	out := make(color.Palette, colors)
+	for i := range out {
+		out[i] = pal[i*len(pal)/colors]
+	}
+	return out
+}
+
+// ditherImage maps every pixel to the closest palette color, diffusing the
+// error scaled by amount to the neighbour pixels (Floyd-Steinberg).
+func ditherImage(dst *image.Paletted, src *image.NRGBA, amount float64, transparent bool) {
+	bounds := src.Bounds()
+	width := bounds.Dx()
+	current := make([][3]float64, width+2)
+	next := make([][3]float64, width+2)
+	opaque := dst.Palette
+	if transparent {
+		opaque = dst.Palette[:len(dst.Palette)-1]
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < width; x++ {
+			i := src.PixOffset(x, y)
+			if transparent && src.Pix[i+3] < 128 {
+				dst.SetColorIndex(x, y, uint8(len(dst.Palette)-1))
+				continue
+			}
+
+			var value [3]float64
+			for c := 0; c < 3; c++ {
+				value[c] = clampChannel(float64(src.Pix[i+c]) + current[x+1][c])
+			}
+
+			index := opaque.Index(color.NRGBA{uint8(value[0]), uint8(value[1]), uint8(value[2]), 255})
+			dst.SetColorIndex(x, y, uint8(index))
+			if amount <= 0 {
+				continue
+			}
+
+			r, g, b, _ := opaque[index].RGBA()
+			chosen := [3]float64{float64(r >> 8), float64(g >> 8), float64(b >> 8)}
+			for c := 0; c < 3; c++ {
+				diff := (value[c] - chosen[c]) * amount
+				current[x+2][c] += diff * 7 / 16
+				next[x][c] += diff * 3 / 16
+				next[x+1][c] += diff * 5 / 16
+				next[x+2][c] += diff * 1 / 16
+			}
+		}
+		current, next = next, current
+		for i := range next {
+			next[i] = [3]float64{}
+		}
+	}
+}
+
+func clampChannel(value float64) float64 {
+	if value < 0 {
+		return 0
+	}
+	if value > 255 {
+		return 255
+	}
+	return value
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"testing"
+)
+
+func gradientPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 128; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 2), uint8(y * 4), 128, 255})
+		}
+	}
+	return encodeTestPNG(t, img)
+}
+
+func TestConvertGIF(t *testing.T) {
+	buf := gradientPNG(t)
+
+	convert := func(o ImageOptions) []byte {
+		o.Type = "gif"
+		out, err := Operation(Convert).Run(buf, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Mime != "image/gif" {
+			t.Fatalf("Invalid image type: %s", out.Mime)
+		}
+		img, err := gif.Decode(bytes.NewReader(out.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth := o.BitDepth; depth > 0 && len(img.(*image.Paletted).Palette) > 1<<uint(depth) {
+			t.Errorf("Palette exceeds %d colors: %d", 1<<uint(depth), len(img.(*image.Paletted).Palette))
+		}
+		return out.Body
+	}
+
+	full := convert(ImageOptions{})
+	small := convert(ImageOptions{BitDepth: 2})
+	dithered := convert(ImageOptions{BitDepth: 2, Dither: 1})
+	fast := convert(ImageOptions{BitDepth: 4, Effort: 1})
+
+	if len(small) >= len(full) {
+		t.Errorf("Smaller palettes must reduce the size: %d >= %d", len(small), len(full))
+	}
+	if len(dithered) <= len(small) {
+		t.Errorf("Dithering must increase the size: %d <= %d", len(dithered), len(small))
+	}
+	if len(fast) == 0 {
+		t.Error("Empty GIF output")
+	}
+}
+
+func TestGIFParamsValidation(t *testing.T) {
+	ts := testServer(controller(Convert))
+	defer ts.Close()
+
+	for _, query := range []string{"bitdepth=9", "dither=1.5", "effort=0", "bitdepth=abc"} {
+		res, err := http.Post(ts.URL+"?type=gif&"+query, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("Invalid response status for %s: %d", query, res.StatusCode)
+		}
+	}
+
+	image := postImage(t, ts.URL+"?type=gif&bitdepth=4&dither=0.5", "large.jpg")
+	if _, err := gif.Decode(bytes.NewReader(image)); err != nil {
+		t.Errorf("Invalid GIF output: %s", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"strings"
+)
+
+// Corner gravities anchoring both axes, resolved by imaginary to the
+// libvips gravity of the axis the crop slides along
+const (
+	GravityNorthEast bimg.Gravity = iota + 110
+	GravityNorthWest
+	GravitySouthEast
+	GravitySouthWest
+)
+
+// cornerGravities maps the corner gravities to their horizontal and
+// vertical anchors
+var cornerGravities = map[bimg.Gravity][2]bimg.Gravity{
+	GravityNorthEast: {bimg.EAST, bimg.NORTH},
+	GravityNorthWest: {bimg.WEST, bimg.NORTH},
+	GravitySouthEast: {bimg.EAST, bimg.SOUTH},
+	GravitySouthWest: {bimg.WEST, bimg.SOUTH},
+}
+
+func isCornerGravity(gravity bimg.Gravity) bool {
+	_, ok := cornerGravities[gravity]
+	return ok
+}
+
+// libvipsGravity returns the gravity passed to libvips, which crops by the
+// centre the gravities resolved by imaginary, unless they were resolved.
+func libvipsGravity(gravity bimg.Gravity) bimg.Gravity {
+	if isSmartGravity(gravity) || isCornerGravity(gravity) {
+		return bimg.CENTRE
+	}
+	return gravity
+}
+
+// gravityAxes splits the gravity into its horizontal and vertical anchors.
+func gravityAxes(gravity bimg.Gravity) (bimg.Gravity, bimg.Gravity) {
+	if axes, ok := cornerGravities[gravity]; ok {
+		return axes[0], axes[1]
+	}
+	if gravity == bimg.EAST || gravity == bimg.WEST {
+		return gravity, bimg.CENTRE
+	}
+	if gravity == bimg.NORTH || gravity == bimg.SOUTH {
+		return bimg.CENTRE, gravity
+	}
+	return bimg.CENTRE, bimg.CENTRE
+}
+
+// combineGravity returns the gravity anchored by both axes. Smart
+// gravities are kept as is.
+func combineGravity(horizontal, vertical bimg.Gravity) bimg.Gravity {
+	if vertical == bimg.CENTRE {
+		return horizontal
+	}
+	if horizontal == bimg.CENTRE {
+		return vertical
+	}
+	for gravity, axes := range cornerGravities {
+		if axes[0] == horizontal && axes[1] == vertical {
+			return gravity
+		}
+	}
+	return bimg.CENTRE
+}
+
+// parseCompoundGravity parses comma separated gravities, such as
+// north,centre or north,east, anchoring each axis independently.
+func parseCompoundGravity(val string) bimg.Gravity {
+	horizontal, vertical := bimg.CENTRE, bimg.CENTRE
+	for _, part := range strings.Split(val, ",") {
+		x, y := gravityAxes(parseGravity(part))
+		if x != bimg.CENTRE {
+			horizontal = x
+		}
+		if y != bimg.CENTRE {
+			vertical = y
+		}
+	}
+	return combineGravity(horizontal, vertical)
+}
+
+// withAxisGravity overrides the gravity anchors by the per axis gravities,
+// if defined.
+func withAxisGravity(gravity, horizontal, vertical bimg.Gravity) bimg.Gravity {
+	if isSmartGravity(gravity) {
+		return gravity
+	}
+	x, y := gravityAxes(gravity)
+	if horizontal, _ := gravityAxes(horizontal); horizontal != bimg.CENTRE {
+		x = horizontal
+	}
+	if _, vertical := gravityAxes(vertical); vertical != bimg.CENTRE {
+		y = vertical
+	}
+	return combineGravity(x, y)
+}
+
+// cropGravity resolves the libvips gravity cropping the image to the given
+// size. As the crop only slides along one axis, corner gravities resolve
+// to the anchor of that axis.
+func cropGravity(buf []byte, gravity bimg.Gravity, width, height int) bimg.Gravity {
+	if isCornerGravity(gravity) == false {
+		return libvipsGravity(gravity)
+	}
+
+	size, err := bimg.Size(buf)
+	if err != nil || width == 0 || height == 0 || size.Height == 0 {
+		return bimg.CENTRE
+	}
+
+	horizontal, vertical := gravityAxes(gravity)
+	if float64(size.Width)/float64(size.Height) > float64(width)/float64(height) {
+		return horizontal
+	}
+	return vertical
+}
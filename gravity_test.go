@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+// bandedPNG returns an image split in three equal bands of different colors
+// along its longest side.
+func bandedPNG(t *testing.T, width, height int) []byte {
+	bands := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			band := y * 3 / height
+			if width > height {
+				band = x * 3 / width
+			}
+			img.SetNRGBA(x, y, bands[band])
+		}
+	}
+	return encodeTestPNG(t, img)
+}
+
+func TestParseAxisGravity(t *testing.T) {
+	cases := []struct {
+		query    url.Values
+		expected bimg.Gravity
+	}{
+		{url.Values{"gravity": {"north"}}, bimg.NORTH},
+		{url.Values{"gravity": {"north,center"}}, bimg.NORTH},
+		{url.Values{"gravity": {"centre, west"}}, bimg.WEST},
+		{url.Values{"gravity": {"north,east"}}, GravityNorthEast},
+		{url.Values{"gravity": {"west,south"}}, GravitySouthWest},
+		{url.Values{"gravityx": {"east"}, "gravityy": {"north"}}, GravityNorthEast},
+		{url.Values{"gravity": {"south"}, "gravityx": {"west"}}, GravitySouthWest},
+		{url.Values{"gravity": {"north,east"}, "gravityy": {"south"}}, GravitySouthEast},
+		{url.Values{"gravity": {"smart"}, "gravityx": {"east"}}, GravitySmart},
+	}
+
+	for _, test := range cases {
+		if gravity := readParams(test.query).Gravity; gravity != test.expected {
+			t.Errorf("Invalid gravity for %v: %v", test.query, gravity)
+		}
+	}
+}
+
+func TestCropGravity(t *testing.T) {
+	wide := bandedPNG(t, 300, 100)
+	if gravity := cropGravity(wide, GravityNorthEast, 100, 100); gravity != bimg.EAST {
+		t.Errorf("Wide images must slide along the horizontal anchor: %v", gravity)
+	}
+	tall := bandedPNG(t, 100, 300)
+	if gravity := cropGravity(tall, GravityNorthEast, 100, 100); gravity != bimg.NORTH {
+		t.Errorf("Tall images must slide along the vertical anchor: %v", gravity)
+	}
+	if gravity := cropGravity(tall, bimg.SOUTH, 100, 100); gravity != bimg.SOUTH {
+		t.Errorf("Single gravities must be kept: %v", gravity)
+	}
+}
+
+func TestCropNorthCentre(t *testing.T) {
+	for _, gravity := range []string{"north,center", "north,east"} {
+		opts := readParams(url.Values{"width": {"100"}, "height": {"100"}, "gravity": {gravity}, "type": {"png"}})
+		out, err := Crop(bandedPNG(t, 100, 300), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := png.Decode(bytes.NewReader(out.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size.X != 100 || size.Y != 100 {
+			t.Fatalf("Invalid image size: %v", size)
+		}
+		if r, g, b, _ := img.At(50, 50).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+			t.Errorf("%s crops must retain the top region: %d,%d,%d", gravity, r>>8, g>>8, b>>8)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ImageHashes is the set of approved image contents, identified by their
+// SHA-256 hex digest. A nil set approves any image.
+type ImageHashes map[string]bool
+
+// ParseImageHashes builds the set from SHA-256 hex digests.
+func ParseImageHashes(values []string) (ImageHashes, error) {
+	hashes := ImageHashes{}
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 image hash: %s", value)
+		}
+		hashes[value] = true
+	}
+	return hashes, nil
+}
+
+// LoadImageHashes reads one SHA-256 hex digest per line from the given
+// file, ignoring empty and # comment lines.
+func LoadImageHashes(path string) (ImageHashes, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" && strings.HasPrefix(line, "#") == false {
+			values = append(values, line)
+		}
+	}
+	return ParseImageHashes(values)
+}
+
+// Check rejects the image unless its content hash is approved.
+func (h ImageHashes) Check(buf []byte) error {
+	if h == nil {
+		return nil
+	}
+	sum := sha256.Sum256(buf)
+	if h[hex.EncodeToString(sum[:])] == false {
+		return ErrImageNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func fixtureHash(name string) string {
+	buf, _ := ioutil.ReadFile("fixtures/" + name)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAllowedHashes(t *testing.T) {
+	hashes, err := ParseImageHashes([]string{fixtureHash("large.jpg")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ServerOptions{AllowedHashes: hashes}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	cases := []struct {
+		file   string
+		status int
+	}{
+		{"large.jpg", http.StatusOK},
+		{"test.png", http.StatusForbidden},
+	}
+	for _, test := range cases {
+		res, err := http.Post(ts.URL+"/resize?width=100", "image/*", readFile(test.file))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %s", test.file, res.Status)
+		}
+	}
+}
+
+func TestLoadImageHashes(t *testing.T) {
+	file, _ := ioutil.TempFile("", "hashes")
+	defer os.Remove(file.Name())
+	file.WriteString("# approved assets\n\n" + fixtureHash("test.png") + "\n")
+	file.Close()
+
+	hashes, err := LoadImageHashes(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	png, _ := ioutil.ReadFile("fixtures/test.png")
+	jpeg, _ := ioutil.ReadFile("fixtures/large.jpg")
+	if hashes.Check(png) != nil || hashes.Check(jpeg) != ErrImageNotAllowed {
+		t.Errorf("Invalid loaded hashes: %v", hashes)
+	}
+
+	if _, err := ParseImageHashes([]string{"abc"}); err == nil {
+		t.Error("Invalid hashes must be rejected")
+	}
+	if ImageHashes(nil).Check(jpeg) != nil {
+		t.Error("A nil hash set must allow any image")
+	}
+}
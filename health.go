@@ -1,34 +1,82 @@
 package main
 
 import (
+	"errors"
+	"gopkg.in/h2non/bimg.v0"
 	"math"
 	"runtime"
+	"sync/atomic"
 	"time"
 )
 
 var start = time.Now()
 
+// Number of libvips operations currently running
+var vipsOperations int64
+
 const MB float64 = 1.0 * 1024 * 1024
 
 type HealthStats struct {
+	Healthy              bool    `json:"healthy"`
 	Uptime               int64   `json:"uptime"`
 	AllocatedMemory      float64 `json:"allocatedMemory"`
 	TotalAllocatedMemory float64 `json:"totalAllocatedMemory"`
 	Goroutines           int     `json:"goroutines"`
 	NumberOfCPUs         int     `json:"cpus"`
+	VipsVersion          string  `json:"libvips"`
+	VipsMemory           float64 `json:"vipsMemory"`
+	VipsPeakMemory       float64 `json:"vipsPeakMemory"`
+	VipsOperations       int64   `json:"vipsOperations"`
 }
 
-func GetHealthStats() *HealthStats {
+// GetHealthStats returns the runtime and libvips diagnostics. The server
+// is unhealthy once libvips allocates more than maxVipsMemory megabytes,
+// unless it is zero.
+func GetHealthStats(maxVipsMemory int) *HealthStats {
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
+	vipsMem, vipsPeak := vipsMemory()
 
-	return &HealthStats{
+	stats := &HealthStats{
 		Uptime:               GetUptime(),
 		AllocatedMemory:      toMegaBytes(mem.Alloc),
 		TotalAllocatedMemory: toMegaBytes(mem.TotalAlloc),
 		Goroutines:           runtime.NumGoroutine(),
 		NumberOfCPUs:         runtime.NumCPU(),
+		VipsVersion:          bimg.VipsVersion,
+		VipsMemory:           toMegaBytes(vipsMem),
+		VipsPeakMemory:       toMegaBytes(vipsPeak),
+		VipsOperations:       atomic.LoadInt64(&vipsOperations),
+	}
+	stats.Healthy = isHealthy(stats, maxVipsMemory)
+	return stats
+}
+
+func isHealthy(stats *HealthStats, maxVipsMemory int) bool {
+	return maxVipsMemory <= 0 || stats.VipsMemory <= float64(maxVipsMemory)
+}
+
+// 1x1 white PNG used to check that libvips is able to decode and encode images
+var readinessImage = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	0x08, 0x00, 0x00, 0x00, 0x00, 0x3a, 0x7e, 0x9b, 0x55, 0x00, 0x00, 0x00,
+	0x0b, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x62, 0xfa, 0x0f, 0x18, 0x00,
+	0x01, 0x05, 0x01, 0x02, 0x2c, 0x6a, 0x36, 0x28, 0x00, 0x00, 0x00, 0x00,
+	0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+// CheckReadiness processes a tiny image end-to-end to verify that
+// libvips is able to decode and encode images.
+func CheckReadiness() error {
+	image, err := Process(readinessImage, bimg.Options{Type: bimg.JPEG})
+	if err != nil {
+		return err
+	}
+	if bimg.DetermineImageType(image.Body) != bimg.JPEG {
+		return errors.New("unexpected output image type")
 	}
+	return nil
 }
 
 func GetUptime() int64 {
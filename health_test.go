@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthController(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(healthController(ServerOptions{})))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	var stats HealthStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Healthy || stats.VipsVersion == "" || stats.Goroutines == 0 {
+		t.Errorf("Invalid health stats: %+v", stats)
+	}
+}
+
+func TestHealthVipsMemoryLimit(t *testing.T) {
+	stats := &HealthStats{VipsMemory: 256}
+
+	cases := []struct {
+		max     int
+		healthy bool
+	}{
+		{0, true},
+		{512, true},
+		{256, true},
+		{128, false},
+	}
+
+	for _, test := range cases {
+		if healthy := isHealthy(stats, test.max); healthy != test.healthy {
+			t.Errorf("Invalid health for max %d MB: %v", test.max, healthy)
+		}
+	}
+}
+
+func TestLivenessController(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(livenessController))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "OK" || res.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Invalid liveness response: %s %s", res.Status, body)
+	}
+}
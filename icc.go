@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"gopkg.in/h2non/bimg.v0"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const maxICCSegmentBytes = 65535 - 2 - 14
+
+var iccSegmentHeader = []byte("ICC_PROFILE\x00")
+
+// LoadICCProfile reads the named .icc or .icm profile from the directory.
+func LoadICCProfile(dir, name string) ([]byte, error) {
+	if dir == "" {
+		return nil, NewError("ICC profiles are not enabled, see the -icc-dir flag", NotAllowed)
+	}
+	if isResourceName(name) == false {
+		return nil, NewError("Invalid ICC profile name: "+name, BadRequest)
+	}
+
+	for _, ext := range []string{".icc", ".icm"} {
+		profile, err := ioutil.ReadFile(filepath.Join(dir, name+ext))
+		if err != nil {
+			continue
+		}
+		if len(profile) < 128 || string(profile[36:40]) != "acsp" {
+			return nil, NewError("Invalid ICC profile: "+name, BadRequest)
+		}
+		return profile, nil
+	}
+	return nil, NewError("ICC profile not found: "+name, NotFound)
+}
+
+// embedICCProfile attaches the requested ICC profile to the output image,
+// replacing any existing one. Pixels are not converted to the profile.
+func embedICCProfile(image Image, o ImageOptions) (Image, error) {
+	if o.ICCProfile == "" {
+		return image, nil
+	}
+
+	profile, err := LoadICCProfile(o.ICCDir, o.ICCProfile)
+	if err != nil {
+		return Image{}, err
+	}
+
+	switch image.Mime {
+	case "image/jpeg":
+		image.Body, err = embedJPEGProfile(image.Body, profile)
+	case "image/png":
+		image.Body, err = embedPNGProfile(image.Body, o.ICCProfile, profile)
+	default:
+		return Image{}, NewError("ICC profiles can only be embedded in JPEG and PNG images", BadRequest)
+	}
+	return image, err
+}
+
+// embedJPEGProfile replaces the APP2 ICC_PROFILE segments, splitting the
+// profile in as many segments as needed, right after the APP0/APP1 ones.
+func embedJPEGProfile(buf, profile []byte) ([]byte, error) {
+	segments, ok := splitJPEGSegments(buf)
+	if !ok {
+		return nil, NewError("Invalid JPEG image", BadRequest)
+	}
+
+	count := (len(profile) + maxICCSegmentBytes - 1) / maxICCSegmentBytes
+	if count > 255 {
+		return nil, NewError("ICC profile too large", BadRequest)
+	}
+
+	var icc []byte
+	for i := 0; i < count; i++ {
+		end := (i + 1) * maxICCSegmentBytes
+		if end > len(profile) {
+			end = len(profile)
+		}
+		chunk := profile[i*maxICCSegmentBytes : end]
+		segment := []byte{0xff, 0xe2, 0, 0}
+		binary.BigEndian.PutUint16(segment[2:], uint16(2+len(iccSegmentHeader)+2+len(chunk)))
+		segment = append(segment, iccSegmentHeader...)
+		segment = append(segment, byte(i+1), byte(count))
+		icc = append(icc, append(segment, chunk...)...)
+	}
+
+	out := make([]byte, 0, len(buf)+len(icc))
+	out = append(out, 0xff, 0xd8)
+	inserted := false
+	for _, segment := range segments {
+		marker := segment[1]
+		if marker == 0xe2 && bytes.HasPrefix(segment[4:], iccSegmentHeader) {
+			continue
+		}
+		if !inserted && marker != 0xe0 && marker != jpegMarkerAPP1 {
+			out = append(out, icc...)
+			inserted = true
+		}
+		out = append(out, segment...)
+	}
+	return out, nil
+}
+
+// embedPNGProfile replaces the iCCP chunk, and the conflicting sRGB one,
+// inserting the compressed profile right after the IHDR chunk.
+func embedPNGProfile(buf []byte, name string, profile []byte) ([]byte, error) {
+	if len(buf) < 33 || bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")) == false {
+		return nil, NewError("Invalid PNG image", BadRequest)
+	}
+
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(profile)
+	writer.Close()
+
+	if len(name) > 79 {
+		name = name[:79]
+	}
+	data := append([]byte("iCCP"+name+"\x00\x00"), compressed.Bytes()...)
+	chunk := make([]byte, 4, len(data)+8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)-4))
+	chunk = append(chunk, data...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(data))
+
+	out := make([]byte, 0, len(buf)+len(chunk))
+	out = append(out, buf[:33]...)
+	out = append(out, chunk...)
+	for pos := 33; pos+12 <= len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(buf) {
+			return nil, NewError("Invalid PNG image", BadRequest)
+		}
+		if name := string(buf[pos+4 : pos+8]); name != "iCCP" && name != "sRGB" {
+			out = append(out, buf[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// extractICCProfile returns the ICC profile embedded in the JPEG APP2
+// segments, in sequence order, or in the PNG iCCP chunk, if any.
+func extractICCProfile(buf []byte) []byte {
+	if segments, ok := splitJPEGSegments(buf); ok {
+		chunks := map[byte][]byte{}
+		for _, segment := range segments {
+			if segment[1] == 0xe2 && bytes.HasPrefix(segment[4:], iccSegmentHeader) && len(segment) > 4+len(iccSegmentHeader)+2 {
+				chunks[segment[4+len(iccSegmentHeader)]] = segment[4+len(iccSegmentHeader)+2:]
+			}
+		}
+		var profile []byte
+		for seq := 1; seq <= len(chunks); seq++ {
+			chunk, ok := chunks[byte(seq)]
+			if !ok {
+				return nil
+			}
+			profile = append(profile, chunk...)
+		}
+		return profile
+	}
+
+	if len(buf) < 33 || bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")) == false {
+		return nil
+	}
+	for pos := 8; pos+12 <= len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(buf) {
+			return nil
+		}
+		if string(buf[pos+4:pos+8]) == "iCCP" {
+			data := buf[pos+8 : pos+8+length]
+			name := bytes.IndexByte(data, 0)
+			if name < 0 || name+2 > len(data) {
+				return nil
+			}
+			reader, err := zlib.NewReader(bytes.NewReader(data[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos = end
+	}
+	return nil
+}
+
+// removeICCProfile drops the JPEG APP2 ICC_PROFILE segments or the PNG
+// iCCP chunk, leaving the rest of the image untouched.
+func removeICCProfile(buf []byte) []byte {
+	if segments, ok := splitJPEGSegments(buf); ok {
+		out := make([]byte, 0, len(buf))
+		out = append(out, 0xff, 0xd8)
+		for _, segment := range segments {
+			if segment[1] != 0xe2 || bytes.HasPrefix(segment[4:], iccSegmentHeader) == false {
+				out = append(out, segment...)
+			}
+		}
+		return out
+	}
+
+	if len(buf) < 33 || bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")) == false {
+		return buf
+	}
+	out := make([]byte, 0, len(buf))
+	out = append(out, buf[:8]...)
+	for pos := 8; pos+12 <= len(buf); {
+		length := int(binary.BigEndian.Uint32(buf[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(buf) {
+			return buf
+		}
+		if string(buf[pos+4:pos+8]) != "iCCP" {
+			out = append(out, buf[pos:end]...)
+		}
+		pos = end
+	}
+	return out
+}
+
+// applyICCProfile strips the ICC profile of the output image if stripicc
+// is requested. Otherwise the RGB profile of the source image is embedded
+// again if the output lost it, such as the images encoded in Go or saved
+// stripped by libvips, since the pixels are only right with the profile.
+// Only JPEG and PNG images are handled.
+func applyICCProfile(image Image, source []byte, o ImageOptions) (Image, error) {
+	if image.Mime != "image/jpeg" && image.Mime != "image/png" {
+		return image, nil
+	}
+	if o.StripICC {
+		image.Body = removeICCProfile(image.Body)
+		return image, nil
+	}
+	if len(source) < 128 || string(source[16:20]) != "RGB " || o.NoProfile || o.Colorspace == bimg.INTERPRETATION_B_W || extractICCProfile(image.Body) != nil {
+		return image, nil
+	}
+
+	var err error
+	if image.Mime == "image/jpeg" {
+		image.Body, err = embedJPEGProfile(image.Body, source)
+	} else {
+		image.Body, err = embedPNGProfile(image.Body, "icc", source)
+	}
+	return image, err
+}
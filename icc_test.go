@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testICCProfile(size int) []byte {
+	profile := make([]byte, size)
+	copy(profile[36:], "acsp")
+	for i := 128; i < size; i++ {
+		profile[i] = byte(i)
+	}
+	return profile
+}
+
+func TestLoadICCProfile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "imaginary")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "p3.icc"), testICCProfile(512), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "broken.icm"), []byte("not a profile"), 0644)
+
+	if profile, err := LoadICCProfile(dir, "p3"); err != nil || len(profile) != 512 {
+		t.Fatalf("Cannot load the ICC profile: %v", err)
+	}
+
+	for _, name := range []string{"", "missing", "broken", "../p3", ".p3"} {
+		if _, err := LoadICCProfile(dir, name); err == nil {
+			t.Errorf("Loading ICC profile %q should fail", name)
+		}
+	}
+	if _, err := LoadICCProfile("", "p3"); err == nil {
+		t.Error("ICC profiles must be disabled without directory")
+	}
+}
+
+func TestEmbedICCProfile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "imaginary")
+	defer os.RemoveAll(dir)
+	profile := testICCProfile(70000)
+	ioutil.WriteFile(filepath.Join(dir, "p3.icc"), profile, 0644)
+
+	opts := ImageOptions{Width: 100, ICCProfile: "p3", ICCDir: dir}
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	// JPEG: the profile is split across two APP2 segments
+	image, err := Operation(Resize).Run(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := splitJPEGSegments(image.Body)
+	var embedded []byte
+	for _, segment := range segments {
+		if segment[1] == 0xe2 && bytes.HasPrefix(segment[4:], iccSegmentHeader) {
+			embedded = append(embedded, segment[4+len(iccSegmentHeader)+2:]...)
+		}
+	}
+	if bytes.Equal(embedded, profile) == false {
+		t.Errorf("Invalid JPEG embedded profile: %d bytes", len(embedded))
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(image.Body)); err != nil {
+		t.Errorf("Cannot decode the JPEG image: %s", err)
+	}
+
+	// PNG: the profile is stored compressed in the iCCP chunk
+	opts.Type = "png"
+	image, err = Operation(Resize).Run(buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := binary.BigEndian.Uint32(image.Body[33:37])
+	chunk := image.Body[37 : 41+length]
+	if string(chunk[:4]) != "iCCP" || bytes.HasPrefix(chunk[4:], []byte("p3\x00\x00")) == false {
+		t.Fatalf("Missing PNG iCCP chunk")
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(chunk[8:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embedded, _ := ioutil.ReadAll(reader); bytes.Equal(embedded, profile) == false {
+		t.Errorf("Invalid PNG embedded profile: %d bytes", len(embedded))
+	}
+	if _, err := png.Decode(bytes.NewReader(image.Body)); err != nil {
+		t.Errorf("Cannot decode the PNG image: %s", err)
+	}
+
+	opts.Type = "webp"
+	if _, err := Operation(Resize).Run(buf, opts); err == nil {
+		t.Error("Unsupported image types must fail")
+	}
+}
+
+func TestExtractICCProfile(t *testing.T) {
+	profile := testICCProfile(70000)
+	copy(profile[16:], "RGB ")
+
+	var jpegBuf, pngBuf bytes.Buffer
+	jpeg.Encode(&jpegBuf, splitImage(8, 8), nil)
+	png.Encode(&pngBuf, splitImage(8, 8))
+
+	embeddedJPEG, _ := embedJPEGProfile(jpegBuf.Bytes(), profile)
+	embeddedPNG, _ := embedPNGProfile(pngBuf.Bytes(), "icc", profile)
+
+	for name, buf := range map[string][]byte{"jpeg": embeddedJPEG, "png": embeddedPNG} {
+		if extracted := extractICCProfile(buf); bytes.Equal(extracted, profile) == false {
+			t.Errorf("Invalid %s extracted profile: %d bytes", name, len(extracted))
+		}
+		stripped := removeICCProfile(buf)
+		if extractICCProfile(stripped) != nil {
+			t.Errorf("The %s profile must be removed", name)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("Cannot decode the stripped %s image: %s", name, err)
+		}
+	}
+
+	if extractICCProfile(jpegBuf.Bytes()) != nil || extractICCProfile(pngBuf.Bytes()) != nil {
+		t.Error("Images without profile must have none")
+	}
+}
+
+func TestApplyICCProfile(t *testing.T) {
+	profile := testICCProfile(512)
+	copy(profile[16:], "RGB ")
+
+	output := Image{Body: encodeTestPNG(t, splitImage(8, 8)), Mime: "image/png"}
+
+	// The profile lost by the output is embedded again
+	preserved, err := applyICCProfile(output, profile, ImageOptions{})
+	if err != nil || bytes.Equal(extractICCProfile(preserved.Body), profile) == false {
+		t.Fatalf("The source profile must be preserved: %v", err)
+	}
+
+	cases := []struct {
+		image   Image
+		profile []byte
+		opts    ImageOptions
+	}{
+		{preserved, profile, ImageOptions{StripICC: true}},
+		{output, profile, ImageOptions{NoProfile: true}},
+		{output, profile, ImageOptions{Colorspace: bimg.INTERPRETATION_B_W}},
+		{output, testICCProfile(512), ImageOptions{}},
+		{output, nil, ImageOptions{}},
+	}
+	for i, test := range cases {
+		image, err := applyICCProfile(test.image, test.profile, test.opts)
+		if err != nil || extractICCProfile(image.Body) != nil {
+			t.Errorf("No profile must be embedded in case %d: %v", i, err)
+		}
+	}
+
+	// Stripping the EXIF metadata keeps the profile
+	var jpegBuf bytes.Buffer
+	jpeg.Encode(&jpegBuf, splitImage(8, 8), nil)
+	embedded, _ := embedJPEGProfile(jpegBuf.Bytes(), profile)
+	stripped := stripMetadata(Image{Body: embedded, Mime: "image/jpeg"}, ImageOptions{StripMeta: true})
+	if bytes.Equal(extractICCProfile(stripped.Body), profile) == false {
+		t.Error("Stripping the metadata must keep the profile")
+	}
+}
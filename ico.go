@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+const (
+	icoImageType  = "ico"
+	icoHeaderSize = 6
+	icoEntrySize  = 16
+	bmpHeaderSize = 40
+	maxICOSize    = 256
+)
+
+// Icon sizes encoded by default for ICO output
+const defaultICOSizes = "16,32,48"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type icoEntry struct {
+	width    int
+	height   int
+	bitCount int
+	payload  []byte
+}
+
+func isICO(mimeType string) bool {
+	return mimeType == "image/x-icon" || mimeType == "image/vnd.microsoft.icon"
+}
+
+func errInvalidICO(reason string) Error {
+	return NewError("Invalid ICO image: "+reason, Unsupported)
+}
+
+// extractICO returns the ICO frame matching the requested width, or the
+// largest one, as a PNG image. PNG compressed frames are returned as is,
+// while bitmap frames are decoded and encoded as PNG.
+func extractICO(buf []byte, width int) ([]byte, error) {
+	entries, err := parseICO(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := selectICOEntry(entries, width)
+	if bytes.HasPrefix(entry.payload, pngSignature) {
+		return entry.payload, nil
+	}
+
+	img, err := decodeICOBitmap(entry)
+	if err != nil {
+		return nil, err
+	}
+	out, err := encodeRaster(img, ImageOptions{})
+	if err != nil {
+		return nil, NewError("Cannot encode the ICO image: "+err.Error(), InternalError)
+	}
+	return out.Body, nil
+}
+
+func parseICO(buf []byte) ([]icoEntry, error) {
+	if len(buf) < icoHeaderSize || binary.LittleEndian.Uint16(buf[0:2]) != 0 || binary.LittleEndian.Uint16(buf[2:4]) != 1 {
+		return nil, errInvalidICO("missing icon header")
+	}
+
+	count := int(binary.LittleEndian.Uint16(buf[4:6]))
+	if count == 0 {
+		return nil, errInvalidICO("no embedded images")
+	}
+	if len(buf) < icoHeaderSize+count*icoEntrySize {
+		return nil, errInvalidICO("truncated image directory")
+	}
+
+	entries := make([]icoEntry, count)
+	for i := range entries {
+		entry := buf[icoHeaderSize+i*icoEntrySize:]
+		size := int(binary.LittleEndian.Uint32(entry[8:12]))
+		offset := int(binary.LittleEndian.Uint32(entry[12:16]))
+		if size <= 0 || offset < 0 || offset+size > len(buf) || offset+size < offset {
+			return nil, errInvalidICO(fmt.Sprintf("image %d out of the file bounds", i))
+		}
+
+		entries[i] = icoEntry{
+			width:    icoDimension(entry[0]),
+			height:   icoDimension(entry[1]),
+			bitCount: int(binary.LittleEndian.Uint16(entry[6:8])),
+			payload:  buf[offset : offset+size],
+		}
+	}
+	return entries, nil
+}
+
+// Zero dimensions in the ICO directory stand for 256 pixels
+func icoDimension(value byte) int {
+	if value == 0 {
+		return 256
+	}
+	return int(value)
+}
+
+// selectICOEntry returns the entry matching the requested width, or the
+// largest one otherwise, preferring the highest color depth.
+func selectICOEntry(entries []icoEntry, width int) icoEntry {
+	best := entries[0]
+	for _, entry := range entries[1:] {
+		if isBetterICOEntry(entry, best, width) {
+			best = entry
+		}
+	}
+	return best
+}
+
+func isBetterICOEntry(a, b icoEntry, width int) bool {
+	if matchA, matchB := a.width == width, b.width == width; matchA != matchB {
+		return matchA
+	}
+	if a.width*a.height != b.width*b.height {
+		return a.width*a.height > b.width*b.height
+	}
+	return a.bitCount > b.bitCount
+}
+
+// decodeICOBitmap decodes a bottom-up device independent bitmap, whose
+// height includes the 1-bit transparency mask following the color data.
+func decodeICOBitmap(entry icoEntry) (*image.NRGBA, error) {
+	dib := entry.payload
+	if len(dib) < bmpHeaderSize || binary.LittleEndian.Uint32(dib[0:4]) < bmpHeaderSize {
+		return nil, errInvalidICO("invalid bitmap header")
+	}
+
+	headerSize := int(binary.LittleEndian.Uint32(dib[0:4]))
+	width := int(int32(binary.LittleEndian.Uint32(dib[4:8])))
+	height := int(int32(binary.LittleEndian.Uint32(dib[8:12]))) / 2
+	bitCount := int(binary.LittleEndian.Uint16(dib[14:16]))
+	compression := binary.LittleEndian.Uint32(dib[16:20])
+	if width <= 0 || height <= 0 || width > 256 || height > 256 || compression != 0 || headerSize > len(dib) {
+		return nil, errInvalidICO("unsupported bitmap format")
+	}
+
+	var palette []color.NRGBA
+	if bitCount <= 8 {
+		colors := int(binary.LittleEndian.Uint32(dib[32:36]))
+		if colors == 0 {
+			colors = 1 << uint(bitCount)
+		}
+		if headerSize+colors*4 > len(dib) {
+			return nil, errInvalidICO("truncated bitmap palette")
+		}
+		palette = make([]color.NRGBA, colors)
+		for i := range palette {
+			c := dib[headerSize+i*4:]
+			palette[i] = color.NRGBA{c[2], c[1], c[0], 255}
+		}
+	} else if bitCount != 24 && bitCount != 32 {
+		return nil, errInvalidICO(fmt.Sprintf("unsupported bitmap depth: %d bits", bitCount))
+	}
+
+	stride := (width*bitCount + 31) / 32 * 4
+	maskStride := (width + 31) / 32 * 4
+	pixels := dib[headerSize+len(palette)*4:]
+	if len(pixels) < stride*height {
+		return nil, errInvalidICO("truncated bitmap data")
+	}
+	mask := pixels[stride*height:]
+	hasMask := bitCount != 32 && len(mask) >= maskStride*height
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		// Rows are stored bottom-up
+		row := pixels[(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bitCount {
+			case 32:
+				c = color.NRGBA{row[x*4+2], row[x*4+1], row[x*4], row[x*4+3]}
+			case 24:
+				c = color.NRGBA{row[x*3+2], row[x*3+1], row[x*3], 255}
+			default:
+				bit := x * bitCount
+				index := int(row[bit/8]>>uint(8-bitCount-bit%8)) & (1<<uint(bitCount) - 1)
+				if index >= len(palette) {
+					return nil, errInvalidICO("invalid bitmap palette index")
+				}
+				c = palette[index]
+			}
+
+			if hasMask && mask[(height-1-y)*maskStride+x/8]&(0x80>>uint(x%8)) != 0 {
+				c.A = 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// parseICOSizes parses the comma separated icon sizes, which must be
+// between 1 and 256 pixels, ignoring duplicates.
+func parseICOSizes(value string) ([]int, error) {
+	if value == "" {
+		value = defaultICOSizes
+	}
+
+	sizes := []int{}
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || size < 1 || size > maxICOSize {
+			return nil, NewError("Invalid sizes param: must be a list of sizes between 1 and 256", BadRequest)
+		}
+		if seen[size] == false {
+			seen[size] = true
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes, nil
+}
+
+// runICO runs the operation with PNG output, then resizes the result to
+// every icon size, packed in a single ICO image as PNG compressed frames.
+func (o Operation) runICO(buf []byte, opts ImageOptions) (Image, error) {
+	sizes, err := parseICOSizes(opts.Sizes)
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts.Type = "png"
+	image, err := o(buf, opts)
+	if err != nil {
+		return image, err
+	}
+
+	frames := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		frame, err := Process(image.Body, bimg.Options{
+			Width:   size,
+			Height:  size,
+			Crop:    true,
+			Enlarge: true,
+			Gravity: libvipsGravity(opts.Gravity),
+			Type:    bimg.PNG,
+		})
+		if err != nil {
+			return Image{}, err
+		}
+		frames[i] = frame.Body
+	}
+
+	return Image{Body: encodeICO(sizes, frames), Mime: "image/x-icon", Headers: image.Headers, Operations: image.Operations}, nil
+}
+
+// encodeICO packs the square PNG frames of the given sizes as an ICO image.
+func encodeICO(sizes []int, frames [][]byte) []byte {
+	header := make([]byte, icoHeaderSize+len(frames)*icoEntrySize)
+	binary.LittleEndian.PutUint16(header[2:4], 1)
+	binary.LittleEndian.PutUint16(header[4:6], uint16(len(frames)))
+
+	offset := len(header)
+	for i, frame := range frames {
+		entry := header[icoHeaderSize+i*icoEntrySize:]
+		// 256 pixels are stored as zero
+		entry[0], entry[1] = byte(sizes[i]%maxICOSize), byte(sizes[i]%maxICOSize)
+		binary.LittleEndian.PutUint16(entry[4:6], 1)
+		binary.LittleEndian.PutUint16(entry[6:8], 32)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(entry[12:16], uint32(offset))
+		offset += len(frame)
+	}
+
+	buf := bytes.NewBuffer(header)
+	for _, frame := range frames {
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// bitmapFrame builds a bottom-up 24-bit bitmap filled with the color,
+// whose transparency mask hides the first pixel of the top row.
+func bitmapFrame(size int, c color.NRGBA) []byte {
+	stride := (size*24 + 31) / 32 * 4
+	maskStride := (size + 31) / 32 * 4
+
+	header := make([]byte, bmpHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], bmpHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(size))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(size*2))
+	binary.LittleEndian.PutUint16(header[12:14], 1)
+	binary.LittleEndian.PutUint16(header[14:16], 24)
+
+	pixels := make([]byte, stride*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			copy(pixels[y*stride+x*3:], []byte{c.B, c.G, c.R})
+		}
+	}
+	mask := make([]byte, maskStride*size)
+	mask[(size-1)*maskStride] = 0x80
+
+	return append(append(header, pixels...), mask...)
+}
+
+func pngFrame(t *testing.T, size int) []byte {
+	return encodeTestPNG(t, image.NewNRGBA(image.Rect(0, 0, size, size)))
+}
+
+func buildICO(frames ...[]byte) []byte {
+	buf := make([]byte, icoHeaderSize+len(frames)*icoEntrySize)
+	binary.LittleEndian.PutUint16(buf[2:4], 1)
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(len(frames)))
+
+	for i, frame := range frames {
+		var size int
+		if bytes.HasPrefix(frame, pngSignature) {
+			config, _ := png.DecodeConfig(bytes.NewReader(frame))
+			size = config.Width
+		} else {
+			size = int(binary.LittleEndian.Uint32(frame[4:8]))
+		}
+
+		entry := buf[icoHeaderSize+i*icoEntrySize:]
+		entry[0], entry[1] = byte(size), byte(size)
+		binary.LittleEndian.PutUint16(entry[6:8], 32)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(entry[12:16], uint32(len(buf)))
+		buf = append(buf, frame...)
+	}
+	return buf
+}
+
+func TestExtractICO(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	large := pngFrame(t, 32)
+	ico := buildICO(bitmapFrame(16, red), large)
+
+	if isICO(DetectContentType(ico)) == false {
+		t.Fatalf("ICO images must be detected: %s", DetectContentType(ico))
+	}
+
+	// PNG frames are returned untouched
+	buf, err := extractICO(ico, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buf, large) == false {
+		t.Error("The largest frame must be returned by default")
+	}
+
+	buf, err = extractICO(ico, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 16 || size.Y != 16 {
+		t.Fatalf("Invalid frame size: %v", size)
+	}
+	if c := color.NRGBAModel.Convert(img.At(5, 5)).(color.NRGBA); c != red {
+		t.Errorf("Invalid bitmap color: %v", c)
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Error("Masked pixels must be transparent")
+	}
+
+	// Unknown widths fall back to the largest frame
+	if buf, _ := extractICO(ico, 48); bytes.Equal(buf, large) == false {
+		t.Error("The largest frame must be returned if none matches the width")
+	}
+}
+
+func TestExtractInvalidICO(t *testing.T) {
+	truncated := buildICO(pngFrame(t, 16))
+	truncated = truncated[:len(truncated)-10]
+
+	cases := [][]byte{
+		buildICO(),
+		truncated,
+		[]byte("\x00\x00\x01\x00\x01\x00"),
+		buildICO([]byte("not a bitmap")),
+	}
+
+	for i, buf := range cases {
+		_, err := extractICO(buf, 0)
+		if err == nil {
+			t.Errorf("Case %d: malformed ICO images must be rejected", i)
+			continue
+		}
+		if code := err.(Error).HTTPCode(); code != 415 {
+			t.Errorf("Case %d: invalid response status: %d", i, code)
+		}
+	}
+}
+
+func TestParseICOSizes(t *testing.T) {
+	sizes, err := parseICOSizes("16, 32,16,256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[0] != 16 || sizes[1] != 32 || sizes[2] != 256 {
+		t.Errorf("Invalid sizes: %v", sizes)
+	}
+
+	if sizes, _ := parseICOSizes(""); len(sizes) != 3 || sizes[2] != 48 {
+		t.Errorf("Invalid default sizes: %v", sizes)
+	}
+
+	for _, value := range []string{"0", "257", "16,abc", "-16"} {
+		if _, err := parseICOSizes(value); err == nil {
+			t.Errorf("Invalid sizes must be rejected: %s", value)
+		}
+	}
+}
+
+func TestICOOutput(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	image, err := Operation(Resize).Run(buf, ImageOptions{Width: 300, Type: "ico", Sizes: "16,32,48,256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/x-icon" {
+		t.Errorf("Invalid mime type: %s", image.Mime)
+	}
+
+	entries, err := parseICO(image.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Invalid number of entries: %d", len(entries))
+	}
+	for i, size := range []int{16, 32, 48, 256} {
+		entry := entries[i]
+		if entry.width != size || entry.height != size {
+			t.Errorf("Invalid entry dimensions: %dx%d", entry.width, entry.height)
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(entry.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != size || config.Height != size {
+			t.Errorf("Invalid frame dimensions: %dx%d", config.Width, config.Height)
+		}
+	}
+}
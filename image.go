@@ -4,45 +4,200 @@ import (
 	"encoding/json"
 	"errors"
 	"gopkg.in/h2non/bimg.v0"
+	"strconv"
+	"sync/atomic"
 )
 
 type ImageOptions struct {
-	Width       int
-	Height      int
-	AreaWidth   int
-	AreaHeight  int
-	Quality     int
-	Compression int
-	Rotate      int
-	Top         int
-	Left        int
-	Margin      int
-	Factor      int
-	DPI         int
-	TextWidth   int
-	Force       bool
-	NoCrop      bool
-	NoReplicate bool
-	NoRotation  bool
-	NoProfile   bool
-	Opacity     float32
-	Text        string
-	Font        string
-	Type        string
-	Color       []uint8
-	Gravity     bimg.Gravity
-	Colorspace  bimg.Interpretation
+	Width              int
+	Height             int
+	AreaWidth          int
+	AreaHeight         int
+	Quality            int
+	Compression        int
+	Rotate             int
+	Top                int
+	Left               int
+	Margin             int
+	Factor             int
+	DPI                int
+	TextWidth          int
+	TextStrokeWidth    int
+	BitDepth           int
+	Effort             int
+	MaxBytes           int
+	MinWidth           int
+	MinHeight          int
+	Tolerance          int
+	BorderWidth        int
+	RoundedCorners     int
+	Levels             int
+	Orientation        int
+	Colors             int
+	Force              bool
+	NoCrop             bool
+	NoReplicate        bool
+	NoRotation         bool
+	NoProfile          bool
+	NoWatermark        bool
+	Attachment         bool
+	ProgressivePreview bool
+	Premultiply        bool
+	ShrinkOnly         bool
+	StripMeta          bool
+	StripGPS           bool
+	StripThumbnail     bool
+	StripICC           bool
+	PreserveAnimation  bool
+	ReduceOnOverflow   bool
+	Opacity            float32
+	Dither             float64
+	Intensity          float64
+	Sigma              float64
+	DPR                float64
+	Text               string
+	Font               string
+	Invert             string
+	Lut                string
+	BorderColor        string
+	WatermarkImage     string
+	WatermarkSprite    string
+	Background         string
+	Flatten            bool
+	Operations         string
+	ICCProfile         string
+	Encoding           string
+	Scan               string
+	Filename           string
+	Sizes              string
+	SuggestCrop        string
+	OpacityCurve       string
+	Type               string
+	Color              []uint8
+	TextStroke         []uint8
+	Gravity            bimg.Gravity
+	Colorspace         bimg.Interpretation
+
+	// Server-side settings, not exposed as query params
+	MaxFrameConcurrency int
+	StrictDimensions    bool
+	LUTDir              string
+	ICCDir              string
+	WatermarkDir        string
+	Source              string
+	MaxQualityAttempts  int
+	// Server limits, applied as well to every pipeline step
+	MaxPixels     int
+	MaxUpscale    float64
+	RejectUpscale bool
+	QualityScale  int
+	// Server-wide watermark stamped on the operation output
+	DefaultWatermarkText    string
+	DefaultWatermarkImage   []byte
+	DefaultWatermarkOpacity float64
 }
 
 type Image struct {
 	Body []byte
 	Mime string
+
+	// Extra response headers reporting details of the processing
+	Headers map[string]string
+	// Steps of the operations chaining others, such as the pipeline,
+	// reported instead of the operation itself
+	Operations []AppliedOperation
 }
 
 type Operation func([]byte, ImageOptions) (Image, error)
 
+const (
+	defaultQuality         = 80
+	minBudgetQuality       = 10
+	defaultQualityAttempts = 6
+	qualityHeader          = "X-Imaginary-Quality"
+)
+
 func (o Operation) Run(buf []byte, opts ImageOptions) (Image, error) {
-	return o(buf, opts)
+	if opts.MaxBytes > 0 {
+		return o.runWithinBudget(buf, opts)
+	}
+	return o.process(buf, opts)
+}
+
+// process runs the operation and stamps the default watermark, then strips
+// the output metadata and embeds the ICC profile, if requested. As every
+// maxbytes attempt is watermarked, the budget holds for the final output.
+func (o Operation) process(buf []byte, opts ImageOptions) (Image, error) {
+	o = o.withDefaultWatermark()
+	if opts.Type == gifImageType {
+		return o.runGIF(buf, opts)
+	}
+	if opts.Type == icoImageType {
+		return o.runICO(buf, opts)
+	}
+
+	image, err := o(buf, opts)
+	if err != nil {
+		return image, err
+	}
+	return embedICCProfile(stripMetadata(image, opts), opts)
+}
+
+// runWithinBudget binary searches the highest quality, between the
+// requested one and minBudgetQuality, whose output fits under
+// opts.MaxBytes, encoding the image up to opts.MaxQualityAttempts times.
+// If no attempt fits, the smallest output is returned. The quality of the
+// returned output is defined in the X-Imaginary-Quality header.
+func (o Operation) runWithinBudget(buf []byte, opts ImageOptions) (Image, error) {
+	image, err := o.process(buf, opts)
+	if err != nil || isQualityAware(image.Mime) == false {
+		return image, err
+	}
+
+	quality := opts.Quality
+	if quality == 0 {
+		quality = defaultQuality
+	}
+	if len(image.Body) <= opts.MaxBytes {
+		image.Headers = withHeader(image.Headers, qualityHeader, strconv.Itoa(quality))
+		return image, nil
+	}
+
+	attempts := opts.MaxQualityAttempts
+	if attempts <= 0 {
+		attempts = defaultQualityAttempts
+	}
+
+	var best Image
+	bestQuality, smallest, smallestQuality := 0, image, quality
+	low, high := minBudgetQuality, quality-1
+	for attempt := 1; attempt < attempts && low <= high; attempt++ {
+		opts.Quality = (low + high) / 2
+		candidate, err := o.process(buf, opts)
+		if err != nil {
+			return Image{}, err
+		}
+
+		if len(candidate.Body) <= opts.MaxBytes {
+			best, bestQuality = candidate, opts.Quality
+			low = opts.Quality + 1
+			continue
+		}
+		if len(candidate.Body) < len(smallest.Body) {
+			smallest, smallestQuality = candidate, opts.Quality
+		}
+		high = opts.Quality - 1
+	}
+
+	if bestQuality == 0 {
+		best, bestQuality = smallest, smallestQuality
+	}
+	best.Headers = withHeader(best.Headers, qualityHeader, strconv.Itoa(bestQuality))
+	return best, nil
+}
+
+func isQualityAware(mime string) bool {
+	return mime == "image/jpeg" || mime == "image/webp"
 }
 
 func BimgOptions(o ImageOptions) bimg.Options {
@@ -54,21 +209,28 @@ func BimgOptions(o ImageOptions) bimg.Options {
 		NoAutoRotate:   o.NoRotation,
 		NoProfile:      o.NoProfile,
 		Force:          o.Force,
-		Gravity:        o.Gravity,
+		Gravity:        libvipsGravity(o.Gravity),
 		Interpretation: o.Colorspace,
+		Interlace:      isProgressiveScan(o.Scan),
 		Type:           ImageType(o.Type),
 	}
 }
 
 type ImageInfo struct {
-	Width       int    `json:"width"`
-	Height      int    `json:"height"`
-	Type        string `json:"type"`
-	Space       string `json:"space"`
-	Alpha       bool   `json:"hasAlpha"`
-	Profile     bool   `json:"hasProfile"`
-	Channels    int    `json:"channels"`
-	Orientation int    `json:"orientation"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Type        string    `json:"type"`
+	Space       string    `json:"space"`
+	Alpha       bool      `json:"hasAlpha"`
+	Profile     bool      `json:"hasProfile"`
+	Channels    int       `json:"channels"`
+	Orientation int       `json:"orientation"`
+	Size        int       `json:"size"`
+	Memory      int64     `json:"estimatedMemory"`
+	Pages       int       `json:"pages"`
+	Quality     int       `json:"quality,omitempty"`
+	Exif        ImageExif `json:"exif"`
+	Crop        *CropBox  `json:"suggestedCrop,omitempty"`
 }
 
 func Info(buf []byte, o ImageOptions) (Image, error) {
@@ -88,6 +250,18 @@ func Info(buf []byte, o ImageOptions) (Image, error) {
 		Profile:     meta.Profile,
 		Channels:    meta.Channels,
 		Orientation: meta.Orientation,
+		Size:        len(buf),
+		Memory:      int64(meta.Size.Width) * int64(meta.Size.Height) * int64(meta.Channels) * int64(bytesPerChannel(buf, meta.Space)),
+		Pages:       imagePages(buf),
+		Quality:     estimateJPEGQuality(buf),
+		Exif:        readExif(buf, o.StripGPS),
+	}
+
+	if o.SuggestCrop != "" {
+		info.Crop, err = suggestCrop(buf, o.SuggestCrop)
+		if err != nil {
+			return image, err
+		}
 	}
 
 	body, _ := json.Marshal(info)
@@ -97,17 +271,91 @@ func Info(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func Resize(buf []byte, o ImageOptions) (Image, error) {
-	if o.Width == 0 && o.Height == 0 {
+	if o.StrictDimensions && o.Width == 0 && o.Height == 0 {
 		return Image{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
+	if withinResizeBounds(buf, o) || (o.Width == 0 && o.Height == 0 && isPassthrough(buf, o)) {
+		return passthrough(buf, o)
+	}
+
 	opts := BimgOptions(o)
 	opts.Embed = true
 
 	if o.NoCrop == false {
 		opts.Crop = true
+		opts.Gravity = cropGravity(buf, o.Gravity, o.Width, o.Height)
+	}
+
+	if o.Background != "" {
+		return resizeWithBackground(buf, opts, o)
+	}
+
+	if o.Premultiply && hasAlpha(buf) {
+		return processPremultiplied(buf, opts, o)
+	}
+
+	return Process(buf, opts)
+}
+
+// withinResizeBounds reports if the image is already small enough to skip
+// the resize: within the target size for shrinkonly, or not exceeding the
+// minwidth/minheight thresholds.
+func withinResizeBounds(buf []byte, o ImageOptions) bool {
+	if o.ShrinkOnly == false && o.MinWidth == 0 && o.MinHeight == 0 {
+		return false
+	}
+
+	size, err := bimg.NewImage(buf).Size()
+	if err != nil {
+		return false
+	}
+
+	if o.ShrinkOnly {
+		if (o.Width == 0 || size.Width <= o.Width) && (o.Height == 0 || size.Height <= o.Height) {
+			return true
+		}
 	}
 
+	if o.MinWidth > 0 || o.MinHeight > 0 {
+		return (o.MinWidth == 0 || size.Width <= o.MinWidth) && (o.MinHeight == 0 || size.Height <= o.MinHeight)
+	}
+
+	return false
+}
+
+// isPassthrough reports if the output would be equivalent to the input
+// image, so it can be returned untouched instead of being re-encoded,
+// which may degrade its quality: same output type and no params changing
+// the encoding, color space or orientation.
+func isPassthrough(buf []byte, o ImageOptions) bool {
+	imageType := bimg.DetermineImageType(buf)
+	if imageType == bimg.UNKNOWN || (o.Type != "" && ImageType(o.Type) != imageType) {
+		return false
+	}
+	if o.Quality != 0 || o.Compression != 0 || o.NoProfile || o.Colorspace == bimg.INTERPRETATION_B_W || o.Background != "" || isProgressiveScan(o.Scan) {
+		return false
+	}
+	if o.NoRotation == false {
+		meta, err := bimg.Metadata(buf)
+		if err != nil || meta.Orientation > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// passthrough returns the image untouched, unless a different output
+// image type is requested.
+func passthrough(buf []byte, o ImageOptions) (Image, error) {
+	imageType := bimg.DetermineImageType(buf)
+	if o.Type == "" || ImageType(o.Type) == imageType {
+		return Image{Body: buf, Mime: GetImageMimeType(imageType)}, nil
+	}
+
+	opts := BimgOptions(o)
+	opts.Width = 0
+	opts.Height = 0
 	return Process(buf, opts)
 }
 
@@ -121,6 +369,7 @@ func Enlarge(buf []byte, o ImageOptions) (Image, error) {
 
 	if o.NoCrop == false {
 		opts.Crop = true
+		opts.Gravity = cropGravity(buf, o.Gravity, o.Width, o.Height)
 	}
 
 	return Process(buf, opts)
@@ -144,12 +393,17 @@ func Extract(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func Crop(buf []byte, o ImageOptions) (Image, error) {
-	if o.Width == 0 && o.Height == 0 {
+	if o.StrictDimensions && o.Width == 0 && o.Height == 0 {
 		return Image{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
+	if isSmartGravity(o.Gravity) && o.Width > 0 && o.Height > 0 {
+		return smartCrop(buf, o)
+	}
+
 	opts := BimgOptions(o)
 	opts.Crop = true
+	opts.Gravity = cropGravity(buf, o.Gravity, o.Width, o.Height)
 	return Process(buf, opts)
 }
 
@@ -157,6 +411,9 @@ func Rotate(buf []byte, o ImageOptions) (Image, error) {
 	if o.Rotate == 0 {
 		return Image{}, NewError("Missing required param: rotate", BadRequest)
 	}
+	if o.Rotate%90 != 0 {
+		return rotateArbitrary(buf, o)
+	}
 
 	opts := BimgOptions(o)
 	opts.Rotate = bimg.Angle(o.Rotate)
@@ -176,7 +433,7 @@ func Flop(buf []byte, o ImageOptions) (Image, error) {
 }
 
 func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
-	if o.Width == 0 && o.Height == 0 {
+	if o.StrictDimensions && o.Width == 0 && o.Height == 0 {
 		return Image{}, NewError("Missing required params: width or height", BadRequest)
 	}
 
@@ -217,6 +474,10 @@ func Convert(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Invalid image type: "+o.Type, BadRequest)
 	}
 
+	if isPassthrough(buf, o) {
+		return passthrough(buf, o)
+	}
+
 	return Process(buf, BimgOptions(o))
 }
 
@@ -238,9 +499,115 @@ func Watermark(buf []byte, o ImageOptions) (Image, error) {
 		opts.Watermark.Background = bimg.Color{o.Color[0], o.Color[1], o.Color[2]}
 	}
 
+	if o.TextStrokeWidth > 0 || len(o.TextStroke) > 2 || o.OpacityCurve != "" {
+		return watermarkWithStroke(buf, opts, o)
+	}
+
 	return Process(buf, opts)
 }
 
+func Invert(buf []byte, o ImageOptions) (Image, error) {
+	if o.Invert != "" && o.Invert != "color" && o.Invert != "alpha" {
+		return Image{}, NewError("Invalid invert mode: "+o.Invert, BadRequest)
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if o.Invert == "alpha" {
+		// Alpha inversion needs an output format with transparency
+		invertAlpha(img)
+		if ImageType(o.Type) != bimg.WEBP {
+			o.Type = "png"
+		}
+	} else {
+		invertColors(img)
+	}
+
+	return encodeRaster(img, o)
+}
+
+func Blur(buf []byte, o ImageOptions) (Image, error) {
+	if o.Sigma <= 0 {
+		return Image{}, NewError("Missing required param: sigma", BadRequest)
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	return encodeRaster(gaussianBlur(img, o.Sigma), keepImageType(buf, o))
+}
+
+func Posterize(buf []byte, o ImageOptions) (Image, error) {
+	if o.Levels == 0 {
+		return Image{}, NewError("Missing required param: levels", BadRequest)
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	posterize(img, o.Levels)
+	return encodeRaster(img, keepImageType(buf, o))
+}
+
+func Lut(buf []byte, o ImageOptions) (Image, error) {
+	lut, err := LoadLUT(o.LUTDir, o.Lut)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	applyLUT(img, lut, o.Intensity)
+	return encodeRaster(img, keepImageType(buf, o))
+}
+
+func hasAlpha(buf []byte) bool {
+	meta, err := bimg.Metadata(buf)
+	return err == nil && meta.Alpha
+}
+
+// processPremultiplied scales the image with premultiplied alpha, avoiding
+// dark halos caused by the color of transparent pixels bleeding on edges.
+func processPremultiplied(buf []byte, opts bimg.Options, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+	premultiplyAlpha(img)
+
+	premultiplied, err := encodeRaster(img, ImageOptions{})
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts.Type = bimg.PNG
+	resized, err := Process(premultiplied.Body, opts)
+	if err != nil {
+		return Image{}, err
+	}
+
+	img, err = decodeRaster(resized.Body)
+	if err != nil {
+		return Image{}, err
+	}
+	unpremultiplyAlpha(img)
+
+	if o.Type == "" {
+		o.Type = bimg.DetermineImageTypeName(buf)
+	}
+	return encodeRaster(img, o)
+}
+
 func Process(buf []byte, opts bimg.Options) (out Image, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -256,6 +623,9 @@ func Process(buf []byte, opts bimg.Options) (out Image, err error) {
 		}
 	}()
 
+	atomic.AddInt64(&vipsOperations, 1)
+	defer atomic.AddInt64(&vipsOperations, -1)
+
 	buf, err = bimg.Resize(buf, opts)
 	if err != nil {
 		return Image{}, err
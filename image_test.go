@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRunWithinBudget(t *testing.T) {
+	encodes := 0
+	// JPEG encoder stub whose output size grows with the quality
+	op := Operation(func(buf []byte, o ImageOptions) (Image, error) {
+		encodes++
+		return Image{Body: make([]byte, o.Quality*100), Mime: "image/jpeg"}, nil
+	})
+
+	cases := []struct {
+		budget   int
+		attempts int
+		quality  int
+		encodes  int
+	}{
+		{9000, 0, 90, 1},
+		{5550, 10, 55, 7},
+		{5550, 0, 54, 6},
+		{500, 0, 11, 6},
+		{500, 2, 49, 2},
+	}
+
+	for _, test := range cases {
+		encodes = 0
+		image, err := op.Run(nil, ImageOptions{Quality: 90, MaxBytes: test.budget, MaxQualityAttempts: test.attempts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quality := image.Headers[qualityHeader]; quality != strconv.Itoa(test.quality) || len(image.Body) != test.quality*100 {
+			t.Errorf("Invalid quality for %d bytes: %s (%d bytes)", test.budget, quality, len(image.Body))
+		}
+		if encodes != test.encodes {
+			t.Errorf("Invalid number of encodes for %d bytes: %d", test.budget, encodes)
+		}
+	}
+
+	// Output types without quality are not searched
+	png := Operation(func(buf []byte, o ImageOptions) (Image, error) {
+		encodes++
+		return Image{Body: make([]byte, 1000), Mime: "image/png"}, nil
+	})
+	encodes = 0
+	if image, _ := png.Run(nil, ImageOptions{MaxBytes: 10}); encodes != 1 || image.Headers[qualityHeader] != "" {
+		t.Errorf("PNG images must be encoded once: %d", encodes)
+	}
+}
@@ -1,39 +1,109 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	. "github.com/tj/go-debug"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"runtime"
 	d "runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var debug = Debug("imaginary")
 
 var (
-	aAddr            = flag.String("a", "", "bind address")
-	aPort            = flag.Int("p", 8088, "port to listen")
-	aVers            = flag.Bool("v", false, "Show version")
-	aVersl           = flag.Bool("version", false, "Show version")
-	aHelp            = flag.Bool("h", false, "Show help")
-	aHelpl           = flag.Bool("help", false, "Show help")
-	aCors            = flag.Bool("cors", false, "Enable CORS support")
-	aGzip            = flag.Bool("gzip", false, "Enable gzip compression")
-	aEnableURLSource = flag.Bool("enable-url-source", false, "Enable remote HTTP URL image source processing")
-	aKey             = flag.String("key", "", "Define API key for authorization")
-	aMount           = flag.String("mount", "", "Mount server local directory")
-	aCertFile        = flag.String("certfile", "", "TLS certificate file path")
-	aKeyFile         = flag.String("keyfile", "", "TLS private key file path")
-	aHttpCacheTtl    = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
-	aReadTimeout     = flag.Int("http-read-timeout", 30, "HTTP read timeout in seconds")
-	aWriteTimeout    = flag.Int("http-write-timeout", 30, "HTTP write timeout in seconds")
-	aConcurrency     = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
-	aBurst           = flag.Int("burst", 100, "Throttle burst max cache size")
-	aMRelease        = flag.Int("mrelease", 30, "OS memory release inverval in seconds")
-	aCpus            = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
+	aAddr               = flag.String("a", "", "bind address")
+	aPort               = flag.Int("p", 8088, "port to listen")
+	aVers               = flag.Bool("v", false, "Show version")
+	aVersl              = flag.Bool("version", false, "Show version")
+	aHelp               = flag.Bool("h", false, "Show help")
+	aHelpl              = flag.Bool("help", false, "Show help")
+	aCors               = flag.Bool("cors", false, "Enable CORS support")
+	aGzip               = flag.Bool("gzip", false, "Enable gzip compression")
+	aEnableURLSource    = flag.Bool("enable-url-source", false, "Enable remote HTTP URL image source processing")
+	aS3Endpoint         = flag.String("s3-endpoint", "", "S3 compatible object storage endpoint URL of the s3 image source")
+	aS3Region           = flag.String("s3-region", "us-east-1", "S3 object storage region")
+	aS3AccessKey        = flag.String("s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 object storage access key")
+	aS3SecretKey        = flag.String("s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 object storage secret key")
+	aKey                = flag.String("key", "", "Define API keys for authorization, comma separated")
+	aMount              = flag.String("mount", "", "Mount server local directories, comma separated, searched in order")
+	aCertFile           = flag.String("certfile", "", "TLS certificate file path")
+	aKeyFile            = flag.String("keyfile", "", "TLS private key file path")
+	aHttpCacheTtl       = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
+	aReadTimeout        = flag.Int("http-read-timeout", 30, "HTTP read timeout in seconds")
+	aWriteTimeout       = flag.Int("http-write-timeout", 30, "HTTP write timeout in seconds")
+	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
+	aBurst              = flag.Int("burst", 100, "Throttle burst max cache size")
+	aMRelease           = flag.Int("mrelease", 30, "OS memory release inverval in seconds")
+	aCpus               = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
+	aFrameConcurrency   = flag.Int("max-frame-concurrency", 2, "Max animation frames processed concurrently per request")
+	aBatchConcurrency   = flag.Int("max-batch-concurrency", 2, "Max batch renditions processed concurrently per request")
+	aWatermarkText      = flag.String("watermark-text", "", "Default watermark text applied to every processed image")
+	aWatermarkImage     = flag.String("watermark-image", "", "Default watermark image path applied to every processed image")
+	aWatermarkOpacity   = flag.Float64("watermark-opacity", 1, "Default watermark text and image opacity")
+	aMaxConcurrent      = flag.Int("max-concurrent", 0, "Max number of images processed at the same time")
+	aMaxQueue           = flag.Int("max-queue", 100, "Max number of requests waiting for a processing slot")
+	aMaxQueueWait       = flag.Duration("max-queue-wait", 0, "Max duration a request waits for a processing slot")
+	aTenantConcurrency  = flag.Int("tenant-concurrency", 0, "Max number of images processed at the same time per API key")
+	aTenantRate         = flag.Int("tenant-rate", 0, "Max number of requests per second per API key")
+	aStrictDimensions   = flag.Bool("strict-dimensions", false, "Reject resize, crop and thumbnail requests without width and height")
+	aAuthUser           = flag.String("source-auth-user", "", "HTTP basic auth user for remote URL image sources")
+	aAuthPassword       = flag.String("source-auth-password", "", "HTTP basic auth password for remote URL image sources")
+	aAuthHosts          = flag.String("source-auth-hosts", "", "Comma separated hosts receiving the remote URL basic auth credentials")
+	aOperationTimeouts  = flag.String("operation-timeouts", "", "Max processing duration per operation or output format")
+	aMaxPixels          = flag.Int("max-pixels", 0, "Max image width x height allowed to be decoded")
+	aSourceDefaultTypes = flag.String("source-default-types", "", "Default output image type per image source type")
+	aRules              = flag.String("rules", "", "JSON file with transform rules based on the source image dimensions")
+	aStrictAnimation    = flag.Bool("strict-animation", false, "Reject animated images with 422 unless the frame param is defined")
+	aMaxUpscale         = flag.Float64("max-upscale", 0, "Max output dimensions as a factor of the source image dimensions")
+	aRejectUpscale      = flag.Bool("reject-upscale", false, "Reject requests exceeding -max-upscale instead of clamping them")
+	aFetchRetries       = flag.Int("source-fetch-retries", 0, "Max attempts to resume interrupted remote URL image downloads")
+	aLUTDir             = flag.String("lut-dir", "", "Directory with the .cube 3D LUTs available to the lut operation")
+	aSourceTLSMin       = flag.String("source-tls-min-version", "", "Min TLS version for remote URL image sources")
+	aSourceTLSCiphers   = flag.String("source-tls-ciphers", "", "Allowed TLS cipher suites for remote URL image sources")
+	aSourceCAFile       = flag.String("source-ca-file", "", "CA bundle file trusted for remote URL image sources")
+	aQualityScale       = flag.Int("quality-scale", 100, "Max value of the quality param scale, mapped to 0-100")
+	aICCDir             = flag.String("icc-dir", "", "Directory with the ICC profiles available to the iccprofile param")
+	aSRGB               = flag.Bool("srgb", false, "Convert the pixels to sRGB before stripping the ICC profile")
+	aFormatFallback     = flag.String("format-fallback", "", "Output image types used when the requested encoder is unavailable")
+	aLogExclude         = flag.String("log-exclude", "", "Comma separated paths excluded from the access log")
+	aCacheSize          = flag.Int64("cache-size", 0, "Max bytes of processed images kept in memory")
+	aCacheMaxSource     = flag.Int64("cache-max-source-size", 64*1024*1024, "Max bytes of the source images hashed to key the cache")
+	aMaxConnections     = flag.Int("max-connections", 0, "Max number of simultaneous client connections")
+	aProfiles           = flag.String("profiles", "", "JSON file with named transform param sets requested via the profile param")
+	aMaxBodySize        = flag.Int64("max-body-size", 0, "Max request body size in bytes for uploaded images")
+	aMaxBodyMemory      = flag.Int64("max-body-memory", 0, "Uploaded image bytes kept in memory, larger uploads are spilled to temp files")
+	aRequestIDHeader    = flag.String("request-id-header", "X-Request-ID", "Request and response header carrying the request ID")
+	aWatermarkDir       = flag.String("watermark-dir", "", "Directory with the overlay images available to the watermarkimage param")
+	aPressureInFlight   = flag.Int("pressure-concurrent", 0, "Images processed at the same time above which the quality is lowered")
+	aPressureMemory     = flag.Int("pressure-memory", 0, "Heap memory in MB above which the quality is lowered")
+	aPressureDelta      = flag.Int("pressure-quality-delta", 10, "Quality reduction applied under server pressure")
+	aDecodeTimeout      = flag.Duration("decode-timeout", 0, "Max duration to decode the image before processing it")
+	aHttpSourceTimeout  = flag.Duration("http-source-timeout", 0, "Max duration to fetch remote URL images, including the connection")
+	aBodyContentTypes   = flag.String("body-content-types", "", "Comma separated Content-Type prefixes accepted for uploaded images")
+	aRequestDeadline    = flag.Duration("request-deadline", 0, "Max duration of a whole image request, from the fetch to the encoding")
+	aAllowedOrigins     = flag.String("allowed-origins", "", "Comma separated hosts allowed as remote URL image sources")
+	aAllowPrivateIPs    = flag.Bool("allow-private-ips", false, "Allow remote URL and S3 image sources resolving to loopback, private or link-local IPs")
+	aDisableBodySource  = flag.Bool("disable-body-source", false, "Reject image uploads, only serving url and file image sources")
+	aAutoFormat         = flag.Bool("auto-format", false, "Negotiate the output image type via the Accept header if no type is requested")
+	aFormatPreference   = flag.String("format-preference", "", "Output image types preferred, in order, by the Accept header negotiation")
+	aAllowedHashes      = flag.String("allowed-hashes", "", "Comma separated SHA-256 hashes of the only images allowed to be processed")
+	aAllowedHashesFile  = flag.String("allowed-hashes-file", "", "File with one SHA-256 hash per line of the only images allowed to be processed")
+	aDefaultImage       = flag.String("default-image", "", "Image path processed instead of url and file source images which are not found")
+	aDefaultImageStatus = flag.Int("default-image-status", 200, "Response status of requests served with the default image")
+	aFallbackImage      = flag.String("fallback-image", "", "Image path processed instead of url and file source images which fail to load")
+	aCMYKMode           = flag.String("cmyk-jpeg", "adobe", "CMYK JPEG handling: adobe, invert or libvips")
+	aSignatureKey       = flag.String("url-signature-key", "", "Secret key of the HMAC-SHA256 signature required in the sign param of every request")
+	aSignatureExempt    = flag.String("url-signature-exempt", "", "Comma separated paths served without URL signature")
+	aMaxOutputBytes     = flag.Int("max-output-bytes", 0, "Max size in bytes of the output images, larger outputs are rejected")
+	aQualityAttempts    = flag.Int("max-quality-attempts", 6, "Max number of encodes of the quality search fitting the output under maxbytes")
+	aMaxVipsMemory      = flag.Int("max-vips-memory", 0, "libvips memory in MB above which the health endpoint reports the server as unhealthy")
 )
 
 const usage = `imaginary %s
@@ -53,17 +123,83 @@ Options:
   -v, -version              output version
   -cors                     Enable CORS support [default: false]
   -gzip                     Enable gzip compression [default: false]
-  -key <key>                Define API key for authorization
-  -mount <path>             Mount server local directory
+  -key <key>                Define API key for authorization. Multiple comma separated keys are accepted, such as one per tenant
+  -mount <path>             Mount server local directory. Multiple comma separated directories are searched in order
   -http-cache-ttl <num>     The TTL in seconds. Adds caching headers to locally served files.
   -http-read-timeout <num>  HTTP read timeout in seconds [default: 30]
   -http-write-timeout <num> HTTP write timeout in seconds [default: 30]
   -enable-url-source        Enable remote HTTP URL image source processing [default: false]
+  -s3-endpoint <url>        Enable the s3 param image source, reading bucket/key objects from the given S3 compatible object storage, such as http://minio:9000
+  -s3-region <region>       S3 object storage region used to sign the requests [default: us-east-1]
+  -s3-access-key <key>      S3 object storage access key. Requests are not signed without it [default: AWS_ACCESS_KEY_ID env var]
+  -s3-secret-key <key>      S3 object storage secret key [default: AWS_SECRET_ACCESS_KEY env var]
   -certfile <path>          TLS certificate file path
   -keyfile <path>           TLS private key file path
   -concurreny <num>         Throttle concurrency limit per second [default: disabled]
   -burst <num>              Throttle burst max cache size [default: 100]
   -mrelease <num>           OS memory release inverval in seconds [default: 30]
+  -max-frame-concurrency <num> Max animation frames processed concurrently per request [default: 2]
+  -max-batch-concurrency <num> Max batch renditions processed concurrently per request [default: 2]
+  -watermark-text <text>    Default watermark text applied to every processed image
+  -watermark-image <path>   Default watermark image path applied to every processed image
+  -watermark-opacity <num>  Default watermark text and image opacity between 0-1 [default: 1]
+  -max-concurrent <num>     Max number of images processed at the same time [default: disabled]
+  -max-queue <num>          Max number of requests waiting for a processing slot [default: 100]
+  -max-queue-wait <duration> Max duration a request waits for a processing slot before being rejected with 429, such as 5s [default: disabled]
+  -tenant-concurrency <num> Max number of images processed at the same time per API key, rejecting the exceeding requests with 429 [default: disabled]
+  -tenant-rate <num>        Max number of requests per second per API key, rejecting the exceeding requests with 429 [default: disabled]
+  -strict-dimensions        Reject resize, crop and thumbnail requests without width and height [default: false]
+  -source-auth-user <user>  HTTP basic auth user for remote URL image sources
+  -source-auth-password <pass> HTTP basic auth password for remote URL image sources
+  -source-auth-hosts <hosts> Comma separated hosts receiving the basic auth credentials, such as *.example.com [default: -allowed-origins]
+  -operation-timeouts <list> Max processing duration per operation or output format. Example: resize=2s,webp=10s
+  -max-pixels <num>         Max image width x height allowed to be decoded [default: disabled]
+  -source-default-types <list> Default output image type per image source type. Example: http=webp,fs=png
+  -rules <path>             JSON file with default transform params based on the source image dimensions
+  -strict-animation         Reject animated images with 422 unless the frame=0 param is defined, instead of silently processing the first frame
+  -max-upscale <factor>     Max output dimensions as a factor of the source image dimensions. Example: 2 [default: disabled]
+  -reject-upscale           Reject requests exceeding -max-upscale with 400 instead of clamping the dimensions
+  -source-fetch-retries <num> Max attempts to resume interrupted remote URL image downloads via range requests [default: 0]
+  -lut-dir <path>           Directory with the .cube 3D LUTs available to the lut operation
+  -source-tls-min-version <version> Min TLS version for remote URL image sources: 1.0, 1.1, 1.2 or 1.3
+  -source-tls-ciphers <list> Comma separated TLS cipher suites allowed for remote URL image sources
+  -source-ca-file <path>    PEM CA bundle trusted for remote URL image sources, instead of the system roots
+  -quality-scale <num>      Max value of the quality param scale, mapped to 0-100. Example: 10 [default: 100]
+  -icc-dir <path>           Directory with the .icc/.icm profiles available to the iccprofile param
+  -srgb                     Convert the pixels of matrix/TRC ICC profiles to sRGB before the stripicc param strips the profile, so colors are kept [default: false]
+  -format-fallback <list>   Output image types used, in order, when the requested encoder is unavailable. Example: webp,jpeg [default: reply 501]
+  -log-exclude <paths>      Comma separated paths excluded from the access log. Example: /health,/ready
+  -cache-size <bytes>       Max size of processed images cached in memory, keyed by the source image and params. Required by /precompute [default: 0]
+  -cache-max-source-size <bytes> Max size of the source images hashed to key the cache, larger ones are processed uncached. 0 means no limit [default: 67108864]
+  -max-connections <num>    Max number of simultaneous client connections. Excess connections wait until one is closed [default: disabled]
+  -profiles <path>          JSON file with named sets of transform params, requested via the profile param
+  -max-body-size <bytes>    Max size of uploaded images request bodies, replying 413 if exceeded [default: disabled]
+  -max-body-memory <bytes>  Max size of uploaded images kept in memory, larger ones are spilled to temp files mapped in memory [default: 33554432 for forms, disabled for raw bodies]
+  -request-id-header <name> Request and response header carrying the request ID, generated if missing [default: X-Request-ID]
+  -watermark-dir <path>     Directory with the .png, .webp or .jpg overlay images available to the watermarkimage param
+  -pressure-concurrent <num> Images processed at the same time above which the output quality is lowered [default: disabled]
+  -pressure-memory <MB>     Heap memory in megabytes above which the output quality is lowered [default: disabled]
+  -pressure-quality-delta <num> Quality reduction applied under server pressure [default: 10]
+  -decode-timeout <duration> Max duration to decode the image before processing it, such as 2s [default: disabled]
+  -http-source-timeout <duration> Max duration to fetch remote URL images, such as 5s, including the connection [default: disabled]
+  -body-content-types <list> Comma separated Content-Type prefixes accepted for uploaded images, such as image/,multipart/ [default: any]
+  -request-deadline <duration> Max duration of a whole image request, such as 10s, from the image fetch to the encoding [default: disabled]
+  -allowed-origins <hosts>  Comma separated hosts allowed as remote URL image sources, such as *.example.com [default: any]
+  -allow-private-ips        Allow remote URL and S3 image sources resolving to loopback, private or link-local IPs, and the proxies from the environment [default: false]
+  -disable-body-source      Reject image uploads with 405, only serving url and file image sources [default: false]
+  -auto-format              Negotiate the output image type via the Accept header if the request defines no type, like type=auto [default: false]
+  -format-preference <list> Output image types negotiated via the Accept header, in order of preference. Example: avif,webp,jpeg [default: avif,webp then the input type]
+  -allowed-hashes <list>    Comma separated SHA-256 hex hashes of the only images allowed to be processed [default: any]
+  -allowed-hashes-file <path> File with one SHA-256 hex hash per line of the only images allowed to be processed [default: any]
+  -default-image <path>     Image processed with the requested params instead of url and file source images which are not found [default: reply 400]
+  -default-image-status <code> Response status of requests served with the default image, such as 404 [default: 200]
+  -fallback-image <path>    Image processed with the requested params instead of url and file source images which fail to load, such as on upstream errors [default: reply the error]
+  -cmyk-jpeg <mode>         CMYK JPEG handling: adobe converts images with the Adobe APP14 marker to RGB, invert treats every CMYK image as Adobe inverted, libvips leaves them to libvips [default: adobe]
+  -url-signature-key <key>  Secret key of the HMAC-SHA256 URL signature required in the sign param of every request [default: disabled]
+  -url-signature-exempt <paths> Comma separated paths served without URL signature, such as /health,/info
+  -max-output-bytes <bytes> Max size in bytes of the output images, larger outputs are rejected with 413 unless reduceonoverflow=true [default: unlimited]
+  -max-quality-attempts <num> Max number of encodes of the quality binary search fitting the output under maxbytes [default: 6]
+  -max-vips-memory <MB>     libvips memory in megabytes above which GET /health replies 503 [default: disabled]
   -cpus <num>               Number of used cpu cores.
                             (default for current machine is %d cores)
 `
@@ -86,20 +222,81 @@ func main() {
 
 	port := getPort(*aPort)
 	opts := ServerOptions{
-		Port:             port,
-		Address:          *aAddr,
-		Gzip:             *aGzip,
-		CORS:             *aCors,
-		EnableURLSource:  *aEnableURLSource,
-		ApiKey:           *aKey,
-		Concurrency:      *aConcurrency,
-		Burst:            *aBurst,
-		Mount:            *aMount,
-		CertFile:         *aCertFile,
-		KeyFile:          *aKeyFile,
-		HttpCacheTtl:     *aHttpCacheTtl,
-		HttpReadTimeout:  *aReadTimeout,
-		HttpWriteTimeout: *aWriteTimeout,
+		Port:                port,
+		Address:             *aAddr,
+		Gzip:                *aGzip,
+		CORS:                *aCors,
+		EnableURLSource:     *aEnableURLSource,
+		S3Endpoint:          *aS3Endpoint,
+		S3Region:            *aS3Region,
+		S3AccessKey:         *aS3AccessKey,
+		S3SecretKey:         *aS3SecretKey,
+		ApiKey:              *aKey,
+		TenantConcurrency:   *aTenantConcurrency,
+		TenantRate:          *aTenantRate,
+		Concurrency:         *aConcurrency,
+		Burst:               *aBurst,
+		Mount:               *aMount,
+		CertFile:            *aCertFile,
+		KeyFile:             *aKeyFile,
+		HttpCacheTtl:        *aHttpCacheTtl,
+		HttpReadTimeout:     *aReadTimeout,
+		HttpWriteTimeout:    *aWriteTimeout,
+		MaxFrameConcurrency: *aFrameConcurrency,
+		MaxBatchConcurrency: *aBatchConcurrency,
+		WatermarkText:       *aWatermarkText,
+		WatermarkImage:      readImageFlag(*aWatermarkImage, "watermark image"),
+		WatermarkOpacity:    *aWatermarkOpacity,
+		MaxConcurrent:       *aMaxConcurrent,
+		MaxQueue:            *aMaxQueue,
+		MaxQueueWait:        *aMaxQueueWait,
+		StrictDimensions:    *aStrictDimensions,
+		BasicAuthUser:       *aAuthUser,
+		BasicAuthPassword:   *aAuthPassword,
+		BasicAuthHosts:      parseListFlag(*aAuthHosts),
+		OperationTimeouts:   parseOperationTimeoutsFlag(*aOperationTimeouts),
+		MaxPixels:           *aMaxPixels,
+		SourceDefaultTypes:  parseSourceDefaultTypesFlag(*aSourceDefaultTypes),
+		Rules:               loadRulesFlag(*aRules),
+		StrictAnimation:     *aStrictAnimation,
+		MaxUpscale:          *aMaxUpscale,
+		RejectUpscale:       *aRejectUpscale,
+		SourceFetchRetries:  *aFetchRetries,
+		LUTDir:              *aLUTDir,
+		SourceTLSConfig:     parseSourceTLSFlags(*aSourceTLSMin, *aSourceTLSCiphers, *aSourceCAFile),
+		QualityScale:        *aQualityScale,
+		ICCDir:              *aICCDir,
+		SRGB:                *aSRGB,
+		FormatFallback:      parseImageTypesFlag(*aFormatFallback),
+		FormatPreference:    parseImageTypesFlag(*aFormatPreference),
+		LogExcludedPaths:    parseListFlag(*aLogExclude),
+		Cache:               NewImageCache(*aCacheSize),
+		CacheMaxSourceSize:  *aCacheMaxSource,
+		MaxConnections:      *aMaxConnections,
+		Profiles:            loadProfilesFlag(*aProfiles),
+		MaxBodySize:         *aMaxBodySize,
+		MaxBodyMemory:       *aMaxBodyMemory,
+		RequestIDHeader:     *aRequestIDHeader,
+		WatermarkDir:        *aWatermarkDir,
+		Pressure:            NewPressureMonitor(*aPressureInFlight, *aPressureMemory, *aPressureDelta),
+		DecodeTimeout:       *aDecodeTimeout,
+		HttpSourceTimeout:   *aHttpSourceTimeout,
+		BodyContentTypes:    parseListFlag(*aBodyContentTypes),
+		RequestDeadline:     *aRequestDeadline,
+		AllowedOrigins:      parseListFlag(*aAllowedOrigins),
+		AllowPrivateIPs:     *aAllowPrivateIPs,
+		DisableBodySource:   *aDisableBodySource,
+		AutoFormat:          *aAutoFormat,
+		AllowedHashes:       loadAllowedHashesFlag(*aAllowedHashes, *aAllowedHashesFile),
+		DefaultImage:        readImageFlag(*aDefaultImage, "default image"),
+		DefaultImageStatus:  *aDefaultImageStatus,
+		FallbackImage:       readImageFlag(*aFallbackImage, "fallback image"),
+		CMYKMode:            parseCMYKModeFlag(*aCMYKMode),
+		URLSignatureKey:     *aSignatureKey,
+		URLSignatureExempt:  parseListFlag(*aSignatureExempt),
+		MaxOutputBytes:      *aMaxOutputBytes,
+		MaxQualityAttempts:  *aQualityAttempts,
+		MaxVipsMemory:       *aMaxVipsMemory,
 	}
 
 	// Create a memory release goroutine
@@ -107,9 +304,14 @@ func main() {
 		memoryRelease(*aMRelease)
 	}
 
-	// Check if the mount directory exists, if present
-	if *aMount != "" {
-		checkMountDirectory(*aMount)
+	// Check if the mount directories exist, if present
+	for _, mount := range parseMountPaths(*aMount) {
+		checkMountDirectory(mount)
+	}
+
+	// Check the S3 endpoint URL, if present
+	if *aS3Endpoint != "" {
+		checkS3Endpoint(*aS3Endpoint)
 	}
 
 	// Validate HTTP cache param, if present
@@ -117,6 +319,18 @@ func main() {
 		checkHttpCacheTtl(*aHttpCacheTtl)
 	}
 
+	if opts.BasicAuthUser != "" && len(opts.BasicAuthHosts) == 0 && len(opts.AllowedOrigins) == 0 {
+		exitWithError("The -source-auth-user flag requires -source-auth-hosts or -allowed-origins to define the hosts receiving the credentials")
+	}
+
+	if *aDefaultImageStatus < 200 || *aDefaultImageStatus > 599 {
+		exitWithError("The -default-image-status flag only accepts a HTTP status from 200 to 599")
+	}
+
+	if len(opts.FallbackImage) > 0 && IsImageMimeTypeSupported(DetectContentType(opts.FallbackImage)) == false {
+		exitWithError("The -fallback-image flag must be a supported image: %s", *aFallbackImage)
+	}
+
 	debug("imaginary server listening on port %d", port)
 
 	// Load image source providers
@@ -162,6 +376,13 @@ func checkMountDirectory(path string) {
 	}
 }
 
+func checkS3Endpoint(endpoint string) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		exitWithError("The -s3-endpoint flag must be an http or https URL: %s", endpoint)
+	}
+}
+
 func checkHttpCacheTtl(ttl int) {
 	if ttl < -1 || ttl > 31556926 {
 		exitWithError("The -http-cache-ttl flag only accepts a value from 0 to 31556926")
@@ -172,6 +393,110 @@ func checkHttpCacheTtl(ttl int) {
 	}
 }
 
+func parseOperationTimeoutsFlag(value string) OperationTimeouts {
+	timeouts, err := ParseOperationTimeouts(value)
+	if err != nil {
+		exitWithError("%s\n", err)
+	}
+	return timeouts
+}
+
+func parseSourceDefaultTypesFlag(value string) SourceDefaultTypes {
+	types, err := ParseSourceDefaultTypes(value)
+	if err != nil {
+		exitWithError("%s\n", err)
+	}
+	return types
+}
+
+func parseSourceTLSFlags(minVersion, cipherSuites, caFile string) *tls.Config {
+	config, err := ParseSourceTLSConfig(minVersion, cipherSuites, caFile)
+	if err != nil {
+		exitWithError("%s\n", err)
+	}
+	return config
+}
+
+func parseImageTypesFlag(value string) []string {
+	chain, err := ParseFormatFallback(value)
+	if err != nil {
+		exitWithError("%s\n", err)
+	}
+	return chain
+}
+
+func parseCMYKModeFlag(value string) string {
+	mode, err := ParseCMYKMode(value)
+	if err != nil {
+		exitWithError("%s\n", err)
+	}
+	return mode
+}
+
+func parseListFlag(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func loadRulesFlag(path string) []Rule {
+	if path == "" {
+		return nil
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		exitWithError("cannot load the rules file: %s\n", err)
+	}
+	return rules
+}
+
+func loadProfilesFlag(path string) Profiles {
+	if path == "" {
+		return nil
+	}
+	profiles, err := LoadProfiles(path)
+	if err != nil {
+		exitWithError("cannot load the profiles file: %s\n", err)
+	}
+	return profiles
+}
+
+func loadAllowedHashesFlag(list, path string) ImageHashes {
+	if list == "" && path == "" {
+		return nil
+	}
+
+	hashes, err := ParseImageHashes(parseListFlag(list))
+	if err != nil {
+		exitWithError("invalid allowed image hashes: %s\n", err)
+	}
+	if path != "" {
+		loaded, err := LoadImageHashes(path)
+		if err != nil {
+			exitWithError("cannot load the allowed image hashes file: %s\n", err)
+		}
+		for hash := range loaded {
+			hashes[hash] = true
+		}
+	}
+	return hashes
+}
+
+func readImageFlag(path, name string) []byte {
+	if path == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		exitWithError("cannot read the "+name+": %s\n", err)
+	}
+	return buf
+}
+
 func memoryRelease(interval int) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	go func() {
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProcessingLimiter bounds how many images are processed at the same time,
+// as a weighted semaphore: every request takes as many slots as its weight,
+// such as the renditions a batch processes at once. Requests exceeding the
+// limit wait in a bounded queue, up to the max wait if defined, and are
+// rejected with 429 once the queue is full or the wait expires.
+type ProcessingLimiter struct {
+	capacity int
+	maxQueue int
+	maxWait  time.Duration
+	mutex    sync.Mutex
+	used     int
+	queued   int
+	// Closed and replaced on every release, waking up the queued requests
+	released chan struct{}
+}
+
+func NewProcessingLimiter(concurrency, maxQueue int, maxWait time.Duration) *ProcessingLimiter {
+	if concurrency <= 0 {
+		return nil
+	}
+	return &ProcessingLimiter{
+		capacity: concurrency,
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+		released: make(chan struct{}),
+	}
+}
+
+// Queued returns the number of requests waiting for a processing slot.
+func (l *ProcessingLimiter) Queued() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.queued
+}
+
+func (l *ProcessingLimiter) Limit(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return l.LimitWeighted(1, fn)
+}
+
+// LimitWeighted limits the handler taking the given number of slots, up to
+// the limiter capacity. Handlers without weight are not limited.
+func (l *ProcessingLimiter) LimitWeighted(weight int, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if l == nil || weight <= 0 {
+		return fn
+	}
+	if weight > l.capacity {
+		weight = l.capacity
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if released, ok := l.tryAcquire(weight); !ok {
+			position, queued := l.enqueue()
+			if !queued {
+				w.Header().Set("Retry-After", strconv.Itoa(l.retryAfter()))
+				ErrorReply(w, ErrTooManyRequests)
+				return
+			}
+
+			// Best-effort position, as the queue is not strictly FIFO
+			w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+
+			var expired <-chan time.Time
+			if l.maxWait > 0 {
+				timer := time.NewTimer(l.maxWait)
+				defer timer.Stop()
+				expired = timer.C
+			}
+
+			for !ok {
+				select {
+				case <-released:
+					released, ok = l.tryAcquire(weight)
+				case <-expired:
+					l.dequeue()
+					w.Header().Del("X-Queue-Position")
+					w.Header().Set("Retry-After", strconv.Itoa(l.retryAfter()))
+					ErrorReply(w, ErrTooManyRequests)
+					return
+				case <-r.Context().Done():
+					l.dequeue()
+					return
+				}
+			}
+			l.dequeue()
+		}
+
+		slots := &processingSlots{refs: 1, release: func() { l.release(weight) }}
+		defer slots.Close()
+		fn(w, r.WithContext(context.WithValue(r.Context(), processingSlotsContextKey, slots)))
+	}
+}
+
+// processingSlots are the limiter slots taken by a request, released once
+// the request and any processing it abandoned on timeout are done, as
+// libvips keeps using the CPU until the call returns.
+type processingSlots struct {
+	mutex   sync.Mutex
+	refs    int
+	release func()
+}
+
+// holdProcessingSlots keeps the request slots taken until the returned
+// function is called, so processing outliving the response is still limited.
+func holdProcessingSlots(ctx context.Context) func() {
+	slots, _ := ctx.Value(processingSlotsContextKey).(*processingSlots)
+	if slots == nil {
+		return func() {}
+	}
+
+	slots.mutex.Lock()
+	slots.refs++
+	slots.mutex.Unlock()
+	return slots.Close
+}
+
+// Close releases the slots once every holder closed them.
+func (s *processingSlots) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refs--
+	if s.refs == 0 {
+		s.release()
+	}
+}
+
+// tryAcquire takes the slots if available. Otherwise it returns the channel
+// closed once slots are released.
+func (l *ProcessingLimiter) tryAcquire(weight int) (<-chan struct{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.used+weight > l.capacity {
+		return l.released, false
+	}
+	l.used += weight
+	return nil, true
+}
+
+func (l *ProcessingLimiter) release(weight int) {
+	l.mutex.Lock()
+	l.used -= weight
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mutex.Unlock()
+}
+
+func (l *ProcessingLimiter) enqueue() (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.queued >= l.maxQueue {
+		return 0, false
+	}
+	l.queued++
+	return l.queued, true
+}
+
+func (l *ProcessingLimiter) dequeue() {
+	l.mutex.Lock()
+	l.queued--
+	l.mutex.Unlock()
+}
+
+// retryAfter estimates in seconds when a slot could be available,
+// assuming roughly one second of processing per queued request.
+func (l *ProcessingLimiter) retryAfter() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	seconds := l.queued / l.capacity
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
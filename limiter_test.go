@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProcessingLimiterSaturation(t *testing.T) {
+	limiter := NewProcessingLimiter(1, 1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	ts := httptest.NewServer(http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})))
+	defer ts.Close()
+
+	responses := make(chan *http.Response, 2)
+	get := func() {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- res
+	}
+
+	// First request takes the only slot
+	go get()
+	<-started
+
+	// Second request waits in the queue
+	go get()
+	for limiter.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Third request overflows the queue
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 429 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Retry-After") == "" {
+		t.Fatal("Missing Retry-After header")
+	}
+
+	close(release)
+
+	positions := []string{}
+	for i := 0; i < 2; i++ {
+		res := <-responses
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+		if position := res.Header.Get("X-Queue-Position"); position != "" {
+			positions = append(positions, position)
+		}
+	}
+
+	if len(positions) != 1 || positions[0] != "1" {
+		t.Fatalf("Invalid queue positions: %#v", positions)
+	}
+}
+
+func TestProcessingLimiterDisabled(t *testing.T) {
+	var limiter *ProcessingLimiter = NewProcessingLimiter(0, 0, 0)
+	if limiter != nil {
+		t.Fatal("Limiter should be disabled")
+	}
+
+	called := false
+	limiter.Limit(func(w http.ResponseWriter, r *http.Request) { called = true })(httptest.NewRecorder(), &http.Request{})
+	if !called {
+		t.Fatal("Handler must be called when the limiter is disabled")
+	}
+}
+
+func TestProcessingLimiterBackpressure(t *testing.T) {
+	const concurrency, overflow = 3, 2
+	limiter := NewProcessingLimiter(concurrency, 0, 0)
+	release := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})))
+	defer ts.Close()
+
+	responses := make(chan *http.Response, concurrency+overflow)
+	for i := 0; i < concurrency+overflow; i++ {
+		go func() {
+			res, err := http.Get(ts.URL)
+			if err != nil {
+				t.Error(err)
+			}
+			responses <- res
+		}()
+	}
+
+	// The requests over the limit are rejected while the others are processed
+	for i := 0; i < overflow; i++ {
+		if res := <-responses; res.StatusCode != 429 || res.Header.Get("Retry-After") == "" {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+	}
+	close(release)
+	for i := 0; i < concurrency; i++ {
+		if res := <-responses; res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+	}
+}
+
+func TestProcessingLimiterWeighted(t *testing.T) {
+	limiter := NewProcessingLimiter(2, 1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	heavy := httptest.NewServer(http.HandlerFunc(limiter.LimitWeighted(3, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})))
+	defer heavy.Close()
+	light := httptest.NewServer(http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {})))
+	defer light.Close()
+	free := httptest.NewServer(http.HandlerFunc(limiter.LimitWeighted(0, func(w http.ResponseWriter, r *http.Request) {})))
+	defer free.Close()
+
+	// The heavy request takes every slot, clamped to the capacity
+	done := make(chan *http.Response)
+	go func() {
+		res, _ := http.Get(heavy.URL)
+		done <- res
+	}()
+	<-started
+
+	if res, _ := http.Get(free.URL); res.StatusCode != 200 {
+		t.Errorf("Unweighted handlers must not be limited: %s", res.Status)
+	}
+
+	// A light request waits until the heavy one releases its slots
+	queued := make(chan *http.Response)
+	go func() {
+		res, _ := http.Get(light.URL)
+		queued <- res
+	}()
+	for limiter.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	for _, res := range []*http.Response{<-done, <-queued} {
+		if res.StatusCode != 200 {
+			t.Errorf("Invalid response status: %s", res.Status)
+		}
+	}
+}
+
+func TestProcessingLimiterQueueWait(t *testing.T) {
+	limiter := NewProcessingLimiter(1, 1, 20*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	ts := httptest.NewServer(http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})))
+	defer ts.Close()
+	defer close(release)
+
+	go http.Get(ts.URL)
+	<-started
+
+	// The queued request is rejected once the wait expires
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 429 || res.Header.Get("Retry-After") == "" || res.Header.Get("X-Queue-Position") != "" {
+		t.Fatalf("Invalid response: %s %v", res.Status, res.Header)
+	}
+	if limiter.Queued() != 0 {
+		t.Errorf("The expired request must leave the queue: %d", limiter.Queued())
+	}
+}
+
+func TestProcessingLimiterTimeoutHoldsSlot(t *testing.T) {
+	limiter := NewProcessingLimiter(1, 0, 0)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+
+	handler := limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		_, err := runWithTimeout(r.Context(), 10*time.Millisecond, func() (Image, error) {
+			<-release
+			return Image{}, nil
+		})
+		if err != ErrProcessingTimeout {
+			t.Errorf("Invalid processing error: %v", err)
+		}
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// The abandoned processing still holds the only slot
+	if _, ok := limiter.tryAcquire(1); ok {
+		t.Fatal("The slot must be held until the processing finishes")
+	}
+
+	close(release)
+	go func() {
+		for {
+			if _, ok := limiter.tryAcquire(1); ok {
+				close(finished)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("The slot must be released once the processing finishes")
+	}
+}
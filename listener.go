@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitListener returns a listener accepting at most n simultaneous
+// connections. Once the limit is reached, Accept blocks until one of the
+// open connections is closed, so pending clients wait in the kernel backlog.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, slots: make(chan struct{}, n)}
+}
+
+type limitListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+type limitListenerConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := LimitListener(ln, 2)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	first, second := <-accepted, <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("Connections over the limit must not be accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing a connection releases its slot
+	first.Close()
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("The pending connection must be accepted once a slot is released")
+	}
+	second.Close()
+}
@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-const formatPattern = "%s - - [%s] \"%s\" %d %d %.4f\n"
+const formatPattern = "%s - - [%s] \"%s\" %d %d %.4f"
 
 // LogRecords implements a Apache-compatible HTTP logging
 type LogRecord struct {
@@ -19,12 +19,17 @@ type LogRecord struct {
 	method, uri, protocol string
 	time                  time.Time
 	elapsedTime           time.Duration
+	requestID             string
 }
 
 func (r *LogRecord) Log(out io.Writer) {
 	timeFormat := r.time.Format("02/Jan/2006 03:04:05")
 	request := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
-	fmt.Fprintf(out, formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
+	line := fmt.Sprintf(formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
+	if r.requestID != "" {
+		line += " " + r.requestID
+	}
+	fmt.Fprintln(out, line)
 }
 
 func (r *LogRecord) Write(p []byte) (int, error) {
@@ -39,16 +44,27 @@ func (r *LogRecord) WriteHeader(status int) {
 }
 
 type LogHandler struct {
-	handler http.Handler
-	io      io.Writer
+	handler  http.Handler
+	io       io.Writer
+	excluded map[string]bool
 }
 
-// Creates a new logger
-func NewLog(handler http.Handler, io io.Writer) http.Handler {
-	return &LogHandler{handler, io}
+// Creates a new logger. Requests to the excluded paths, such as health
+// probes, are not logged.
+func NewLog(handler http.Handler, io io.Writer, excludedPaths ...string) http.Handler {
+	excluded := make(map[string]bool)
+	for _, path := range excludedPaths {
+		excluded[path] = true
+	}
+	return &LogHandler{handler, io, excluded}
 }
 
 func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.excluded[r.URL.Path] {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
 	clientIP := r.RemoteAddr
 	if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
 		clientIP = clientIP[:colon]
@@ -71,6 +87,7 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	record.time = finishTime.UTC()
 	record.elapsedTime = finishTime.Sub(startTime)
+	record.requestID = record.Header().Get(requestIDHeader)
 
 	record.Log(h.io)
 }
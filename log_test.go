@@ -38,3 +38,29 @@ func TestLog(t *testing.T) {
 		t.Fatalf("Invalid log output: %s", data)
 	}
 }
+
+func TestLogExcludedPaths(t *testing.T) {
+	var lines []string
+	writer := fakeWriter(func(b []byte) (int, error) {
+		lines = append(lines, string(b))
+		return len(b), nil
+	})
+
+	noopHandler := func(w http.ResponseWriter, r *http.Request) {}
+	log := NewLog(http.HandlerFunc(noopHandler), writer, "/health", "/ready")
+
+	ts := httptest.NewServer(log)
+	defer ts.Close()
+
+	for _, path := range []string{"/health", "/ready", "/health?probe=1", "/resize"} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if len(lines) != 1 || strings.Contains(lines[0], "GET /resize ") == false {
+		t.Fatalf("Only non excluded paths must be logged: %v", lines)
+	}
+}
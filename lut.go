@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LUT3D is a 3D color lookup table parsed from a .cube file. Table entries
+// are stored with the red index changing fastest, as defined by the format.
+type LUT3D struct {
+	Size      int
+	DomainMin [3]float64
+	DomainMax [3]float64
+	Table     [][3]float64
+}
+
+// ParseCubeLUT parses an Adobe/Resolve .cube 3D LUT.
+func ParseCubeLUT(r io.Reader) (*LUT3D, error) {
+	lut := &LUT3D{DomainMax: [3]float64{1, 1, 1}}
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("1D LUTs are not supported")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid LUT_3D_SIZE: %s", line)
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 || size > 256 {
+				return nil, fmt.Errorf("invalid LUT_3D_SIZE: %s", line)
+			}
+			lut.Size = size
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			values, err := parseCubeTriplet(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				lut.DomainMin = values
+			} else {
+				lut.DomainMax = values
+			}
+		default:
+			values, err := parseCubeTriplet(fields)
+			if err != nil {
+				return nil, err
+			}
+			lut.Table = append(lut.Table, values)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if lut.Size == 0 {
+		return nil, fmt.Errorf("missing LUT_3D_SIZE")
+	}
+	if len(lut.Table) != lut.Size*lut.Size*lut.Size {
+		return nil, fmt.Errorf("invalid LUT entries: expected %d, got %d", lut.Size*lut.Size*lut.Size, len(lut.Table))
+	}
+	for c := 0; c < 3; c++ {
+		if lut.DomainMax[c] <= lut.DomainMin[c] {
+			return nil, fmt.Errorf("invalid LUT domain")
+		}
+	}
+	return lut, nil
+}
+
+func parseCubeTriplet(fields []string) ([3]float64, error) {
+	var values [3]float64
+	if len(fields) != 3 {
+		return values, fmt.Errorf("invalid LUT line: %s", strings.Join(fields, " "))
+	}
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return values, fmt.Errorf("invalid LUT value: %s", field)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// LoadLUT reads the named .cube LUT from the directory. Names cannot
+// contain path separators, so files outside the directory are not exposed.
+func LoadLUT(dir, name string) (*LUT3D, error) {
+	if dir == "" {
+		return nil, NewError("LUT operation is not enabled, see the -lut-dir flag", NotAllowed)
+	}
+	if name == "" {
+		return nil, NewError("Missing required param: lut", BadRequest)
+	}
+	if isResourceName(name) == false {
+		return nil, NewError("Invalid LUT name: "+name, BadRequest)
+	}
+
+	file, err := os.Open(filepath.Join(dir, name+".cube"))
+	if err != nil {
+		return nil, NewError("LUT not found: "+name, NotFound)
+	}
+	defer file.Close()
+
+	lut, err := ParseCubeLUT(file)
+	if err != nil {
+		return nil, NewError("Invalid LUT "+name+": "+err.Error(), BadRequest)
+	}
+	return lut, nil
+}
+
+// Lookup returns the LUT color for the normalized RGB input using
+// trilinear interpolation between the surrounding table entries.
+func (l *LUT3D) Lookup(rgb [3]float64) [3]float64 {
+	var index [3]int
+	var frac [3]float64
+	last := float64(l.Size - 1)
+	for c := 0; c < 3; c++ {
+		value := (rgb[c] - l.DomainMin[c]) / (l.DomainMax[c] - l.DomainMin[c]) * last
+		value = math.Max(0, math.Min(last, value))
+		index[c] = int(value)
+		if index[c] == l.Size-1 {
+			index[c]--
+		}
+		frac[c] = value - float64(index[c])
+	}
+
+	var out [3]float64
+	for corner := 0; corner < 8; corner++ {
+		weight := 1.0
+		var pos [3]int
+		for c := 0; c < 3; c++ {
+			if corner&(1<<uint(c)) != 0 {
+				pos[c] = index[c] + 1
+				weight *= frac[c]
+			} else {
+				pos[c] = index[c]
+				weight *= 1 - frac[c]
+			}
+		}
+		entry := l.Table[pos[0]+pos[1]*l.Size+pos[2]*l.Size*l.Size]
+		for c := 0; c < 3; c++ {
+			out[c] += entry[c] * weight
+		}
+	}
+	return out
+}
+
+// applyLUT maps every pixel color through the LUT, blending the result
+// with the original color by the given intensity.
+func applyLUT(img *image.NRGBA, lut *LUT3D, intensity float64) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		rgb := [3]float64{float64(img.Pix[i]) / 255, float64(img.Pix[i+1]) / 255, float64(img.Pix[i+2]) / 255}
+		graded := lut.Lookup(rgb)
+		for c := 0; c < 3; c++ {
+			value := rgb[c]*(1-intensity) + graded[c]*intensity
+			img.Pix[i+c] = uint8(math.Max(0, math.Min(255, math.Floor(value*255+0.5))))
+		}
+	}
+}
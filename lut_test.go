@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func cubeLUT(size int, fn func(r, g, b float64) (float64, float64, float64)) string {
+	lines := []string{"TITLE \"test\"", fmt.Sprintf("LUT_3D_SIZE %d", size)}
+	step := 1 / float64(size-1)
+	for b := 0; b < size; b++ {
+		for g := 0; g < size; g++ {
+			for r := 0; r < size; r++ {
+				x, y, z := fn(float64(r)*step, float64(g)*step, float64(b)*step)
+				lines = append(lines, fmt.Sprintf("%f %f %f", x, y, z))
+			}
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestParseCubeLUT(t *testing.T) {
+	identity := cubeLUT(2, func(r, g, b float64) (float64, float64, float64) { return r, g, b })
+	lut, err := ParseCubeLUT(strings.NewReader("# comment\n" + identity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lut.Size != 2 || len(lut.Table) != 8 || lut.Table[1] != [3]float64{1, 0, 0} {
+		t.Errorf("Invalid parsed LUT: %v", lut)
+	}
+
+	invalid := []string{
+		"",
+		"LUT_3D_SIZE 2\n0 0 0\n",
+		"LUT_3D_SIZE 1\n0 0 0\n",
+		"LUT_1D_SIZE 2\n0 0 0\n1 1 1\n",
+		"LUT_3D_SIZE 2\n0 0\n",
+		strings.Replace(identity, "1.000000 1.000000 1.000000", "1 1 a", 1),
+	}
+	for _, value := range invalid {
+		if _, err := ParseCubeLUT(strings.NewReader(value)); err == nil {
+			t.Errorf("Invalid LUT should fail: %q", value)
+		}
+	}
+}
+
+func TestLoadLUT(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "imaginary")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "broken.cube"), []byte("LUT_3D_SIZE 2\n"), 0644)
+
+	cases := []struct {
+		dir  string
+		name string
+	}{
+		{"", "identity"},
+		{dir, ""},
+		{dir, "../identity"},
+		{dir, "missing"},
+		{dir, "broken"},
+	}
+	for _, test := range cases {
+		if _, err := LoadLUT(test.dir, test.name); err == nil {
+			t.Errorf("Loading LUT %q from %q should fail", test.name, test.dir)
+		}
+	}
+}
+
+func TestLutOperation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "imaginary")
+	defer os.RemoveAll(dir)
+
+	identity := cubeLUT(17, func(r, g, b float64) (float64, float64, float64) { return r, g, b })
+	invert := cubeLUT(2, func(r, g, b float64) (float64, float64, float64) { return 1 - r, 1 - g, 1 - b })
+	ioutil.WriteFile(filepath.Join(dir, "identity.cube"), []byte(identity), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "invert.cube"), []byte(invert), 0644)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = uint8(i*4), 100, 200, 255
+	}
+	buf := encodeTestPNG(t, src)
+
+	cases := []struct {
+		lut       string
+		intensity float64
+		expected  func(c color.NRGBA) color.NRGBA
+	}{
+		{"identity", 1, func(c color.NRGBA) color.NRGBA { return c }},
+		{"invert", 1, func(c color.NRGBA) color.NRGBA { return color.NRGBA{255 - c.R, 255 - c.G, 255 - c.B, 255} }},
+		{"invert", 0, func(c color.NRGBA) color.NRGBA { return c }},
+	}
+
+	for _, test := range cases {
+		out, err := Lut(buf, ImageOptions{LUTDir: dir, Lut: test.lut, Intensity: test.intensity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(out.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := toNRGBA(img)
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				if c, expected := result.NRGBAAt(x, y), test.expected(src.NRGBAAt(x, y)); c != expected {
+					t.Errorf("Invalid %s LUT color at %d,%d: %v != %v", test.lut, x, y, c, expected)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	jpegMarkerSOS   = 0xda
+	jpegMarkerCOM   = 0xfe
+	jpegMarkerAPP1  = 0xe1
+	jpegMarkerAPP13 = 0xed
+
+	exifTagExifIFD    = 0x8769
+	exifTagGPSIFD     = 0x8825
+	exifTagInteropIFD = 0xa005
+	exifTagThumbnail  = 0x0201
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifTypeSizes maps the TIFF field types to their size in bytes
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// stripMetadata removes the JPEG metadata segments (EXIF, XMP, IPTC and
+// comments) when stripmeta is enabled, or only the embedded EXIF thumbnail
+// when stripthumbnail is enabled. ICC profiles and JFIF/Adobe segments
+// are preserved since they affect how the image is decoded.
+func stripMetadata(image Image, o ImageOptions) Image {
+	if image.Mime != "image/jpeg" || (o.StripMeta == false && o.StripThumbnail == false) {
+		return image
+	}
+
+	segments, ok := splitJPEGSegments(image.Body)
+	if !ok {
+		return image
+	}
+
+	out := make([]byte, 0, len(image.Body))
+	out = append(out, 0xff, 0xd8)
+	for _, segment := range segments {
+		marker := segment[1]
+		if o.StripMeta && (marker == jpegMarkerAPP1 || marker == jpegMarkerAPP13 || marker == jpegMarkerCOM) {
+			continue
+		}
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(segment[4:], exifHeader) {
+			segment = removeExifThumbnail(segment)
+		}
+		out = append(out, segment...)
+	}
+
+	image.Body = out
+	return image
+}
+
+// splitJPEGSegments splits the JPEG stream after the SOI marker into its
+// marker segments. The last segment holds the scan data until the end.
+func splitJPEGSegments(buf []byte) ([][]byte, bool) {
+	if len(buf) < 4 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return nil, false
+	}
+
+	var segments [][]byte
+	for pos := 2; pos < len(buf); {
+		if buf[pos] != 0xff || pos+4 > len(buf) {
+			return nil, false
+		}
+
+		marker := buf[pos+1]
+		if marker == jpegMarkerSOS {
+			return append(segments, buf[pos:]), true
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(buf) {
+			return nil, false
+		}
+		segments = append(segments, buf[pos:pos+2+length])
+		pos += 2 + length
+	}
+
+	return nil, false
+}
+
+// removeExifThumbnail unlinks the IFD1 (thumbnail) directory from the EXIF
+// segment and truncates its data, as long as no other EXIF data follows it.
+func removeExifThumbnail(segment []byte) []byte {
+	tiff := segment[4+len(exifHeader):]
+	if len(tiff) < 8 {
+		return segment
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return segment
+	}
+
+	ifd0 := int(order.Uint32(tiff[4:8]))
+	end, next, ok := exifIFDBounds(tiff, order, ifd0, 0)
+	if !ok || next == 0 {
+		return segment
+	}
+
+	cut := next
+	if offset, found := exifIFDValue(tiff, order, next, exifTagThumbnail); found && offset < cut {
+		cut = offset
+	}
+	if cut < end || cut > len(tiff) {
+		return segment
+	}
+
+	stripped := append([]byte{}, tiff[:cut]...)
+	count := int(order.Uint16(stripped[ifd0 : ifd0+2]))
+	order.PutUint32(stripped[ifd0+2+count*12:], 0)
+
+	out := make([]byte, 0, 4+len(exifHeader)+len(stripped))
+	out = append(out, 0xff, jpegMarkerAPP1, 0, 0)
+	out = append(out, exifHeader...)
+	out = append(out, stripped...)
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)-2))
+	return out
+}
+
+// exifIFDBounds returns the end offset of the data referenced by the IFD,
+// including its sub IFDs, and the offset of the next IFD.
+func exifIFDBounds(tiff []byte, order binary.ByteOrder, offset, depth int) (int, int, bool) {
+	if depth > 4 || offset < 8 || offset+2 > len(tiff) {
+		return 0, 0, false
+	}
+
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	end := offset + 2 + count*12 + 4
+	if end > len(tiff) {
+		return 0, 0, false
+	}
+
+	for i := 0; i < count; i++ {
+		entry := tiff[offset+2+i*12:]
+		tag := order.Uint16(entry[0:2])
+		size := exifTypeSizes[order.Uint16(entry[2:4])] * int(order.Uint32(entry[4:8]))
+		value := int(order.Uint32(entry[8:12]))
+
+		if tag == exifTagExifIFD || tag == exifTagGPSIFD || tag == exifTagInteropIFD {
+			subEnd, _, ok := exifIFDBounds(tiff, order, value, depth+1)
+			if !ok {
+				return 0, 0, false
+			}
+			if subEnd > end {
+				end = subEnd
+			}
+			continue
+		}
+
+		if size > 4 && value+size > end {
+			end = value + size
+		}
+	}
+
+	return end, int(order.Uint32(tiff[offset+2+count*12:])), true
+}
+
+// exifIFDValue returns the value of the given tag in the IFD.
+func exifIFDValue(tiff []byte, order binary.ByteOrder, offset int, tag uint16) (int, bool) {
+	if offset+2 > len(tiff) {
+		return 0, false
+	}
+
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		pos := offset + 2 + i*12
+		if pos+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[pos:pos+2]) == tag {
+			return int(order.Uint32(tiff[pos+8 : pos+12])), true
+		}
+	}
+	return 0, false
+}
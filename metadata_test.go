@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+func noisyJPEG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	random := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(random.Intn(256))
+	}
+	buf := &bytes.Buffer{}
+	jpeg.Encode(buf, img, &jpeg.Options{Quality: 95})
+	return buf.Bytes()
+}
+
+// exifJPEG injects an EXIF segment with a Make tag and an IFD1 thumbnail
+func exifJPEG(body, thumbnail []byte) []byte {
+	order := binary.LittleEndian
+	maker := []byte("imaginary\x00")
+
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8))
+
+	// IFD0: Make tag, followed by its data and IFD1
+	ifd1 := 8 + 2 + 12 + 4 + len(maker)
+	binary.Write(tiff, order, uint16(1))
+	binary.Write(tiff, order, []uint16{0x010f, 2})
+	binary.Write(tiff, order, []uint32{uint32(len(maker)), 8 + 2 + 12 + 4})
+	binary.Write(tiff, order, uint32(ifd1))
+	tiff.Write(maker)
+
+	// IFD1: thumbnail offset and length, followed by the thumbnail
+	binary.Write(tiff, order, uint16(2))
+	binary.Write(tiff, order, []uint16{0x0201, 4})
+	binary.Write(tiff, order, []uint32{1, uint32(ifd1 + 2 + 24 + 4)})
+	binary.Write(tiff, order, []uint16{0x0202, 4})
+	binary.Write(tiff, order, []uint32{1, uint32(len(thumbnail))})
+	binary.Write(tiff, order, uint32(0))
+	tiff.Write(thumbnail)
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, body[2:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	thumbnail := noisyJPEG(160, 120)
+	body := noisyJPEG(10, 10)
+	source := Image{Body: exifJPEG(body, thumbnail), Mime: "image/jpeg"}
+
+	unchanged := stripMetadata(source, ImageOptions{})
+	if bytes.Equal(unchanged.Body, source.Body) == false {
+		t.Fatal("Metadata must be preserved by default")
+	}
+
+	cases := []struct {
+		opts ImageOptions
+		exif bool
+	}{
+		{ImageOptions{StripThumbnail: true}, true},
+		{ImageOptions{StripMeta: true}, false},
+	}
+
+	for _, test := range cases {
+		image := stripMetadata(source, test.opts)
+		if len(source.Body)-len(image.Body) < len(thumbnail) {
+			t.Errorf("Output must shrink by the thumbnail size: %d -> %d", len(source.Body), len(image.Body))
+		}
+		if bytes.Contains(image.Body, []byte("imaginary\x00")) != test.exif {
+			t.Errorf("Invalid EXIF tags presence: %v", test.opts)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(image.Body)); err != nil {
+			t.Errorf("Cannot decode the stripped image: %s", err)
+		}
+	}
+
+	png := Image{Body: []byte("\x89PNG"), Mime: "image/png"}
+	if bytes.Equal(stripMetadata(png, ImageOptions{StripMeta: true}).Body, png.Body) == false {
+		t.Error("Only JPEG images must be stripped")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/daaku/go.httpgzip"
 	"github.com/rs/cors"
@@ -8,6 +9,7 @@ import (
 	"gopkg.in/throttled/throttled.v2"
 	"gopkg.in/throttled/throttled.v2/store/memstore"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -26,6 +28,9 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 	if o.ApiKey != "" {
 		next = authorizeClient(next, o.ApiKey)
 	}
+	if o.URLSignatureKey != "" {
+		next = verifySignature(next, o.URLSignatureKey, o.URLSignatureExempt)
+	}
 	if o.HttpCacheTtl >= 0 {
 		next = setCacheHeaders(next, o.HttpCacheTtl)
 	}
@@ -34,8 +39,33 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 }
 
 func ImageMiddleware(o ServerOptions) func(Operation) http.Handler {
+	image := WeightedImageMiddleware(o, LimitedMiddleware(o))
 	return func(fn Operation) http.Handler {
-		return validateImage(Middleware(imageController(o, Operation(fn)), o), o)
+		return image(fn, 1)
+	}
+}
+
+// LimitedHandler wraps a handler processing images, taking as many
+// processing slots as its weight.
+type LimitedHandler func(fn func(http.ResponseWriter, *http.Request), weight int) http.Handler
+
+// LimitedMiddleware returns the middleware of every handler processing
+// images, sharing the processing limiter and the tenant limits. Handlers
+// without weight, such as the metadata read by /info, are not limited.
+func LimitedMiddleware(o ServerOptions) LimitedHandler {
+	limiter := NewProcessingLimiter(o.MaxConcurrent, o.MaxQueue, o.MaxQueueWait)
+	tenants := NewTenantLimiter(o.TenantConcurrency, o.TenantRate)
+	return func(fn func(http.ResponseWriter, *http.Request), weight int) http.Handler {
+		return Middleware(tenants.Limit(limiter.LimitWeighted(weight, fn)), o)
+	}
+}
+
+// WeightedImageMiddleware returns the image endpoints middleware whose
+// operations take as many processing slots as their weight, within the
+// limits of the given middleware.
+func WeightedImageMiddleware(o ServerOptions, limited LimitedHandler) func(Operation, int) http.Handler {
+	return func(fn Operation, weight int) http.Handler {
+		return validateImage(limited(imageController(o, Operation(fn)), weight), o)
 	}
 }
 
@@ -84,31 +114,68 @@ func validateImage(next http.Handler, o ServerOptions) http.Handler {
 			return
 		}
 
-		if r.Method == "GET" && o.Mount == "" && o.EnableURLSource == false {
+		if r.Method == "GET" && o.Mount == "" && o.EnableURLSource == false && o.S3Endpoint == "" {
 			ErrorReply(w, ErrMethodNotAllowed)
 			return
 		}
 
+		if r.Method == "GET" && o.EnableURLSource == false && r.URL.Query().Get("url") != "" {
+			ErrorReply(w, ErrURLSourceDisabled)
+			return
+		}
+
+		if r.Method == "POST" && o.DisableBodySource {
+			ErrorReply(w, ErrUploadsDisabled)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func authorizeClient(next http.Handler, validKey string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := r.Header.Get("API-Key")
-		if key == "" {
-			key = r.URL.Query().Get("key")
-		}
+// authorizeClient accepts the requests with any of the comma separated
+// API keys, such as one per tenant.
+func authorizeClient(next http.Handler, validKeys string) http.Handler {
+	keys := make(map[string]bool)
+	for _, key := range parseListFlag(validKeys) {
+		keys[key] = true
+	}
 
-		if key != validKey {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestApiKey(r)
+		if keys[key] == false {
 			ErrorReply(w, ErrInvalidApiKey)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)))
 	})
 }
 
+// authorizedApiKey returns the API key validated by authorizeClient, if any.
+func authorizedApiKey(r *http.Request) string {
+	key, _ := r.Context().Value(apiKeyContextKey).(string)
+	return key
+}
+
+// requestApiKey reads the API key from the API-Key, X-API-Key or
+// Authorization headers, in that order, falling back to the key query param.
+func requestApiKey(r *http.Request) string {
+	if key := r.Header.Get("API-Key"); key != "" {
+		return key
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if strings.HasPrefix(strings.ToLower(auth), "bearer ") {
+			return strings.TrimSpace(auth[len("bearer "):])
+		}
+		return auth
+	}
+	return r.URL.Query().Get("key")
+}
+
 func defaultHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Server", fmt.Sprintf("imaginary %s (bimg %s)", Version, bimg.Version))
@@ -139,5 +206,5 @@ func setCacheHeaders(next http.Handler, ttl int) http.Handler {
 }
 
 func isPrivatePath(path string) bool {
-	return path == "/" || path == "/health" || path == "/form"
+	return path == "/" || path == "/health" || path == "/live" || path == "/ready" || path == "/form"
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeClient(t *testing.T) {
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(authorizeClient(noop, "secret"))
+	defer ts.Close()
+
+	cases := []struct {
+		header string
+		value  string
+		query  string
+		status int
+	}{
+		{"API-Key", "secret", "", 200},
+		{"X-API-Key", "secret", "", 200},
+		{"Authorization", "secret", "", 200},
+		{"Authorization", "Bearer secret", "", 200},
+		{"", "", "?key=secret", 200},
+		{"X-API-Key", "secret", "?key=invalid", 200},
+		{"X-API-Key", "invalid", "?key=secret", 401},
+		{"Authorization", "Bearer invalid", "", 401},
+		{"", "", "", 401},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("GET", ts.URL+test.query, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %s %s: %d", test.header, test.value, test.query, res.StatusCode)
+		}
+	}
+}
+
+func TestAuthorizeClientKeys(t *testing.T) {
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(authorizeClient(noop, "first, second"))
+	defer ts.Close()
+
+	for key, status := range map[string]int{"first": 200, "second": 200, "first, second": 401, "third": 401} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("API-Key", key)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Errorf("Invalid response status for %s: %d", key, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/h2non/bimg.v0"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// autoImageType is the output image type negotiated from the client Accept header.
+const autoImageType = "auto"
+
+// Modern image types are only negotiated when explicitly accepted, since
+// clients accepting any image may be unable to decode them
+var negotiatedModernTypes = []string{"avif", "webp"}
+
+// negotiateImageType resolves the output image type for auto requests,
+// picking the accepted type with the highest quality value. On equal
+// values the server preference applies: the configured preference list,
+// if any, or otherwise modern types first, then the input type if it can
+// be encoded. Types the build cannot encode are skipped. The input type,
+// falling back to JPEG, is used if the client accepts none of them.
+func negotiateImageType(r *http.Request, buf []byte, preference []string) string {
+	fallback := "jpeg"
+	if name := bimg.DetermineImageTypeName(buf); name == "png" {
+		fallback = name
+	}
+
+	candidates := preference
+	if len(candidates) == 0 {
+		candidates = append(append([]string{}, negotiatedModernTypes...), fallback, "jpeg", "png")
+	}
+	accept := parseAccept(r.Header.Get("Accept"))
+
+	best, bestQuality := fallback, 0.0
+	for _, name := range candidates {
+		if isEncoderMissing(name) {
+			continue
+		}
+		if quality := accept.quality(name); quality > bestQuality {
+			best, bestQuality = name, quality
+		}
+	}
+	return best
+}
+
+// acceptRanges maps the media ranges of an Accept header to their quality value.
+type acceptRanges map[string]float64
+
+func parseAccept(header string) acceptRanges {
+	ranges := acceptRanges{}
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(parts[0]))
+		if mediaRange == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if strings.HasPrefix(param, "q=") {
+				value, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil || value < 0 || value > 1 {
+					value = 0
+				}
+				quality = value
+			}
+		}
+
+		// Repeated ranges keep the highest quality
+		if current, ok := ranges[mediaRange]; !ok || quality > current {
+			ranges[mediaRange] = quality
+		}
+	}
+	return ranges
+}
+
+// quality returns the quality value of the image type, from the most
+// specific matching range. Modern types ignore wildcard ranges.
+func (a acceptRanges) quality(name string) float64 {
+	if quality, ok := a["image/"+name]; ok {
+		return quality
+	}
+	for _, modern := range negotiatedModernTypes {
+		if name == modern {
+			return 0
+		}
+	}
+	if quality, ok := a["image/*"]; ok {
+		return quality
+	}
+	return a["*/*"]
+}
+
+// Image formats known to imaginary, which the libvips build may be unable to encode
+var encoderOnlyImageTypes = []string{"avif", "heif", "heic", "jxl", "jp2"}
+
+// isEncoderMissing reports whether the image type is a known format which
+// cannot be encoded by the current build.
+func isEncoderMissing(name string) bool {
+	if name == gifImageType || name == icoImageType {
+		return false
+	}
+	if t := ImageType(name); t != bimg.UNKNOWN {
+		return bimg.IsTypeSupported(t) == false
+	}
+	for _, known := range encoderOnlyImageTypes {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// downgradeImageType returns the first image type of the fallback chain
+// which can be encoded by the current build.
+func downgradeImageType(chain []string) (string, bool) {
+	for _, name := range chain {
+		if isOutputTypeSupported(name) && isEncoderMissing(name) == false {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ParseFormatFallback parses a comma separated list of output image types.
+func ParseFormatFallback(value string) ([]string, error) {
+	var chain []string
+	for _, name := range strings.Split(value, ",") {
+		name = parseImageTypeName(name)
+		if name == "" {
+			continue
+		}
+		if isOutputTypeSupported(name) == false {
+			return nil, fmt.Errorf("invalid image type: %s", name)
+		}
+		chain = append(chain, name)
+	}
+	return chain, nil
+}
+
+// addVary appends the given request headers to the response Vary header,
+// so caches store a variant per value of every header which influenced
+// the response.
+func addVary(w http.ResponseWriter, headers ...string) {
+	current := w.Header().Get("Vary")
+	for _, header := range headers {
+		if hasVary(current, header) {
+			continue
+		}
+		if current != "" {
+			current += ", "
+		}
+		current += header
+	}
+	if current != "" {
+		w.Header().Set("Vary", current)
+	}
+}
+
+func hasVary(vary, header string) bool {
+	for _, field := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(field), header) {
+			return true
+		}
+	}
+	return false
+}
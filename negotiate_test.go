@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateImageTypeQuality(t *testing.T) {
+	jpeg, _ := ioutil.ReadFile("fixtures/large.jpg")
+	png, _ := ioutil.ReadFile("fixtures/test.png")
+
+	cases := []struct {
+		accept   string
+		buf      []byte
+		expected string
+	}{
+		{"image/avif;q=0.5, image/webp;q=0.9", jpeg, "webp"},
+		{"image/webp;q=0.9, image/jpeg;q=0.5", jpeg, "webp"},
+		{"image/webp;q=0.5, image/jpeg;q=0.9", jpeg, "jpeg"},
+		{"image/webp;q=0.5, */*", jpeg, "jpeg"},
+		{"image/webp;q=0.5, image/png;q=0.8, image/jpeg;q=0.6", jpeg, "png"},
+		{"image/webp;q=0, image/*", jpeg, "jpeg"},
+		{"image/webp, image/*", jpeg, "webp"},
+		{"IMAGE/WEBP ; Q=0.2, image/*", jpeg, "jpeg"},
+		{"image/webp;q=invalid, image/jpeg;q=0.1", jpeg, "jpeg"},
+		{"*/*", png, "png"},
+		{"image/*;q=0.8, image/png;q=0.1", png, "jpeg"},
+		{"*/*", jpeg, "jpeg"},
+		{"image/png;q=0, image/jpeg;q=0", png, "png"},
+		{"", png, "png"},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", test.accept)
+		if name := negotiateImageType(req, test.buf, nil); name != test.expected {
+			t.Errorf("Invalid image type for %q: %s != %s", test.accept, name, test.expected)
+		}
+	}
+}
+
+func TestNegotiateImageTypePreference(t *testing.T) {
+	jpeg, _ := ioutil.ReadFile("fixtures/large.jpg")
+	png, _ := ioutil.ReadFile("fixtures/test.png")
+
+	modern := "webp"
+	if isEncoderMissing("avif") == false {
+		modern = "avif"
+	}
+
+	cases := []struct {
+		preference []string
+		accept     string
+		buf        []byte
+		expected   string
+	}{
+		{[]string{"avif", "webp", "jpeg"}, "image/avif, image/webp, */*", jpeg, modern},
+		{[]string{"avif", "webp", "jpeg"}, "image/webp, image/*", jpeg, "webp"},
+		// Equal quality values follow the preference order
+		{[]string{"jpeg", "webp"}, "image/webp, image/jpeg", jpeg, "jpeg"},
+		{[]string{"webp", "jpeg"}, "image/webp, image/jpeg", png, "webp"},
+		// Higher quality values still win
+		{[]string{"webp", "jpeg"}, "image/webp;q=0.5, image/jpeg", jpeg, "jpeg"},
+		// Unlisted types are not negotiated
+		{[]string{"avif", "webp", "jpeg"}, "image/png, image/*;q=0.5", png, "jpeg"},
+		// Types accepted by the client are missing, so the input type is kept
+		{[]string{"avif", "webp"}, "image/jpeg, image/png", png, "png"},
+		{[]string{"avif", "webp", "jpeg"}, "", png, "png"},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", test.accept)
+		if name := negotiateImageType(req, test.buf, test.preference); name != test.expected {
+			t.Errorf("Invalid image type for %q (preference: %v): %s != %s", test.accept, test.preference, name, test.expected)
+		}
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	ranges := parseAccept("image/webp;q=0.8, image/webp;q=0.3, image/*;level=1, text/html;q=2")
+	if ranges["image/webp"] != 0.8 {
+		t.Errorf("Repeated ranges must keep the highest quality: %v", ranges["image/webp"])
+	}
+	if ranges["image/*"] != 1 {
+		t.Errorf("Quality must default to 1: %v", ranges["image/*"])
+	}
+	if ranges["text/html"] != 0 {
+		t.Errorf("Out of range quality values must be ignored: %v", ranges["text/html"])
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	cases := []struct {
+		auto     bool
+		query    string
+		accept   string
+		expected string
+		vary     bool
+	}{
+		{true, "", "image/avif,image/webp,image/*;q=0.8", "image/webp", true},
+		{true, "", "*/*", "image/jpeg", true},
+		{true, "", "", "image/jpeg", true},
+		{true, "&type=png", "image/webp", "image/png", false},
+		{false, "", "image/webp", "image/jpeg", false},
+	}
+
+	for _, test := range cases {
+		opts := ServerOptions{Mount: "fixtures", AutoFormat: test.auto, Cache: NewImageCache(10)}
+		LoadSources(opts)
+		ts := httptest.NewServer(NewServerMux(opts))
+
+		req, _ := http.NewRequest("GET", ts.URL+"/resize?width=100&file=large.jpg"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.Header.Get("Content-Type") != test.expected {
+			t.Errorf("Invalid content type for %q (auto: %v): %s", test.accept, test.auto, res.Header.Get("Content-Type"))
+		}
+		vary := strings.Contains(res.Header.Get("Vary"), "Accept")
+		if vary != test.vary {
+			t.Errorf("Invalid Vary header for %q (auto: %v): %s", test.accept, test.auto, res.Header.Get("Vary"))
+		}
+		if vary && opts.Cache.Len() != 0 {
+			t.Errorf("Negotiated images must not be cached")
+		}
+	}
+	LoadSources(ServerOptions{})
+}
+
+func TestFormatPreference(t *testing.T) {
+	opts := ServerOptions{Mount: "fixtures", AutoFormat: true, FormatPreference: []string{"webp", "png", "jpeg"}}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	cases := []struct {
+		query    string
+		accept   string
+		expected string
+	}{
+		{"", "image/webp, image/*", "image/webp"},
+		{"", "image/*", "image/png"},
+		{"", "image/png;q=0.5, image/jpeg", "image/jpeg"},
+		// An explicit type overrides the negotiation
+		{"&type=jpeg", "image/webp, image/*", "image/jpeg"},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("GET", ts.URL+"/resize?width=100&file=large.jpg"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+
+		if res.Header.Get("Content-Type") != test.expected {
+			t.Errorf("Invalid content type for %q%s: %s", test.accept, test.query, res.Header.Get("Content-Type"))
+		}
+	}
+	LoadSources(ServerOptions{})
+}
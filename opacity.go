@@ -0,0 +1,88 @@
+package main
+
+import (
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Min radius in pixels of the area whose mean brightness modulates the
+// watermark opacity
+const minBrightnessRadius = 4
+
+// opacityMap returns the watermark opacity at the given pixel.
+type opacityMap func(x, y int) float64
+
+func uniformOpacity(opacity float64) opacityMap {
+	return func(x, y int) float64 { return opacity }
+}
+
+// parseOpacityCurve parses the dark,light watermark opacities, applied
+// over the darkest and the brightest image regions respectively.
+func parseOpacityCurve(value string) (float64, float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) == 2 {
+		dark, errDark := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		light, errLight := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if errDark == nil && errLight == nil && dark >= 0 && dark <= 1 && light >= 0 && light <= 1 {
+			return dark, light, nil
+		}
+	}
+	return 0, 0, NewError("Invalid opacitycurve param: must be two dark,light opacities between 0 and 1", BadRequest)
+}
+
+// curveOpacity returns the opacity map interpolating the dark and light
+// opacities by the local brightness of the image, so the watermark stays
+// visible over both dark and light regions.
+func curveOpacity(img *image.NRGBA, dark, light float64) opacityMap {
+	bounds := img.Bounds()
+	radius := int(math.Max(minBrightnessRadius, math.Min(float64(bounds.Dx()), float64(bounds.Dy()))/20))
+	brightness := brightnessMap(img, radius)
+
+	return func(x, y int) float64 {
+		level := float64(brightness.GrayAt(x, y).Y) / 255
+		return dark + (light-dark)*level
+	}
+}
+
+// brightnessMap returns the mean luminance of the square area of the given
+// radius around every pixel, computed via a summed area table.
+func brightnessMap(img *image.NRGBA, radius int) *image.Gray {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	sums := make([]float64, (width+1)*(height+1))
+	for y := 0; y < height; y++ {
+		row := 0.0
+		for x := 0; x < width; x++ {
+			c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			row += 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+			sums[(y+1)*(width+1)+x+1] = sums[y*(width+1)+x+1] + row
+		}
+	}
+
+	out := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		top, bottom := 0, y+radius+1
+		if y-radius > 0 {
+			top = y - radius
+		}
+		if bottom > height {
+			bottom = height
+		}
+		for x := 0; x < width; x++ {
+			left, right := 0, x+radius+1
+			if x-radius > 0 {
+				left = x - radius
+			}
+			if right > width {
+				right = width
+			}
+
+			sum := sums[bottom*(width+1)+right] - sums[top*(width+1)+right] - sums[bottom*(width+1)+left] + sums[top*(width+1)+left]
+			out.Pix[y*out.Stride+x] = uint8(sum/float64((bottom-top)*(right-left)) + 0.5)
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// splitImage returns an image with a black left half and a white right half.
+func splitImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x >= width/2 {
+				img.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestCurveOpacity(t *testing.T) {
+	opacity := curveOpacity(splitImage(80, 20), 0.2, 0.8)
+
+	if value := opacity(2, 10); math.Abs(value-0.2) > 0.01 {
+		t.Errorf("Invalid opacity over the dark region: %v", value)
+	}
+	if value := opacity(77, 10); math.Abs(value-0.8) > 0.01 {
+		t.Errorf("Invalid opacity over the light region: %v", value)
+	}
+	if dark, edge := opacity(2, 10), opacity(39, 10); edge <= dark {
+		t.Errorf("The opacity must grow towards the light region: %v <= %v", edge, dark)
+	}
+}
+
+func TestStrokeTextOpacityCurve(t *testing.T) {
+	img := splitImage(80, 20)
+
+	// Text mask covering a line across both halves
+	mask := image.NewGray(img.Bounds())
+	for x := 0; x < 80; x++ {
+		mask.SetGray(x, 10, color.Gray{255})
+	}
+
+	fill := color.NRGBA{255, 0, 0, 255}
+	strokeText(img, mask, fill, color.NRGBA{}, 0, curveOpacity(img, 0.2, 0.8))
+
+	// Red over black keeps the red share, while red over white lowers green
+	dark := float64(img.NRGBAAt(2, 10).R) / 255
+	light := 1 - float64(img.NRGBAAt(77, 10).G)/255
+	if math.Abs(dark-0.2) > 0.02 || math.Abs(light-0.8) > 0.02 {
+		t.Errorf("Invalid opacities over the dark and light regions: %v, %v", dark, light)
+	}
+
+	if c := img.NRGBAAt(2, 9); c != (color.NRGBA{0, 0, 0, 255}) {
+		t.Errorf("No stroke must be painted: %v", c)
+	}
+}
+
+func TestParseOpacityCurve(t *testing.T) {
+	dark, light, err := parseOpacityCurve("0.2, 0.6")
+	if err != nil || dark != 0.2 || light != 0.6 {
+		t.Errorf("Invalid opacity curve: %v, %v (%v)", dark, light, err)
+	}
+
+	for _, value := range []string{"0.2", "0.2,1.5", "-1,0.5", "a,b", "0.1,0.2,0.3"} {
+		if _, _, err := parseOpacityCurve(value); err == nil {
+			t.Errorf("Opacity curve %s must be rejected", value)
+		}
+	}
+}
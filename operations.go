@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const operationsHeader = "X-Imaginary-Operations"
+
+// AppliedOperation describes a processing step applied to the image,
+// with the params resolved after server rules, defaults and limits.
+type AppliedOperation struct {
+	Operation string                 `json:"operation"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+// appliedOperations lists, in order, the requested operation, or the steps
+// it applied, and the server default watermark, if any.
+func appliedOperations(name string, query url.Values, image Image, opts ImageOptions, o ServerOptions) []AppliedOperation {
+	operations := image.Operations
+	if len(operations) == 0 {
+		operations = []AppliedOperation{{Operation: name, Params: resolvedParams(query, opts)}}
+	}
+
+	if opts.NoWatermark == false && hasDefaultWatermark(o) {
+		params := map[string]interface{}{"opacity": o.WatermarkOpacity}
+		if o.WatermarkText != "" {
+			params["text"] = o.WatermarkText
+		}
+		if len(o.WatermarkImage) > 0 {
+			params["image"] = true
+		}
+		operations = append(operations, AppliedOperation{Operation: "watermark", Params: params})
+	}
+
+	return operations
+}
+
+// Params naming one of a set of values, which are normalized to lowercase.
+// Free text ones, such as the watermark text or font, are kept as given.
+var enumParams = map[string]bool{
+	"type":       true,
+	"format":     true,
+	"gravity":    true,
+	"colorspace": true,
+	"scan":       true,
+	"encoding":   true,
+}
+
+// resolvedParams normalizes the request params, replacing the ones the
+// server may have changed by their final values.
+func resolvedParams(query url.Values, opts ImageOptions) map[string]interface{} {
+	params := make(map[string]interface{})
+	for key, kind := range allowedParams {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		switch {
+		case kind == "int" || kind == "float" || kind == "bool" || kind == "unitfloat":
+			params[key] = parseParam(value, kind)
+		case enumParams[key]:
+			params[key] = strings.ToLower(strings.TrimSpace(value))
+		default:
+			params[key] = value
+		}
+	}
+
+	delete(params, "format")
+	if opts.Type != "" {
+		params["type"] = opts.Type
+	}
+	for key, value := range map[string]int{"width": opts.Width, "height": opts.Height, "factor": opts.Factor, "quality": opts.Quality} {
+		if _, ok := params[key]; ok || value != 0 {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+func setOperationsHeader(w http.ResponseWriter, operations []AppliedOperation) {
+	if buf, err := json.Marshal(operations); err == nil {
+		w.Header().Set(operationsHeader, string(buf))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/png"
+)
+
+// applyOrientation transforms the image as defined by the orientation
+// param, using the EXIF orientation values, instead of the embedded one.
+// The oriented image is returned as lossless PNG, processed afterwards by
+// the requested operation without auto rotation, keeping the input type.
+func applyOrientation(buf []byte, o ImageOptions) ([]byte, ImageOptions, error) {
+	if o.Orientation == 0 {
+		return buf, o, nil
+	}
+
+	decoded, err := Process(buf, bimg.Options{Type: bimg.PNG, NoAutoRotate: true})
+	if err != nil {
+		return nil, o, err
+	}
+	img, err := png.Decode(bytes.NewReader(decoded.Body))
+	if err != nil {
+		return nil, o, err
+	}
+
+	oriented, err := encodeRaster(orientImage(toNRGBA(img), o.Orientation), ImageOptions{})
+	if err != nil {
+		return nil, o, err
+	}
+
+	o = keepImageType(buf, o)
+	o.NoRotation = true
+	return oriented.Body, o, nil
+}
+
+// orientImage returns the image as displayed with the given EXIF
+// orientation: 2 mirrors it horizontally, 3 rotates it 180 degrees,
+// 4 mirrors it vertically, 5 transposes it, 6 rotates it 90 degrees
+// clockwise, 7 transverses it and 8 rotates it 270 degrees clockwise.
+func orientImage(img *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	size := image.Pt(w, h)
+	if orientation >= 5 {
+		size = image.Pt(h, w)
+	}
+	out := image.NewNRGBA(image.Rectangle{image.ZP, size})
+
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			out.SetNRGBA(x, y, img.NRGBAAt(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return out
+}
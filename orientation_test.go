@@ -0,0 +1,88 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestOrientImage(t *testing.T) {
+	// Each pixel red channel holds its index: 0 1 2 / 3 4 5
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		img.SetNRGBA(i%3, i/3, color.NRGBA{uint8(i), 0, 0, 255})
+	}
+
+	cases := []struct {
+		orientation int
+		expected    [][]uint8
+	}{
+		{1, [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+		{2, [][]uint8{{2, 1, 0}, {5, 4, 3}}},
+		{3, [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{4, [][]uint8{{3, 4, 5}, {0, 1, 2}}},
+		{5, [][]uint8{{0, 3}, {1, 4}, {2, 5}}},
+		{6, [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{7, [][]uint8{{5, 2}, {4, 1}, {3, 0}}},
+		{8, [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+	}
+
+	for _, test := range cases {
+		out := orientImage(img, test.orientation)
+		size := out.Bounds().Size()
+
+		rows := make([][]uint8, size.Y)
+		for y := range rows {
+			rows[y] = make([]uint8, size.X)
+			for x := range rows[y] {
+				rows[y][x] = out.NRGBAAt(x, y).R
+			}
+		}
+		if reflect.DeepEqual(rows, test.expected) == false {
+			t.Errorf("Invalid image for orientation %d: %v", test.orientation, rows)
+		}
+	}
+}
+
+func TestOrientationParam(t *testing.T) {
+	for _, value := range []string{"1", "8"} {
+		if err := validateParams(url.Values{"orientation": {value}}); err != nil {
+			t.Errorf("Valid orientation %s must be accepted: %s", value, err)
+		}
+	}
+	for _, value := range []string{"0", "9"} {
+		if err := validateParams(url.Values{"orientation": {value}}); err == nil {
+			t.Errorf("Invalid orientation %s must be rejected", value)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	size, err := bimg.NewImage(buf).Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		out, opts, err := applyOrientation(buf, ImageOptions{Orientation: orientation})
+		if err != nil {
+			t.Fatalf("Orientation %d: %s", orientation, err)
+		}
+		if opts.Type != "jpeg" || opts.NoRotation == false {
+			t.Errorf("Orientation %d must keep the input type without auto rotation: %+v", orientation, opts)
+		}
+
+		width, height := size.Width, size.Height
+		if orientation >= 5 {
+			width, height = height, width
+		}
+		if err := assertSize(out, width, height); err != nil {
+			t.Errorf("Orientation %d: %s", orientation, err)
+		}
+	}
+}
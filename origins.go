@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resolves the remote image hosts, then connects to the checked IP
+var (
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	dialOrigin   = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+)
+
+// isAllowedOrigin reports whether the host matches any of the patterns.
+// Patterns are host names, optionally prefixed by *. to match any of their
+// subdomains, but not the domain itself.
+func isAllowedOrigin(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateIP reports whether the IP belongs to the loopback, private,
+// link-local or unspecified ranges, usually reserved to internal services.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// sourceClient returns the client fetching remote images, which only
+// connects to the allowed hosts, if any, resolving to public IPs, unless
+// private IPs are explicitly allowed.
+func sourceClient(config *SourceConfig, origins []string) *http.Client {
+	if config.AllowPrivateIPs && len(origins) == 0 {
+		if config.TLSConfig == nil {
+			return http.DefaultClient
+		}
+		return &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     config.TLSConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}}
+	}
+
+	client := &http.Client{Transport: originTransport(config, origins)}
+	if len(origins) > 0 {
+		client.CheckRedirect = checkRedirectOrigin(origins)
+	}
+	return client
+}
+
+// originTransport returns a transport which only connects to allowed hosts
+// resolving to public IPs. The IP is checked when connecting, so a host
+// resolving to an internal IP after the allowlist check (DNS rebinding),
+// or redirecting to one, cannot be reached either. Proxies are not used,
+// as the proxy IP would be checked instead.
+func originTransport(config *SourceConfig, origins []string) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:     config.TLSConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			if len(origins) > 0 && isAllowedOrigin(host, origins) == false {
+				return nil, ErrOriginNotAllowed
+			}
+
+			addrs, err := lookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				if config.AllowPrivateIPs == false && isPrivateIP(addr.IP) {
+					return nil, ErrOriginNotAllowed
+				}
+			}
+			if len(addrs) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host}
+			}
+			return dialOrigin(ctx, network, net.JoinHostPort(addrs[0].IP.String(), port))
+		},
+	}
+}
+
+// checkRedirectOrigin stops redirects to hosts out of the allowlist.
+func checkRedirectOrigin(patterns []string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if isAllowedOrigin(req.URL.Hostname(), patterns) == false {
+			return ErrOriginNotAllowed
+		}
+		return nil
+	}
+}
+
+// isOriginError reports whether the request failed due to a host or IP
+// out of the allowlist, either when connecting or when redirected.
+func isOriginError(err error) bool {
+	e, ok := err.(*url.Error)
+	return ok && e.Err == ErrOriginNotAllowed
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAllowedOrigin(t *testing.T) {
+	patterns := []string{"images.example.com", "*.cdn.example.org"}
+	cases := []struct {
+		host     string
+		expected bool
+	}{
+		{"images.example.com", true},
+		{"IMAGES.example.com.", true},
+		{"a.cdn.example.org", true},
+		{"a.b.cdn.example.org", true},
+		{"cdn.example.org", false},
+		{"evilcdn.example.org", false},
+		{"example.com", false},
+		{"images.example.com.evil.com", false},
+	}
+
+	for _, test := range cases {
+		if isAllowedOrigin(test.host, patterns) != test.expected {
+			t.Errorf("Invalid origin check for %s", test.host)
+		}
+	}
+}
+
+func TestHttpImageSourceAllowedOrigins(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://evil.com/large.jpg", http.StatusFound)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	// Public hosts are served by the test server
+	lookup, dial := lookupIPAddr, dialOrigin
+	defer func() { lookupIPAddr, dialOrigin = lookup, dial }()
+	hosts := map[string]string{
+		"images.example.com":   "93.184.216.34",
+		"internal.example.com": "169.254.169.254",
+		"local.example.com":    "127.0.0.1",
+		"evil.com":             "93.184.216.35",
+	}
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP(hosts[host])}}, nil
+	}
+	dialOrigin = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dial(ctx, network, ts.Listener.Addr().String())
+	}
+
+	source := NewHttpImageSource(&SourceConfig{AllowedOrigins: []string{"*.example.com"}})
+	cases := []struct {
+		url string
+		err error
+	}{
+		{"http://images.example.com/large.jpg", nil},
+		{"http://evil.com/large.jpg", ErrOriginNotAllowed},
+		{"http://internal.example.com/latest/meta-data", ErrOriginNotAllowed},
+		{"http://local.example.com/large.jpg", ErrOriginNotAllowed},
+		{"http://images.example.com/redirect", ErrOriginNotAllowed},
+	}
+
+	for _, test := range cases {
+		r, _ := http.NewRequest("GET", "http://foo/bar?url="+test.url, nil)
+		image, err := source.GetImage(r)
+		if err != test.err {
+			t.Errorf("Invalid error for %s: %v", test.url, err)
+		}
+		if test.err == nil && len(image) != len(buf) {
+			t.Errorf("Invalid image for %s", test.url)
+		}
+	}
+}
+
+func TestAllowedOriginsStatus(t *testing.T) {
+	opts := ServerOptions{EnableURLSource: true, AllowedOrigins: []string{"images.example.com"}}
+	LoadSources(opts)
+	defer LoadSources(ServerOptions{})
+
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/resize?width=100&url=http://169.254.169.254/latest/meta-data")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestPrivateIPsBlockedByDefault(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL+"&s3=images/large.jpg", nil)
+	for _, allow := range []bool{false, true} {
+		sources := map[string]ImageSource{
+			"http":     NewHttpImageSource(&SourceConfig{AllowPrivateIPs: allow}),
+			"http+tls": NewHttpImageSource(&SourceConfig{AllowPrivateIPs: allow, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}),
+			"s3":       NewS3ImageSource(&SourceConfig{AllowPrivateIPs: allow, S3Endpoint: ts.URL}),
+		}
+		for name, source := range sources {
+			image, err := source.GetImage(r)
+			if allow == false && err != ErrOriginNotAllowed {
+				t.Errorf("Loopback IPs must be rejected by the %s source: %v", name, err)
+			}
+			if allow && (err != nil || len(image) != len(buf)) {
+				t.Errorf("Allowed loopback IPs must be fetched by the %s source: %v", name, err)
+			}
+		}
+	}
+}
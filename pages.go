@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// Max number of TIFF pages walked, guarding against huge IFD chains
+const maxTIFFPages = 1024
+
+// tiffPageOffsets walks the TIFF IFD chain, returning the offset of every
+// page directory. Non-TIFF images have no offsets.
+func tiffPageOffsets(buf []byte) (binary.ByteOrder, []int) {
+	if len(buf) < 8 {
+		return nil, nil
+	}
+
+	var order binary.ByteOrder
+	switch string(buf[0:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, nil
+	}
+
+	offsets := []int{}
+	seen := make(map[int]bool)
+	offset := int(order.Uint32(buf[4:8]))
+	for offset >= 8 && offset+2 <= len(buf) && seen[offset] == false && len(offsets) < maxTIFFPages {
+		seen[offset] = true
+		offsets = append(offsets, offset)
+
+		next := offset + 2 + int(order.Uint16(buf[offset:offset+2]))*12
+		if next+4 > len(buf) {
+			break
+		}
+		offset = int(order.Uint32(buf[next : next+4]))
+	}
+	return order, offsets
+}
+
+// imagePages returns the number of pages of multi-page TIFF images, or 1
+// for any other image.
+func imagePages(buf []byte) int {
+	if _, offsets := tiffPageOffsets(buf); len(offsets) > 0 {
+		return len(offsets)
+	}
+	return 1
+}
+
+// selectPage returns the image with the requested page as the first one,
+// which is the page loaded by libvips. For TIFF images, the header is
+// pointed to the directory of the page, leaving the page data untouched.
+func selectPage(buf []byte, value string) ([]byte, error) {
+	if value == "" {
+		return buf, nil
+	}
+
+	page, err := strconv.Atoi(value)
+	if err != nil || page < 0 {
+		return nil, NewError("Invalid page param: must be a positive integer", BadRequest)
+	}
+
+	order, offsets := tiffPageOffsets(buf)
+	pages := len(offsets)
+	if pages == 0 {
+		pages = 1
+	}
+	if page >= pages {
+		return nil, NewError("Invalid page param: the image has "+strconv.Itoa(pages)+" page(s)", BadRequest)
+	}
+	if page == 0 {
+		return buf, nil
+	}
+
+	out := append([]byte{}, buf...)
+	order.PutUint32(out[4:8], uint32(offsets[page]))
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// multiPageTIFF builds a little endian TIFF with empty page directories
+func multiPageTIFF(pages int) []byte {
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	for i := 0; i < pages; i++ {
+		next := uint32(0)
+		if i < pages-1 {
+			next = uint32(len(buf) + 6)
+		}
+		buf = append(buf, 0, 0)
+		buf = append(buf, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], next)
+	}
+	return buf
+}
+
+func TestImagePages(t *testing.T) {
+	if pages := imagePages(multiPageTIFF(3)); pages != 3 {
+		t.Errorf("Invalid TIFF pages: %d", pages)
+	}
+	jpeg, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	if pages := imagePages(jpeg); pages != 1 {
+		t.Errorf("Invalid JPEG pages: %d", pages)
+	}
+
+	// Directories pointing to themselves must not loop forever
+	buf := multiPageTIFF(1)
+	binary.LittleEndian.PutUint32(buf[10:14], 8)
+	if pages := imagePages(buf); pages != 1 {
+		t.Errorf("Invalid looped TIFF pages: %d", pages)
+	}
+}
+
+func TestSelectPage(t *testing.T) {
+	buf := multiPageTIFF(3)
+
+	out, err := selectPage(buf, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := binary.LittleEndian.Uint32(out[4:8]); offset != 20 {
+		t.Errorf("Invalid first page offset: %d", offset)
+	}
+	if binary.LittleEndian.Uint32(buf[4:8]) != 8 {
+		t.Error("The source image must not be modified")
+	}
+
+	for _, value := range []string{"", "0"} {
+		if out, err := selectPage(buf, value); err != nil || &out[0] != &buf[0] {
+			t.Errorf("The first page must keep the image untouched: %q", value)
+		}
+	}
+
+	for _, value := range []string{"3", "-1", "foo", "1.5"} {
+		if _, err := selectPage(buf, value); err == nil || err.(Error).HTTPCode() != 400 {
+			t.Errorf("Invalid page %q must be rejected: %v", value, err)
+		}
+	}
+
+	jpeg, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	if _, err := selectPage(jpeg, "1"); err == nil {
+		t.Error("Single page images must reject pages other than 0")
+	}
+}
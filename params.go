@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/h2non/bimg.v0"
 	"math"
 	"net/url"
@@ -9,31 +10,79 @@ import (
 )
 
 var allowedParams = map[string]string{
-	"width":       "int",
-	"height":      "int",
-	"quality":     "int",
-	"top":         "int",
-	"left":        "int",
-	"areawidth":   "int",
-	"areaheight":  "int",
-	"compression": "int",
-	"rotate":      "int",
-	"margin":      "int",
-	"factor":      "int",
-	"dpi":         "int",
-	"textwidth":   "int",
-	"opacity":     "float",
-	"nocrop":      "bool",
-	"noprofile":   "bool",
-	"norotation":  "bool",
-	"noreplicate": "bool",
-	"force":       "bool",
-	"text":        "string",
-	"font":        "string",
-	"type":        "string",
-	"color":       "color",
-	"colorspace":  "colorspace",
-	"gravity":     "gravity",
+	"width":              "int",
+	"height":             "int",
+	"quality":            "int",
+	"top":                "int",
+	"left":               "int",
+	"areawidth":          "int",
+	"areaheight":         "int",
+	"compression":        "int",
+	"rotate":             "int",
+	"margin":             "int",
+	"factor":             "int",
+	"dpi":                "int",
+	"textwidth":          "int",
+	"textstrokewidth":    "int",
+	"bitdepth":           "int",
+	"effort":             "int",
+	"dither":             "float",
+	"intensity":          "unitfloat",
+	"sigma":              "float",
+	"dpr":                "float",
+	"maxbytes":           "int",
+	"minwidth":           "int",
+	"minheight":          "int",
+	"tolerance":          "int",
+	"borderwidth":        "int",
+	"roundedcorners":     "int",
+	"levels":             "int",
+	"page":               "int",
+	"orientation":        "int",
+	"colors":             "int",
+	"opacity":            "float",
+	"nocrop":             "bool",
+	"noprofile":          "bool",
+	"norotation":         "bool",
+	"noreplicate":        "bool",
+	"nowatermark":        "bool",
+	"premultiply":        "bool",
+	"shrinkonly":         "bool",
+	"stripmeta":          "bool",
+	"stripgps":           "bool",
+	"stripthumbnail":     "bool",
+	"stripicc":           "bool",
+	"preserveanimation":  "bool",
+	"reduceonoverflow":   "bool",
+	"interlace":          "bool",
+	"force":              "bool",
+	"text":               "string",
+	"font":               "string",
+	"invert":             "string",
+	"lut":                "string",
+	"bordercolor":        "string",
+	"watermarkimage":     "string",
+	"watermarksprite":    "string",
+	"background":         "string",
+	"flatten":            "bool",
+	"operations":         "string",
+	"iccprofile":         "string",
+	"encoding":           "string",
+	"scan":               "string",
+	"filename":           "string",
+	"sizes":              "string",
+	"suggestcrop":        "string",
+	"opacitycurve":       "string",
+	"attachment":         "bool",
+	"progressivepreview": "bool",
+	"type":               "type",
+	"format":             "type",
+	"color":              "color",
+	"textstroke":         "color",
+	"colorspace":         "colorspace",
+	"gravity":            "gravity",
+	"gravityx":           "gravity",
+	"gravityy":           "gravity",
 }
 
 func readParams(query url.Values) ImageOptions {
@@ -44,7 +93,93 @@ func readParams(query url.Values) ImageOptions {
 		params[key] = parseParam(param, kind)
 	}
 
-	return mapImageParams(params)
+	return applyDPR(mapImageParams(params))
+}
+
+// applyDPR multiplies the requested dimensions by the device pixel ratio.
+// Undefined dimensions are kept, so the aspect ratio is preserved.
+func applyDPR(opts ImageOptions) ImageOptions {
+	if opts.DPR <= 0 {
+		return opts
+	}
+	opts.Width = int(math.Floor(float64(opts.Width)*opts.DPR + 0.5))
+	opts.Height = int(math.Floor(float64(opts.Height)*opts.DPR + 0.5))
+	return opts
+}
+
+// Params where a negative value is rejected instead of taking its absolute value
+var dimensionParams = []string{"width", "height"}
+
+// Params which must be within the given inclusive range
+var rangeParams = map[string][2]float64{
+	"bitdepth":    {1, 8},
+	"colors":      {1, 64},
+	"dither":      {0, 1},
+	"dpr":         {1, 4},
+	"effort":      {1, 10},
+	"intensity":   {0, 1},
+	"levels":      {2, 256},
+	"orientation": {1, 8},
+	"sigma":       {0, 50},
+	"tolerance":   {0, 255},
+}
+
+func validateParams(query url.Values) error {
+	for _, key := range dimensionParams {
+		if value := query.Get(key); value != "" {
+			if num, err := strconv.ParseFloat(value, 64); err == nil && num < 0 {
+				return NewError("Invalid "+key+" param: must be a positive number", BadRequest)
+			}
+		}
+	}
+
+	if value := query.Get("scan"); value != "" && isValidScan(value) == false {
+		return NewError("Invalid scan param: must be baseline, progressive or earlycolor", BadRequest)
+	}
+
+	if value := query.Get("suggestcrop"); value != "" {
+		if _, _, err := parseCropRatio(value); err != nil {
+			return err
+		}
+	}
+
+	if value := query.Get("opacitycurve"); value != "" {
+		if _, _, err := parseOpacityCurve(value); err != nil {
+			return err
+		}
+	}
+
+	if value := query.Get("sizes"); value != "" {
+		if _, err := parseICOSizes(value); err != nil {
+			return err
+		}
+	}
+
+	if value := query.Get("roundedcorners"); value != "" {
+		if radius, err := strconv.Atoi(value); err != nil || radius < 0 {
+			return NewError("Invalid roundedcorners param: must be a radius in pixels", BadRequest)
+		}
+	}
+
+	if parseBool(query.Get("stripicc")) && query.Get("iccprofile") != "" {
+		return NewError("Invalid stripicc param: cannot be combined with iccprofile", BadRequest)
+	}
+
+	for _, key := range []string{"background", "bordercolor"} {
+		if value := query.Get(key); value != "" && isValidAutoColor(value) == false {
+			return NewError("Invalid "+key+" param: must be auto or an RGB decimal or hex color", BadRequest)
+		}
+	}
+
+	for key, bounds := range rangeParams {
+		if value := query.Get(key); value != "" {
+			num, err := strconv.ParseFloat(value, 64)
+			if err != nil || num < bounds[0] || num > bounds[1] {
+				return NewError(fmt.Sprintf("Invalid %s param: must be between %v and %v", key, bounds[0], bounds[1]), BadRequest)
+			}
+		}
+	}
+	return nil
 }
 
 func parseParam(param, kind string) interface{} {
@@ -66,43 +201,112 @@ func parseParam(param, kind string) interface{} {
 	if kind == "bool" {
 		return parseBool(param)
 	}
+	if kind == "unitfloat" {
+		return parseFloatDefault(param, 1)
+	}
+	if kind == "type" {
+		return parseImageTypeName(param)
+	}
 	return param
 }
 
 func mapImageParams(params map[string]interface{}) ImageOptions {
 	return ImageOptions{
-		Width:       params["width"].(int),
-		Height:      params["height"].(int),
-		Top:         params["top"].(int),
-		Left:        params["left"].(int),
-		AreaWidth:   params["areawidth"].(int),
-		AreaHeight:  params["areaheight"].(int),
-		DPI:         params["dpi"].(int),
-		Quality:     params["quality"].(int),
-		TextWidth:   params["textwidth"].(int),
-		Compression: params["compression"].(int),
-		Rotate:      params["rotate"].(int),
-		Factor:      params["factor"].(int),
-		Color:       params["color"].([]uint8),
-		Text:        params["text"].(string),
-		Font:        params["font"].(string),
-		Type:        params["type"].(string),
-		NoCrop:      params["nocrop"].(bool),
-		Force:       params["force"].(bool),
-		NoReplicate: params["noreplicate"].(bool),
-		NoRotation:  params["norotation"].(bool),
-		NoProfile:   params["noprofile"].(bool),
-		Opacity:     float32(params["opacity"].(float64)),
-		Gravity:     params["gravity"].(bimg.Gravity),
-		Colorspace:  params["colorspace"].(bimg.Interpretation),
+		Width:              params["width"].(int),
+		Height:             params["height"].(int),
+		Top:                params["top"].(int),
+		Left:               params["left"].(int),
+		AreaWidth:          params["areawidth"].(int),
+		AreaHeight:         params["areaheight"].(int),
+		DPI:                params["dpi"].(int),
+		Quality:            params["quality"].(int),
+		TextWidth:          params["textwidth"].(int),
+		TextStrokeWidth:    params["textstrokewidth"].(int),
+		BitDepth:           params["bitdepth"].(int),
+		Effort:             params["effort"].(int),
+		Dither:             params["dither"].(float64),
+		Intensity:          params["intensity"].(float64),
+		Sigma:              params["sigma"].(float64),
+		DPR:                params["dpr"].(float64),
+		MaxBytes:           params["maxbytes"].(int),
+		MinWidth:           params["minwidth"].(int),
+		MinHeight:          params["minheight"].(int),
+		Compression:        params["compression"].(int),
+		Rotate:             params["rotate"].(int),
+		Factor:             params["factor"].(int),
+		Color:              params["color"].([]uint8),
+		TextStroke:         params["textstroke"].([]uint8),
+		Text:               params["text"].(string),
+		Font:               params["font"].(string),
+		Invert:             params["invert"].(string),
+		Lut:                params["lut"].(string),
+		Operations:         params["operations"].(string),
+		BorderColor:        params["bordercolor"].(string),
+		WatermarkImage:     params["watermarkimage"].(string),
+		WatermarkSprite:    params["watermarksprite"].(string),
+		Tolerance:          params["tolerance"].(int),
+		BorderWidth:        params["borderwidth"].(int),
+		RoundedCorners:     params["roundedcorners"].(int),
+		Levels:             params["levels"].(int),
+		Orientation:        params["orientation"].(int),
+		Colors:             params["colors"].(int),
+		Background:         params["background"].(string),
+		Flatten:            params["flatten"].(bool),
+		ICCProfile:         params["iccprofile"].(string),
+		Encoding:           params["encoding"].(string),
+		Scan:               coalesceString(params["scan"].(string), interlaceScan(params["interlace"].(bool))),
+		Filename:           params["filename"].(string),
+		Sizes:              params["sizes"].(string),
+		SuggestCrop:        params["suggestcrop"].(string),
+		OpacityCurve:       params["opacitycurve"].(string),
+		Attachment:         params["attachment"].(bool),
+		ProgressivePreview: params["progressivepreview"].(bool),
+		Type:               coalesceString(params["type"].(string), params["format"].(string)),
+		NoCrop:             params["nocrop"].(bool),
+		Force:              params["force"].(bool),
+		NoReplicate:        params["noreplicate"].(bool),
+		NoRotation:         params["norotation"].(bool),
+		NoProfile:          params["noprofile"].(bool),
+		NoWatermark:        params["nowatermark"].(bool),
+		Premultiply:        params["premultiply"].(bool),
+		ShrinkOnly:         params["shrinkonly"].(bool),
+		StripMeta:          params["stripmeta"].(bool),
+		StripGPS:           params["stripgps"].(bool),
+		StripThumbnail:     params["stripthumbnail"].(bool),
+		StripICC:           params["stripicc"].(bool),
+		PreserveAnimation:  params["preserveanimation"].(bool),
+		ReduceOnOverflow:   params["reduceonoverflow"].(bool),
+		Opacity:            float32(params["opacity"].(float64)),
+		Gravity:            withAxisGravity(params["gravity"].(bimg.Gravity), params["gravityx"].(bimg.Gravity), params["gravityy"].(bimg.Gravity)),
+		Colorspace:         params["colorspace"].(bimg.Interpretation),
 	}
 }
 
+// scaleQuality maps a quality value from the 0-scale range, used by legacy
+// clients, to the standard 0-100 range.
+func scaleQuality(quality, scale int) int {
+	if scale <= 0 || scale == 100 || quality == 0 {
+		return quality
+	}
+	value := int(math.Floor(float64(quality)*100/float64(scale) + 0.5))
+	if value > 100 {
+		return 100
+	}
+	return value
+}
+
 func parseBool(val string) bool {
 	value, _ := strconv.ParseBool(val)
 	return value
 }
 
+func parseFloatDefault(param string, defaultValue float64) float64 {
+	if param == "" {
+		return defaultValue
+	}
+	return parseFloat(param)
+}
+
 func parseInt(param string) int {
 	return int(math.Floor(parseFloat(param) + 0.5))
 }
@@ -112,6 +316,25 @@ func parseFloat(param string) float64 {
 	return math.Abs(val)
 }
 
+// parseImageTypeName accepts both format names (webp) and
+// image MIME types (image/webp)
+func parseImageTypeName(val string) string {
+	val = strings.TrimSpace(strings.ToLower(val))
+	if strings.HasPrefix(val, "image/") {
+		return ExtractImageTypeFromMime(val)
+	}
+	return val
+}
+
+func coalesceString(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
 func parseColorspace(val string) bimg.Interpretation {
 	if val == "bw" {
 		return bimg.INTERPRETATION_B_W
@@ -133,6 +356,9 @@ func parseColor(val string) []uint8 {
 
 func parseGravity(val string) bimg.Gravity {
 	val = strings.TrimSpace(strings.ToLower(val))
+	if strings.Contains(val, ",") {
+		return parseCompoundGravity(val)
+	}
 	if val == "south" {
 		return bimg.SOUTH
 	}
@@ -145,5 +371,11 @@ func parseGravity(val string) bimg.Gravity {
 	if val == "west" {
 		return bimg.WEST
 	}
+	if val == "smart" || val == "attention" {
+		return GravitySmart
+	}
+	if val == "entropy" {
+		return GravityEntropy
+	}
 	return bimg.CENTRE
 }
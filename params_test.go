@@ -14,6 +14,8 @@ func TestReadParams(t *testing.T) {
 	q.Add("noreplicate", "1")
 	q.Add("opacity", "0.2")
 	q.Add("text", "hello")
+	q.Add("textstroke", "0,0,0")
+	q.Add("textstrokewidth", "2")
 
 	params := readParams(q)
 
@@ -21,7 +23,9 @@ func TestReadParams(t *testing.T) {
 		params.Height == 80 &&
 		params.NoReplicate == true &&
 		params.Opacity == 0.2 &&
-		params.Text == "hello"
+		params.Text == "hello" &&
+		len(params.TextStroke) == 3 &&
+		params.TextStrokeWidth == 2
 
 	if assert == false {
 		t.Error("Invalid params")
@@ -119,3 +123,79 @@ func TestParseColor(t *testing.T) {
 		}
 	}
 }
+
+func TestReadParamsType(t *testing.T) {
+	cases := []struct {
+		params   map[string]string
+		expected string
+	}{
+		{map[string]string{"type": "webp"}, "webp"},
+		{map[string]string{"type": "image/webp"}, "webp"},
+		{map[string]string{"type": "IMAGE/PNG"}, "png"},
+		{map[string]string{"format": "webp"}, "webp"},
+		{map[string]string{"format": "image/webp"}, "webp"},
+		{map[string]string{"type": "png", "format": "webp"}, "png"},
+		{map[string]string{"type": "application/json"}, "application/json"},
+		{map[string]string{}, ""},
+	}
+
+	for _, test := range cases {
+		q := url.Values{}
+		for key, value := range test.params {
+			q.Set(key, value)
+		}
+
+		params := readParams(q)
+		if params.Type != test.expected {
+			t.Errorf("Invalid type for %v: %s != %s", test.params, params.Type, test.expected)
+		}
+	}
+}
+
+func TestScaleQuality(t *testing.T) {
+	cases := []struct {
+		quality  int
+		scale    int
+		expected int
+	}{
+		{8, 10, 80},
+		{10, 10, 100},
+		{15, 10, 100},
+		{0, 10, 0},
+		{3, 5, 60},
+		{80, 100, 80},
+		{80, 0, 80},
+	}
+
+	for _, test := range cases {
+		if quality := scaleQuality(test.quality, test.scale); quality != test.expected {
+			t.Errorf("Invalid quality %d on the 0-%d scale: %d", test.quality, test.scale, quality)
+		}
+	}
+}
+
+func TestReadParamsDPR(t *testing.T) {
+	cases := []struct {
+		params url.Values
+		width  int
+		height int
+	}{
+		{url.Values{"width": {"300"}, "dpr": {"2"}}, 600, 0},
+		{url.Values{"width": {"300"}, "height": {"200"}, "dpr": {"1.5"}}, 450, 300},
+		{url.Values{"height": {"333"}, "dpr": {"1.5"}}, 0, 500},
+		{url.Values{"width": {"300"}}, 300, 0},
+	}
+
+	for _, test := range cases {
+		params := readParams(test.params)
+		if params.Width != test.width || params.Height != test.height {
+			t.Errorf("Invalid dimensions for %v: %dx%d", test.params, params.Width, params.Height)
+		}
+	}
+
+	for _, value := range []string{"0.5", "5", "abc"} {
+		if err := validateParams(url.Values{"dpr": {value}}); err == nil {
+			t.Errorf("DPR %s must be rejected", value)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/h2non/bimg.v0"
+	"net/url"
+)
+
+const maxPipelineOperations = 10
+
+// PipelineOperation is a single pipeline step, defined as a JSON object
+// with the operation name and its params.
+type PipelineOperation struct {
+	Name          string                 `json:"operation"`
+	IgnoreFailure bool                   `json:"ignore_failure"`
+	Params        map[string]interface{} `json:"params"`
+}
+
+// Operations available as pipeline steps
+var pipelineOperations = map[string]Operation{
+	"resize":         Resize,
+	"enlarge":        Enlarge,
+	"extract":        Extract,
+	"crop":           Crop,
+	"rotate":         Rotate,
+	"flip":           Flip,
+	"flop":           Flop,
+	"thumbnail":      Thumbnail,
+	"zoom":           Zoom,
+	"convert":        Convert,
+	"watermark":      Watermark,
+	"watermarkimage": WatermarkImage,
+	"invert":         Invert,
+	"blur":           Blur,
+	"posterize":      Posterize,
+	"lut":            Lut,
+	"removeborder":   RemoveBorder,
+	"circle":         Circle,
+}
+
+func parsePipelineOperations(value string) ([]PipelineOperation, error) {
+	var operations []PipelineOperation
+	if err := json.Unmarshal([]byte(value), &operations); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("at least one operation is required")
+	}
+	if len(operations) > maxPipelineOperations {
+		return nil, fmt.Errorf("max %d operations are allowed", maxPipelineOperations)
+	}
+	for _, operation := range operations {
+		if _, ok := pipelineOperations[operation.Name]; !ok {
+			return nil, fmt.Errorf("unsupported operation: %s", operation.Name)
+		}
+	}
+	return operations, nil
+}
+
+// Pipeline applies the operations in the given order, each one to the
+// output of the previous one. The output image type, if requested, applies
+// to the last step unless the step defines its own.
+func Pipeline(buf []byte, o ImageOptions) (Image, error) {
+	operations, err := parsePipelineOperations(o.Operations)
+	if err != nil {
+		return Image{}, NewError("Invalid pipeline operations: "+err.Error(), BadRequest)
+	}
+
+	image := Image{Body: buf, Mime: GetImageMimeType(bimg.DetermineImageType(buf))}
+	var applied []AppliedOperation
+	for i, operation := range operations {
+		query := url.Values{}
+		for key, value := range operation.Params {
+			query.Set(key, fmt.Sprint(value))
+		}
+		if err := validateParams(query); err != nil {
+			return Image{}, err
+		}
+
+		// Each step is limited from its own input, which previous
+		// steps may have enlarged
+		opts, err := withServerLimits(image.Body, withServerSettings(readParams(query), o))
+		if err != nil {
+			return Image{}, err
+		}
+		if opts.Type == "" && i == len(operations)-1 {
+			opts.Type = o.Type
+		}
+
+		out, err := pipelineOperations[operation.Name](image.Body, opts)
+		if err != nil {
+			if operation.IgnoreFailure {
+				continue
+			}
+			return Image{}, fmt.Errorf("%s operation failed: %s", operation.Name, err)
+		}
+		if err := checkPixelLimit(out.Body, o.MaxPixels); err != nil {
+			return Image{}, err
+		}
+		image = out
+		applied = append(applied, AppliedOperation{Operation: operation.Name, Params: resolvedParams(query, opts)})
+	}
+	image.Operations = applied
+	return image, nil
+}
+
+// withServerSettings copies the server-side settings to the step options.
+func withServerSettings(opts, o ImageOptions) ImageOptions {
+	opts.MaxFrameConcurrency = o.MaxFrameConcurrency
+	opts.StrictDimensions = o.StrictDimensions
+	opts.LUTDir = o.LUTDir
+	opts.ICCDir = o.ICCDir
+	opts.WatermarkDir = o.WatermarkDir
+	opts.MaxQualityAttempts = o.MaxQualityAttempts
+	opts.MaxPixels = o.MaxPixels
+	opts.MaxUpscale = o.MaxUpscale
+	opts.RejectUpscale = o.RejectUpscale
+	opts.QualityScale = o.QualityScale
+	return opts
+}
+
+// withServerLimits maps the requested quality to the server scale and caps
+// the requested dimensions to the max upscale of the source image.
+func withServerLimits(buf []byte, opts ImageOptions) (ImageOptions, error) {
+	opts.Quality = scaleQuality(opts.Quality, opts.QualityScale)
+	return limitUpscale(buf, opts, opts.MaxUpscale, opts.RejectUpscale)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// halfBlackPNG returns a 200x100 image, black on the left half and white
+// on the right one.
+func halfBlackPNG(t *testing.T) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			value := uint8(255)
+			if x < 100 {
+				value = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{value, value, value, 255})
+		}
+	}
+	return encodeTestPNG(t, img)
+}
+
+func TestPipelineOrder(t *testing.T) {
+	ts := testServer(controller(Pipeline))
+	defer ts.Close()
+
+	extract := `{"operation": "extract", "params": {"top": 1, "left": 100, "areawidth": 50, "areaheight": 50}}`
+	blur := `{"operation": "blur", "params": {"sigma": 3}}`
+
+	run := func(operations string) *image.NRGBA {
+		query := url.Values{"operations": []string{operations}, "type": []string{"png"}}
+		res, err := http.Post(ts.URL+"?"+query.Encode(), "image/png", bytes.NewReader(halfBlackPNG(t)))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+		img, err := png.Decode(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 50 {
+			t.Fatalf("Invalid image size: %v", img.Bounds())
+		}
+		return toNRGBA(img)
+	}
+
+	// Blurring first spreads the black half into the extracted area edge
+	blurred := run("[" + blur + "," + extract + "]")
+	if c := blurred.NRGBAAt(0, 25); c.R > 200 {
+		t.Errorf("Blur then extract must darken the left edge: %v", c)
+	}
+
+	// Extracting first leaves a white area, unchanged by the blur
+	extracted := run("[" + extract + "," + blur + "]")
+	if c := extracted.NRGBAAt(0, 25); c.R != 255 {
+		t.Errorf("Extract then blur must keep the left edge white: %v", c)
+	}
+}
+
+func TestPipelineInvalidOperations(t *testing.T) {
+	buf := halfBlackPNG(t)
+	cases := []string{
+		"",
+		"[]",
+		"{}",
+		`[{"operation": "pipeline"}]`,
+		`[{"operation": "info"}]`,
+		`[{"operation": "blur", "params": {"sigma": 0}}]`,
+		`[{"operation": "resize", "params": {"width": -10}}]`,
+	}
+
+	for _, operations := range cases {
+		if _, err := Pipeline(buf, ImageOptions{Operations: operations}); err == nil {
+			t.Errorf("Invalid pipeline must fail: %s", operations)
+		}
+	}
+
+	image, err := Pipeline(buf, ImageOptions{Operations: `[{"operation": "blur", "ignore_failure": true}, {"operation": "flip"}]`})
+	if err != nil || image.Mime != "image/png" {
+		t.Errorf("Failures must be ignored on demand: %v", err)
+	}
+}
+
+func TestPipelineUpscaleLimits(t *testing.T) {
+	enlarge := `{"operation": "enlarge", "params": {"width": 40000, "height": 20000}}`
+	run := func(o ServerOptions, operations string) *http.Response {
+		ts := testServer(optionsController(Pipeline, o))
+		defer ts.Close()
+
+		query := url.Values{"operations": []string{operations}, "type": []string{"png"}}
+		res, err := http.Post(ts.URL+"?"+query.Encode(), "image/png", bytes.NewReader(halfBlackPNG(t)))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		return res
+	}
+
+	// Every step is clamped to the max upscale of its own input
+	res := run(ServerOptions{MaxUpscale: 2}, "["+enlarge+"]")
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if err := assertSize(body, 400, 200); err != nil {
+		t.Error(err)
+	}
+
+	res = run(ServerOptions{MaxUpscale: 2, RejectUpscale: true}, "["+enlarge+"]")
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+
+	// Intermediate outputs over the max pixels are not processed further
+	res = run(ServerOptions{MaxUpscale: 2, MaxPixels: 100000}, "["+enlarge+","+enlarge+"]")
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxPrecomputeSpecs       = 50
+	maxPrecomputeBodyBytes   = 1024 * 1024
+	maxPrecomputeConcurrency = 4
+)
+
+// PrecomputeRequest defines an image source and the transformations to
+// process and cache for it.
+type PrecomputeRequest struct {
+	URL   string           `json:"url"`
+	File  string           `json:"file"`
+	Specs []PrecomputeSpec `json:"specs"`
+}
+
+type PrecomputeSpec struct {
+	Name   string                 `json:"operation"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type PrecomputeResult struct {
+	Operation string `json:"operation"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type PrecomputeSummary struct {
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Results   []PrecomputeResult `json:"results"`
+}
+
+// precomputeOperation returns the operation an endpoint name maps to.
+func precomputeOperation(name string) (Operation, bool) {
+	if name == "pipeline" {
+		return Pipeline, true
+	}
+	operation, ok := pipelineOperations[name]
+	return operation, ok
+}
+
+// precomputeController processes every spec for the given source and
+// stores the output in the image cache, so later GET requests with the
+// same params are served without processing. Only a per-spec summary is
+// replied.
+func precomputeController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			ErrorReply(w, ErrMethodNotAllowed)
+			return
+		}
+
+		var job PrecomputeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrecomputeBodyBytes)).Decode(&job); err != nil {
+			ErrorReply(w, NewError("Invalid precompute request: "+err.Error(), BadRequest))
+			return
+		}
+
+		source := url.Values{}
+		if job.URL != "" {
+			source.Set("url", job.URL)
+		}
+		if job.File != "" {
+			source.Set("file", job.File)
+		}
+		if len(source) != 1 {
+			ErrorReply(w, NewError("Invalid precompute request: exactly one of url or file must be defined", BadRequest))
+			return
+		}
+		if len(job.Specs) == 0 || len(job.Specs) > maxPrecomputeSpecs {
+			ErrorReply(w, NewError("Invalid precompute request: between 1 and "+strconv.Itoa(maxPrecomputeSpecs)+" specs are allowed", BadRequest))
+			return
+		}
+		for _, spec := range job.Specs {
+			if _, ok := precomputeOperation(spec.Name); !ok {
+				ErrorReply(w, NewError("Invalid precompute request: unsupported operation: "+spec.Name, BadRequest))
+				return
+			}
+		}
+
+		req := precomputeRequest(r, "/", source)
+		imageSource := MatchSource(req)
+		if imageSource == nil {
+			ErrorReply(w, ErrMissingImageSource)
+			return
+		}
+
+		buf, err := imageSource.GetImage(req)
+		if err != nil {
+			ErrorReply(w, NewError(err.Error(), BadRequest))
+			return
+		}
+		if len(buf) == 0 {
+			ErrorReply(w, ErrEmptyBody)
+			return
+		}
+
+		summary := precompute(r, imageSource, buf, source, job.Specs, o)
+		body, _ := json.Marshal(summary)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+func precompute(r *http.Request, imageSource ImageSource, buf []byte, source url.Values, specs []PrecomputeSpec, o ServerOptions) PrecomputeSummary {
+	results := make([]PrecomputeResult, len(specs))
+	slots := make(chan struct{}, maxPrecomputeConcurrency)
+
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		go func(i int, spec PrecomputeSpec) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			query := url.Values{}
+			for key, value := range spec.Params {
+				query.Set(key, fmt.Sprint(value))
+			}
+			for key, values := range source {
+				query[key] = values
+			}
+
+			req := withImageSource(precomputeRequest(r, "/"+spec.Name, query), imageSource)
+			operation, _ := precomputeOperation(spec.Name)
+
+			// The image handler caches the output on success
+			res := httptest.NewRecorder()
+			imageHandler(res, req, buf, operation, o)
+
+			results[i] = PrecomputeResult{Operation: spec.Name, Status: "ok"}
+			if res.Code != http.StatusOK {
+				var reply Error
+				json.Unmarshal(res.Body.Bytes(), &reply)
+				results[i].Status = "failed"
+				results[i].Error = reply.Message
+			}
+		}(i, spec)
+	}
+	wg.Wait()
+
+	summary := PrecomputeSummary{Results: results}
+	for _, result := range results {
+		if result.Status == "ok" {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// precomputeRequest builds the GET request equivalent to a precomputed
+// spec, keeping the original headers for the image source.
+func precomputeRequest(r *http.Request, path string, query url.Values) *http.Request {
+	req := &http.Request{
+		Method: "GET",
+		Header: r.Header,
+		URL:    &url.URL{Path: path, RawQuery: query.Encode()},
+	}
+	return req.WithContext(r.Context())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrecompute(t *testing.T) {
+	opts := ServerOptions{Mount: "fixtures", ApiKey: "secret", Cache: NewImageCache(10)}
+	LoadSources(opts)
+
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	body := `{"file": "large.jpg", "specs": [
+		{"operation": "resize", "params": {"width": 320}},
+		{"operation": "crop", "params": {"width": 100, "height": 100, "type": "png"}},
+		{"operation": "resize", "params": {"width": -10}}
+	]}`
+	req, _ := http.NewRequest("POST", ts.URL+"/precompute", strings.NewReader(body))
+	req.Header.Set("API-Key", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	var summary PrecomputeSummary
+	if err := json.NewDecoder(res.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Succeeded != 2 || summary.Failed != 1 || len(summary.Results) != 3 {
+		t.Fatalf("Invalid precompute summary: %#v", summary)
+	}
+	if summary.Results[0].Status != "ok" || summary.Results[1].Status != "ok" {
+		t.Errorf("Invalid spec results: %#v", summary.Results)
+	}
+	if summary.Results[2].Status != "failed" || summary.Results[2].Error == "" {
+		t.Errorf("Invalid failed spec result: %#v", summary.Results[2])
+	}
+
+	if opts.Cache.Len() != 2 {
+		t.Fatalf("Invalid cache entries: %d", opts.Cache.Len())
+	}
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, ok := opts.Cache.Get(imageCacheKey(buf, "/crop", url.Values{"width": {"100"}, "height": {"100"}, "type": {"png"}}))
+	if !ok || image.Mime != "image/png" {
+		t.Fatalf("Missing cached image: %#v", image.Mime)
+	}
+
+	// Equivalent GET requests are served from the cache
+	opts.Cache.Set(imageCacheKey(buf, "/resize", url.Values{"width": {"320"}}), Image{Body: []byte("cached"), Mime: "image/jpeg"})
+	res, err = http.Get(ts.URL + "/resize?width=320&file=large.jpg&key=secret")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	cached, _ := ioutil.ReadAll(res.Body)
+	if string(cached) != "cached" {
+		t.Error("The image must be served from the cache")
+	}
+}
+
+func TestPrecomputeAuthorization(t *testing.T) {
+	opts := ServerOptions{Mount: "fixtures", ApiKey: "secret", Cache: NewImageCache(10)}
+	LoadSources(opts)
+
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	body := `{"file": "large.jpg", "specs": [{"operation": "resize", "params": {"width": 320}}]}`
+	res, err := http.Post(ts.URL+"/precompute", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 401 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+	if opts.Cache.Len() != 0 {
+		t.Errorf("Unauthorized requests must not be cached")
+	}
+
+	// The endpoint is only available with an API key
+	ts = httptest.NewServer(NewServerMux(ServerOptions{Cache: NewImageCache(10)}))
+	defer ts.Close()
+	res, err = http.Post(ts.URL+"/precompute", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 404 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestPrecomputeInvalidRequest(t *testing.T) {
+	cases := []string{
+		`{`,
+		`{"specs": [{"operation": "resize"}]}`,
+		`{"file": "large.jpg", "url": "http://localhost/large.jpg", "specs": [{"operation": "resize"}]}`,
+		`{"file": "large.jpg", "specs": []}`,
+		`{"file": "large.jpg", "specs": [{"operation": "info"}]}`,
+	}
+
+	fn := precomputeController(ServerOptions{Cache: NewImageCache(10)})
+	for _, body := range cases {
+		res := httptest.NewRecorder()
+		fn(res, httptest.NewRequest("POST", "/precompute", strings.NewReader(body)))
+		if res.Code != 400 {
+			t.Errorf("Invalid response status for %s: %d", body, res.Code)
+		}
+	}
+}
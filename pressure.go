@@ -0,0 +1,92 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+const minPressureQuality = 10
+
+// PressureMonitor detects when the server is under load, measured by the
+// images being processed at the same time and the allocated heap memory,
+// so requests can trade some output quality for lower CPU and memory.
+type PressureMonitor struct {
+	inFlight    int64
+	maxInFlight int
+	maxMemory   uint64
+	delta       int
+	memory      func() uint64
+}
+
+// NewPressureMonitor returns a monitor which lowers the quality by delta
+// once more than maxInFlight images are processed or the heap exceeds
+// maxMemory megabytes. Zero thresholds are ignored.
+func NewPressureMonitor(maxInFlight, maxMemory, delta int) *PressureMonitor {
+	if delta <= 0 || (maxInFlight <= 0 && maxMemory <= 0) {
+		return nil
+	}
+	return &PressureMonitor{
+		maxInFlight: maxInFlight,
+		maxMemory:   uint64(maxMemory) * 1024 * 1024,
+		delta:       delta,
+		memory:      heapMemory,
+	}
+}
+
+func heapMemory() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// Begin registers an image being processed, returning the function which
+// must be called once it is done.
+func (p *PressureMonitor) Begin() func() {
+	if p == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&p.inFlight, 1)
+	return func() { atomic.AddInt64(&p.inFlight, -1) }
+}
+
+// UnderPressure reports whether any threshold is currently exceeded.
+func (p *PressureMonitor) UnderPressure() bool {
+	if p == nil {
+		return false
+	}
+	if p.maxInFlight > 0 && atomic.LoadInt64(&p.inFlight) > int64(p.maxInFlight) {
+		return true
+	}
+	return p.maxMemory > 0 && p.memory() > p.maxMemory
+}
+
+// Lower reduces the quality and the GIF encoding effort while the server
+// is under pressure, reporting whether the options were changed.
+func (p *PressureMonitor) Lower(o ImageOptions) (ImageOptions, bool) {
+	if p.UnderPressure() == false {
+		return o, false
+	}
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = defaultQuality
+	}
+	o.Quality = quality - p.delta
+	if o.Quality < minPressureQuality {
+		o.Quality = minPressureQuality
+	}
+
+	effort := o.Effort
+	if effort == 0 {
+		effort = defaultGIFEffort
+	}
+	if effort > 1 {
+		o.Effort = effort - 1
+	}
+	return o, true
+}
+
+func pressureWarning(o ImageOptions) string {
+	return `199 imaginary "quality lowered to ` + strconv.Itoa(o.Quality) + ` under server load"`
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPressureMonitorLower(t *testing.T) {
+	if NewPressureMonitor(0, 0, 10) != nil || NewPressureMonitor(10, 0, 0) != nil {
+		t.Fatal("The monitor must be disabled without thresholds or delta")
+	}
+
+	var memory uint64
+	pressure := NewPressureMonitor(1, 100, 30)
+	pressure.memory = func() uint64 { return memory }
+
+	if _, lowered := pressure.Lower(ImageOptions{Quality: 90}); lowered {
+		t.Fatal("The quality must not be lowered without pressure")
+	}
+
+	release := pressure.Begin()
+	second := pressure.Begin()
+	opts, lowered := pressure.Lower(ImageOptions{Quality: 90})
+	if !lowered || opts.Quality != 60 || opts.Effort != defaultGIFEffort-1 {
+		t.Fatalf("Invalid lowered options: %#v", opts)
+	}
+	if opts, _ := pressure.Lower(ImageOptions{}); opts.Quality != defaultQuality-30 {
+		t.Errorf("The default quality must be lowered: %d", opts.Quality)
+	}
+	if opts, _ := pressure.Lower(ImageOptions{Quality: 20, Effort: 1}); opts.Quality != minPressureQuality || opts.Effort != 1 {
+		t.Errorf("Invalid min lowered options: %#v", opts)
+	}
+	second()
+	release()
+
+	memory = 200 * 1024 * 1024
+	if _, lowered := pressure.Lower(ImageOptions{Quality: 90}); !lowered {
+		t.Error("The quality must be lowered under memory pressure")
+	}
+	memory = 0
+	if _, lowered := pressure.Lower(ImageOptions{Quality: 90}); lowered {
+		t.Error("The quality must revert once the pressure subsides")
+	}
+}
+
+func TestPressureLowersQuality(t *testing.T) {
+	pressure := NewPressureMonitor(1, 0, 40)
+	opts := ServerOptions{Pressure: pressure, Cache: NewImageCache(10), Mount: "fixtures"}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	get := func() (int, string) {
+		res, err := http.Get(ts.URL + "/resize?width=300&quality=95&file=large.jpg")
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return len(body), res.Header.Get("Warning")
+	}
+
+	// Simulates another image being processed
+	release := pressure.Begin()
+	lowered, warning := get()
+	if !strings.Contains(warning, "quality lowered to 55") {
+		t.Errorf("Invalid warning header: %s", warning)
+	}
+	if opts.Cache.Len() != 0 {
+		t.Error("Images with lowered quality must not be cached")
+	}
+	release()
+
+	size, warning := get()
+	if warning != "" {
+		t.Errorf("Unexpected warning header: %s", warning)
+	}
+	if lowered >= size {
+		t.Errorf("The lowered quality image must be smaller: %d >= %d", lowered, size)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/h2non/bimg.v0"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+const (
+	previewWidth   = 32
+	previewSigma   = 1.5
+	previewQuality = 40
+)
+
+// previewImage returns the tiny blurred preview of the output image, as
+// JPEG, or as PNG if the image has transparency.
+func previewImage(image Image) (Image, error) {
+	buf := image.Body
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return Image{}, err
+	}
+	if size.Width > previewWidth {
+		small, err := Process(buf, bimg.Options{Width: previewWidth, Type: bimg.PNG})
+		if err != nil {
+			return Image{}, err
+		}
+		buf = small.Body
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+	img = gaussianBlur(img, previewSigma)
+
+	var out bytes.Buffer
+	if img.Opaque() {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: previewQuality})
+		return Image{Body: out.Bytes(), Mime: "image/jpeg"}, err
+	}
+	err = png.Encode(&out, img)
+	return Image{Body: out.Bytes(), Mime: "image/png"}, err
+}
+
+// previewReply writes a multipart/mixed response whose first part is the
+// preview, flushed right away so clients can render it while the second
+// part, the full image, is still being received.
+func previewReply(w http.ResponseWriter, preview, image Image) {
+	parts := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+
+	for _, part := range []struct {
+		name  string
+		image Image
+	}{{"preview", preview}, {"image", image}} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {part.image.Mime},
+			"Content-Length":      {strconv.Itoa(len(part.image.Body))},
+			"Content-Disposition": {`inline; name="` + part.name + `"`},
+		})
+		if err != nil {
+			return
+		}
+		writer.Write(part.image.Body)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	parts.Close()
+}
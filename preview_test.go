@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreviewReply(t *testing.T) {
+	preview := Image{Body: encodeTestPNG(t, splitImage(16, 8)), Mime: "image/png"}
+	image := Image{Body: []byte("full image"), Mime: "image/jpeg"}
+
+	w := httptest.NewRecorder()
+	previewReply(w, preview, image)
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Invalid content type: %s", w.Header().Get("Content-Type"))
+	}
+	if !w.Flushed {
+		t.Error("The preview must be flushed")
+	}
+
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for i, expected := range []Image{preview, image} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Type") != expected.Mime || bytes.Equal(body, expected.Body) == false {
+			t.Errorf("Invalid %s part: %d bytes", part.Header.Get("Content-Type"), len(body))
+		}
+		if i == 0 {
+			// The first part decodes to the small preview image
+			config, err := png.DecodeConfig(bytes.NewReader(body))
+			if err != nil || config.Width != 16 || config.Height != 8 {
+				t.Errorf("Invalid preview image: %v", err)
+			}
+		}
+	}
+	if _, err := reader.NextPart(); err == nil {
+		t.Error("Only the preview and the image parts must be written")
+	}
+}
+
+func TestProgressivePreview(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=300&progressivepreview=true", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(res.Body, params["boundary"])
+
+	// The first bytes decode to a blurred JPEG, at most 32 pixels wide
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := jpeg.Decode(part)
+	if err != nil || preview.Bounds().Dx() > previewWidth {
+		t.Fatalf("Invalid preview image: %v", err)
+	}
+
+	part, err = reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := jpeg.Decode(part)
+	if err != nil || full.Bounds().Dx() != 300 {
+		t.Errorf("Invalid full image: %v", err)
+	}
+}
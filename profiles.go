@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+)
+
+// Profiles maps profile names to the transform params they define.
+type Profiles map[string]map[string]string
+
+// LoadProfiles reads the named profiles from the given JSON file.
+func LoadProfiles(path string) (Profiles, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles Profiles
+	if err := json.Unmarshal(buf, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// applyProfile sets the params of the requested profile, unless the
+// request already defines them.
+func applyProfile(profiles Profiles, query url.Values) (url.Values, error) {
+	name := query.Get("profile")
+	if name == "" {
+		return query, nil
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		return query, NewError("Unknown profile: "+name, BadRequest)
+	}
+
+	for key, value := range profile {
+		if query.Get(key) == "" {
+			query.Set(key, value)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "profiles.json")
+	ioutil.WriteFile(file, []byte(`{"avatar": {"width": "128", "height": "128", "type": "webp", "quality": "80"}}`), 0644)
+
+	profiles, err := LoadProfiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profiles["avatar"]["type"] != "webp" || profiles["avatar"]["width"] != "128" {
+		t.Errorf("Invalid profiles: %v", profiles)
+	}
+
+	ioutil.WriteFile(file, []byte(`[]`), 0644)
+	if _, err := LoadProfiles(file); err == nil {
+		t.Error("Invalid profiles file must fail")
+	}
+}
+
+func TestProfileResize(t *testing.T) {
+	profiles := Profiles{"avatar": {"width": "128", "height": "128", "type": "webp", "quality": "80"}}
+	ts := testServer(optionsController(Circle, ServerOptions{Profiles: profiles}))
+	defer ts.Close()
+
+	image := postImage(t, ts.URL+"?profile=avatar", "large.jpg")
+	if err := assertSize(image, 128, 128); err != nil {
+		t.Error(err)
+	}
+	if bimg.DetermineImageTypeName(image) != "webp" {
+		t.Errorf("Invalid image type: %s", bimg.DetermineImageTypeName(image))
+	}
+
+	// Request params override the profile ones
+	image = postImage(t, ts.URL+"?profile=avatar&width=64&height=64&type=png", "large.jpg")
+	if err := assertSize(image, 64, 64); err != nil {
+		t.Error(err)
+	}
+	if bimg.DetermineImageTypeName(image) != "png" {
+		t.Errorf("Invalid image type: %s", bimg.DetermineImageTypeName(image))
+	}
+
+	res, err := http.Post(ts.URL+"?profile=unknown", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 400 {
+		t.Errorf("Unknown profiles must be rejected: %s", res.Status)
+	}
+}
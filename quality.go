@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Reference luminance and chrominance quantization tables of the JPEG
+// standard, in zigzag order, scaled by encoders for a given quality.
+var standardQuantTables = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegQuantTables returns the quantization tables defined by the JPEG
+// DQT segments, indexed by table id, stopping at the first scan.
+func jpegQuantTables(buf []byte) map[int][]int {
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return nil
+	}
+
+	tables := make(map[int][]int)
+	offset := 2
+	for offset+4 <= len(buf) {
+		if buf[offset] != 0xFF {
+			return tables
+		}
+		marker := buf[offset+1]
+		if marker == 0xFF {
+			offset++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return tables
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[offset+2 : offset+4]))
+		end := offset + 2 + length
+		if length < 2 || end > len(buf) {
+			return tables
+		}
+
+		if marker == 0xDB {
+			segment := buf[offset+4 : end]
+			for len(segment) > 0 {
+				precision, id := int(segment[0]>>4), int(segment[0]&0x0F)
+				size := 64 * (precision + 1)
+				if len(segment) < 1+size {
+					break
+				}
+
+				table := make([]int, 64)
+				for i := range table {
+					if precision == 0 {
+						table[i] = int(segment[1+i])
+					} else {
+						table[i] = int(binary.BigEndian.Uint16(segment[1+2*i:]))
+					}
+				}
+				tables[id] = table
+				segment = segment[1+size:]
+			}
+		}
+		offset = end
+	}
+	return tables
+}
+
+// estimateJPEGQuality estimates the quality factor the JPEG image was
+// encoded with, comparing its quantization tables with the standard ones
+// scaled as the IJG encoder does. It returns 0 for non-JPEG images.
+func estimateJPEGQuality(buf []byte) int {
+	tables := jpegQuantTables(buf)
+
+	sum, reference := 0, 0
+	for id, standard := range standardQuantTables {
+		table, ok := tables[id]
+		if !ok {
+			continue
+		}
+		for i, value := range table {
+			// Clamped values no longer follow the scale
+			if value <= 1 || value >= 255 {
+				continue
+			}
+			sum += value
+			reference += standard[i]
+		}
+	}
+	if len(tables) == 0 {
+		return 0
+	}
+	if reference == 0 {
+		// Every value is clamped, as lowest for the best quality
+		if tables[0] != nil && tables[0][0] <= 1 {
+			return 100
+		}
+		return 1
+	}
+
+	scale := float64(sum) * 100 / float64(reference)
+	quality := 5000 / scale
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	}
+	return int(math.Max(1, math.Min(100, math.Floor(quality+0.5))))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestEstimateJPEGQuality(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+
+	for _, quality := range []int{5, 10, 30, 50, 75, 90, 95, 100} {
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+
+		estimate := estimateJPEGQuality(buf.Bytes())
+		if estimate < quality-2 || estimate > quality+2 {
+			t.Errorf("Invalid quality estimate for %d: %d", quality, estimate)
+		}
+	}
+}
+
+func TestEstimateJPEGQualityNonJPEG(t *testing.T) {
+	if quality := estimateJPEGQuality(stripedPNG(t)); quality != 0 {
+		t.Errorf("Non-JPEG images must have no quality: %d", quality)
+	}
+	if quality := estimateJPEGQuality([]byte{0xFF, 0xD8, 0xFF}); quality != 0 {
+		t.Errorf("Truncated images must have no quality: %d", quality)
+	}
+}
+
+func TestInfoQuality(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, 16, 16)), &jpeg.Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	for source, expected := range map[string]int{"jpeg": 60, "png": 0} {
+		input := buf.Bytes()
+		if source == "png" {
+			input = stripedPNG(t)
+		}
+
+		image, err := Info(input, ImageOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info ImageInfo
+		if err := json.Unmarshal(image.Body, &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Quality < expected-2 || info.Quality > expected+2 {
+			t.Errorf("Invalid %s quality: %d", source, info.Quality)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+)
+
+// decodeRaster normalizes the image to PNG via libvips and decodes it
+// in Go, so pixel-level operations not exposed by bimg can be applied.
+func decodeRaster(buf []byte) (*image.NRGBA, error) {
+	if bimg.DetermineImageType(buf) != bimg.PNG {
+		out, err := Process(buf, bimg.Options{Type: bimg.PNG})
+		if err != nil {
+			return nil, err
+		}
+		buf = out.Body
+	}
+
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	return toNRGBA(img), nil
+}
+
+// encodeRaster encodes the image as PNG, converting it afterwards via
+// libvips if a different output type was requested.
+func encodeRaster(img image.Image, o ImageOptions) (Image, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return Image{}, err
+	}
+
+	if o.Type == "" || ImageType(o.Type) == bimg.PNG {
+		return Image{Body: buf.Bytes(), Mime: "image/png"}, nil
+	}
+
+	return Process(buf.Bytes(), bimg.Options{
+		Type:        ImageType(o.Type),
+		Quality:     o.Quality,
+		Compression: o.Compression,
+		Interlace:   isProgressiveScan(o.Scan),
+	})
+}
+
+// keepImageType defines the input image type as output type, unless a
+// different one is requested, falling back to JPEG for input types which
+// cannot be encoded.
+func keepImageType(buf []byte, o ImageOptions) ImageOptions {
+	if o.Type == "" {
+		o.Type = bimg.DetermineImageTypeName(buf)
+		if ImageType(o.Type) == bimg.UNKNOWN {
+			o.Type = "jpeg"
+		}
+	}
+	return o
+}
+
+// toNRGBA copies the image into a non-premultiplied RGBA image,
+// preserving the color of fully transparent pixels.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
+	}
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			out.SetNRGBA(x-bounds.Min.X, y-bounds.Min.Y, nrgbaAt(img, x, y))
+		}
+	}
+	return out
+}
+
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	// 16-bit PNGs decode as NRGBA64, which must not go through the
+	// premultiplied conversion to keep the color of transparent pixels
+	if wide, ok := img.(*image.NRGBA64); ok {
+		c := wide.NRGBA64At(x, y)
+		return color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)}
+	}
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func colorAlpha(opacity float64) color.Alpha {
+	return color.Alpha{uint8(opacity * 255)}
+}
+
+func invertColors(img *image.NRGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255 - img.Pix[i]
+		img.Pix[i+1] = 255 - img.Pix[i+1]
+		img.Pix[i+2] = 255 - img.Pix[i+2]
+	}
+}
+
+func invertAlpha(img *image.NRGBA) {
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255 - img.Pix[i]
+	}
+}
+
+// premultiplyAlpha scales the color channels by the alpha channel, storing
+// premultiplied values in the non-premultiplied image buffer.
+func premultiplyAlpha(img *image.NRGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = uint8((uint32(img.Pix[i+c])*a + 127) / 255)
+		}
+	}
+}
+
+func unpremultiplyAlpha(img *image.NRGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			if a == 0 {
+				img.Pix[i+c] = 0
+				continue
+			}
+			value := (uint32(img.Pix[i+c])*255 + a/2) / a
+			if value > 255 {
+				value = 255
+			}
+			img.Pix[i+c] = uint8(value)
+		}
+	}
+}
+
+// posterize quantizes each color channel to the given number of evenly
+// spaced levels, keeping the alpha channel.
+func posterize(img *image.NRGBA, levels int) {
+	var table [256]uint8
+	step := 255 / float64(levels-1)
+	for i := range table {
+		table[i] = uint8(math.Floor(float64(i)/step+0.5)*step + 0.5)
+	}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = table[img.Pix[i]]
+		img.Pix[i+1] = table[img.Pix[i+1]]
+		img.Pix[i+2] = table[img.Pix[i+2]]
+	}
+}
+
+// gaussianBlur blurs the image with a separable gaussian kernel, clamping
+// the samples at the image edges.
+func gaussianBlur(img *image.NRGBA, sigma float64) *image.NRGBA {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	bounds := img.Bounds()
+	horizontal := convolve(img, kernel, image.Pt(1, 0), bounds)
+	return convolve(horizontal, kernel, image.Pt(0, 1), bounds)
+}
+
+func convolve(img *image.NRGBA, kernel []float64, axis image.Point, bounds image.Rectangle) *image.NRGBA {
+	radius := len(kernel) / 2
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var acc [4]float64
+			for k, weight := range kernel {
+				sx := clampInt(x+(k-radius)*axis.X, bounds.Min.X, bounds.Max.X-1)
+				sy := clampInt(y+(k-radius)*axis.Y, bounds.Min.Y, bounds.Max.Y-1)
+				i := img.PixOffset(sx, sy)
+				alpha := float64(img.Pix[i+3])
+				// Weight colors by alpha to avoid dark halos around transparent areas
+				for c := 0; c < 3; c++ {
+					acc[c] += float64(img.Pix[i+c]) * alpha * weight
+				}
+				acc[3] += alpha * weight
+			}
+			i := out.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				if acc[3] > 0 {
+					out.Pix[i+c] = uint8(math.Min(255, acc[c]/acc[3]+0.5))
+				}
+			}
+			out.Pix[i+3] = uint8(math.Min(255, acc[3]+0.5))
+		}
+	}
+	return out
+}
+
+func clampInt(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+func TestInvertAlphaChannel(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{10, 20, 30, 255})
+
+	invertAlpha(img)
+
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			t.Fatalf("Pixel should be fully transparent: %d", img.Pix[i])
+		}
+	}
+	if c := img.NRGBAAt(0, 0); c.R != 10 || c.G != 20 || c.B != 30 {
+		t.Fatalf("Color must be preserved: %#v", c)
+	}
+}
+
+func TestInvertColors(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 100, 255, 128})
+
+	invertColors(img)
+
+	if c := img.NRGBAAt(0, 0); c != (color.NRGBA{255, 155, 0, 128}) {
+		t.Fatalf("Invalid inverted color: %#v", c)
+	}
+}
+
+func TestToNRGBAPreservesTransparentColor(t *testing.T) {
+	src := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	src.SetNRGBA64(0, 0, color.NRGBA64{0xffff, 0, 0, 0})
+
+	out := toNRGBA(src)
+	if c := out.NRGBAAt(0, 0); c.R != 255 || c.A != 0 {
+		t.Fatalf("Invalid converted color: %#v", c)
+	}
+}
+
+func TestPremultiplyAlphaRoundTrip(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{200, 100, 50, 128})
+	img.SetNRGBA(2, 0, color.NRGBA{200, 100, 50, 0})
+
+	premultiplyAlpha(img)
+	if c := img.NRGBAAt(1, 0); c.R != 100 || c.G != 50 || c.B != 25 {
+		t.Fatalf("Invalid premultiplied color: %#v", c)
+	}
+	if c := img.NRGBAAt(2, 0); c.R != 0 || c.G != 0 || c.B != 0 {
+		t.Fatalf("Transparent pixel must be black once premultiplied: %#v", c)
+	}
+
+	unpremultiplyAlpha(img)
+	for x := 0; x < 2; x++ {
+		c := img.NRGBAAt(x, 0)
+		if c.R < 199 || c.R > 201 || c.G < 99 || c.G > 101 || c.B < 49 || c.B > 51 {
+			t.Fatalf("Invalid unpremultiplied color: %#v", c)
+		}
+	}
+}
+
+func TestPosterize(t *testing.T) {
+	gradient := image.NewNRGBA(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		gradient.SetNRGBA(x, 0, color.NRGBA{uint8(x), uint8(255 - x), uint8(x / 2), 255})
+	}
+	buf := encodeTestPNG(t, gradient)
+
+	for _, levels := range []int{2, 4, 16, 256} {
+		image, err := Posterize(buf, ImageOptions{Levels: levels})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeRaster(image.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		channels := []map[uint8]bool{{}, {}, {}}
+		for x := 0; x < 256; x++ {
+			c := img.NRGBAAt(x, 0)
+			channels[0][c.R], channels[1][c.G], channels[2][c.B] = true, true, true
+		}
+		for i, values := range channels {
+			if len(values) > levels {
+				t.Errorf("Channel %d has %d values for %d levels", i, len(values), levels)
+			}
+		}
+		if levels == 256 && len(channels[0]) != 256 {
+			t.Errorf("256 levels must keep the image untouched")
+		}
+		if c := img.NRGBAAt(0, 0); c.R != 0 || c.G != 255 {
+			t.Errorf("Channel bounds must be preserved: %v", c)
+		}
+	}
+}
+
+func TestPosterizeLevelsParam(t *testing.T) {
+	for _, levels := range []string{"1", "257"} {
+		if err := validateParams(url.Values{"levels": []string{levels}}); err == nil {
+			t.Errorf("Invalid levels accepted: %s", levels)
+		}
+	}
+
+	buf, _ := ioutil.ReadFile("fixtures/test.png")
+	if _, err := Posterize(buf, ImageOptions{}); err == nil {
+		t.Error("Missing levels must be rejected")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// Longer incoming request IDs are replaced by a generated one
+const maxRequestIDLength = 128
+
+// requestIDHeader is the request and response header carrying the request
+// ID, read by the access log and error replies.
+var requestIDHeader = defaultRequestIDHeader
+
+// setRequestID replies the incoming request ID, or a generated one if it
+// is missing or invalid, so requests can be traced from the client to the
+// access log.
+func setRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if isValidRequestID(id) == false {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isValidRequestID only accepts IDs safe to be written to the logs.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
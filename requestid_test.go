@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDCustomHeader(t *testing.T) {
+	defer func() { requestIDHeader = defaultRequestIDHeader }()
+
+	var lines []string
+	writer := fakeWriter(func(b []byte) (int, error) {
+		lines = append(lines, string(b))
+		return len(b), nil
+	})
+
+	ts := httptest.NewServer(NewLog(NewServerMux(ServerOptions{RequestIDHeader: "X-Correlation-ID"}), writer))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/resize?width=100", nil)
+	req.Header.Set("X-Correlation-ID", "abc-123")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if id := res.Header.Get("X-Correlation-ID"); id != "abc-123" {
+		t.Errorf("Invalid response request ID: %s", id)
+	}
+	if id := res.Header.Get("X-Request-ID"); id != "" {
+		t.Errorf("The default request ID header must not be used: %s", id)
+	}
+
+	var reply Error
+	json.NewDecoder(res.Body).Decode(&reply)
+	if reply.RequestID != "abc-123" {
+		t.Errorf("Invalid error reply request ID: %#v", reply)
+	}
+
+	if len(lines) != 1 || strings.HasSuffix(lines[0], " abc-123\n") == false {
+		t.Errorf("Invalid log output: %v", lines)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	ts := httptest.NewServer(NewServerMux(ServerOptions{}))
+	defer ts.Close()
+
+	for _, incoming := range []string{"", "invalid id", strings.Repeat("a", 200)} {
+		req, _ := http.NewRequest("GET", ts.URL+"/health", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-ID", incoming)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		id := res.Header.Get("X-Request-ID")
+		if len(id) != 32 || id == incoming {
+			t.Errorf("Invalid generated request ID for %q: %s", incoming, id)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// rotateArbitrary rotates the image clockwise by an angle which is not a
+// multiple of 90, which libvips cannot rotate, enlarging the canvas to fit
+// the rotated image. The exposed corners are transparent for output types
+// supporting it, unless the background color is defined, which is also
+// used for the other types, defaulting to white.
+func rotateArbitrary(buf []byte, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	o = keepImageType(buf, o)
+	rotated := rotateImage(img, float64(o.Rotate))
+
+	if o.Background != "" {
+		rotated = flattenBackground(rotated, backgroundColor(img, o.Background))
+	} else if isTransparentType(o.Type) == false {
+		rotated = flattenBackground(rotated, color.NRGBA{255, 255, 255, 255})
+	}
+	return encodeRaster(rotated, o)
+}
+
+// rotateImage returns the image rotated clockwise by the given degrees,
+// bilinearly interpolated, on a transparent canvas fitting its bounds.
+func rotateImage(img *image.NRGBA, degrees float64) *image.NRGBA {
+	angle := degrees * math.Pi / 180
+	sin, cos := math.Sin(angle), math.Cos(angle)
+
+	bounds := img.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	// The tolerance avoids an extra pixel due to rounding errors
+	width := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin) - 1e-9))
+	height := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos) - 1e-9))
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// Source position of the pixel center, via the inverse rotation
+			dx, dy := float64(x)+0.5-float64(width)/2, float64(y)+0.5-float64(height)/2
+			sx := cos*dx + sin*dy + w/2 - 0.5
+			sy := -sin*dx + cos*dy + h/2 - 0.5
+			out.SetNRGBA(x, y, bilinearAt(img, sx, sy))
+		}
+	}
+	return out
+}
+
+// bilinearAt interpolates the premultiplied colors of the four pixels
+// around the position, taking the pixels out of the image as transparent.
+func bilinearAt(img *image.NRGBA, x, y float64) color.NRGBA {
+	bounds := img.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var r, g, b, a float64
+	for _, p := range [4]struct {
+		x, y   int
+		weight float64
+	}{
+		{x0, y0, (1 - fx) * (1 - fy)},
+		{x0 + 1, y0, fx * (1 - fy)},
+		{x0, y0 + 1, (1 - fx) * fy},
+		{x0 + 1, y0 + 1, fx * fy},
+	} {
+		px, py := bounds.Min.X+p.x, bounds.Min.Y+p.y
+		if p.weight == 0 || image.Pt(px, py).In(bounds) == false {
+			continue
+		}
+		c := img.NRGBAAt(px, py)
+		alpha := float64(c.A) * p.weight
+		r += float64(c.R) * alpha
+		g += float64(c.G) * alpha
+		b += float64(c.B) * alpha
+		a += alpha
+	}
+
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{uint8(r/a + 0.5), uint8(g/a + 0.5), uint8(b/a + 0.5), uint8(math.Min(255, a+0.5))}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestRotateImage(t *testing.T) {
+	img := opaqueImage(100, 50)
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+
+	// Right angles keep every pixel, rotated clockwise
+	rotated := rotateImage(img, 90)
+	if rotated.Bounds().Dx() != 50 || rotated.Bounds().Dy() != 100 {
+		t.Fatalf("Invalid rotated size: %v", rotated.Bounds())
+	}
+	if c := rotated.NRGBAAt(49, 0); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("The top left pixel must be rotated to the top right: %v", c)
+	}
+
+	rotated = rotateImage(img, 45)
+	if rotated.Bounds().Dx() != 107 || rotated.Bounds().Dy() != 107 {
+		t.Fatalf("Invalid rotated size: %v", rotated.Bounds())
+	}
+	for _, corner := range [][2]int{{0, 0}, {106, 0}, {0, 106}, {106, 106}} {
+		if c := rotated.NRGBAAt(corner[0], corner[1]); c.A != 0 {
+			t.Errorf("Corner pixel must be transparent: %v %v", corner, c)
+		}
+	}
+	if c := rotated.NRGBAAt(53, 53); c != (color.NRGBA{0, 0, 255, 255}) {
+		t.Errorf("Center pixel must be kept: %v", c)
+	}
+}
+
+func TestRotateArbitrary(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 80, 40))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{0, 200, 0, 160})
+	}
+	buf := encodeTestPNG(t, img)
+
+	cases := []struct {
+		opts   ImageOptions
+		corner color.NRGBA
+	}{
+		{ImageOptions{Rotate: 30}, color.NRGBA{}},
+		{ImageOptions{Rotate: 30, Type: "jpeg"}, color.NRGBA{255, 255, 255, 255}},
+		{ImageOptions{Rotate: 30, Type: "jpeg", Background: "255,0,0"}, color.NRGBA{255, 0, 0, 255}},
+		{ImageOptions{Rotate: 30, Background: "255,0,0"}, color.NRGBA{255, 0, 0, 255}},
+	}
+
+	for _, test := range cases {
+		image, err := Rotate(buf, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated, err := decodeRaster(image.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := rotated.NRGBAAt(0, 0)
+		if test.corner.A == 0 && c.A != 0 {
+			t.Errorf("Corner pixel must be transparent for %#v: %v", test.opts, c)
+		}
+		if test.corner.A != 0 && (c.A != 255 || absInt(int(c.R)-int(test.corner.R)) > 8 || absInt(int(c.G)-int(test.corner.G)) > 8 || absInt(int(c.B)-int(test.corner.B)) > 8) {
+			t.Errorf("Invalid corner pixel for %#v: %v", test.opts, c)
+		}
+	}
+}
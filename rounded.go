@@ -0,0 +1,75 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// applyRoundedCorners masks the corners of the processed image with the
+// roundedcorners radius, clamped to half the smallest side, which turns
+// square images into circles. Output types without transparency are only
+// allowed with a background color, which the corners are flattened over.
+func applyRoundedCorners(image Image, o ImageOptions) (Image, error) {
+	if o.RoundedCorners <= 0 {
+		return image, nil
+	}
+
+	if o.Type == "" {
+		o.Type = bimg.DetermineImageTypeName(image.Body)
+		if isTransparentType(o.Type) == false {
+			o.Type = "png"
+		}
+	}
+	if isTransparentType(o.Type) == false && o.Background == "" {
+		return Image{}, NewError("Rounded corners output image type must support transparency (png or webp), or define a background color", BadRequest)
+	}
+
+	img, err := decodeRaster(image.Body)
+	if err != nil {
+		return Image{}, err
+	}
+	maskRoundedCorners(img, o.RoundedCorners)
+
+	if isTransparentType(o.Type) == false {
+		img = flattenBackground(img, backgroundColor(img, o.Background))
+	}
+	return encodeRaster(img, o)
+}
+
+func isTransparentType(name string) bool {
+	return ImageType(name) == bimg.PNG || ImageType(name) == bimg.WEBP
+}
+
+// maskRoundedCorners makes transparent the pixels outside the corner arcs
+// of the given radius, antialiasing the edge.
+func maskRoundedCorners(img *image.NRGBA, radius int) {
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	r := math.Min(float64(radius), math.Min(width, height)/2)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Distance to the nearest arc center, which is 0 out of the corners
+			px, py := float64(x-bounds.Min.X)+0.5, float64(y-bounds.Min.Y)+0.5
+			dx := px - math.Max(r, math.Min(width-r, px))
+			dy := py - math.Max(r, math.Min(height-r, py))
+			if dx == 0 && dy == 0 {
+				continue
+			}
+
+			i := img.PixOffset(x, y)
+			img.Pix[i+3] = uint8(float64(img.Pix[i+3]) * clampUnit(r-math.Sqrt(dx*dx+dy*dy)+0.5))
+		}
+	}
+}
+
+// flattenBackground composites the image over the background color.
+func flattenBackground(img *image.NRGBA, background color.NRGBA) *image.NRGBA {
+	canvas := image.NewNRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+	return canvas
+}
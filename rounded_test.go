@@ -0,0 +1,81 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"testing"
+)
+
+func opaqueImage(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+	return img
+}
+
+func TestMaskRoundedCorners(t *testing.T) {
+	img := opaqueImage(100, 60)
+	maskRoundedCorners(img, 20)
+
+	for _, corner := range [][2]int{{0, 0}, {99, 0}, {0, 59}, {99, 59}, {3, 3}} {
+		if c := img.NRGBAAt(corner[0], corner[1]); c.A != 0 {
+			t.Errorf("Corner pixel must be transparent: %v %v", corner, c)
+		}
+	}
+	for _, inner := range [][2]int{{50, 0}, {0, 30}, {50, 30}, {15, 15}} {
+		if c := img.NRGBAAt(inner[0], inner[1]); c.A != 255 {
+			t.Errorf("Inner pixel must be opaque: %v %v", inner, c)
+		}
+	}
+}
+
+func TestMaskRoundedCornersClamp(t *testing.T) {
+	// Radius over half the side masks a circle
+	rounded, circle := opaqueImage(50, 50), opaqueImage(50, 50)
+	maskRoundedCorners(rounded, 1000)
+	maskCircle(circle, 0, color.NRGBA{})
+
+	for i := range rounded.Pix {
+		if rounded.Pix[i] != circle.Pix[i] {
+			t.Fatalf("Clamped radius must mask a circle at byte %d: %d != %d", i, rounded.Pix[i], circle.Pix[i])
+		}
+	}
+}
+
+func TestRoundedCorners(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	source, _ := Resize(buf, ImageOptions{Width: 100, Height: 100})
+
+	if image, err := applyRoundedCorners(source, ImageOptions{}); err != nil || &image.Body[0] != &source.Body[0] {
+		t.Error("A radius of 0 must leave the image untouched")
+	}
+
+	image, err := applyRoundedCorners(source, ImageOptions{RoundedCorners: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/png" {
+		t.Fatalf("JPEG images must be output as PNG: %s", image.Mime)
+	}
+	img, _ := decodeRaster(image.Body)
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Errorf("Corner pixel must be transparent: %v", c)
+	}
+
+	if _, err := applyRoundedCorners(source, ImageOptions{RoundedCorners: 10, Type: "jpeg"}); err == nil {
+		t.Error("JPEG output without background must be rejected")
+	}
+
+	image, err = applyRoundedCorners(source, ImageOptions{RoundedCorners: 10, Type: "jpeg", Background: "255,0,0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Fatalf("Invalid image type: %s", image.Mime)
+	}
+	img, _ = decodeRaster(image.Body)
+	if c := img.NRGBAAt(0, 0); c.R < 240 || c.G > 15 || c.B > 15 {
+		t.Errorf("Corner pixel must be flattened over the background: %v", c)
+	}
+}
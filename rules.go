@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+)
+
+// Rule defines default transform params applied when the source image
+// dimensions match all the defined conditions.
+type Rule struct {
+	WidthAbove  int               `json:"widthAbove"`
+	WidthBelow  int               `json:"widthBelow"`
+	HeightAbove int               `json:"heightAbove"`
+	HeightBelow int               `json:"heightBelow"`
+	Params      map[string]string `json:"params"`
+}
+
+// Matches reports whether the source image dimensions satisfy the rule.
+func (r Rule) Matches(width, height int) bool {
+	if r.WidthAbove > 0 && width <= r.WidthAbove {
+		return false
+	}
+	if r.WidthBelow > 0 && width >= r.WidthBelow {
+		return false
+	}
+	if r.HeightAbove > 0 && height <= r.HeightAbove {
+		return false
+	}
+	if r.HeightBelow > 0 && height >= r.HeightBelow {
+		return false
+	}
+	return true
+}
+
+// LoadRules reads an ordered JSON list of rules from the given file.
+func LoadRules(path string) ([]Rule, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// applyRules sets the params of the first rule matching the source image
+// dimensions, unless the request already defines them.
+func applyRules(rules []Rule, query url.Values, buf []byte) url.Values {
+	if len(rules) == 0 {
+		return query
+	}
+
+	width, height, ok := sourceDimensions(buf)
+	if !ok {
+		return query
+	}
+
+	for _, rule := range rules {
+		if rule.Matches(width, height) == false {
+			continue
+		}
+		for key, value := range rule.Params {
+			if query.Get(key) == "" {
+				query.Set(key, value)
+			}
+		}
+		break
+	}
+	return query
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	cases := []struct {
+		rule     Rule
+		width    int
+		height   int
+		expected bool
+	}{
+		{Rule{WidthAbove: 2000}, 2400, 100, true},
+		{Rule{WidthAbove: 2000}, 2000, 100, false},
+		{Rule{WidthBelow: 500}, 400, 100, true},
+		{Rule{HeightAbove: 1000, WidthAbove: 1000}, 2000, 800, false},
+		{Rule{HeightBelow: 1000}, 2000, 800, true},
+		{Rule{}, 10, 10, true},
+	}
+
+	for i, test := range cases {
+		if test.rule.Matches(test.width, test.height) != test.expected {
+			t.Errorf("Invalid rule match for case %d", i)
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	rules := []Rule{
+		{WidthAbove: 3000, Params: map[string]string{"width": "2000"}},
+		{WidthAbove: 1000, Params: map[string]string{"width": "800", "type": "png"}},
+		{Params: map[string]string{"width": "100"}},
+	}
+
+	query := applyRules(rules, url.Values{}, buf)
+	if query.Get("width") != "800" || query.Get("type") != "png" {
+		t.Errorf("Invalid rule params: %v", query)
+	}
+
+	query = applyRules(rules, url.Values{"width": []string{"300"}}, buf)
+	if query.Get("width") != "300" || query.Get("type") != "png" {
+		t.Errorf("Request params must override rules: %v", query)
+	}
+
+	query = applyRules(rules[:1], url.Values{}, buf)
+	if len(query) != 0 {
+		t.Errorf("Unmatched rules must not set params: %v", query)
+	}
+}
+
+func TestRulesResize(t *testing.T) {
+	rules := []Rule{{WidthAbove: 1000, Params: map[string]string{"width": "320"}}}
+	ts := testServer(optionsController(Resize, ServerOptions{Rules: rules}))
+	defer ts.Close()
+
+	image := postImage(t, ts.URL, "large.jpg")
+	if err := assertSize(image, 320, 180); err != nil {
+		t.Error(err)
+	}
+
+	image = postImage(t, ts.URL+"?width=640", "large.jpg")
+	if err := assertSize(image, 640, 360); err != nil {
+		t.Error(err)
+	}
+
+	rules[0].WidthAbove = 2000
+	ts2 := testServer(optionsController(Resize, ServerOptions{Rules: rules}))
+	defer ts2.Close()
+
+	image = postImage(t, ts2.URL, "large.jpg")
+	if err := assertSize(image, 1920, 1080); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+// JPEG scan modes requested via the scan param
+const (
+	scanBaseline    = "baseline"
+	scanProgressive = "progressive"
+	scanEarlyColor  = "earlycolor"
+)
+
+func isValidScan(value string) bool {
+	return value == scanBaseline || value == scanProgressive || value == scanEarlyColor
+}
+
+// resolveScan returns the scan mode supported by the libvips bindings:
+// custom scan scripts, such as sending the color scans first, cannot be
+// defined, so the early color mode falls back to the default progressive
+// script of libjpeg, which already sends a coarse color scan first.
+func resolveScan(scan string) (string, bool) {
+	if scan == scanEarlyColor {
+		return scanProgressive, true
+	}
+	return scan, false
+}
+
+// interlaceScan maps the interlace param to the scan mode, which is
+// progressive JPEG and interlaced PNG output.
+func interlaceScan(interlace bool) string {
+	if interlace {
+		return scanProgressive
+	}
+	return ""
+}
+
+func isProgressiveScan(scan string) bool {
+	return scan == scanProgressive || scan == scanEarlyColor
+}
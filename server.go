@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -8,25 +10,86 @@ import (
 )
 
 type ServerOptions struct {
-	Port             int
-	Burst            int
-	Concurrency      int
-	HttpCacheTtl     int
-	HttpReadTimeout  int
-	HttpWriteTimeout int
-	CORS             bool
-	Gzip             bool
-	EnableURLSource  bool
-	Address          string
-	ApiKey           string
-	Mount            string
-	CertFile         string
-	KeyFile          string
+	Port                int
+	Burst               int
+	Concurrency         int
+	HttpCacheTtl        int
+	HttpReadTimeout     int
+	HttpWriteTimeout    int
+	MaxFrameConcurrency int
+	MaxBatchConcurrency int
+	CORS                bool
+	Gzip                bool
+	EnableURLSource     bool
+	S3Endpoint          string
+	S3Region            string
+	S3AccessKey         string
+	S3SecretKey         string
+	Address             string
+	ApiKey              string
+	TenantConcurrency   int
+	TenantRate          int
+	Mount               string
+	CertFile            string
+	KeyFile             string
+	WatermarkText       string
+	WatermarkImage      []byte
+	WatermarkOpacity    float64
+	MaxConcurrent       int
+	MaxQueue            int
+	MaxQueueWait        time.Duration
+	StrictDimensions    bool
+	BasicAuthUser       string
+	BasicAuthPassword   string
+	BasicAuthHosts      []string
+	OperationTimeouts   OperationTimeouts
+	MaxPixels           int
+	SourceDefaultTypes  SourceDefaultTypes
+	Rules               []Rule
+	StrictAnimation     bool
+	MaxUpscale          float64
+	RejectUpscale       bool
+	SourceFetchRetries  int
+	LUTDir              string
+	SourceTLSConfig     *tls.Config
+	QualityScale        int
+	ICCDir              string
+	SRGB                bool
+	FormatFallback      []string
+	FormatPreference    []string
+	LogExcludedPaths    []string
+	Cache               *ImageCache
+	CacheMaxSourceSize  int64
+	MaxConnections      int
+	Profiles            Profiles
+	MaxBodySize         int64
+	RequestIDHeader     string
+	WatermarkDir        string
+	Pressure            *PressureMonitor
+	DecodeTimeout       time.Duration
+	HttpSourceTimeout   time.Duration
+	BodyContentTypes    []string
+	RequestDeadline     time.Duration
+	AllowedOrigins      []string
+	AllowPrivateIPs     bool
+	DisableBodySource   bool
+	AutoFormat          bool
+	AllowedHashes       ImageHashes
+	DefaultImage        []byte
+	DefaultImageStatus  int
+	FallbackImage       []byte
+	MaxBodyMemory       int64
+	CMYKMode            string
+	URLSignatureKey     string
+	URLSignatureExempt  []string
+	MaxOutputBytes      int
+	MaxQualityAttempts  int
+	MaxVipsMemory       int
 }
 
 func Server(o ServerOptions) error {
 	addr := o.Address + ":" + strconv.Itoa(o.Port)
-	handler := NewLog(NewServerMux(o), os.Stdout)
+	handler := NewLog(NewServerMux(o), os.Stdout, o.LogExcludedPaths...)
 
 	server := &http.Server{
 		Addr:           addr,
@@ -40,20 +103,46 @@ func Server(o ServerOptions) error {
 }
 
 func listenAndServe(s *http.Server, o ServerOptions) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if o.MaxConnections > 0 {
+		listener = LimitListener(listener, o.MaxConnections)
+	}
+
 	if o.CertFile != "" && o.KeyFile != "" {
-		return s.ListenAndServeTLS(o.CertFile, o.KeyFile)
+		return s.ServeTLS(listener, o.CertFile, o.KeyFile)
 	}
-	return s.ListenAndServe()
+	return s.Serve(listener)
 }
 
 func NewServerMux(o ServerOptions) http.Handler {
+	requestIDHeader = coalesceString(o.RequestIDHeader, defaultRequestIDHeader)
 	mux := http.NewServeMux()
 
 	mux.Handle("/", Middleware(indexController, o))
 	mux.Handle("/form", Middleware(formController, o))
-	mux.Handle("/health", Middleware(healthController, o))
+	mux.Handle("/health", Middleware(healthController(o), o))
+	mux.Handle("/live", Middleware(livenessController, o))
+	mux.Handle("/ready", Middleware(readyController, o))
 
-	image := ImageMiddleware(o)
+	// Endpoints processing images share the processing and tenant limits
+	limited := LimitedMiddleware(o)
+
+	if o.ApiKey != "" && o.Cache != nil {
+		mux.Handle("/precompute", limited(precomputeController(o), maxPrecomputeConcurrency))
+	}
+	if o.Cache != nil {
+		mux.Handle("/cache/stats", Middleware(cacheStatsController(o), o))
+	}
+
+	mux.Handle("/contactsheet", validateImage(limited(contactSheetController(o), 1), o))
+	mux.Handle("/composite", validateImage(limited(compositeController(o), 1), o))
+	mux.Handle("/transform", limited(transformController(o), 1))
+
+	weighted := WeightedImageMiddleware(o, limited)
+	image := func(fn Operation) http.Handler { return weighted(fn, 1) }
 	mux.Handle("/resize", image(Resize))
 	mux.Handle("/enlarge", image(Enlarge))
 	mux.Handle("/extract", image(Extract))
@@ -65,7 +154,23 @@ func NewServerMux(o ServerOptions) http.Handler {
 	mux.Handle("/zoom", image(Zoom))
 	mux.Handle("/convert", image(Convert))
 	mux.Handle("/watermark", image(Watermark))
-	mux.Handle("/info", image(Info))
+	mux.Handle("/stamp", image(Stamp))
+	mux.Handle("/watermarkimage", image(WatermarkImage))
+	mux.Handle("/invert", image(Invert))
+	mux.Handle("/lut", image(Lut))
+	mux.Handle("/blur", image(Blur))
+	mux.Handle("/posterize", image(Posterize))
+	mux.Handle("/removeborder", image(RemoveBorder))
+	mux.Handle("/circle", image(Circle))
+	mux.Handle("/pipeline", image(Pipeline))
+	// Batches process up to -max-batch-concurrency renditions at once
+	batchWeight := o.MaxBatchConcurrency
+	if batchWeight < 1 {
+		batchWeight = 1
+	}
+	mux.Handle("/batch", weighted(batchOperation(o), batchWeight))
+	mux.Handle("/info", weighted(Info, 0))
+	mux.Handle("/colors", image(Colors))
 
-	return mux
+	return setRequestID(mux)
 }
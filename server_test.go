@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -169,7 +177,7 @@ func TestExtract(t *testing.T) {
 }
 
 func TestRemoteHTTPSource(t *testing.T) {
-	opts := ServerOptions{EnableURLSource: true}
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true}
 	fn := ImageMiddleware(opts)(Crop)
 	LoadSources(opts)
 
@@ -209,8 +217,48 @@ func TestRemoteHTTPSource(t *testing.T) {
 	}
 }
 
+func TestRemoteHTTPSourceDisabled(t *testing.T) {
+	fetched := 0
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetched++
+		buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	opts := ServerOptions{S3Endpoint: tsImage.URL, AllowPrivateIPs: true}
+	LoadSources(opts)
+	ts := httptest.NewServer(ImageMiddleware(opts)(Crop))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=200&url=" + tsImage.URL)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 405 {
+		t.Errorf("Invalid response status: %d", res.StatusCode)
+	}
+
+	// Sources matched without the middleware are gated as well
+	req, _ := http.NewRequest("GET", "http://foo/bar?url="+tsImage.URL, nil)
+	if source := MatchSource(req); source != nil {
+		t.Errorf("Unexpected image source: %T", source)
+	}
+	if fetched != 0 {
+		t.Errorf("Remote image fetched %d times", fetched)
+	}
+
+	// Requests defining several sources are ambiguous
+	opts.EnableURLSource = true
+	LoadSources(opts)
+	req, _ = http.NewRequest("GET", "http://foo/bar?url="+tsImage.URL+"&s3=images/large.jpg", nil)
+	if source := MatchSource(req); source != nil {
+		t.Errorf("Unexpected image source: %T", source)
+	}
+}
+
 func TestInvalidRemoteHTTPSource(t *testing.T) {
-	opts := ServerOptions{EnableURLSource: true}
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true}
 	fn := ImageMiddleware(opts)(Crop)
 	LoadSources(opts)
 
@@ -268,7 +316,10 @@ func TestMountDirectory(t *testing.T) {
 }
 
 func TestMountInvalidDirectory(t *testing.T) {
-	fn := ImageMiddleware(ServerOptions{Mount: "_invalid_"})(Crop)
+	opts := ServerOptions{Mount: "_invalid_"}
+	fn := ImageMiddleware(opts)(Crop)
+	LoadSources(opts)
+
 	ts := httptest.NewServer(fn)
 	url := ts.URL + "?top=100&left=100&areawidth=200&areaheight=120&file=large.jpg"
 	defer ts.Close()
@@ -284,7 +335,10 @@ func TestMountInvalidDirectory(t *testing.T) {
 }
 
 func TestMountInvalidPath(t *testing.T) {
-	fn := ImageMiddleware(ServerOptions{Mount: "_invalid_"})(Crop)
+	opts := ServerOptions{Mount: "_invalid_"}
+	fn := ImageMiddleware(opts)(Crop)
+	LoadSources(opts)
+
 	ts := httptest.NewServer(fn)
 	url := ts.URL + "?top=100&left=100&areawidth=200&areaheight=120&file=../../large.jpg"
 	defer ts.Close()
@@ -299,10 +353,227 @@ func TestMountInvalidPath(t *testing.T) {
 	}
 }
 
+func TestDefaultImage(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	opts := ServerOptions{Mount: "fixtures", DefaultImage: buf, Cache: NewImageCache(10)}
+	LoadSources(opts)
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=100&height=100&file=missing.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	image, _ := ioutil.ReadAll(res.Body)
+	if err := assertSize(image, 100, 100); err != nil {
+		t.Error(err)
+	}
+	if opts.Cache.Len() != 0 {
+		t.Error("Default image outputs must not be cached")
+	}
+
+	// Existing images are processed as usual
+	res, err = http.Get(ts.URL + "?width=100&height=100&file=large.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	image, _ = ioutil.ReadAll(res.Body)
+	if bytes.Equal(image, buf) || res.StatusCode != 200 {
+		t.Errorf("Invalid response for an existing image: %s", res.Status)
+	}
+}
+
+func TestDefaultImageStatus(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true, DefaultImage: buf, DefaultImageStatus: 404}
+	LoadSources(opts)
+
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer tsImage.Close()
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=100&height=100&url=" + tsImage.URL)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 404 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	image, _ := ioutil.ReadAll(res.Body)
+	if err := assertSize(image, 100, 100); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFallbackImage(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/imaginary.jpg")
+	errorImage, _ := ioutil.ReadFile("fixtures/large.jpg")
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true, FallbackImage: buf, Cache: NewImageCache(10)}
+	LoadSources(opts)
+
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/error.jpg" {
+			w.Write(errorImage)
+			return
+		}
+		w.WriteHeader(500)
+	}))
+	defer tsImage.Close()
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	cases := []struct {
+		query    string
+		fallback string
+	}{
+		{"", "fallback-image"},
+		{"&errorimage=" + tsImage.URL + "/error.jpg", "errorimage"},
+		// Error images failing to load are replaced by the fallback one
+		{"&errorimage=" + tsImage.URL + "/missing.jpg", "fallback-image"},
+	}
+
+	for _, test := range cases {
+		res, err := http.Get(ts.URL + "?width=100&height=100&url=" + tsImage.URL + "/broken.jpg" + test.query)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status for %s: %s", test.query, res.Status)
+		}
+		if res.Header.Get(fallbackImageHeader) != test.fallback {
+			t.Errorf("Invalid fallback header for %s: %s", test.query, res.Header.Get(fallbackImageHeader))
+		}
+
+		image, _ := ioutil.ReadAll(res.Body)
+		if err := assertSize(image, 100, 100); err != nil {
+			t.Error(err)
+		}
+	}
+	if opts.Cache.Len() != 0 {
+		t.Error("Fallback image outputs must not be cached")
+	}
+
+	// Without a loadable fallback image the source error is replied
+	opts.FallbackImage = nil
+	ts = httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=100&url=" + tsImage.URL + "/broken.jpg&errorimage=" + tsImage.URL + "/missing.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 400 || res.Header.Get(fallbackImageHeader) != "" {
+		t.Errorf("The source error must be replied: %s", res.Status)
+	}
+}
+
+func TestProgressiveScan(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	encode := func(scan string) ([]byte, *http.Response) {
+		res, err := http.Post(ts.URL+"?width=300&scan="+scan, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status for %s scan: %s", scan, res.Status)
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		if _, err := jpeg.Decode(bytes.NewReader(buf)); err != nil {
+			t.Fatalf("Cannot decode the %s image: %s", scan, err)
+		}
+		return buf, res
+	}
+
+	// Progressive JPEGs start their frame with the SOF2 marker
+	sof2 := []byte{0xff, 0xc2}
+	baseline, _ := encode("baseline")
+	if bytes.Contains(baseline, sof2) {
+		t.Error("Baseline images must not be progressive")
+	}
+
+	progressive, res := encode("progressive")
+	if bytes.Contains(progressive, sof2) == false || bytes.Equal(progressive, baseline) {
+		t.Error("Invalid progressive image")
+	}
+	if res.Header.Get("Warning") != "" {
+		t.Errorf("Unexpected warning: %s", res.Header.Get("Warning"))
+	}
+
+	earlyColor, res := encode("earlycolor")
+	if bytes.Equal(earlyColor, progressive) == false {
+		t.Error("Early color scans must fall back to the progressive scan")
+	}
+	if strings.Contains(res.Header.Get("Warning"), "earlycolor scan unsupported") == false {
+		t.Errorf("Missing fallback warning: %s", res.Header.Get("Warning"))
+	}
+
+	res, _ = http.Post(ts.URL+"?width=300&scan=foo", "image/jpeg", readFile("large.jpg"))
+	if res.StatusCode != 400 {
+		t.Errorf("Invalid scan modes must be rejected: %s", res.Status)
+	}
+}
+
+func TestInterlace(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	encode := func(query string) []byte {
+		res, err := http.Post(ts.URL+"?width=300&"+query, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status for %s: %s", query, res.Status)
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		return buf
+	}
+
+	sof2 := []byte{0xff, 0xc2}
+	interlaced, baseline := encode("interlace=true"), encode("interlace=false")
+	if bytes.Contains(interlaced, sof2) == false || bytes.Contains(baseline, sof2) {
+		t.Error("Only interlaced JPEG images must be progressive")
+	}
+	if bytes.Equal(interlaced, baseline) {
+		t.Error("Interlaced and baseline images must differ")
+	}
+	if bytes.Equal(baseline, encode("")) == false {
+		t.Error("Images must not be interlaced by default")
+	}
+
+	// WebP images cannot be interlaced, so the param is ignored
+	if webp := encode("interlace=true&type=webp"); bimg.DetermineImageType(webp) != bimg.WEBP {
+		t.Error("Interlaced WebP output must be encoded as WebP")
+	}
+}
+
 func controller(op Operation) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		buf, _ := ioutil.ReadAll(r.Body)
-		imageHandler(w, r, buf, op)
+		imageHandler(w, r, buf, op, ServerOptions{})
+	}
+}
+
+func optionsController(op Operation, o ServerOptions) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		imageHandler(w, r, buf, op, o)
 	}
 }
 
@@ -315,6 +586,15 @@ func readFile(file string) io.Reader {
 	return buf
 }
 
+// encodeTestPNG encodes the generated test image as PNG.
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
 func assertSize(buf []byte, width, height int) error {
 	size, err := bimg.NewImage(buf).Size()
 	if err != nil {
@@ -325,3 +605,755 @@ func assertSize(buf []byte, width, height int) error {
 	}
 	return nil
 }
+
+func TestResizeMaxBytes(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	baseline := postImage(t, ts.URL+"?width=300&quality=95", "large.jpg")
+
+	cases := []struct {
+		budget  int
+		smaller bool
+	}{
+		{len(baseline) - 1, true},
+		{len(baseline) * 10, false},
+	}
+
+	for _, test := range cases {
+		url := fmt.Sprintf("%s?width=300&quality=95&maxbytes=%d", ts.URL, test.budget)
+		image := postImage(t, url, "large.jpg")
+
+		if test.smaller && len(image) >= len(baseline) {
+			t.Errorf("Output should be lowered below %d bytes: %d", len(baseline), len(image))
+		}
+		if !test.smaller && len(image) != len(baseline) {
+			t.Errorf("Output should keep the requested quality: %d != %d", len(image), len(baseline))
+		}
+	}
+
+	res, err := http.Post(ts.URL+"?width=300&quality=95&maxbytes=100", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 || res.Header.Get("Warning") == "" || res.Header.Get(qualityHeader) == "" {
+		t.Errorf("Unreachable budgets must return the smallest output with a warning: %s %v", res.Status, res.Header)
+	}
+}
+
+func postImage(t *testing.T, url, file string) []byte {
+	res, err := http.Post(url, "image/jpeg", readFile(file))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	image, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) == 0 {
+		t.Fatalf("Empty response body")
+	}
+	return image
+}
+
+func TestCropGravityBodyMatchesURLSource(t *testing.T) {
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true}
+	fn := ImageMiddleware(opts)(Crop)
+	LoadSources(opts)
+
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	for _, gravity := range []string{"north", "south", "east", "west", "centre"} {
+		query := "?width=200&height=200&gravity=" + gravity
+
+		bodyImage := postImage(t, ts.URL+query, "large.jpg")
+
+		res, err := http.Get(ts.URL + query + "&url=" + tsImage.URL)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %d", res.StatusCode)
+		}
+		urlImage, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(bodyImage, urlImage) == false {
+			t.Errorf("Body and URL sources differ for gravity %s", gravity)
+		}
+		if err := assertSize(bodyImage, 200, 200); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestInvertAlpha(t *testing.T) {
+	ts := testServer(controller(Invert))
+	defer ts.Close()
+
+	opaque := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := range opaque.Pix {
+		opaque.Pix[i] = 255
+	}
+	res, err := http.Post(ts.URL+"?invert=alpha", "image/png", bytes.NewReader(encodeTestPNG(t, opaque)))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	out, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatalf("Output must be a PNG: %s", err)
+	}
+
+	bounds := out.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := out.At(x, y).RGBA(); a != 0 {
+				t.Fatalf("Pixel %dx%d should be transparent", x, y)
+			}
+		}
+	}
+}
+
+func TestDefaultWatermark(t *testing.T) {
+	mark := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := 0; i < len(mark.Pix); i += 4 {
+		mark.Pix[i], mark.Pix[i+3] = 255, 255
+	}
+	ts := testServer(optionsController(Resize, ServerOptions{WatermarkImage: encodeTestPNG(t, mark)}))
+	defer ts.Close()
+
+	cases := []struct {
+		query  string
+		marked bool
+	}{
+		{"?width=300&type=png", true},
+		{"?width=300&type=png&nowatermark=true", false},
+	}
+
+	for _, test := range cases {
+		body := postImage(t, ts.URL+test.query, "large.jpg")
+		out, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bounds := out.Bounds()
+		r, g, b, _ := out.At(bounds.Max.X-15, bounds.Max.Y-15).RGBA()
+		isRed := r>>8 == 255 && g>>8 == 0 && b>>8 == 0
+		if isRed != test.marked {
+			t.Errorf("Invalid watermark state for %s: %d,%d,%d", test.query, r>>8, g>>8, b>>8)
+		}
+	}
+}
+
+func TestDefaultWatermarkWithinBudget(t *testing.T) {
+	// Noisy watermark, adding many bytes to the output
+	mark := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i := 0; i < len(mark.Pix); i++ {
+		mark.Pix[i] = uint8(i * 7919 % 251)
+		if i%4 == 3 {
+			mark.Pix[i] = 255
+		}
+	}
+	ts := testServer(optionsController(Resize, ServerOptions{WatermarkImage: encodeTestPNG(t, mark)}))
+	defer ts.Close()
+
+	watermarked := postImage(t, ts.URL+"?width=300&quality=95", "large.jpg")
+	maxBytes := len(watermarked) - 1
+
+	res, err := http.Post(ts.URL+"?width=300&quality=95&maxbytes="+fmt.Sprint(maxBytes), "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if len(body) > maxBytes || res.Header.Get("Warning") != "" {
+		t.Errorf("The watermarked output must fit the budget: %d > %d", len(body), maxBytes)
+	}
+}
+
+func TestConvertTypeAliases(t *testing.T) {
+	ts := testServer(controller(Convert))
+	defer ts.Close()
+
+	for _, query := range []string{"?format=webp", "?type=image/webp", "?format=image/webp"} {
+		image := postImage(t, ts.URL+query, "large.jpg")
+		if bimg.DetermineImageTypeName(image) != "webp" {
+			t.Errorf("Invalid image type for %s", query)
+		}
+	}
+}
+
+func TestConvertInvalidMimeType(t *testing.T) {
+	ts := testServer(controller(Convert))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?type=image/unknown", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if strings.Contains(string(body), "unknown") == false {
+		t.Fatalf("Error should report the invalid type: %s", body)
+	}
+}
+
+func TestResizePremultiply(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	// White opaque square over a transparent black background
+	shape := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	for y := 50; y < 150; y++ {
+		for x := 50; x < 150; x++ {
+			shape.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 200})
+		}
+	}
+	source := encodeTestPNG(t, shape)
+
+	edgeBrightness := func(query string) float64 {
+		res, err := http.Post(ts.URL+query, "image/png", bytes.NewReader(source))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %s", res.Status)
+		}
+		out, err := png.Decode(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total, count float64
+		bounds := out.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+				if c.A > 0 && c.A < 200 {
+					total += float64(c.R)
+					count++
+				}
+			}
+		}
+		if count == 0 {
+			return 255
+		}
+		return total / count
+	}
+
+	premultiplied := edgeBrightness("?width=73&height=73&type=png&premultiply=true")
+	straight := edgeBrightness("?width=73&height=73&type=png")
+
+	if premultiplied < 250 {
+		t.Errorf("Premultiplied edges should keep the shape color: %f", premultiplied)
+	}
+	if premultiplied < straight {
+		t.Errorf("Premultiplied edges must not be darker: %f < %f", premultiplied, straight)
+	}
+}
+
+func TestZeroDimensions(t *testing.T) {
+	cases := []struct {
+		op     Operation
+		query  string
+		width  int
+		height int
+	}{
+		{Resize, "?width=0&height=180", 320, 180},
+		{Crop, "?width=0&height=180", 320, 180},
+		{Thumbnail, "?width=300&height=0", 300, 168},
+		{Resize, "?width=0&height=0", 1920, 1080},
+		{Crop, "", 1920, 1080},
+		{Thumbnail, "?width=0&height=0", 1920, 1080},
+	}
+
+	for _, test := range cases {
+		ts := testServer(controller(test.op))
+		image := postImage(t, ts.URL+test.query, "large.jpg")
+		ts.Close()
+
+		if err := assertSize(image, test.width, test.height); err != nil {
+			t.Errorf("%s: %s", test.query, err)
+		}
+	}
+}
+
+func TestInvalidDimensions(t *testing.T) {
+	cases := []struct {
+		query   string
+		options ServerOptions
+	}{
+		{"?width=-100", ServerOptions{}},
+		{"?width=100&height=-1", ServerOptions{}},
+		{"?width=0&height=0", ServerOptions{StrictDimensions: true}},
+	}
+
+	for _, test := range cases {
+		ts := testServer(optionsController(Resize, test.options))
+		res, err := http.Post(ts.URL+test.query, "image/jpeg", readFile("large.jpg"))
+		ts.Close()
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		if res.StatusCode != 400 {
+			t.Errorf("Invalid response status for %s: %s", test.query, res.Status)
+		}
+	}
+}
+
+func TestBase64Encoding(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=300&encoding=base64", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	var envelope Base64Image
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.ContentType != "image/jpeg" || envelope.Width != 300 || envelope.Height != 168 {
+		t.Fatalf("Invalid envelope: %s %dx%d", envelope.ContentType, envelope.Width, envelope.Height)
+	}
+
+	image, err := base64.StdEncoding.DecodeString(envelope.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertSize(image, 300, 168); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalidEncoding(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=300&encoding=hex", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ts := testServer(readyController)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != `{"ready":true}` {
+		t.Fatalf("Invalid body response: %s", body)
+	}
+}
+
+func TestAttachmentFilenameFromSourceKey(t *testing.T) {
+	opts := ServerOptions{Mount: "fixtures"}
+	fn := ImageMiddleware(opts)(Resize)
+	LoadSources(opts)
+
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=100&type=png&attachment=true&file=large.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+
+	disposition := res.Header.Get("Content-Disposition")
+	if disposition != `attachment; filename="large.png"` {
+		t.Fatalf("Invalid Content-Disposition header: %s", disposition)
+	}
+}
+
+func TestSourceDefaultTypes(t *testing.T) {
+	types, err := ParseSourceDefaultTypes("http=webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true, SourceDefaultTypes: types}
+	fn := ImageMiddleware(opts)(Resize)
+	LoadSources(opts)
+
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"?width=100&url=" + tsImage.URL, "webp"},
+		{"?width=100&type=png&url=" + tsImage.URL, "png"},
+	}
+
+	for _, test := range cases {
+		res, err := http.Get(ts.URL + test.query)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		image, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %d", res.StatusCode)
+		}
+		if bimg.DetermineImageTypeName(image) != test.expected {
+			t.Errorf("Invalid image type for %s: %s", test.query, bimg.DetermineImageTypeName(image))
+		}
+	}
+
+	image := postImage(t, ts.URL+"?width=100", "large.jpg")
+	if bimg.DetermineImageTypeName(image) != "jpeg" {
+		t.Errorf("Body source must preserve the input image type")
+	}
+
+	if _, err := ParseSourceDefaultTypes("http=bmp"); err == nil {
+		t.Error("Invalid image types must be rejected")
+	}
+}
+
+func TestAutoTypeVary(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	cases := []struct {
+		query    string
+		accept   string
+		expected string
+		vary     string
+	}{
+		{"?width=100&type=auto", "image/webp,image/*", "webp", "Accept"},
+		{"?width=100&type=auto", "image/*", "jpeg", "Accept"},
+		{"?width=100&type=png", "image/webp", "png", ""},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("POST", ts.URL+test.query, bytes.NewReader(buf))
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("Accept", test.accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		image, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != 200 {
+			t.Fatalf("Invalid response status: %d", res.StatusCode)
+		}
+		if bimg.DetermineImageTypeName(image) != test.expected {
+			t.Errorf("Invalid image type for %s: %s", test.accept, bimg.DetermineImageTypeName(image))
+		}
+		if vary := res.Header.Get("Vary"); vary != test.vary {
+			t.Errorf("Invalid Vary header for %s: %s", test.query, vary)
+		}
+	}
+}
+
+func TestResizeShrinkOnly(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	original, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	cases := []struct {
+		query       string
+		passthrough bool
+		width       int
+		height      int
+	}{
+		{"?width=3200&shrinkonly=true", true, 1920, 1080},
+		{"?width=320&shrinkonly=true", false, 320, 180},
+		{"?width=320&minwidth=2000", true, 1920, 1080},
+		{"?width=320&minwidth=1000", false, 320, 180},
+		{"?width=320&minheight=1000", false, 320, 180},
+	}
+
+	for _, test := range cases {
+		image := postImage(t, ts.URL+test.query, "large.jpg")
+		if bytes.Equal(image, original) != test.passthrough {
+			t.Errorf("Invalid passthrough for %s", test.query)
+		}
+		if err := assertSize(image, test.width, test.height); err != nil {
+			t.Errorf("%s: %s", test.query, err)
+		}
+	}
+}
+
+func TestOperationsHeader(t *testing.T) {
+	opts := ServerOptions{WatermarkText: "imaginary", WatermarkOpacity: 0.5, MaxUpscale: 2}
+	fn := ImageMiddleware(opts)(Resize)
+	LoadSources(opts)
+
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/resize?width=8000&format=image/png&gravity=North&nocrop=1", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+
+	var operations []AppliedOperation
+	if err := json.Unmarshal([]byte(res.Header.Get("X-Imaginary-Operations")), &operations); err != nil {
+		t.Fatalf("Invalid operations header: %s", err)
+	}
+	if len(operations) != 2 {
+		t.Fatalf("Invalid number of operations: %d", len(operations))
+	}
+
+	resize := operations[0]
+	if resize.Operation != "resize" {
+		t.Errorf("Invalid first operation: %s", resize.Operation)
+	}
+	expected := map[string]interface{}{"width": float64(3840), "type": "png", "gravity": "north", "nocrop": true}
+	if len(resize.Params) != len(expected) {
+		t.Errorf("Invalid resize params: %v", resize.Params)
+	}
+	for key, value := range expected {
+		if resize.Params[key] != value {
+			t.Errorf("Invalid resize param %s: %v", key, resize.Params[key])
+		}
+	}
+
+	watermark := operations[1]
+	if watermark.Operation != "watermark" || watermark.Params["text"] != "imaginary" || watermark.Params["opacity"] != 0.5 {
+		t.Errorf("Invalid watermark operation: %v", watermark)
+	}
+}
+
+func TestPipelineOperationsHeader(t *testing.T) {
+	opts := ServerOptions{MaxUpscale: 2}
+	fn := ImageMiddleware(opts)(Pipeline)
+	LoadSources(opts)
+
+	ts := httptest.NewServer(fn)
+	defer ts.Close()
+
+	steps := `[{"operation": "enlarge", "params": {"width": 8000, "height": 4000}}, {"operation": "watermark", "params": {"text": "Hello World", "font": "DejaVu Sans 12"}}]`
+	query := url.Values{"operations": {steps}, "type": {"PNG"}}
+	res, err := http.Post(ts.URL+"/pipeline?"+query.Encode(), "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+
+	var operations []AppliedOperation
+	if err := json.Unmarshal([]byte(res.Header.Get("X-Imaginary-Operations")), &operations); err != nil {
+		t.Fatalf("Invalid operations header: %s", err)
+	}
+	if len(operations) != 2 || operations[0].Operation != "enlarge" || operations[1].Operation != "watermark" {
+		t.Fatalf("Pipeline steps must be listed: %v", operations)
+	}
+	if operations[0].Params["width"] != float64(3840) {
+		t.Errorf("Invalid enlarge params: %v", operations[0].Params)
+	}
+	if params := operations[1].Params; params["text"] != "Hello World" || params["font"] != "DejaVu Sans 12" || params["type"] != "png" {
+		t.Errorf("Invalid watermark params: %v", params)
+	}
+}
+
+func TestQualityScale(t *testing.T) {
+	ts := testServer(optionsController(Resize, ServerOptions{QualityScale: 10}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/resize?width=100&quality=8", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+
+	var operations []AppliedOperation
+	json.Unmarshal([]byte(res.Header.Get("X-Imaginary-Operations")), &operations)
+	if len(operations) == 0 || operations[0].Params["quality"] != float64(80) {
+		t.Errorf("Quality must be mapped to the 0-100 scale: %v", operations)
+	}
+}
+
+func TestFormatFallback(t *testing.T) {
+	cases := []struct {
+		fallback []string
+		query    string
+		status   int
+		expected string
+	}{
+		{nil, "?width=100&type=avif", 501, ""},
+		{[]string{"webp", "jpeg"}, "?width=100&type=avif", 200, "webp"},
+		{[]string{"jpeg"}, "?width=100&type=image/avif", 200, "jpeg"},
+		{[]string{"webp"}, "?width=100&type=bmp", 400, ""},
+		{[]string{"webp"}, "?width=100&type=png", 200, "png"},
+	}
+
+	for _, test := range cases {
+		ts := testServer(optionsController(Resize, ServerOptions{FormatFallback: test.fallback}))
+		res, err := http.Post(ts.URL+test.query, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		image, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.query, res.StatusCode)
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+		if bimg.DetermineImageTypeName(image) != test.expected || res.Header.Get("Content-Type") != "image/"+test.expected {
+			t.Errorf("Invalid image type for %s: %s", test.query, res.Header.Get("Content-Type"))
+		}
+		hasWarning := strings.Contains(res.Header.Get("Warning"), "encoded as "+test.expected)
+		if hasWarning != strings.Contains(test.query, "avif") {
+			t.Errorf("Invalid Warning header for %s: %s", test.query, res.Header.Get("Warning"))
+		}
+	}
+
+	if _, err := ParseFormatFallback("webp,bmp"); err == nil {
+		t.Error("Invalid fallback image types must fail")
+	}
+}
+
+func TestWebPPassthrough(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/test.png")
+	webp, err := Process(buf, bimg.Options{Type: bimg.WEBP})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		operation Operation
+		opts      ImageOptions
+	}{
+		{Convert, ImageOptions{Type: "webp"}},
+		{Resize, ImageOptions{Type: "webp"}},
+		{Resize, ImageOptions{}},
+	}
+
+	for i, test := range cases {
+		image, err := test.operation.Run(webp.Body, test.opts)
+		if err != nil {
+			t.Fatalf("Case %d: %s", i, err)
+		}
+		if bytes.Equal(image.Body, webp.Body) == false || image.Mime != "image/webp" {
+			t.Errorf("The image must pass through untouched for case %d", i)
+		}
+	}
+
+	for i, opts := range []ImageOptions{
+		{Type: "webp", Quality: 50},
+		{Type: "png"},
+		{Type: "webp", Colorspace: bimg.INTERPRETATION_B_W},
+		{Type: "webp", NoProfile: true},
+	} {
+		if isPassthrough(webp.Body, opts) {
+			t.Errorf("The image must be re-encoded for case %d", i)
+		}
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=300&quality=95", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	baseline, _ := ioutil.ReadAll(res.Body)
+	if size := res.Header.Get("X-Output-Size"); size != fmt.Sprint(len(baseline)) {
+		t.Errorf("Invalid X-Output-Size header: %s != %d", size, len(baseline))
+	}
+
+	limited := testServer(optionsController(Resize, ServerOptions{MaxOutputBytes: len(baseline) - 1}))
+	defer limited.Close()
+
+	res, err = http.Post(limited.URL+"?width=300&quality=95", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 413 {
+		t.Errorf("Outputs over the max size must be rejected: %s", res.Status)
+	}
+
+	res, err = http.Post(limited.URL+"?width=300&quality=95&reduceonoverflow=true", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Outputs over the max size must be reduced: %s", res.Status)
+	}
+	image, _ := ioutil.ReadAll(res.Body)
+	if len(image) >= len(baseline) {
+		t.Errorf("Output should be lowered below %d bytes: %d", len(baseline), len(image))
+	}
+	if size := res.Header.Get("X-Output-Size"); size != fmt.Sprint(len(image)) {
+		t.Errorf("Invalid X-Output-Size header: %s != %d", size, len(image))
+	}
+
+	tiny := testServer(optionsController(Resize, ServerOptions{MaxOutputBytes: 100}))
+	defer tiny.Close()
+
+	res, err = http.Post(tiny.URL+"?width=300&reduceonoverflow=true", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 413 {
+		t.Errorf("Outputs which cannot be reduced below the max size must be rejected: %s", res.Status)
+	}
+}
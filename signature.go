@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
+
+// Query param carrying the URL signature
+const signatureParam = "sign"
+
+// URLSignature returns the hex HMAC-SHA256 signature of the request path
+// and query params, which must be passed as the sign query param. The
+// path and params are the URL decoded ones, so the signature does not
+// depend on how the client encodes them: the signed string is the path,
+// followed by ? and the params sorted by key and encoded as by
+// url.Values.Encode, if any. The sign param itself is not signed.
+func URLSignature(key, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signaturePayload(path, query)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signaturePayload(path string, query url.Values) string {
+	params := url.Values{}
+	for key, values := range query {
+		if key != signatureParam {
+			params[key] = values
+		}
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + params.Encode()
+}
+
+// verifySignature rejects the requests without a valid URL signature,
+// except for the exempt paths.
+func verifySignature(next http.Handler, key string, exempt []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		expected := URLSignature(key, r.URL.Path, query)
+		if hmac.Equal([]byte(query.Get(signatureParam)), []byte(expected)) == false {
+			ErrorReply(w, ErrInvalidSignature)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestURLSignature(t *testing.T) {
+	query := url.Values{"width": {"300"}, "url": {"http://example.com/a b.jpg"}}
+	if payload := signaturePayload("/resize", query); payload != "/resize?url=http%3A%2F%2Fexample.com%2Fa+b.jpg&width=300" {
+		t.Errorf("Invalid signed string: %s", payload)
+	}
+
+	signature := URLSignature("secret", "/resize", query)
+	if len(signature) != 64 {
+		t.Errorf("Invalid signature: %s", signature)
+	}
+
+	query.Set("sign", signature)
+	if URLSignature("secret", "/resize", query) != signature {
+		t.Error("The sign param must not be signed")
+	}
+	if URLSignature("other", "/resize", query) == signature {
+		t.Error("The signature must depend on the key")
+	}
+	if URLSignature("secret", "/crop", query) == signature {
+		t.Error("The signature must depend on the path")
+	}
+	if signaturePayload("/health", url.Values{"sign": {"x"}}) != "/health" {
+		t.Error("Paths without params must be signed without query")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(verifySignature(noop, "secret", []string{"/health"}))
+	defer ts.Close()
+
+	signature := URLSignature("secret", "/resize", url.Values{"width": {"300"}, "url": {"http://example.com/a b.jpg"}})
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		// Any encoding of the same params, in any order, is accepted
+		{"/resize?width=300&url=http://example.com/a+b.jpg&sign=" + signature, 200},
+		{"/resize?sign=" + signature + "&url=http%3A%2F%2Fexample.com%2Fa%20b.jpg&width=300", 200},
+		{"/resize?width=400&url=http://example.com/a+b.jpg&sign=" + signature, 403},
+		{"/crop?width=300&url=http://example.com/a+b.jpg&sign=" + signature, 403},
+		{"/resize?width=300&url=http://example.com/a+b.jpg", 403},
+		{"/resize?width=300&url=http://example.com/a+b.jpg&sign=invalid", 403},
+		{"/health", 200},
+		{"/", 403},
+	}
+
+	for _, test := range cases {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.path, res.StatusCode)
+		}
+	}
+}
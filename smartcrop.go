@@ -0,0 +1,227 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Gravities resolved by imaginary itself, not supported by libvips
+const (
+	GravitySmart bimg.Gravity = iota + 100
+	GravityEntropy
+)
+
+// Max number of pixels per side sampled to score the crop window
+const smartCropSamples = 256
+
+// Luminance histogram bins used by the entropy strategy
+const entropyBins = 32
+
+func isSmartGravity(gravity bimg.Gravity) bool {
+	return gravity == GravitySmart || gravity == GravityEntropy
+}
+
+// smartCrop crops the window with the most interesting content for the
+// output aspect ratio, resizing it to the requested size. Explicit top or
+// left offsets take precedence over the window picked by the gravity.
+func smartCrop(buf []byte, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	window := smartCropWindow(img, o.Width, o.Height, o.Gravity)
+	if o.Top != 0 || o.Left != 0 {
+		window = clampWindow(window.Sub(window.Min).Add(image.Pt(o.Left, o.Top).Add(img.Bounds().Min)), img.Bounds())
+	}
+
+	cropped, err := encodeRaster(img.SubImage(window), ImageOptions{})
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts := BimgOptions(keepImageType(buf, o))
+	opts.Force = true
+	return Process(cropped.Body, opts)
+}
+
+// smartCropWindow returns the crop window with the aspect ratio of the
+// given size. The window always spans one side of the image, so it only
+// slides along the other one, scored by the given gravity strategy.
+func smartCropWindow(img *image.NRGBA, width, height int, gravity bimg.Gravity) image.Rectangle {
+	bounds := img.Bounds()
+	scale := math.Max(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+	windowWidth := int(math.Min(float64(bounds.Dx()), math.Floor(float64(width)/scale+0.5)))
+	windowHeight := int(math.Min(float64(bounds.Dy()), math.Floor(float64(height)/scale+0.5)))
+
+	horizontal := windowWidth < bounds.Dx()
+	length, size := bounds.Dy(), windowHeight
+	if horizontal {
+		length, size = bounds.Dx(), windowWidth
+	}
+	window := image.Rect(0, 0, windowWidth, windowHeight).Add(bounds.Min)
+	if size >= length {
+		return window
+	}
+
+	step := int(math.Ceil(math.Max(float64(bounds.Dx()), float64(bounds.Dy())) / smartCropSamples))
+	scores, histograms := scoreLines(img, horizontal, step)
+
+	best, bestScore, bestDistance := 0, math.Inf(-1), length
+	for offset := 0; ; offset += step {
+		if offset > length-size {
+			offset = length - size
+		}
+		first, last := offset/step, (offset+size-1)/step+1
+		var score float64
+		if gravity == GravityEntropy {
+			score = histogramEntropy(histograms[first], histograms[last])
+		} else {
+			score = scores[last] - scores[first]
+		}
+
+		// The closest window to the centre wins on equal scores
+		distance := absInt(offset - (length-size)/2)
+		if score > bestScore+1e-9 || (score > bestScore-1e-9 && distance < bestDistance) {
+			best, bestScore, bestDistance = offset, score, distance
+		}
+		if offset == length-size {
+			break
+		}
+	}
+
+	if horizontal {
+		return window.Add(image.Pt(best, 0))
+	}
+	return window.Add(image.Pt(0, best))
+}
+
+// scoreLines samples the image lines along the sliding axis, returning the
+// cumulative attention score and luminance histogram of the lines.
+func scoreLines(img *image.NRGBA, horizontal bool, step int) ([]float64, [][entropyBins]int) {
+	bounds := img.Bounds()
+	lines, across := bounds.Dy(), bounds.Dx()
+	if horizontal {
+		lines, across = bounds.Dx(), bounds.Dy()
+	}
+
+	pixel := func(line, position int) (float64, float64) {
+		x, y := bounds.Min.X+position, bounds.Min.Y+line
+		if horizontal {
+			x, y = bounds.Min.X+line, bounds.Min.Y+position
+		}
+		c := img.NRGBAAt(x, y)
+		luma := (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) * float64(c.A) / 255
+		high := math.Max(float64(c.R), math.Max(float64(c.G), float64(c.B)))
+		low := math.Min(float64(c.R), math.Min(float64(c.G), float64(c.B)))
+		saturation := (high - low) * float64(c.A) / 255
+		return luma, saturation
+	}
+
+	count := (lines + step - 1) / step
+	scores := make([]float64, count+1)
+	histograms := make([][entropyBins]int, count+1)
+	for i := 0; i < count; i++ {
+		line := i * step
+		score := 0.0
+		histogram := histograms[i]
+		for position := 0; position < across; position += step {
+			luma, saturation := pixel(line, position)
+			histogram[int(luma)*entropyBins/256]++
+
+			// Edges and saturated colors draw the attention
+			if next := line + step; next < lines {
+				neighbour, _ := pixel(next, position)
+				score += math.Abs(luma - neighbour)
+			}
+			if next := position + step; next < across {
+				neighbour, _ := pixel(line, next)
+				score += math.Abs(luma - neighbour)
+			}
+			score += saturation / 2
+		}
+		scores[i+1] = scores[i] + score
+		histograms[i+1] = histogram
+	}
+	return scores, histograms
+}
+
+// histogramEntropy returns the Shannon entropy of the lines between the
+// given cumulative histograms.
+func histogramEntropy(from, to [entropyBins]int) float64 {
+	total := 0
+	for i := range to {
+		total += to[i] - from[i]
+	}
+
+	entropy := 0.0
+	for i := range to {
+		if count := to[i] - from[i]; count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// clampWindow moves the window within the bounds, keeping its size.
+func clampWindow(window, bounds image.Rectangle) image.Rectangle {
+	offset := image.Pt(0, 0)
+	if window.Max.X > bounds.Max.X {
+		offset.X = bounds.Max.X - window.Max.X
+	}
+	if window.Max.Y > bounds.Max.Y {
+		offset.Y = bounds.Max.Y - window.Max.Y
+	}
+	window = window.Add(offset)
+
+	offset = image.Pt(0, 0)
+	if window.Min.X < bounds.Min.X {
+		offset.X = bounds.Min.X - window.Min.X
+	}
+	if window.Min.Y < bounds.Min.Y {
+		offset.Y = bounds.Min.Y - window.Min.Y
+	}
+	return window.Add(offset)
+}
+
+// CropBox is a crop area of the auto rotated image, in pixels.
+type CropBox struct {
+	Top    int `json:"top"`
+	Left   int `json:"left"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// parseCropRatio parses a W:H aspect ratio, such as 16:9.
+func parseCropRatio(value string) (int, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 {
+		width, errWidth := strconv.Atoi(strings.TrimSpace(parts[0]))
+		height, errHeight := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if errWidth == nil && errHeight == nil && width > 0 && height > 0 {
+			return width, height, nil
+		}
+	}
+	return 0, 0, NewError("Invalid suggestcrop param: must be a W:H ratio of positive integers", BadRequest)
+}
+
+// suggestCrop returns the crop box picked by the smart gravity for the
+// given W:H aspect ratio.
+func suggestCrop(buf []byte, ratio string) (*CropBox, error) {
+	width, height, err := parseCropRatio(ratio)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return nil, NewError("Cannot decode the image: "+err.Error(), BadRequest)
+	}
+
+	window := smartCropWindow(img, width, height, GravitySmart).Sub(img.Bounds().Min)
+	return &CropBox{Top: window.Min.Y, Left: window.Min.X, Width: window.Dx(), Height: window.Dy()}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// offCenterImage returns a 300x100 flat gray image with a detailed,
+// colorful subject on its right side.
+func offCenterImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			c := color.NRGBA{128, 128, 128, 255}
+			if x >= 220 && x < 280 && y >= 20 && y < 80 {
+				c = color.NRGBA{uint8(x * 7), 200, uint8(y * 13), 255}
+				if (x/4+y/4)%2 == 0 {
+					c = color.NRGBA{20, 30, 230, 255}
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestSmartCropWindow(t *testing.T) {
+	img := offCenterImage()
+	for _, gravity := range []bimg.Gravity{GravitySmart, GravityEntropy} {
+		window := smartCropWindow(img, 100, 100, gravity)
+		if window.Dx() != 100 || window.Dy() != 100 {
+			t.Errorf("Invalid window size: %v", window)
+		}
+		if window.Min.X < 180 || window.Max.X > 300 {
+			t.Errorf("The window must contain the subject: %v", window)
+		}
+	}
+
+	flat := image.NewNRGBA(image.Rect(0, 0, 300, 100))
+	if window := smartCropWindow(flat, 100, 100, GravitySmart); window != image.Rect(100, 0, 200, 100) {
+		t.Errorf("Flat images must be cropped by the centre: %v", window)
+	}
+	if window := smartCropWindow(img, 300, 100, GravitySmart); window != img.Bounds() {
+		t.Errorf("Windows matching the image must not slide: %v", window)
+	}
+}
+
+func TestClampWindow(t *testing.T) {
+	bounds := image.Rect(0, 0, 300, 100)
+	if window := clampWindow(image.Rect(250, 0, 350, 100), bounds); window != image.Rect(200, 0, 300, 100) {
+		t.Errorf("Invalid clamped window: %v", window)
+	}
+	if window := clampWindow(image.Rect(-10, 0, 90, 100), bounds); window != image.Rect(0, 0, 100, 100) {
+		t.Errorf("Invalid clamped window: %v", window)
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	buf := encodeTestPNG(t, offCenterImage())
+
+	centred, err := Crop(buf, ImageOptions{Width: 100, Height: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	smart, err := Crop(buf, ImageOptions{Width: 100, Height: 100, Gravity: GravitySmart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertSize(smart.Body, 100, 100); err != nil {
+		t.Error(err)
+	}
+	if bytes.Equal(smart.Body, centred.Body) {
+		t.Error("Smart crops must differ from centred crops")
+	}
+
+	explicit, err := Crop(buf, ImageOptions{Width: 100, Height: 100, Gravity: GravitySmart, Left: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(explicit.Body, smart.Body) {
+		t.Error("Explicit offsets must take precedence over smart gravity")
+	}
+}
+
+func TestInfoSuggestCrop(t *testing.T) {
+	buf := encodeTestPNG(t, offCenterImage())
+
+	image, err := Info(buf, ImageOptions{SuggestCrop: "1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info ImageInfo
+	if err := json.Unmarshal(image.Body, &info); err != nil {
+		t.Fatal(err)
+	}
+
+	box := info.Crop
+	if box == nil {
+		t.Fatal("Missing suggested crop")
+	}
+	if box.Width != 100 || box.Height != 100 || box.Top != 0 {
+		t.Errorf("Invalid crop box size: %+v", box)
+	}
+	if box.Left < 180 || box.Left+box.Width > info.Width {
+		t.Errorf("The crop box must be in bounds and contain the subject: %+v", box)
+	}
+
+	if image, _ := Info(buf, ImageOptions{}); bytes.Contains(image.Body, []byte("suggestedCrop")) {
+		t.Error("The crop must only be suggested if requested")
+	}
+}
+
+func TestParseCropRatio(t *testing.T) {
+	if width, height, err := parseCropRatio("16:9"); err != nil || width != 16 || height != 9 {
+		t.Errorf("Invalid ratio: %d:%d (%v)", width, height, err)
+	}
+	for _, value := range []string{"16", "16:0", "a:b", "-1:2", "1:2:3"} {
+		if _, _, err := parseCropRatio(value); err == nil {
+			t.Errorf("Invalid ratios must be rejected: %s", value)
+		}
+	}
+}
@@ -1,13 +1,37 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
 
 type ImageSourceType string
 type ImageSourceFactoryFunction func(*SourceConfig) ImageSource
 
 type SourceConfig struct {
-	Type      ImageSourceType
-	MountPath string
+	Type              ImageSourceType
+	MountPaths        []string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BasicAuthHosts    []string
+	FetchRetries      int
+	TLSConfig         *tls.Config
+	MaxBodySize       int64
+	EnableURLSource   bool
+	FetchTimeout      time.Duration
+	BodyContentTypes  []string
+	AllowedOrigins    []string
+	AllowPrivateIPs   bool
+	DisableBody       bool
+	MaxBodyMemory     int64
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKey       string
+	S3SecretKey       string
 }
 
 var imageSourceMap = make(map[ImageSourceType]ImageSource)
@@ -18,6 +42,56 @@ type ImageSource interface {
 	GetImage(*http.Request) ([]byte, error)
 }
 
+// ImageKeySource is implemented by sources able to identify the requested
+// image by a key, such as a file path or an URL path.
+type ImageKeySource interface {
+	GetImageKey(*http.Request) string
+}
+
+// MultiImageSource is implemented by sources able to provide multiple
+// images in a single request, keyed by name.
+type MultiImageSource interface {
+	GetImages(*http.Request) (map[string][]byte, error)
+}
+
+// SourceDefaultTypes maps image source types to the output image type
+// used when the request does not define one.
+type SourceDefaultTypes map[ImageSourceType]string
+
+// ParseSourceDefaultTypes parses a comma separated list of source=type pairs.
+func ParseSourceDefaultTypes(value string) (SourceDefaultTypes, error) {
+	types := SourceDefaultTypes{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid source default type: %s", pair)
+		}
+
+		name := parseImageTypeName(strings.TrimSpace(parts[1]))
+		if name != autoImageType && isOutputTypeSupported(name) == false {
+			return nil, fmt.Errorf("invalid source default image type: %s", pair)
+		}
+
+		types[ImageSourceType(strings.ToLower(strings.TrimSpace(parts[0])))] = name
+	}
+	return types, nil
+}
+
+type contextKey int
+
+const (
+	imageSourceContextKey contextKey = iota
+	defaultImageContextKey
+	bodySpoolContextKey
+	processingSlotsContextKey
+	apiKeyContextKey
+)
+
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
 	imageSourceFactoryMap[sourceType] = factory
 }
@@ -25,17 +99,75 @@ func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFuncti
 func LoadSources(o ServerOptions) {
 	for name, factory := range imageSourceFactoryMap {
 		imageSourceMap[name] = factory(&SourceConfig{
-			Type:      name,
-			MountPath: o.Mount,
+			Type:              name,
+			MountPaths:        parseMountPaths(o.Mount),
+			BasicAuthUser:     o.BasicAuthUser,
+			BasicAuthPassword: o.BasicAuthPassword,
+			BasicAuthHosts:    o.BasicAuthHosts,
+			FetchRetries:      o.SourceFetchRetries,
+			TLSConfig:         o.SourceTLSConfig,
+			MaxBodySize:       o.MaxBodySize,
+			EnableURLSource:   o.EnableURLSource,
+			FetchTimeout:      o.HttpSourceTimeout,
+			BodyContentTypes:  o.BodyContentTypes,
+			AllowedOrigins:    o.AllowedOrigins,
+			AllowPrivateIPs:   o.AllowPrivateIPs,
+			DisableBody:       o.DisableBodySource,
+			MaxBodyMemory:     o.MaxBodyMemory,
+			S3Endpoint:        o.S3Endpoint,
+			S3Region:          o.S3Region,
+			S3AccessKey:       o.S3AccessKey,
+			S3SecretKey:       o.S3SecretKey,
 		})
 	}
 }
 
+// MatchSource returns the image source matching the request, if any.
+// Requests matched by several sources, such as defining both url and s3,
+// are ambiguous and match none.
 func MatchSource(req *http.Request) ImageSource {
+	var matched ImageSource
 	for _, source := range imageSourceMap {
 		if source.Matches(req) {
-			return source
+			if matched != nil {
+				return nil
+			}
+			matched = source
+		}
+	}
+	return matched
+}
+
+func withImageSource(req *http.Request, source ImageSource) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), imageSourceContextKey, source))
+}
+
+// RequestImageSource returns the image source which matched the request, if any.
+func RequestImageSource(req *http.Request) ImageSource {
+	source, _ := req.Context().Value(imageSourceContextKey).(ImageSource)
+	return source
+}
+
+// RequestImageSourceType returns the type of the image source which matched
+// the request, if any.
+func RequestImageSourceType(req *http.Request) ImageSourceType {
+	source := RequestImageSource(req)
+	if source == nil {
+		return ""
+	}
+	for name, s := range imageSourceMap {
+		if s == source {
+			return name
 		}
 	}
-	return nil
+	return ""
+}
+
+// RequestImageKey returns the key of the requested image, if the matched
+// image source supports it.
+func RequestImageKey(req *http.Request) string {
+	if source, ok := RequestImageSource(req).(ImageKeySource); ok {
+		return source.GetImageKey(req)
+	}
+	return ""
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"io/ioutil"
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"os"
 	"strings"
 )
 
@@ -19,33 +22,129 @@ func NewBodyImageSource(config *SourceConfig) ImageSource {
 }
 
 func (s *BodyImageSource) Matches(r *http.Request) bool {
-	return r.Method == "POST"
+	return r.Method == "POST" && s.Config.DisableBody == false
 }
 
 func (s *BodyImageSource) GetImage(r *http.Request) ([]byte, error) {
+	if s.isContentTypeAccepted(r) == false {
+		return nil, ErrUnsupportedMedia
+	}
+
+	body, err := s.limitBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := s.readBody(r)
+	if body != nil && body.exceeded {
+		return nil, ErrBodyTooLarge
+	}
+	return buf, err
+}
+
+// GetImages reads every file field of a multipart body, keyed by the
+// field name, for operations consuming multiple uploaded images.
+func (s *BodyImageSource) GetImages(r *http.Request) (map[string][]byte, error) {
+	if s.isContentTypeAccepted(r) == false || isFormBody(r) == false {
+		return nil, ErrUnsupportedMedia
+	}
+
+	body, err := s.limitBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.readFormFiles(r)
+	if body != nil && body.exceeded {
+		return nil, ErrBodyTooLarge
+	}
+	return images, err
+}
+
+// limitBody limits the body reads to the max body size, if defined.
+// Declared sizes are rejected before reading any byte, while chunked
+// bodies are read up to the limit.
+func (s *BodyImageSource) limitBody(r *http.Request) (*limitedBody, error) {
+	if s.Config.MaxBodySize <= 0 {
+		return nil, nil
+	}
+	if r.ContentLength > s.Config.MaxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+
+	body := &limitedBody{ReadCloser: r.Body, remaining: s.Config.MaxBodySize}
+	r.Body = body
+	return body, nil
+}
+
+func (s *BodyImageSource) readBody(r *http.Request) ([]byte, error) {
 	if isFormBody(r) {
-		return readFormBody(r)
+		return s.readFormBody(r)
+	}
+	return readRawBody(r, s.Config.MaxBodyMemory)
+}
+
+// formMemory returns the max bytes of the multipart file parts kept in
+// memory, stored in temp files otherwise.
+func (s *BodyImageSource) formMemory() int64 {
+	if s.Config.MaxBodyMemory > 0 {
+		return s.Config.MaxBodyMemory
+	}
+	return maxMemory
+}
+
+// isContentTypeAccepted reports whether the request Content-Type matches
+// any of the accepted prefixes. Any body is accepted if none is defined.
+func (s *BodyImageSource) isContentTypeAccepted(r *http.Request) bool {
+	if len(s.Config.BodyContentTypes) == 0 {
+		return true
+	}
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	for _, prefix := range s.Config.BodyContentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
 	}
-	return readRawBody(r)
+	return false
 }
 
 func isFormBody(r *http.Request) bool {
 	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
 }
 
-func readFormBody(r *http.Request) ([]byte, error) {
-	err := r.ParseMultipartForm(maxMemory)
-	if err != nil {
+// parseForm parses the multipart body, storing the file parts over the
+// form memory in temp files, removed along with the request spool.
+func (s *BodyImageSource) parseForm(r *http.Request) error {
+	err := r.ParseMultipartForm(s.formMemory())
+	if spool := requestBodySpool(r); spool != nil && r.MultipartForm != nil {
+		spool.removeForm(r.MultipartForm)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrIncompleteBody
+	}
+	return err
+}
+
+// readFormBody reads the image from the file form field or, if missing,
+// fetches the image referenced by the url form field.
+func (s *BodyImageSource) readFormBody(r *http.Request) ([]byte, error) {
+	if err := s.parseForm(r); err != nil {
 		return nil, err
 	}
 
 	file, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		if value := r.FormValue("url"); value != "" {
+			return s.fetchFormURL(r, value)
+		}
+		return nil, ErrEmptyBody
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	buf, err := ioutil.ReadAll(file)
+	buf, err := readFormFile(r, file, s.formMemory())
 	if len(buf) == 0 {
 		err = ErrEmptyBody
 	}
@@ -53,8 +152,90 @@ func readFormBody(r *http.Request) ([]byte, error) {
 	return buf, err
 }
 
-func readRawBody(r *http.Request) ([]byte, error) {
-	return ioutil.ReadAll(r.Body)
+// readFormFile maps the file part in memory if it was stored in a temp
+// file, so large uploads are not held in the heap. Parts sharing a temp
+// file with others are spilled to their own file over the memory limit.
+func readFormFile(r *http.Request, file multipart.File, limit int64) ([]byte, error) {
+	spool := requestBodySpool(r)
+	if disk, ok := file.(*os.File); ok && spool != nil {
+		return spool.mapFile(disk)
+	}
+	return readSpooled(spool, file, limit)
+}
+
+// readFormFiles reads the first file of each form field, skipping empty
+// ones. As for a single file, large parts are mapped from their temp file.
+func (s *BodyImageSource) readFormFiles(r *http.Request) (map[string][]byte, error) {
+	if err := s.parseForm(r); err != nil {
+		return nil, err
+	}
+
+	images := make(map[string][]byte)
+	for name, headers := range r.MultipartForm.File {
+		if len(headers) == 0 {
+			continue
+		}
+
+		file, err := headers[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		buf, err := readFormFile(r, file, s.formMemory())
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(buf) > 0 {
+			images[name] = buf
+		}
+	}
+	return images, nil
+}
+
+// fetchFormURL fetches the image like the HTTP source does, which must be
+// enabled, so forms cannot bypass its restrictions.
+func (s *BodyImageSource) fetchFormURL(r *http.Request, value string) ([]byte, error) {
+	if s.Config.EnableURLSource == false {
+		return nil, ErrURLSourceDisabled
+	}
+
+	return fetchURLImage(r, value)
+}
+
+// readRawBody reads the whole body, failing if fewer bytes than declared
+// by Content-Length are received, as with clients disconnected mid-upload.
+// Bodies larger than memoryLimit bytes are spilled to disk, if defined.
+func readRawBody(r *http.Request, memoryLimit int64) ([]byte, error) {
+	buf, err := readSpooledBody(r, memoryLimit)
+	if errors.Is(err, io.ErrUnexpectedEOF) || (err == nil && r.ContentLength > 0 && int64(len(buf)) != r.ContentLength) {
+		return nil, ErrIncompleteBody
+	}
+	return buf, err
+}
+
+// limitedBody fails reads once more than the remaining bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		b.exceeded = true
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.exceeded = true
+		return n, ErrBodyTooLarge
+	}
+	return n, err
 }
 
 func init() {
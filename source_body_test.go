@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -65,3 +71,332 @@ func testReadBody(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+type unreadableBody struct{ t *testing.T }
+
+func (b unreadableBody) Read(p []byte) (int, error) {
+	b.t.Fatal("Oversized declared bodies must not be read")
+	return 0, nil
+}
+
+func TestBodyImageSourceDeclaredSizeLimit(t *testing.T) {
+	source := NewBodyImageSource(&SourceConfig{MaxBodySize: 1024})
+
+	r, _ := http.NewRequest("POST", "http://foo/bar", unreadableBody{t})
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=foo")
+	r.ContentLength = 2048
+
+	if _, err := source.GetImage(r); err != ErrBodyTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
+
+func TestBodyImageSourceChunkedSizeLimit(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("file", "large.jpg")
+	part.Write(buf)
+	form.Close()
+
+	// Chunked requests do not declare the body size
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest("POST", "http://foo/bar", ioutil.NopCloser(bytes.NewReader(body.Bytes())))
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.ContentLength = -1
+		return r
+	}
+
+	source := NewBodyImageSource(&SourceConfig{MaxBodySize: int64(len(buf) / 2)})
+	if _, err := source.GetImage(newRequest()); err != ErrBodyTooLarge {
+		t.Fatalf("Invalid error: %v", err)
+	}
+
+	source = NewBodyImageSource(&SourceConfig{MaxBodySize: int64(body.Len())})
+	image, err := source.GetImage(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != len(buf) {
+		t.Error("Invalid image")
+	}
+}
+
+func TestBodyImageSourceMemoryLimit(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	source := NewBodyImageSource(&SourceConfig{MaxBodyMemory: int64(len(buf))})
+
+	read := func(body []byte) ([]byte, *bodySpool) {
+		r, _ := http.NewRequest("POST", "http://foo/bar", bytes.NewReader(body))
+		r, spool := withBodySpool(r)
+		image, err := source.GetImage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(image, body) == false {
+			t.Fatal("Invalid image")
+		}
+		return image, spool
+	}
+
+	// Bodies at the limit stay in memory
+	_, spool := read(buf)
+	if len(spool.paths) != 0 {
+		t.Errorf("Body within the limit must not be spilled: %v", spool.paths)
+	}
+	spool.Close()
+
+	spilled, spool := read(append(buf, 0))
+	if len(spool.paths) != 1 {
+		t.Fatalf("Body over the limit must be spilled to disk: %v", spool.paths)
+	}
+	detached := spool.detach(spilled)
+	if &detached[0] == &spilled[0] || bytes.Equal(detached, spilled) == false {
+		t.Fatal("Spilled body must be detached as a copy")
+	}
+	path := spool.paths[0]
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Spilled body must be kept until released: %s", err)
+	}
+
+	// Abandoned processing keeps the file until it finishes
+	release := holdBodySpool(context.WithValue(context.Background(), bodySpoolContextKey, spool))
+	spool.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Held spilled body must not be removed: %s", err)
+	}
+	release()
+	if _, err := os.Stat(path); os.IsNotExist(err) == false {
+		t.Errorf("Spilled body must be removed once released: %v", err)
+	}
+	if bytes.Equal(detached, append(buf, 0)) == false {
+		t.Error("Detached body must outlive the spool")
+	}
+}
+
+func TestBodyImageSourceFormFilesMemoryLimit(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, name := range []string{"base", "overlay"} {
+		part, _ := form.CreateFormFile(name, name+".jpg")
+		part.Write(buf)
+	}
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "http://foo/bar", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r, spool := withBodySpool(r)
+
+	source := NewBodyImageSource(&SourceConfig{MaxBodyMemory: 1024}).(MultiImageSource)
+	images, err := source.GetImages(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"base", "overlay"} {
+		if bytes.Equal(images[name], buf) == false {
+			t.Errorf("Invalid %s image", name)
+		}
+	}
+
+	// Parts over the memory limit are mapped from disk, and the form
+	// temp files removed with the spool
+	if len(spool.releases) != 2 || len(spool.forms) != 1 {
+		t.Errorf("Form parts must be mapped from disk: %d mapped", len(spool.releases))
+	}
+	spool.Close()
+	if spool.forms != nil {
+		t.Error("Form temp files must be removed with the spool")
+	}
+}
+
+func TestBodySizeLimitStatus(t *testing.T) {
+	opts := ServerOptions{MaxBodySize: 1024}
+	LoadSources(opts)
+	defer LoadSources(ServerOptions{})
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=100", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
+
+func newFormRequest(fields map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "http://foo/bar", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestBodyImageSourceFormURL(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	// Form URLs are fetched by the registered HTTP source
+	LoadSources(ServerOptions{EnableURLSource: true, AllowPrivateIPs: true})
+	source := NewBodyImageSource(&SourceConfig{EnableURLSource: true})
+	image, err := source.GetImage(newFormRequest(map[string]string{"url": ts.URL + "/large.jpg"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(image) != len(buf) {
+		t.Error("Invalid image")
+	}
+
+	cases := []struct {
+		config *SourceConfig
+		fields map[string]string
+		err    error
+	}{
+		{&SourceConfig{}, map[string]string{"url": ts.URL}, ErrURLSourceDisabled},
+		{&SourceConfig{EnableURLSource: true}, map[string]string{"url": "file:///etc/passwd"}, ErrInvalidImageURL},
+		{&SourceConfig{EnableURLSource: true}, map[string]string{"width": "100"}, ErrEmptyBody},
+	}
+	for _, test := range cases {
+		_, err := NewBodyImageSource(test.config).GetImage(newFormRequest(test.fields))
+		if err != test.err {
+			t.Errorf("Invalid error for %v: %v", test.fields, err)
+		}
+	}
+}
+
+// truncatedBody returns fewer bytes than declared, as with clients
+// disconnected mid-upload.
+type truncatedBody struct {
+	reader io.Reader
+	err    error
+}
+
+func (b truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err == io.EOF {
+		return n, b.err
+	}
+	return n, err
+}
+
+func TestBodyImageSourceIncompleteBody(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureFile)
+	source := NewBodyImageSource(&SourceConfig{})
+
+	for _, readErr := range []error{io.EOF, io.ErrUnexpectedEOF, fmt.Errorf("read body: %w", io.ErrUnexpectedEOF)} {
+		r, _ := http.NewRequest("POST", "http://foo/bar", truncatedBody{bytes.NewReader(buf[:len(buf)/2]), readErr})
+		r.ContentLength = int64(len(buf))
+		if _, err := source.GetImage(r); err != ErrIncompleteBody {
+			t.Errorf("Invalid error for a truncated raw body: %v", err)
+		}
+	}
+
+	// Truncated multipart bodies are detected from wrapped read errors too
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, name := range []string{"file", "overlay"} {
+		part, _ := form.CreateFormFile(name, name+".jpg")
+		part.Write(buf)
+	}
+	form.Close()
+
+	for _, readErr := range []error{io.EOF, io.ErrUnexpectedEOF, fmt.Errorf("read body: %w", io.ErrUnexpectedEOF)} {
+		newRequest := func() *http.Request {
+			r, _ := http.NewRequest("POST", "http://foo/bar", truncatedBody{bytes.NewReader(body.Bytes()[:body.Len()/2]), readErr})
+			r.Header.Set("Content-Type", form.FormDataContentType())
+			return r
+		}
+		if _, err := source.GetImage(newRequest()); err != ErrIncompleteBody {
+			t.Errorf("Invalid error for a truncated form body: %v", err)
+		}
+		if _, err := source.(MultiImageSource).GetImages(newRequest()); err != ErrIncompleteBody {
+			t.Errorf("Invalid error for a truncated form with multiple files: %v", err)
+		}
+	}
+}
+
+func TestBodyImageSourceContentTypes(t *testing.T) {
+	source := NewBodyImageSource(&SourceConfig{BodyContentTypes: []string{"image/", "multipart/"}})
+	r, _ := http.NewRequest("POST", "http://foo/bar", unreadableBody{t})
+	r.Header.Set("Content-Type", "application/json")
+	if _, err := source.GetImage(r); err != ErrUnsupportedMedia {
+		t.Errorf("Invalid error for a rejected content type: %v", err)
+	}
+
+	opts := ServerOptions{BodyContentTypes: []string{"image/", "multipart/"}}
+	LoadSources(opts)
+	defer LoadSources(ServerOptions{})
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Resize))
+	defer ts.Close()
+
+	cases := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"image/jpeg", http.StatusOK},
+		{"IMAGE/JPEG", http.StatusOK},
+	}
+	for _, test := range cases {
+		res, err := http.Post(ts.URL+"?width=100", test.contentType, readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %s: %s", test.contentType, res.Status)
+		}
+	}
+}
+
+func TestDisableBodySource(t *testing.T) {
+	for _, disabled := range []bool{true, false} {
+		opts := ServerOptions{Mount: "fixtures", DisableBodySource: disabled}
+		LoadSources(opts)
+		ts := httptest.NewServer(NewServerMux(opts))
+
+		res, err := http.Post(ts.URL+"/resize?width=100", "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		expected := http.StatusOK
+		if disabled {
+			expected = http.StatusMethodNotAllowed
+		}
+		if res.StatusCode != expected {
+			t.Errorf("Invalid upload response status (disabled: %v): %s", disabled, res.Status)
+		}
+
+		res, err = http.Get(ts.URL + "/resize?width=100&file=large.jpg")
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Invalid file source response status (disabled: %v): %s", disabled, res.Status)
+		}
+		ts.Close()
+	}
+	LoadSources(ServerOptions{})
+
+	res := httptest.NewRecorder()
+	body := `{"source": {"data": "AA=="}, "operations": [{"operation": "resize"}]}`
+	transformController(ServerOptions{DisableBodySource: true})(res, httptest.NewRequest("POST", "/transform", strings.NewReader(body)))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Invalid transform inline source status: %d", res.Code)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 )
@@ -21,23 +22,37 @@ func (s *FileSystemImageSource) Matches(r *http.Request) bool {
 	return r.Method == "GET" && s.getFileParam(r) != ""
 }
 
+// GetImage reads the file from the first mount directory where it exists.
+// The file path must be within every mount directory.
 func (s *FileSystemImageSource) GetImage(r *http.Request) ([]byte, error) {
 	file := s.getFileParam(r)
 	if file == "" {
 		return nil, ErrMissingParamFile
 	}
 
-	file, err := s.buildPath(file)
-	if err != nil {
-		return nil, err
+	for _, mount := range s.Config.MountPaths {
+		filePath, err := buildPath(mount, file)
+		if err != nil {
+			return nil, err
+		}
+
+		buf, err := s.read(filePath)
+		if err == ErrSourceNotFound {
+			continue
+		}
+		return buf, err
 	}
+	return nil, ErrSourceNotFound
+}
 
-	return s.read(file)
+func (s *FileSystemImageSource) GetImageKey(r *http.Request) string {
+	return s.getFileParam(r)
 }
 
-func (s *FileSystemImageSource) buildPath(file string) (string, error) {
-	file = path.Clean(path.Join(s.Config.MountPath, file))
-	if strings.HasPrefix(file, s.Config.MountPath) == false {
+func buildPath(mount, file string) (string, error) {
+	mount = path.Clean(mount)
+	file = path.Join(mount, file)
+	if file != mount && strings.HasPrefix(file, strings.TrimSuffix(mount, "/")+"/") == false {
 		return "", ErrInvalidFilePath
 	}
 	return file, nil
@@ -45,6 +60,9 @@ func (s *FileSystemImageSource) buildPath(file string) (string, error) {
 
 func (s *FileSystemImageSource) read(file string) ([]byte, error) {
 	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, ErrSourceNotFound
+	}
 	if err != nil {
 		return nil, ErrInvalidFilePath
 	}
@@ -55,6 +73,18 @@ func (s *FileSystemImageSource) getFileParam(r *http.Request) string {
 	return r.URL.Query().Get("file")
 }
 
+// parseMountPaths splits the comma separated mount directories, in the
+// order they are searched.
+func parseMountPaths(value string) []string {
+	var paths []string
+	for _, mount := range strings.Split(value, ",") {
+		if mount = strings.TrimSpace(mount); mount != "" {
+			paths = append(paths, mount)
+		}
+	}
+	return paths
+}
+
 func init() {
 	RegisterSource(ImageSourceTypeFileSystem, NewFileSystemImageSource)
 }
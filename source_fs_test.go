@@ -13,7 +13,7 @@ func TestFileSystemImageSource(t *testing.T) {
 	var err error
 	const fixtureFile = "fixtures/large.jpg"
 
-	source := NewFileSystemImageSource(&SourceConfig{MountPath: "fixtures"})
+	source := NewFileSystemImageSource(&SourceConfig{MountPaths: []string{"fixtures"}})
 	fakeHandler := func(w http.ResponseWriter, r *http.Request) {
 		if !source.Matches(r) {
 			t.Fatal("Cannot match the request")
@@ -36,3 +36,70 @@ func TestFileSystemImageSource(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestFileSystemImageSourceMounts(t *testing.T) {
+	first, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(first)
+	ioutil.WriteFile(first+"/large.jpg", []byte("first"), 0644)
+
+	source := NewFileSystemImageSource(&SourceConfig{MountPaths: []string{first, "fixtures"}})
+
+	cases := []struct {
+		file     string
+		fixture  string
+		expected error
+	}{
+		// Files in both mounts are read from the first one
+		{"large.jpg", "", nil},
+		{"medium.jpg", "fixtures/medium.jpg", nil},
+		{"missing.jpg", "", ErrSourceNotFound},
+		{"../source_fs.go", "", ErrInvalidFilePath},
+	}
+
+	for _, test := range cases {
+		r, _ := http.NewRequest("GET", "http://foo/bar?file="+test.file, nil)
+		body, err := source.GetImage(r)
+		if err != test.expected {
+			t.Errorf("Invalid error for %s: %v", test.file, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		expected := []byte("first")
+		if test.fixture != "" {
+			expected, _ = ioutil.ReadFile(test.fixture)
+		}
+		if string(body) != string(expected) {
+			t.Errorf("Invalid image read for %s", test.file)
+		}
+	}
+}
+
+func TestBuildPath(t *testing.T) {
+	cases := []struct {
+		mount    string
+		file     string
+		expected string
+	}{
+		{"fixtures", "large.jpg", "fixtures/large.jpg"},
+		{"./fixtures/", "a/../large.jpg", "fixtures/large.jpg"},
+		{"/mnt/images", "/large.jpg", "/mnt/images/large.jpg"},
+		{"/mnt/images", "../images2/large.jpg", ""},
+		{"fixtures", "../server.go", ""},
+	}
+
+	for _, test := range cases {
+		file, err := buildPath(test.mount, test.file)
+		if test.expected == "" && err != ErrInvalidFilePath {
+			t.Errorf("Path %s must be rejected for %s", test.file, test.mount)
+		}
+		if test.expected != "" && file != test.expected {
+			t.Errorf("Invalid path for %s in %s: %s", test.file, test.mount, file)
+		}
+	}
+}
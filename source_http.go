@@ -1,24 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const ImageSourceTypeHttp ImageSourceType = "http"
 
 type HttpImageSource struct {
 	Config *SourceConfig
+	client *http.Client
 }
 
 func NewHttpImageSource(config *SourceConfig) ImageSource {
-	return &HttpImageSource{config}
+	return &HttpImageSource{config, sourceClient(config, config.AllowedOrigins)}
 }
 
 func (s *HttpImageSource) Matches(r *http.Request) bool {
-	return r.Method == "GET" && r.URL.Query().Get("url") != ""
+	return r.Method == "GET" && s.Config.EnableURLSource && r.URL.Query().Get("url") != ""
 }
 
 func (s *HttpImageSource) GetImage(req *http.Request) ([]byte, error) {
@@ -26,39 +31,185 @@ func (s *HttpImageSource) GetImage(req *http.Request) ([]byte, error) {
 	if err != nil {
 		return nil, ErrInvalidImageURL
 	}
-	return s.fetchImage(url)
+	if len(s.Config.AllowedOrigins) > 0 && isAllowedOrigin(url.Hostname(), s.Config.AllowedOrigins) == false {
+		return nil, ErrOriginNotAllowed
+	}
+	return s.fetchRequestImage(req, url)
 }
 
-func (s *HttpImageSource) fetchImage(url *url.URL) ([]byte, error) {
-	req := s.newHttpRequest(url)
-	res, err := http.DefaultClient.Do(req)
+func (s *HttpImageSource) GetImageKey(req *http.Request) string {
+	url, err := s.parseURL(req)
+	if err != nil {
+		return ""
+	}
+	return url.Path
+}
+
+// fetchRequestImage fetches the image bound to the request context and
+// the fetch timeout, which the fetchtimeout param, in milliseconds, can
+// shorten. The timeout covers both the connection and the body download.
+func (s *HttpImageSource) fetchRequestImage(req *http.Request, url *url.URL) ([]byte, error) {
+	timeout := s.Config.FetchTimeout
+	if value := req.URL.Query().Get("fetchtimeout"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return nil, NewError("Invalid fetchtimeout param: must be a positive number of milliseconds", BadRequest)
+		}
+		if requested := time.Duration(ms) * time.Millisecond; timeout <= 0 || requested < timeout {
+			timeout = requested
+		}
+	}
+
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	buf, err := s.fetchImage(ctx, url)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, ErrSourceTimeout
+	}
+	return buf, err
+}
+
+func (s *HttpImageSource) fetchImage(ctx context.Context, url *url.URL) ([]byte, error) {
+	req := s.newHttpRequest(ctx, url)
+	res, err := s.client.Do(req)
+	if isOriginError(err) {
+		return nil, ErrOriginNotAllowed
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Error downloading image: %v", err)
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		return nil, ErrSourceNotFound
+	}
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("Error downloading image: (status=%d) (url=%s)", res.StatusCode, req.URL.RequestURI())
+		return nil, fmt.Errorf("Error downloading image: (status=%d) (url=%s)", res.StatusCode, redactURL(req.URL))
 	}
 
 	buf, err := ioutil.ReadAll(res.Body)
+	if err != nil && s.Config.FetchRetries > 0 {
+		buf, err = s.resumeFetch(ctx, url, res.Header, buf)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create image from response body: %s (url=%s)", req.URL.RequestURI(), err)
+		return nil, fmt.Errorf("Unable to create image from response body: %s (url=%s)", err, redactURL(req.URL))
 	}
 	return buf, nil
 }
 
+// resumeFetch retries an interrupted download requesting the remaining
+// bytes via the Range header, as long as the server supports byte ranges.
+// If-Range guarantees the parts belong to the same version of the image,
+// otherwise the server replies with the full image and the download restarts.
+func (s *HttpImageSource) resumeFetch(ctx context.Context, url *url.URL, header http.Header, buf []byte) ([]byte, error) {
+	if header.Get("Accept-Ranges") != "bytes" {
+		return nil, fmt.Errorf("interrupted download not resumable: range requests not supported")
+	}
+
+	validator := header.Get("ETag")
+	if validator == "" {
+		validator = header.Get("Last-Modified")
+	}
+
+	var err error
+	for attempt := 0; attempt < s.Config.FetchRetries; attempt++ {
+		req := s.newHttpRequest(ctx, url)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(buf)))
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+
+		var res *http.Response
+		res, err = s.client.Do(req)
+		if err != nil {
+			continue
+		}
+
+		switch res.StatusCode {
+		case http.StatusPartialContent:
+			if strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", len(buf))) == false {
+				res.Body.Close()
+				return nil, fmt.Errorf("invalid content range: %s", res.Header.Get("Content-Range"))
+			}
+		case http.StatusOK:
+			buf = buf[:0]
+		default:
+			res.Body.Close()
+			return nil, fmt.Errorf("cannot resume the download: (status=%d)", res.StatusCode)
+		}
+
+		var chunk []byte
+		chunk, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		buf = append(buf, chunk...)
+		if err == nil {
+			return buf, nil
+		}
+	}
+
+	return nil, err
+}
+
 func (s *HttpImageSource) parseURL(request *http.Request) (*url.URL, error) {
 	queryUrl := request.URL.Query().Get("url")
 	return url.Parse(queryUrl)
 }
 
-func (s *HttpImageSource) newHttpRequest(url *url.URL) *http.Request {
+func (s *HttpImageSource) newHttpRequest(ctx context.Context, url *url.URL) *http.Request {
 	req, _ := http.NewRequest("GET", url.RequestURI(), nil)
 	req.Header.Set("User-Agent", "imaginary")
 	req.URL = url
+	req = req.WithContext(ctx)
+
+	if s.Config.BasicAuthUser != "" && s.isAuthHost(url.Hostname()) {
+		req.SetBasicAuth(s.Config.BasicAuthUser, s.Config.BasicAuthPassword)
+	}
+
 	return req
 }
 
+// isAuthHost reports whether the basic auth credentials can be sent to the
+// host, matching the credential hosts or, if none, the allowed origins.
+// Credentials are never sent to any other host, such as form or transform
+// URLs and error images pointing elsewhere.
+func (s *HttpImageSource) isAuthHost(host string) bool {
+	hosts := s.Config.BasicAuthHosts
+	if len(hosts) == 0 {
+		hosts = s.Config.AllowedOrigins
+	}
+	return isAllowedOrigin(host, hosts)
+}
+
+// redactURL strips credentials from the URL, so it can be safely reported
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	return redacted.String()
+}
+
+// fetchURLImage fetches an image URL given other than by the url param,
+// such as the errorimage param or form fields, with the registered HTTP
+// source. It must be enabled, so the URL cannot bypass its restrictions.
+func fetchURLImage(r *http.Request, value string) ([]byte, error) {
+	source, ok := imageSourceMap[ImageSourceTypeHttp].(*HttpImageSource)
+	if !ok || source.Config.EnableURLSource == false {
+		return nil, ErrURLSourceDisabled
+	}
+
+	url, err := url.Parse(value)
+	if err != nil || (url.Scheme != "http" && url.Scheme != "https") || url.Host == "" {
+		return nil, ErrInvalidImageURL
+	}
+	if len(source.Config.AllowedOrigins) > 0 && isAllowedOrigin(url.Hostname(), source.Config.AllowedOrigins) == false {
+		return nil, ErrOriginNotAllowed
+	}
+	return source.fetchRequestImage(r, url)
+}
+
 func init() {
 	RegisterSource(ImageSourceTypeHttp, NewHttpImageSource)
 }
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttpImageSource(t *testing.T) {
@@ -18,7 +27,7 @@ func TestHttpImageSource(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	source := NewHttpImageSource(&SourceConfig{})
+	source := NewHttpImageSource(&SourceConfig{EnableURLSource: true, AllowPrivateIPs: true})
 	fakeHandler := func(w http.ResponseWriter, r *http.Request) {
 		if !source.Matches(r) {
 			t.Fatal("Cannot match the request")
@@ -50,7 +59,7 @@ func TestHttpImageSourceError(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	source := NewHttpImageSource(&SourceConfig{})
+	source := NewHttpImageSource(&SourceConfig{EnableURLSource: true, AllowPrivateIPs: true})
 	fakeHandler := func(w http.ResponseWriter, r *http.Request) {
 		if !source.Matches(r) {
 			t.Fatal("Cannot match the request")
@@ -69,3 +78,231 @@ func TestHttpImageSourceError(t *testing.T) {
 	w := httptest.NewRecorder()
 	fakeHandler(w, r)
 }
+
+func TestHttpImageSourceBasicAuth(t *testing.T) {
+	var user, password string
+	var ok bool
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok = r.BasicAuth()
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true, BasicAuthUser: "foo", BasicAuthPassword: "s3cr3t", BasicAuthHosts: []string{"127.0.0.1"}})
+
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL, nil)
+	body, err := source.GetImage(r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if len(body) != len(buf) {
+		t.Error("Invalid response body")
+	}
+	if !ok || user != "foo" || password != "s3cr3t" {
+		t.Fatalf("Invalid basic auth credentials: %s:%s", user, password)
+	}
+
+	userinfoURL := strings.Replace(ts.URL, "http://", "http://bar:s3cr3t@", 1) + "/missing"
+	r, _ = http.NewRequest("GET", "http://foo/bar?url="+userinfoURL, nil)
+	_, err = source.GetImage(r)
+	if err == nil {
+		t.Fatal("Missing image should fail")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Fatalf("Error must not expose credentials: %s", err)
+	}
+}
+
+func TestHttpImageSourceBasicAuthHosts(t *testing.T) {
+	var authorization string
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true, BasicAuthUser: "foo", BasicAuthPassword: "s3cr3t", BasicAuthHosts: []string{"images.example.com"}})
+
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL, nil)
+	if _, err := source.GetImage(r); err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if authorization != "" {
+		t.Fatalf("Credentials must not be sent to other hosts: %s", authorization)
+	}
+}
+
+func TestHttpImageSourceResumeFetch(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"large"`)
+
+		start := 0
+		if value := r.Header.Get("Range"); value != "" {
+			ranges = append(ranges, value)
+			if r.Header.Get("If-Range") != `"large"` {
+				t.Errorf("Invalid If-Range header: %s", r.Header.Get("If-Range"))
+			}
+			fmt.Sscanf(value, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(buf)-1, len(buf)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(buf)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		}
+
+		// Drop the connection after sending a third of the image, twice
+		end := len(buf)
+		if len(ranges) < 2 {
+			end = start + len(buf)/3
+		}
+		w.Write(buf[start:end])
+		if end < len(buf) {
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL, nil)
+
+	source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true})
+	if _, err := source.GetImage(r); err == nil {
+		t.Fatal("Interrupted download must fail without retries")
+	}
+
+	ranges = nil
+	source = NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true, FetchRetries: 3})
+	body, err := source.GetImage(r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if bytes.Equal(body, buf) == false {
+		t.Errorf("Invalid assembled image: %d of %d bytes", len(body), len(buf))
+	}
+	if len(ranges) != 2 || ranges[0] != fmt.Sprintf("bytes=%d-", len(buf)/3) {
+		t.Errorf("Invalid range requests: %v", ranges)
+	}
+}
+
+func TestHttpImageSourceTLS(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	})
+
+	modern := httptest.NewTLSServer(handler)
+	defer modern.Close()
+
+	legacy := httptest.NewUnstartedServer(handler)
+	legacy.TLS = &tls.Config{MaxVersion: tls.VersionTLS11}
+	legacy.StartTLS()
+	defer legacy.Close()
+
+	// Trust the test servers certificate via a CA bundle file
+	caFile, _ := ioutil.TempFile("", "imaginary")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: modern.Certificate().Raw})
+	caFile.Close()
+
+	config, err := ParseSourceTLSConfig("1.2", "", caFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true, TLSConfig: config})
+
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+modern.URL, nil)
+	body, err := source.GetImage(r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if len(body) != len(buf) {
+		t.Error("Invalid response body")
+	}
+
+	r, _ = http.NewRequest("GET", "http://foo/bar?url="+legacy.URL, nil)
+	if _, err := source.GetImage(r); err == nil {
+		t.Fatal("Server with an older TLS version must be rejected")
+	}
+
+	for _, args := range [][]string{{"1.4", ""}, {"", "TLS_FOO"}, {"", "TLS_RSA_WITH_RC4_128_SHA"}} {
+		if _, err := ParseSourceTLSConfig(args[0], args[1], ""); err == nil {
+			t.Errorf("Invalid TLS settings must fail: %v", args)
+		}
+	}
+	if config, _ := ParseSourceTLSConfig("", "", ""); config != nil {
+		t.Error("Empty TLS settings must use the default transport")
+	}
+}
+
+func TestHttpImageSourceFetchTimeout(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	aborted := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		if r.URL.Query().Get("stall") == "body" {
+			w.Write(buf[:100])
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(delay):
+			w.Write(buf)
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		}
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		timeout time.Duration
+		query   string
+		err     error
+	}{
+		{50 * time.Millisecond, "delay=1s", ErrSourceTimeout},
+		{50 * time.Millisecond, "delay=1s&stall=body", ErrSourceTimeout},
+		{500 * time.Millisecond, "delay=20ms", nil},
+		{0, "delay=1s&fetchtimeout=50", ErrSourceTimeout},
+		{time.Second, "delay=200ms&fetchtimeout=50", ErrSourceTimeout},
+		{50 * time.Millisecond, "delay=200ms&fetchtimeout=1000", ErrSourceTimeout},
+	}
+
+	for _, test := range cases {
+		source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true, FetchTimeout: test.timeout})
+		target := url.QueryEscape(ts.URL + "/?" + test.query)
+		r, _ := http.NewRequest("GET", "http://foo/bar?url="+target+"&"+test.query, nil)
+
+		start := time.Now()
+		_, err := source.GetImage(r)
+		if err != test.err {
+			t.Errorf("Invalid fetch error for %s: %v", test.query, err)
+		}
+		if test.err != nil {
+			if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+				t.Errorf("The fetch must be aborted at the deadline: %s", elapsed)
+			}
+			select {
+			case <-aborted:
+			case <-time.After(time.Second):
+				t.Errorf("The upstream request must be cancelled: %s", test.query)
+			}
+		}
+	}
+
+	source := NewHttpImageSource(&SourceConfig{AllowPrivateIPs: true})
+	r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL+"&fetchtimeout=foo", nil)
+	if _, err := source.GetImage(r); err == nil || err == ErrSourceTimeout {
+		t.Errorf("Invalid fetchtimeout param must be rejected: %v", err)
+	}
+}
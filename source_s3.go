@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ImageSourceTypeS3 ImageSourceType = "s3"
+
+// SHA-256 hash of the empty payload of the signed GET requests
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3ImageSource fetches the image from S3 compatible object storage, such
+// as MinIO, defined by the s3 param as bucket/key. Objects are requested
+// via path style URLs of the configured endpoint, signed via AWS Signature
+// Version 4 if credentials are defined.
+type S3ImageSource struct {
+	Config *SourceConfig
+	client *http.Client
+}
+
+func NewS3ImageSource(config *SourceConfig) ImageSource {
+	return &S3ImageSource{config, sourceClient(config, nil)}
+}
+
+func (s *S3ImageSource) Matches(r *http.Request) bool {
+	return r.Method == "GET" && s.Config.S3Endpoint != "" && r.URL.Query().Get("s3") != ""
+}
+
+func (s *S3ImageSource) GetImage(r *http.Request) ([]byte, error) {
+	bucket, key, err := parseS3Object(r.URL.Query().Get("s3"))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := r.Context()
+	if s.Config.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Config.FetchTimeout)
+		defer cancel()
+	}
+
+	buf, err := s.fetchObject(ctx, bucket, key)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, ErrSourceTimeout
+	}
+	return buf, err
+}
+
+func (s *S3ImageSource) GetImageKey(r *http.Request) string {
+	if _, _, err := parseS3Object(r.URL.Query().Get("s3")); err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(r.URL.Query().Get("s3"), "/")
+}
+
+// fetchObject reads the object, failing once it exceeds the max body
+// size, if defined, like uploaded images.
+func (s *S3ImageSource) fetchObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	objectURL, err := url.Parse(strings.TrimSuffix(s.Config.S3Endpoint, "/") + s3EscapePath("/"+bucket+"/"+key))
+	if err != nil {
+		return nil, ErrInvalidS3Object
+	}
+
+	req, _ := http.NewRequest("GET", objectURL.String(), nil)
+	req.Header.Set("User-Agent", "imaginary")
+	req = req.WithContext(ctx)
+	if s.Config.S3AccessKey != "" {
+		signS3Request(req, s.Config.S3AccessKey, s.Config.S3SecretKey, s.Config.S3Region, time.Now())
+	}
+
+	res, err := s.client.Do(req)
+	if isOriginError(err) {
+		return nil, ErrOriginNotAllowed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error downloading object: %v", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrObjectNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrObjectAccessDenied
+	default:
+		return nil, fmt.Errorf("Error downloading object: (status=%d) (bucket=%s) (key=%s)", res.StatusCode, bucket, key)
+	}
+
+	limit := s.Config.MaxBodySize
+	if limit <= 0 {
+		return ioutil.ReadAll(res.Body)
+	}
+	if res.ContentLength > limit {
+		return nil, ErrBodyTooLarge
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err == nil && int64(len(buf)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return buf, err
+}
+
+// parseS3Object parses the bucket/key object reference.
+func parseS3Object(value string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", ErrInvalidS3Object
+	}
+	return parts[0], parts[1], nil
+}
+
+// s3EscapePath escapes every byte of the path but the unreserved ones and
+// the slashes, as required by the canonical request of the signature.
+func s3EscapePath(path string) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~/", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// signS3Request signs the GET request headers via AWS Signature Version 4.
+func signS3Request(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	date := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name != "User-Agent" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date[:8] + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func init() {
+	RegisterSource(ImageSourceTypeS3, NewS3ImageSource)
+}
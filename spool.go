@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// bodySpool keeps the request bodies spilled to temp files, mapped in
+// memory instead of held in the heap. Files are unmapped and removed once
+// the response is written and no abandoned processing still reads them.
+type bodySpool struct {
+	mutex    sync.Mutex
+	refs     int
+	paths    []string
+	releases []func() error
+	forms    []*multipart.Form
+}
+
+func withBodySpool(req *http.Request) (*http.Request, *bodySpool) {
+	spool := &bodySpool{refs: 1}
+	return req.WithContext(context.WithValue(req.Context(), bodySpoolContextKey, spool)), spool
+}
+
+func requestBodySpool(req *http.Request) *bodySpool {
+	spool, _ := req.Context().Value(bodySpoolContextKey).(*bodySpool)
+	return spool
+}
+
+// holdBodySpool keeps the request spool files until the returned function
+// is called, so processing outliving the response can still read them.
+func holdBodySpool(ctx context.Context) func() {
+	spool, _ := ctx.Value(bodySpoolContextKey).(*bodySpool)
+	if spool == nil {
+		return func() {}
+	}
+
+	spool.mutex.Lock()
+	spool.refs++
+	spool.mutex.Unlock()
+	return spool.Close
+}
+
+// Close releases the spool files once every holder closed it.
+func (s *bodySpool) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	for _, release := range s.releases {
+		release()
+	}
+	for _, path := range s.paths {
+		os.Remove(path)
+	}
+	for _, form := range s.forms {
+		form.RemoveAll()
+	}
+	s.paths, s.releases, s.forms = nil, nil, nil
+}
+
+// removeForm removes the temp files of the multipart form once the spool
+// closes. The server only removes the form of the request it served, not
+// the one of a request copy, as the spool requests are.
+func (s *bodySpool) removeForm(form *multipart.Form) {
+	s.mutex.Lock()
+	s.forms = append(s.forms, form)
+	s.mutex.Unlock()
+}
+
+// detach returns a copy of the buffer if the spool mapped any file, as the
+// buffer can then alias the mapped bytes, unmapped once the spool closes.
+func (s *bodySpool) detach(buf []byte) []byte {
+	if s == nil {
+		return buf
+	}
+	s.mutex.Lock()
+	mapped := len(s.releases) > 0
+	s.mutex.Unlock()
+	if mapped == false {
+		return buf
+	}
+	return append([]byte(nil), buf...)
+}
+
+// spill writes the already read head and the rest of the body to a temp
+// file, returning the file contents mapped in memory.
+func (s *bodySpool) spill(head []byte, rest io.Reader) ([]byte, error) {
+	file, err := ioutil.TempFile("", "imaginary-body-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s.mutex.Lock()
+	s.paths = append(s.paths, file.Name())
+	s.mutex.Unlock()
+
+	if _, err := file.Write(head); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, rest); err != nil {
+		return nil, err
+	}
+	return s.mapFile(file)
+}
+
+// mapFile returns the file contents mapped in memory, where supported.
+func (s *bodySpool) mapFile(file *os.File) ([]byte, error) {
+	buf, release, err := mapFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.releases = append(s.releases, release)
+	s.mutex.Unlock()
+	return buf, nil
+}
+
+// readSpooledBody reads up to limit bytes of the body in memory, spilling
+// larger bodies to the request spool, if any.
+func readSpooledBody(r *http.Request, limit int64) ([]byte, error) {
+	return readSpooled(requestBodySpool(r), r.Body, limit)
+}
+
+// readSpooled reads up to limit bytes in memory, spilling the larger
+// contents to the spool, if any.
+func readSpooled(spool *bodySpool, body io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 || spool == nil {
+		return ioutil.ReadAll(body)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(buf)) <= limit {
+		return buf, err
+	}
+	return spool.spill(buf, body)
+}
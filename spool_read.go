@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mapFile reads the whole file in memory on platforms without mmap.
+func mapFile(file *os.File) ([]byte, func() error, error) {
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, nil, err
+	}
+	buf, err := ioutil.ReadAll(file)
+	return buf, func() error { return nil }, err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+)
+
+// xyzToSRGB converts D50 XYZ, the ICC profile connection space, to linear
+// sRGB, with the Bradford chromatic adaptation to D65
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// Number of parameters of the ICC parametric curve function types
+var iccParametricSizes = []int{1, 3, 4, 5, 7}
+
+// matrixProfile is the matrix/TRC model of RGB ICC profiles, such as
+// Adobe RGB or Display P3: the channels are linearized by their tone
+// curves, then mapped to the profile connection space by the matrix.
+type matrixProfile struct {
+	curves [3][256]float64
+	matrix [3][3]float64
+}
+
+// parseMatrixProfile reads the rXYZ, gXYZ and bXYZ colorants and the
+// rTRC, gTRC and bTRC tone curves of RGB profiles with XYZ connection
+// space. Other profiles, such as LUT based ones, are not supported.
+func parseMatrixProfile(profile []byte) (*matrixProfile, bool) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, false
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:132]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, false
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4 : entry+8]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8 : entry+12]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, false
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	p := &matrixProfile{}
+	for channel, prefix := range []string{"r", "g", "b"} {
+		colorant := tags[prefix+"XYZ"]
+		if len(colorant) < 20 || string(colorant[0:4]) != "XYZ " {
+			return nil, false
+		}
+		for i := 0; i < 3; i++ {
+			p.matrix[i][channel] = s15Fixed16(colorant[8+i*4:])
+		}
+
+		curve, ok := parseToneCurve(tags[prefix+"TRC"])
+		if !ok {
+			return nil, false
+		}
+		for value := 0; value < 256; value++ {
+			p.curves[channel][value] = curve(float64(value) / 255)
+		}
+	}
+	return p, true
+}
+
+// parseToneCurve reads curv (identity, gamma or sampled) and para tone
+// curves as a function linearizing the normalized channel values.
+func parseToneCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+
+	switch string(tag[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:12]))
+		if count < 0 || 12+count*2 > len(tag) {
+			return nil, false
+		}
+		if count == 0 {
+			return func(x float64) float64 { return x }, true
+		}
+		if count == 1 {
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(count-1)
+			i := int(pos)
+			if i >= count-1 {
+				return table[count-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, true
+
+	case "para":
+		function := int(binary.BigEndian.Uint16(tag[8:10]))
+		if function >= len(iccParametricSizes) || 12+iccParametricSizes[function]*4 > len(tag) {
+			return nil, false
+		}
+		// g, a, b, c, d, e and f, with the identity defaults of the simpler types
+		params := []float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < iccParametricSizes[function]; i++ {
+			params[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		switch function {
+		case 1, 2:
+			// The curve starts at -b/a, offset by c for type 2
+			d, e, f = -b/a, c, c
+			c = 0
+		case 3:
+			e, f = 0, 0
+		}
+		return func(x float64) float64 {
+			if function > 0 && x < d {
+				return c*x + f
+			}
+			return math.Pow(math.Max(a*x+b, 0), g) + e
+		}, true
+	}
+	return nil, false
+}
+
+func s15Fixed16(buf []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(buf[0:4]))) / 65536
+}
+
+// sRGB returns the transform of the linearized profile channels to
+// linear sRGB, through the profile connection space.
+func (p *matrixProfile) sRGB() [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// convertToSRGB converts the pixels of the image from its matrix/TRC ICC
+// profile to sRGB, clipping the out of gamut colors, so the profile can be
+// stripped keeping the colors. The converted image is returned as PNG
+// without profile, keeping the input type. It reports false, returning
+// the image as is, if the profile cannot be converted.
+func convertToSRGB(buf, profile []byte, o ImageOptions) ([]byte, ImageOptions, bool, error) {
+	p, ok := parseMatrixProfile(profile)
+	if !ok {
+		return buf, o, false, nil
+	}
+
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return nil, o, false, err
+	}
+	transformSRGB(img, p)
+
+	converted, err := encodeRaster(img, ImageOptions{})
+	if err != nil {
+		return nil, o, false, err
+	}
+	return converted.Body, keepImageType(buf, o), true, nil
+}
+
+// transformSRGB converts the color channels of the image in place, keeping
+// the alpha channel.
+func transformSRGB(img *image.NRGBA, p *matrixProfile) {
+	m := p.sRGB()
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b := p.curves[0][img.Pix[i]], p.curves[1][img.Pix[i+1]], p.curves[2][img.Pix[i+2]]
+		for c := 0; c < 3; c++ {
+			img.Pix[i+c] = encodeSRGB(m[c][0]*r + m[c][1]*g + m[c][2]*b)
+		}
+	}
+}
+
+// encodeSRGB applies the sRGB transfer function to the linear value.
+func encodeSRGB(value float64) uint8 {
+	value = math.Max(0, math.Min(1, value))
+	if value <= 0.0031308 {
+		value *= 12.92
+	} else {
+		value = 1.055*math.Pow(value, 1/2.4) - 0.055
+	}
+	return uint8(value*255 + 0.5)
+}
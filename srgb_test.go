@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// adobeRGBProfile returns a matrix/TRC profile with the Adobe RGB (1998)
+// D50 adapted colorants and its 2.2 gamma tone curves.
+func adobeRGBProfile() []byte {
+	colorants := [][3]float64{{0.60974, 0.31111, 0.01947}, {0.20528, 0.62567, 0.06087}, {0.14919, 0.06322, 0.74457}}
+
+	profile := make([]byte, 132+6*12)
+	copy(profile[16:], "RGB XYZ ")
+	copy(profile[36:], "acsp")
+	binary.BigEndian.PutUint32(profile[128:], 6)
+
+	curve := make([]byte, 16)
+	copy(curve, "curv")
+	binary.BigEndian.PutUint32(curve[8:], 1)
+	binary.BigEndian.PutUint16(curve[12:], 563)
+	curveOffset := len(profile)
+	profile = append(profile, curve...)
+
+	for i, prefix := range []string{"r", "g", "b"} {
+		tag := make([]byte, 20)
+		copy(tag, "XYZ ")
+		for j, value := range colorants[i] {
+			binary.BigEndian.PutUint32(tag[8+j*4:], uint32(int32(math.Round(value*65536))))
+		}
+
+		entry := profile[132+i*24:]
+		copy(entry, prefix+"XYZ")
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(profile)))
+		binary.BigEndian.PutUint32(entry[8:], 20)
+		copy(entry[12:], prefix+"TRC")
+		binary.BigEndian.PutUint32(entry[16:], uint32(curveOffset))
+		binary.BigEndian.PutUint32(entry[20:], 14)
+		profile = append(profile, tag...)
+	}
+
+	binary.BigEndian.PutUint32(profile[0:], uint32(len(profile)))
+	return profile
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	colors := []color.NRGBA{{200, 50, 50, 255}, {255, 255, 255, 255}, {50, 100, 200, 128}}
+	srgb := []color.NRGBA{{232, 46, 46, 255}, {255, 255, 255, 255}, {0, 100, 204, 128}}
+
+	img := image.NewNRGBA(image.Rect(0, 0, len(colors), 1))
+	for x, c := range colors {
+		img.SetNRGBA(x, 0, c)
+	}
+	profile := adobeRGBProfile()
+	source, _ := embedPNGProfile(encodeTestPNG(t, img), "Adobe RGB", profile)
+
+	// Naively stripped: the Adobe RGB values are displayed as sRGB ones
+	naive, err := applyICCProfile(Image{Body: source, Mime: "image/png"}, profile, ImageOptions{StripICC: true})
+	if err != nil || extractICCProfile(naive.Body) != nil {
+		t.Fatalf("The profile must be stripped: %v", err)
+	}
+
+	converted, opts, ok, err := convertToSRGB(source, profile, ImageOptions{StripICC: true})
+	if err != nil || !ok {
+		t.Fatalf("Cannot convert the image to sRGB: %v", err)
+	}
+	if opts.Type != "png" || extractICCProfile(converted) != nil {
+		t.Errorf("Invalid converted image: %s", opts.Type)
+	}
+
+	naiveImg, _ := png.Decode(bytes.NewReader(naive.Body))
+	convertedImg, _ := png.Decode(bytes.NewReader(converted))
+	for x := range colors {
+		if c := nrgbaAt(naiveImg, x, 0); c != colors[x] {
+			t.Errorf("Naively stripped pixels must be unchanged: %v", c)
+		}
+		c := nrgbaAt(convertedImg, x, 0)
+		if absInt(int(c.R)-int(srgb[x].R)) > 1 || absInt(int(c.G)-int(srgb[x].G)) > 1 || absInt(int(c.B)-int(srgb[x].B)) > 1 || c.A != srgb[x].A {
+			t.Errorf("Invalid sRGB pixel of %v: %v, expected %v", colors[x], c, srgb[x])
+		}
+	}
+
+	// The converted red is more saturated than the naively stripped one
+	if c := nrgbaAt(convertedImg, 0, 0); c.R <= colors[0].R {
+		t.Errorf("The Adobe RGB red must be converted to a brighter sRGB red: %v", c)
+	}
+
+	if _, _, ok, _ := convertToSRGB(source, testICCProfile(512), ImageOptions{}); ok {
+		t.Error("Profiles without matrix/TRC tags must not be converted")
+	}
+}
+
+func TestParseToneCurve(t *testing.T) {
+	para := func(function uint16, params ...float64) []byte {
+		tag := make([]byte, 12+len(params)*4)
+		copy(tag, "para")
+		binary.BigEndian.PutUint16(tag[8:], function)
+		for i, value := range params {
+			binary.BigEndian.PutUint32(tag[12+i*4:], uint32(int32(math.Round(value*65536))))
+		}
+		return tag
+	}
+
+	// The sRGB curve as parametric type 3
+	curve, ok := parseToneCurve(para(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045))
+	if !ok {
+		t.Fatal("Cannot parse the parametric curve")
+	}
+	for _, value := range []float64{0, 0.02, 0.5, 1} {
+		if linear := curve(value); math.Abs(float64(encodeSRGB(linear))-value*255) > 0.5 {
+			t.Errorf("Invalid sRGB curve value of %v: %v", value, linear)
+		}
+	}
+
+	if curve, ok := parseToneCurve(para(0, 2)); !ok || math.Abs(curve(0.5)-0.25) > 0.001 {
+		t.Error("Invalid gamma parametric curve")
+	}
+	if _, ok := parseToneCurve(para(3, 2.4)); ok {
+		t.Error("Truncated parametric curves must be rejected")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	stampTextHeader  = "X-Imaginary-Stamp-Text"
+	defaultStampText = "{date} {time}"
+)
+
+// stampClock returns the processing time, replaceable in tests.
+var stampClock = time.Now
+
+// Escapes the Pango markup rendered by libvips text, so the resolved
+// values are drawn literally
+var markupEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Stamp overlays a text resolving its template tokens at processing time,
+// such as the timestamp burned into security camera stills.
+func Stamp(buf []byte, o ImageOptions) (Image, error) {
+	if o.Text == "" {
+		o.Text = defaultStampText
+	}
+	o.Text = resolveStampText(o.Text, o.Source, stampClock())
+	o.NoReplicate = true
+
+	image, err := Watermark(buf, o)
+	if err != nil {
+		return image, err
+	}
+	image.Headers = withHeader(image.Headers, stampTextHeader, o.Text)
+	return image, nil
+}
+
+// resolveStampText replaces the {date}, {time} and {source} tokens by the
+// UTC processing date and time and the source image key. Unknown tokens
+// are kept as they are, and the values are never resolved again, so a
+// source key cannot inject tokens or markup.
+func resolveStampText(text, source string, now time.Time) string {
+	now = now.UTC()
+	return strings.NewReplacer(
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("15:04:05"),
+		"{source}", markupEscaper.Replace(source),
+	).Replace(text)
+}
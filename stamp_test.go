@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResolveStampText(t *testing.T) {
+	now := time.Date(2024, 3, 9, 17, 4, 5, 0, time.FixedZone("CET", 3600))
+
+	cases := []struct {
+		text, source, expected string
+	}{
+		{"{date} {time}", "", "2024-03-09 16:04:05"},
+		{"Camera {source} at {time}", "cam1.jpg", "Camera cam1.jpg at 16:04:05"},
+		{"{unknown} {Date} {date", "", "{unknown} {Date} {date"},
+		// Values are neither resolved again nor rendered as markup
+		{"{source}", "{date}<b>&", "{date}&lt;b&gt;&amp;"},
+	}
+
+	for _, test := range cases {
+		if text := resolveStampText(test.text, test.source, now); text != test.expected {
+			t.Errorf("Invalid stamp text for %s: %s", test.text, text)
+		}
+	}
+}
+
+func TestStamp(t *testing.T) {
+	ts := testServer(controller(Stamp))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?text=Camera%20{date}&margin=10", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	if text := res.Header.Get(stampTextHeader); text != "Camera "+time.Now().UTC().Format("2006-01-02") {
+		t.Errorf("The stamp must contain the current date: %s", text)
+	}
+}
+
+func TestStampDefaultText(t *testing.T) {
+	stampClock = func() time.Time { return time.Date(2024, 3, 9, 16, 4, 5, 0, time.UTC) }
+	defer func() { stampClock = time.Now }()
+
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, err := Stamp(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot stamp the image: %s", err)
+	}
+	if image.Headers[stampTextHeader] != "2024-03-09 16:04:05" {
+		t.Errorf("Invalid stamp text: %s", image.Headers[stampTextHeader])
+	}
+}
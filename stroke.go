@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+const (
+	defaultWatermarkOpacity = 0.25
+	maxTextStrokeWidth      = 10
+)
+
+// watermarkWithStroke renders the watermark text as a mask on a blank
+// canvas of the same size via libvips, then paints the stroke (the mask
+// dilated by the stroke width), if any, and the text fill over the image.
+// With an opacity curve, the opacity follows the local image brightness.
+func watermarkWithStroke(buf []byte, opts bimg.Options, o ImageOptions) (Image, error) {
+	img, err := decodeRaster(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	mask, err := renderTextMask(img.Bounds(), opts.Watermark)
+	if err != nil {
+		return Image{}, err
+	}
+
+	fill := color.NRGBA{255, 255, 255, 255}
+	if len(o.Color) > 2 {
+		fill = color.NRGBA{o.Color[0], o.Color[1], o.Color[2], 255}
+	}
+	stroke := color.NRGBA{0, 0, 0, 255}
+	if len(o.TextStroke) > 2 {
+		stroke = color.NRGBA{o.TextStroke[0], o.TextStroke[1], o.TextStroke[2], 255}
+	}
+
+	width := o.TextStrokeWidth
+	if width <= 0 && len(o.TextStroke) > 2 {
+		width = 1
+	}
+
+	opacity := float64(o.Opacity)
+	if opacity <= 0 {
+		opacity = defaultWatermarkOpacity
+	}
+	opacityAt := uniformOpacity(opacity)
+	if o.OpacityCurve != "" {
+		dark, light, err := parseOpacityCurve(o.OpacityCurve)
+		if err != nil {
+			return Image{}, err
+		}
+		opacityAt = curveOpacity(img, dark, light)
+	}
+
+	strokeText(img, mask, fill, stroke, width, opacityAt)
+
+	return encodeRaster(img, keepImageType(buf, o))
+}
+
+// renderTextMask renders the watermark text in white over a black canvas,
+// returning its luminance as the text coverage mask.
+func renderTextMask(bounds image.Rectangle, watermark bimg.Watermark) (*image.Gray, error) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for i := 3; i < len(canvas.Pix); i += 4 {
+		canvas.Pix[i] = 255
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, err
+	}
+
+	watermark.Opacity = 1
+	watermark.Background = bimg.Color{255, 255, 255}
+	out, err := Process(buf.Bytes(), bimg.Options{Type: bimg.PNG, Watermark: watermark})
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := png.Decode(bytes.NewReader(out.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	mask := image.NewGray(canvas.Bounds())
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			mask.SetGray(x, y, color.GrayModel.Convert(rendered.At(x, y)).(color.Gray))
+		}
+	}
+	return mask, nil
+}
+
+// strokeText paints the stroke color where the dilated text mask covers
+// the image and the fill color over the original text mask. No stroke is
+// painted with a zero width. Only the text area, padded by the stroke
+// width, is painted, as the mask is empty elsewhere.
+func strokeText(img *image.NRGBA, mask *image.Gray, fill, stroke color.NRGBA, width int, opacity opacityMap) {
+	if width > maxTextStrokeWidth {
+		width = maxTextStrokeWidth
+	}
+	if width < 0 {
+		width = 0
+	}
+
+	area := textBounds(mask).Inset(-width).Intersect(mask.Bounds())
+	var outline *image.Gray
+	if width > 0 {
+		outline = dilateMask(mask, area, width)
+	}
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			alpha := opacity(x, y)
+			if outline != nil {
+				blendPixel(img, x, y, stroke, float64(outline.GrayAt(x, y).Y)/255*alpha)
+			}
+			blendPixel(img, x, y, fill, float64(mask.GrayAt(x, y).Y)/255*alpha)
+		}
+	}
+}
+
+// textBounds returns the smallest rectangle covering the text mask, or an
+// empty one without text.
+func textBounds(mask *image.Gray) image.Rectangle {
+	var text image.Rectangle
+	bounds := mask.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if mask.Pix[mask.PixOffset(x, y)] > 0 {
+				text = text.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return text
+}
+
+// dilateMask expands the mask coverage by the given radius in pixels,
+// within the given area of the mask.
+func dilateMask(mask *image.Gray, area image.Rectangle, radius int) *image.Gray {
+	out := image.NewGray(mask.Bounds())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			var peak uint8
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					if dx*dx+dy*dy > radius*radius {
+						continue
+					}
+					if value := mask.GrayAt(x+dx, y+dy).Y; value > peak {
+						peak = value
+					}
+				}
+			}
+			out.SetGray(x, y, color.Gray{peak})
+		}
+	}
+	return out
+}
+
+func blendPixel(img *image.NRGBA, x, y int, c color.NRGBA, alpha float64) {
+	if alpha <= 0 {
+		return
+	}
+	i := img.PixOffset(x, y)
+	img.Pix[i] = uint8(float64(img.Pix[i])*(1-alpha) + float64(c.R)*alpha)
+	img.Pix[i+1] = uint8(float64(img.Pix[i+1])*(1-alpha) + float64(c.G)*alpha)
+	img.Pix[i+2] = uint8(float64(img.Pix[i+2])*(1-alpha) + float64(c.B)*alpha)
+	img.Pix[i+3] = uint8(255 - (1-alpha)*float64(255-img.Pix[i+3]))
+}
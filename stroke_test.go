@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStrokeText(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	// Text mask covering a 4x4 square at the center
+	mask := image.NewGray(img.Bounds())
+	for y := 8; y < 12; y++ {
+		for x := 8; x < 12; x++ {
+			mask.SetGray(x, y, color.Gray{255})
+		}
+	}
+
+	fill := color.NRGBA{255, 255, 255, 255}
+	stroke := color.NRGBA{255, 0, 0, 255}
+	strokeText(img, mask, fill, stroke, 2, uniformOpacity(1))
+
+	cases := []struct {
+		x, y     int
+		expected color.NRGBA
+	}{
+		{10, 10, fill},
+		{8, 8, fill},
+		{7, 10, stroke},
+		{6, 10, stroke},
+		{12, 10, stroke},
+		{10, 6, stroke},
+		{10, 13, stroke},
+		{5, 10, color.NRGBA{255, 255, 255, 255}},
+		{0, 0, color.NRGBA{255, 255, 255, 255}},
+	}
+
+	for _, test := range cases {
+		if c := img.NRGBAAt(test.x, test.y); c != test.expected {
+			t.Errorf("Invalid pixel color at %d,%d: %v", test.x, test.y, c)
+		}
+	}
+}
+
+func TestWatermarkStrokeKeepsImageType(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	image, err := Watermark(buf, ImageOptions{Text: "imaginary", TextStroke: []uint8{0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image type: %s", image.Mime)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tenants tracked before idle ones are forgotten, bounding the memory
+// used by clients sending many different keys
+const maxTrackedTenants = 10000
+
+// TenantLimiter bounds, per API key, how many images are processed at the
+// same time and how many requests per second are served, so a tenant
+// cannot starve the others, only bound together by the global limits.
+// Over limit requests are rejected with 429 instead of queued.
+type TenantLimiter struct {
+	concurrency int
+	rate        float64
+	mutex       sync.Mutex
+	tenants     map[string]*tenantUsage
+}
+
+// tenantUsage keeps the tenant images in process and its token bucket,
+// holding up to one second of requests.
+type tenantUsage struct {
+	active  int
+	tokens  float64
+	updated time.Time
+}
+
+func NewTenantLimiter(concurrency, rate int) *TenantLimiter {
+	if concurrency <= 0 && rate <= 0 {
+		return nil
+	}
+	return &TenantLimiter{
+		concurrency: concurrency,
+		rate:        float64(rate),
+		tenants:     make(map[string]*tenantUsage),
+	}
+}
+
+func (l *TenantLimiter) Limit(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if l == nil {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := requestTenant(r)
+		retryAfter, ok := l.acquire(tenant, time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			ErrorReply(w, ErrTooManyRequests)
+			return
+		}
+
+		defer l.release(tenant)
+		fn(w, r)
+	}
+}
+
+// requestTenant identifies the tenant by its validated API key. Any other
+// key is chosen by the client, which could rotate it to dodge the limits,
+// so requests without a validated key are limited per client IP instead.
+func requestTenant(r *http.Request) string {
+	if key := authorizedApiKey(r); key != "" {
+		return "key:" + key
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// acquire takes a processing slot and a rate token of the tenant, or
+// returns in how many seconds to retry if the tenant is over its limits.
+func (l *TenantLimiter) acquire(tenant string, now time.Time) (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	usage, ok := l.tenants[tenant]
+	if !ok {
+		if len(l.tenants) >= maxTrackedTenants {
+			l.forgetIdle(now)
+		}
+		usage = &tenantUsage{tokens: l.rate, updated: now}
+		l.tenants[tenant] = usage
+	}
+
+	if l.concurrency > 0 && usage.active >= l.concurrency {
+		return 1, false
+	}
+	if l.rate > 0 {
+		usage.tokens = math.Min(l.rate, usage.tokens+now.Sub(usage.updated).Seconds()*l.rate)
+		usage.updated = now
+		if usage.tokens < 1 {
+			return int(math.Ceil((1 - usage.tokens) / l.rate)), false
+		}
+		usage.tokens--
+	}
+
+	usage.active++
+	return 0, true
+}
+
+func (l *TenantLimiter) release(tenant string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if usage, ok := l.tenants[tenant]; ok {
+		usage.active--
+	}
+}
+
+// forgetIdle drops the tenants without images in process and with a full
+// token bucket, which would be tracked again from the same state.
+func (l *TenantLimiter) forgetIdle(now time.Time) {
+	for tenant, usage := range l.tenants {
+		if usage.active == 0 && (l.rate == 0 || usage.tokens+now.Sub(usage.updated).Seconds()*l.rate >= l.rate) {
+			delete(l.tenants, tenant)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTenantLimiterConcurrency(t *testing.T) {
+	limiter := NewTenantLimiter(1, 0)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	handler := http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {
+		if requestApiKey(r) == "a" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	ts := httptest.NewServer(authorizeClient(handler, "a,b"))
+	defer ts.Close()
+
+	get := func(key string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Tenant a takes its only slot
+	done := make(chan *http.Response)
+	go func() { done <- get("a") }()
+	<-started
+
+	if res := get("a"); res.StatusCode != 429 || res.Header.Get("Retry-After") == "" {
+		t.Errorf("Saturated tenant must be rejected: %s", res.Status)
+	}
+	if res := get("b"); res.StatusCode != 200 {
+		t.Errorf("Other tenants must not be affected: %s", res.Status)
+	}
+
+	close(release)
+	if res := <-done; res.StatusCode != 200 {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+
+	// Released slots are available again
+	if res := get("a"); res.StatusCode != 200 {
+		t.Errorf("Released tenant must be served: %s", res.Status)
+	}
+}
+
+func TestTenantLimiterUnauthorizedKeys(t *testing.T) {
+	limiter := NewTenantLimiter(0, 1)
+	ts := httptest.NewServer(http.HandlerFunc(limiter.Limit(func(w http.ResponseWriter, r *http.Request) {})))
+	defer ts.Close()
+
+	// Keys not validated by authorizeClient share the client IP limits
+	for i, key := range []string{"a", "b", "c"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Header.Set("API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && res.StatusCode != 429 {
+			t.Errorf("Rotated keys must not dodge the limits: %s", res.Status)
+		}
+	}
+	if len(limiter.tenants) != 1 {
+		t.Errorf("Invalid tracked tenants: %v", limiter.tenants)
+	}
+}
+
+func TestTenantLimiterRate(t *testing.T) {
+	limiter := NewTenantLimiter(0, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := limiter.acquire("a", now); !ok {
+			t.Fatalf("Request %d within the rate must be accepted", i)
+		}
+		limiter.release("a")
+	}
+	if retryAfter, ok := limiter.acquire("a", now); ok || retryAfter != 1 {
+		t.Errorf("Requests over the rate must be rejected: %v (retry after %d)", ok, retryAfter)
+	}
+	if _, ok := limiter.acquire("b", now); !ok {
+		t.Error("Other tenants must not be affected")
+	}
+
+	// Tokens are refilled over time
+	if _, ok := limiter.acquire("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Refilled tenant must be accepted")
+	}
+}
+
+func TestTenantLimiterForgetIdle(t *testing.T) {
+	limiter := NewTenantLimiter(1, 1)
+	now := time.Now()
+
+	limiter.acquire("busy", now)
+	limiter.acquire("idle", now.Add(-time.Second))
+	limiter.release("idle")
+	limiter.acquire("throttled", now)
+	limiter.release("throttled")
+
+	limiter.forgetIdle(now)
+	if _, ok := limiter.tenants["idle"]; ok {
+		t.Error("Idle tenants must be forgotten")
+	}
+	if len(limiter.tenants) != 2 {
+		t.Errorf("Busy and throttled tenants must be kept: %v", limiter.tenants)
+	}
+}
+
+func TestTenantLimiterDisabled(t *testing.T) {
+	if NewTenantLimiter(0, 0) != nil {
+		t.Fatal("Limiter should be disabled")
+	}
+}
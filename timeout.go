@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/h2non/bimg.v0"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OperationTimeouts maps operation names (resize, crop...) or output
+// image formats (jpeg, webp...) to their max processing duration.
+type OperationTimeouts map[string]time.Duration
+
+// ParseOperationTimeouts parses a comma separated list of name=duration pairs.
+func ParseOperationTimeouts(value string) (OperationTimeouts, error) {
+	timeouts := OperationTimeouts{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid operation timeout: %s", pair)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid operation timeout duration: %s", pair)
+		}
+
+		timeouts[strings.ToLower(strings.TrimSpace(parts[0]))] = duration
+	}
+	return timeouts, nil
+}
+
+// For returns the longest timeout matching the operation or the output
+// format, so slow encoders are granted more time than fast operations.
+func (t OperationTimeouts) For(operation, format string) time.Duration {
+	timeout := t[operation]
+	if formatTimeout := t[format]; formatTimeout > timeout {
+		timeout = formatTimeout
+	}
+	return timeout
+}
+
+// runWithTimeout runs the processing function until the timeout or the
+// context deadline expires, or the context is cancelled. libvips calls
+// cannot be interrupted, so the function keeps running in background,
+// holding its processing slots, but the request is released.
+func runWithTimeout(ctx context.Context, timeout time.Duration, fn func() (Image, error)) (Image, error) {
+	if _, ok := ctx.Deadline(); timeout <= 0 && !ok {
+		return fn()
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		image Image
+		err   error
+	}
+
+	// Abandoned processing may still read the spilled request body
+	release := holdBodySpool(ctx)
+	releaseSlots := holdProcessingSlots(ctx)
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		defer releaseSlots()
+		image, err := fn()
+		done <- result{image, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.image, res.err
+	case <-ctx.Done():
+		return Image{}, ErrProcessingTimeout
+	}
+}
+
+// requestDeadline returns the max duration of the whole request, from the
+// image fetch to the encoding. The deadline param, in milliseconds, is
+// capped to the server deadline.
+func requestDeadline(r *http.Request, max time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("deadline")
+	if value == "" {
+		return max, nil
+	}
+
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, NewError("Invalid deadline param: must be a positive number of milliseconds", BadRequest)
+	}
+	if deadline := time.Duration(ms) * time.Millisecond; max <= 0 || deadline < max {
+		return deadline, nil
+	}
+	return max, nil
+}
+
+// decodeImage loads the image metadata, which makes libvips parse the
+// image, including the vector formats rendered on load.
+var decodeImage = func(buf []byte) error {
+	_, err := bimg.Metadata(buf)
+	return err
+}
+
+// checkDecodeTimeout decodes the image before any processing, so malicious
+// inputs stalling the decoder are rejected within the decode timeout,
+// regardless of the longer operation timeouts.
+func checkDecodeTimeout(ctx context.Context, timeout time.Duration, buf []byte) error {
+	if timeout <= 0 {
+		return nil
+	}
+	_, err := runWithTimeout(ctx, timeout, func() (Image, error) {
+		return Image{}, decodeImage(buf)
+	})
+	if err == ErrProcessingTimeout {
+		return ErrDecodeTimeout
+	}
+	if err != nil {
+		return NewError("Cannot decode the image: "+err.Error(), BadRequest)
+	}
+	return nil
+}
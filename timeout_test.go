@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseOperationTimeouts(t *testing.T) {
+	timeouts, err := ParseOperationTimeouts("resize=2s, AVIF=30s,,webp=500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeouts["resize"] != 2*time.Second || timeouts["avif"] != 30*time.Second || timeouts["webp"] != 500*time.Millisecond {
+		t.Fatalf("Invalid timeouts: %#v", timeouts)
+	}
+
+	for _, value := range []string{"resize", "resize=foo", "resize=-1s", "=1s=2"} {
+		if _, err := ParseOperationTimeouts(value); err == nil {
+			t.Errorf("Timeouts should be invalid: %s", value)
+		}
+	}
+}
+
+func TestOperationTimeoutsFor(t *testing.T) {
+	timeouts := OperationTimeouts{"resize": 20 * time.Millisecond, "avif": 200 * time.Millisecond}
+
+	cases := []struct {
+		operation string
+		format    string
+		expected  time.Duration
+	}{
+		{"resize", "jpeg", 20 * time.Millisecond},
+		{"resize", "avif", 200 * time.Millisecond},
+		{"crop", "avif", 200 * time.Millisecond},
+		{"crop", "jpeg", 0},
+	}
+
+	for _, test := range cases {
+		if timeout := timeouts.For(test.operation, test.format); timeout != test.expected {
+			t.Errorf("Invalid timeout for %s/%s: %s", test.operation, test.format, timeout)
+		}
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	timeouts := OperationTimeouts{"resize": 20 * time.Millisecond, "avif": 200 * time.Millisecond}
+	slowEncode := func() (Image, error) {
+		time.Sleep(60 * time.Millisecond)
+		return Image{Body: []byte("ok")}, nil
+	}
+
+	// A slow AVIF encode is granted the longer format timeout
+	image, err := runWithTimeout(context.Background(), timeouts.For("resize", "avif"), slowEncode)
+	if err != nil || string(image.Body) != "ok" {
+		t.Fatalf("AVIF processing should not timeout: %v", err)
+	}
+
+	// The same delay exceeds the resize timeout
+	_, err = runWithTimeout(context.Background(), timeouts.For("resize", "jpeg"), slowEncode)
+	if err != ErrProcessingTimeout {
+		t.Fatalf("Resize processing should timeout: %v", err)
+	}
+}
+
+func TestOperationTimeoutResponse(t *testing.T) {
+	slow := Operation(func(buf []byte, o ImageOptions) (Image, error) {
+		time.Sleep(100 * time.Millisecond)
+		return Convert(buf, o)
+	})
+
+	opts := ServerOptions{OperationTimeouts: OperationTimeouts{"slow": 10 * time.Millisecond}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", optionsController(slow, opts))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/slow?type=png", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 504 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestDecodeTimeout(t *testing.T) {
+	// Simulates a decoder stalled by a pathological vector image
+	release := make(chan struct{})
+	defer close(release)
+	decode := decodeImage
+	decodeImage = func(buf []byte) error {
+		<-release
+		return nil
+	}
+	defer func() { decodeImage = decode }()
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><defs><pattern id="p"><use href="#p"/></pattern></defs></svg>`)
+	if err := checkDecodeTimeout(context.Background(), 20*time.Millisecond, svg); err != ErrDecodeTimeout {
+		t.Fatalf("Invalid decode timeout error: %v", err)
+	}
+
+	opts := ServerOptions{DecodeTimeout: 20 * time.Millisecond}
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/resize?width=100", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestDecodeTimeoutDisabled(t *testing.T) {
+	if err := checkDecodeTimeout(context.Background(), 0, nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkDecodeTimeout(context.Background(), time.Second, []byte("invalid")); err == nil {
+		t.Error("Invalid images must fail to decode")
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		w.Write(buf)
+	}))
+	defer origin.Close()
+
+	slowEncode := func(buf []byte, o ImageOptions) (Image, error) {
+		time.Sleep(60 * time.Millisecond)
+		return Image{Body: buf, Mime: "image/jpeg"}, nil
+	}
+
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true, RequestDeadline: 100 * time.Millisecond}
+	LoadSources(opts)
+
+	cases := []struct {
+		deadline time.Duration
+		query    string
+		status   int
+	}{
+		// Fetch and encode fit the deadline separately, but not together
+		{100 * time.Millisecond, "", http.StatusGatewayTimeout},
+		{time.Second, "", http.StatusOK},
+		{time.Second, "&deadline=100", http.StatusGatewayTimeout},
+		{100 * time.Millisecond, "&deadline=5000", http.StatusGatewayTimeout},
+		{0, "&deadline=foo", http.StatusBadRequest},
+	}
+
+	for _, test := range cases {
+		opts.RequestDeadline = test.deadline
+		ts := httptest.NewServer(http.HandlerFunc(imageController(opts, slowEncode)))
+		res, err := http.Get(ts.URL + "/?url=" + origin.URL + test.query)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for deadline %s%s: %d", test.deadline, test.query, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseSourceTLSConfig builds the TLS client config used to fetch remote
+// URL images. It returns nil if no setting is defined, so the default
+// transport is used.
+func ParseSourceTLSConfig(minVersion, cipherSuites, caFile string) (*tls.Config, error) {
+	if minVersion == "" && cipherSuites == "" && caFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS version: %s", minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if cipherSuites != "" {
+		suites, err := parseCipherSuites(cipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+
+	if caFile != "" {
+		buf, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the CA bundle: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if pool.AppendCertsFromPEM(buf) == false {
+			return nil, fmt.Errorf("no valid certificates in the CA bundle: %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// parseCipherSuites maps a comma separated list of cipher suite names,
+// such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their IDs. Cipher
+// suites are not configurable in TLS 1.3.
+func parseCipherSuites(value string) ([]uint16, error) {
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid or insecure TLS cipher suite: %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TransformRequest defines the image source, the operations applied in
+// order and the output settings in a single JSON document.
+type TransformRequest struct {
+	Source      TransformSource     `json:"source"`
+	Operations  []PipelineOperation `json:"operations"`
+	Type        string              `json:"type"`
+	Quality     int                 `json:"quality"`
+	Compression int                 `json:"compression"`
+}
+
+// TransformSource defines exactly one of a remote URL, a file of the
+// mounted directory or the base64 encoded image data.
+type TransformSource struct {
+	URL  string `json:"url"`
+	File string `json:"file"`
+	Data string `json:"data"`
+}
+
+// transformController processes a JSON transform spec, running its
+// operations as a pipeline so every step accepts the same params as the
+// single endpoints.
+func transformController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			ErrorReply(w, ErrMethodNotAllowed)
+			return
+		}
+
+		var spec TransformRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMemory)).Decode(&spec); err != nil {
+			ErrorReply(w, NewError("Invalid transform request: "+err.Error(), BadRequest))
+			return
+		}
+
+		operations, _ := json.Marshal(spec.Operations)
+		query := url.Values{"operations": []string{string(operations)}}
+		if spec.Type != "" {
+			query.Set("type", spec.Type)
+		}
+		if spec.Quality != 0 {
+			query.Set("quality", strconv.Itoa(spec.Quality))
+		}
+		if spec.Compression != 0 {
+			query.Set("compression", strconv.Itoa(spec.Compression))
+		}
+
+		// Inline images over the max body memory are spilled to disk
+		r, spool := withBodySpool(r)
+		defer spool.Close()
+
+		buf, imageSource, err := transformSource(r, spec.Source, query, o)
+		if err != nil {
+			ErrorReply(w, err.(Error))
+			return
+		}
+		if len(buf) == 0 {
+			ErrorReply(w, ErrEmptyBody)
+			return
+		}
+
+		req := precomputeRequest(r, "/transform", query)
+		if imageSource != nil {
+			req = withImageSource(req, imageSource)
+		} else {
+			// Inline images are not identified by the query, so
+			// they cannot be cached
+			req.Method = "POST"
+		}
+		imageHandler(w, req, buf, Pipeline, o)
+	}
+}
+
+// transformSource reads the source image, reusing the registered url and
+// file image sources, which must be enabled as for GET requests.
+func transformSource(r *http.Request, source TransformSource, query url.Values, o ServerOptions) ([]byte, ImageSource, error) {
+	defined := 0
+	for _, value := range []string{source.URL, source.File, source.Data} {
+		if value != "" {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return nil, nil, NewError("Invalid transform request: exactly one of url, file or data source must be defined", BadRequest)
+	}
+
+	if source.Data != "" {
+		if o.DisableBodySource {
+			return nil, nil, ErrUploadsDisabled
+		}
+		buf, err := inlineImage(r, source.Data, o)
+		if e, ok := err.(Error); ok && err != ErrIncompleteBody {
+			return nil, nil, e
+		}
+		if err != nil {
+			return nil, nil, NewError("Invalid transform request: invalid base64 image data", BadRequest)
+		}
+		return buf, nil, nil
+	}
+
+	if source.URL != "" {
+		if o.EnableURLSource == false {
+			return nil, nil, ErrURLSourceDisabled
+		}
+		query.Set("url", source.URL)
+	}
+	if source.File != "" {
+		if o.Mount == "" {
+			return nil, nil, NewError("Mounted file image sources are not enabled", NotAllowed)
+		}
+		query.Set("file", source.File)
+	}
+
+	req := precomputeRequest(r, "/", query)
+	imageSource := MatchSource(req)
+	if imageSource == nil {
+		return nil, nil, ErrMissingImageSource
+	}
+
+	buf, err := imageSource.GetImage(req)
+	if err != nil {
+		if e, ok := err.(Error); ok {
+			return nil, nil, e
+		}
+		return nil, nil, NewError(err.Error(), BadRequest)
+	}
+	return buf, imageSource, nil
+}
+
+// inlineImage decodes the base64 image data as an uploaded body, so the
+// same max body size, memory and accepted Content-Type limits apply. As
+// the data has no declared Content-Type, it is detected from the image.
+func inlineImage(r *http.Request, data string, o ServerOptions) ([]byte, error) {
+	source := NewBodyImageSource(&SourceConfig{
+		MaxBodySize:      o.MaxBodySize,
+		MaxBodyMemory:    o.MaxBodyMemory,
+		BodyContentTypes: o.BodyContentTypes,
+	})
+
+	body := bufio.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	head, _ := body.Peek(512)
+
+	req := r.WithContext(r.Context())
+	req.Header = http.Header{"Content-Type": {DetectContentType(head)}}
+	req.Body = ioutil.NopCloser(body)
+	req.ContentLength = -1
+	return source.GetImage(req)
+}
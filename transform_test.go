@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"gopkg.in/h2non/bimg.v0"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	}))
+	defer origin.Close()
+
+	opts := ServerOptions{EnableURLSource: true, AllowPrivateIPs: true}
+	LoadSources(opts)
+	ts := httptest.NewServer(NewServerMux(opts))
+	defer ts.Close()
+
+	body := fmt.Sprintf(`{
+		"source": {"url": "%s/large.jpg"},
+		"operations": [
+			{"operation": "resize", "params": {"width": 300}},
+			{"operation": "convert", "params": {"type": "png"}}
+		]
+	}`, origin.URL)
+	res, err := http.Post(ts.URL+"/transform", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	image, _ := ioutil.ReadAll(res.Body)
+	size, err := bimg.Size(image)
+	if err != nil || size.Width != 300 {
+		t.Errorf("Invalid image size: %#v", size)
+	}
+}
+
+func TestTransformInlineSource(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	ts := httptest.NewServer(NewServerMux(ServerOptions{}))
+	defer ts.Close()
+
+	body := `{"source": {"data": "` + base64.StdEncoding.EncodeToString(buf) + `"},
+		"operations": [{"operation": "resize", "params": {"width": 200}}], "type": "webp"}`
+	res, err := http.Post(ts.URL+"/transform", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/webp" {
+		t.Fatalf("Invalid response: %s %s", res.Status, res.Header.Get("Content-Type"))
+	}
+}
+
+func TestTransformInlineSourceLimits(t *testing.T) {
+	buf, _ := ioutil.ReadFile("fixtures/large.jpg")
+	body := `{"source": {"data": "` + base64.StdEncoding.EncodeToString(buf) + `"},
+		"operations": [{"operation": "resize", "params": {"width": 200}}]}`
+
+	cases := []struct {
+		opts   ServerOptions
+		status int
+	}{
+		{ServerOptions{MaxBodySize: int64(len(buf))}, 200},
+		{ServerOptions{MaxBodySize: int64(len(buf)) - 1}, 413},
+		{ServerOptions{MaxBodyMemory: 1024}, 200},
+		{ServerOptions{BodyContentTypes: []string{"image/jpeg"}}, 200},
+		{ServerOptions{BodyContentTypes: []string{"image/png"}}, 415},
+	}
+
+	for _, test := range cases {
+		ts := httptest.NewServer(NewServerMux(test.opts))
+		res, err := http.Post(ts.URL+"/transform", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %#v: %s", test.opts, res.Status)
+		}
+	}
+}
+
+func TestTransformInvalidRequest(t *testing.T) {
+	cases := []struct {
+		body   string
+		status int
+	}{
+		{`{`, 400},
+		{`{"operations": [{"operation": "resize"}]}`, 400},
+		{`{"source": {"url": "http://localhost/a.jpg", "data": "AA=="}, "operations": [{"operation": "resize"}]}`, 400},
+		{`{"source": {"data": "%%%"}, "operations": [{"operation": "resize"}]}`, 400},
+		{`{"source": {"url": "http://localhost/a.jpg"}, "operations": [{"operation": "resize"}]}`, 405},
+		{`{"source": {"file": "large.jpg"}, "operations": [{"operation": "resize"}]}`, 405},
+	}
+
+	fn := transformController(ServerOptions{})
+	for _, test := range cases {
+		res := httptest.NewRecorder()
+		fn(res, httptest.NewRequest("POST", "/transform", strings.NewReader(test.body)))
+		if res.Code != test.status {
+			t.Errorf("Invalid response status for %s: %d", test.body, res.Code)
+		}
+	}
+}
@@ -1,10 +1,158 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"gopkg.in/h2non/bimg.v0"
+	"net/http"
 	"strings"
 )
 
+// Bytes read by DetectContent to find the Extra hints, as many as
+// http.DetectContentType considers
+const sniffLength = 512
+
+// Extra hints of the detected images, to route color managed processing
+const (
+	hintJPEGCMYK = "jpeg-cmyk"
+	hintJPEGICC  = "jpeg-icc"
+	hintTIFFCMYK = "tiff-cmyk"
+	hintTIFFICC  = "tiff-icc"
+)
+
+// TIFF tags and values of the color space and the embedded ICC profile
+const (
+	tiffTagPhotometric  = 262
+	tiffTagICCProfile   = 34675
+	tiffPhotometricCMYK = 5
+)
+
+// ISOBMFF brands identifying AVIF still images and image sequences
+var avifBrands = [][]byte{[]byte("ftypavif"), []byte("ftypavis")}
+
+// Little and big endian TIFF headers
+var tiffHeaders = [][]byte{[]byte("II*\x00"), []byte("MM\x00*")}
+
+// DetectContentType extends http.DetectContentType with the image formats
+// it does not know about, such as AVIF and TIFF.
+func DetectContentType(buf []byte) string {
+	for _, header := range tiffHeaders {
+		if bytes.HasPrefix(buf, header) {
+			return "image/tiff"
+		}
+	}
+	if len(buf) >= 12 {
+		for _, brand := range avifBrands {
+			if bytes.Equal(buf[4:12], brand) {
+				return "image/avif"
+			}
+		}
+	}
+	return http.DetectContentType(buf)
+}
+
+// ContentDetection is the detected MIME type of the image, with its Extra
+// hints, such as jpeg-cmyk or tiff-icc.
+type ContentDetection struct {
+	Mime  string
+	Extra []string
+}
+
+// DetectContent detects the MIME type of the image as DetectContentType
+// does, hinting at CMYK color spaces and embedded ICC profiles of JPEG and
+// TIFF images. Hints are best effort: only the first 512 bytes are read,
+// so markers following large EXIF or XMP segments are missed, and the lack
+// of a hint does not mean the image is RGB or without profile.
+func DetectContent(buf []byte) ContentDetection {
+	detection := ContentDetection{Mime: DetectContentType(buf)}
+	if len(buf) > sniffLength {
+		buf = buf[:sniffLength]
+	}
+
+	switch detection.Mime {
+	case "image/jpeg":
+		detection.Extra = jpegHints(buf)
+	case "image/tiff":
+		detection.Extra = tiffHints(buf)
+	}
+	return detection
+}
+
+// jpegHints reads the marker segments within the window: the APP14 Adobe
+// segment color transform, YCCK or none, flags CMYK images unless a frame
+// header with three components is found, while the APP2 ICC_PROFILE
+// segment flags the embedded profile.
+func jpegHints(buf []byte) []string {
+	adobeCMYK, icc, components := false, false, 0
+	for pos := 2; pos+4 <= len(buf) && buf[pos] == 0xff; {
+		marker := buf[pos+1]
+		if marker == jpegMarkerSOS {
+			break
+		}
+		segment := buf[pos+4:]
+		length := int(binary.BigEndian.Uint16(buf[pos+2 : pos+4]))
+		if length < 2 {
+			break
+		}
+		if length-2 < len(segment) {
+			segment = segment[:length-2]
+		}
+
+		switch {
+		case marker == jpegMarkerAPP14 && bytes.HasPrefix(segment, adobeHeader) && len(segment) >= 12:
+			adobeCMYK = segment[11] != 1
+		case marker == 0xe2 && bytes.HasPrefix(segment, iccSegmentHeader):
+			icc = true
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc && len(segment) >= 6:
+			components = int(segment[5])
+		}
+		pos += 2 + length
+	}
+
+	var hints []string
+	if components == 4 || (adobeCMYK && components != 3) {
+		hints = append(hints, hintJPEGCMYK)
+	}
+	if icc {
+		hints = append(hints, hintJPEGICC)
+	}
+	return hints
+}
+
+// tiffHints reads the first IFD entries within the window: the CMYK
+// (separated) photometric interpretation and the ICC profile tag.
+func tiffHints(buf []byte) []string {
+	if len(buf) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if buf[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	var hints []string
+	offset := int(order.Uint32(buf[4:8]))
+	if offset < 8 || offset+2 > len(buf) {
+		return nil
+	}
+	count := int(order.Uint16(buf[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(buf) {
+			break
+		}
+		switch order.Uint16(buf[entry : entry+2]) {
+		case tiffTagPhotometric:
+			if order.Uint16(buf[entry+8:entry+10]) == tiffPhotometricCMYK {
+				hints = append(hints, hintTIFFCMYK)
+			}
+		case tiffTagICCProfile:
+			hints = append(hints, hintTIFFICC)
+		}
+	}
+	return hints
+}
+
 func ExtractImageTypeFromMime(mime string) string {
 	mime = strings.Split(mime, ";")[0]
 	part := strings.Split(mime, "/")
@@ -2,6 +2,9 @@ package main
 
 import (
 	"gopkg.in/h2non/bimg.v0"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -92,3 +95,99 @@ func TestGetImageMimeType(t *testing.T) {
 		}
 	}
 }
+
+func TestDetectContentType(t *testing.T) {
+	cases := []struct {
+		buf      []byte
+		expected string
+	}{
+		{[]byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf"), "image/avif"},
+		{[]byte("\x00\x00\x00\x20ftypavis\x00\x00\x00\x00avisavifmsf1"), "image/avif"},
+		{[]byte("\x00\x00\x00\x1cftypavi"), "application/octet-stream"},
+		{[]byte("\x00\x00\x00\x1cftypavix\x00\x00\x00\x00"), "application/octet-stream"},
+		{[]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{[]byte("II*\x00\x08\x00\x00\x00"), "image/tiff"},
+		{[]byte("MM\x00*\x00\x00\x00\x08"), "image/tiff"},
+	}
+
+	for _, test := range cases {
+		if mime := DetectContentType(test.buf); mime != test.expected {
+			t.Errorf("Invalid content type for %q: %s != %s", test.buf, mime, test.expected)
+		}
+	}
+
+	if IsImageMimeTypeSupported(DetectContentType(cases[0].buf)) {
+		t.Error("AVIF images cannot be decoded by this build")
+	}
+}
+
+func TestDetectContent(t *testing.T) {
+	ycck := append([]byte{}, adobeSegment...)
+	ycck[15] = 2
+	icc := append([]byte{0xff, 0xe2, 0x00, 0x12}, append(iccSegmentHeader, 1, 1, 0, 0)...)
+	exif := append([]byte{0xff, jpegMarkerAPP1, 0x02, 0x02}, make([]byte, 0x200)...)
+	jfif := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x02\x00")
+	tiff = append(tiff, 0x06, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x73, 0x87, 0x07, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00)
+
+	cases := []struct {
+		name     string
+		buf      []byte
+		mime     string
+		expected []string
+	}{
+		{"adobe cmyk", cmykJPEG(8, 8, [4]byte{}, adobeSegment), "image/jpeg", []string{"jpeg-cmyk"}},
+		{"cmyk without marker", cmykJPEG(8, 8, [4]byte{}), "image/jpeg", []string{"jpeg-cmyk"}},
+		{"adobe ycck header", append(append([]byte{0xff, 0xd8}, ycck...), icc...), "image/jpeg", []string{"jpeg-cmyk", "jpeg-icc"}},
+		{"icc profile", append(jfif, icc...), "image/jpeg", []string{"jpeg-icc"}},
+		{"marker past the window", cmykJPEG(8, 8, [4]byte{}, exif, adobeSegment), "image/jpeg", nil},
+		{"rgb with profile", readBytes(t, "imaginary.jpg"), "image/jpeg", []string{"jpeg-icc"}},
+		{"cmyk tiff", tiff, "image/tiff", []string{"tiff-cmyk", "tiff-icc"}},
+		{"png", readBytes(t, "test.png"), "image/png", nil},
+	}
+
+	for _, test := range cases {
+		detection := DetectContent(test.buf)
+		if detection.Mime != test.mime || strings.Join(detection.Extra, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Invalid detection of %s: %s %v", test.name, detection.Mime, detection.Extra)
+		}
+	}
+}
+
+func readBytes(t *testing.T, file string) []byte {
+	buf, err := ioutil.ReadFile("fixtures/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestAVIFOutputFallback(t *testing.T) {
+	cases := []struct {
+		fallback []string
+		status   int
+		warning  string
+	}{
+		{nil, 501, ""},
+		{[]string{"webp"}, 200, "avif encoder unavailable, image encoded as webp"},
+	}
+
+	for _, test := range cases {
+		ts := testServer(optionsController(Convert, ServerOptions{FormatFallback: test.fallback}))
+		res, err := http.Post(ts.URL+"?type=avif", "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Invalid response status for %v: %d", test.fallback, res.StatusCode)
+		}
+		if strings.Contains(res.Header.Get("Warning"), test.warning) == false || (test.warning == "" && res.Header.Get("Warning") != "") {
+			t.Errorf("Invalid Warning header for %v: %s", test.fallback, res.Header.Get("Warning"))
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+// #cgo pkg-config: vips
+// #include <vips/vips.h>
+import "C"
+
+// vipsMemory returns the memory currently allocated by libvips and its
+// peak, in bytes, which the bimg bindings do not expose.
+func vipsMemory() (uint64, uint64) {
+	return uint64(C.vips_tracked_get_mem()), uint64(C.vips_tracked_get_mem_highwater())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"gopkg.in/h2non/bimg.v0"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const watermarkMargin = 10
+
+func hasDefaultWatermark(o ServerOptions) bool {
+	return o.WatermarkText != "" || len(o.WatermarkImage) > 0
+}
+
+// withDefaultWatermarkSettings copies the server-wide watermark to the
+// image options.
+func withDefaultWatermarkSettings(opts ImageOptions, o ServerOptions) ImageOptions {
+	opts.DefaultWatermarkText = o.WatermarkText
+	opts.DefaultWatermarkImage = o.WatermarkImage
+	opts.DefaultWatermarkOpacity = o.WatermarkOpacity
+	return opts
+}
+
+// withDefaultWatermark returns the operation stamping the server-wide
+// watermark on its output, right after the requested operation.
+func (o Operation) withDefaultWatermark() Operation {
+	return func(buf []byte, opts ImageOptions) (Image, error) {
+		image, err := o(buf, opts)
+		if err != nil {
+			return image, err
+		}
+		return applyDefaultWatermark(image, opts)
+	}
+}
+
+// applyDefaultWatermark stamps the server-wide watermark on the processed
+// image, if any.
+func applyDefaultWatermark(img Image, opts ImageOptions) (Image, error) {
+	if opts.NoWatermark || strings.HasPrefix(img.Mime, "image/") == false {
+		return img, nil
+	}
+
+	var err error
+	if opts.DefaultWatermarkText != "" {
+		headers, operations := img.Headers, img.Operations
+		img, err = Process(img.Body, bimg.Options{
+			Quality: opts.Quality,
+			Type:    bimg.DetermineImageType(img.Body),
+			Watermark: bimg.Watermark{
+				Text:    opts.DefaultWatermarkText,
+				Opacity: float32(opts.DefaultWatermarkOpacity),
+			},
+		})
+		if err != nil {
+			return Image{}, err
+		}
+		img.Headers, img.Operations = headers, operations
+	}
+
+	if len(opts.DefaultWatermarkImage) > 0 {
+		headers, operations := img.Headers, img.Operations
+		img, err = overlayWatermarkImage(img, opts.DefaultWatermarkImage, opts.DefaultWatermarkOpacity, opts)
+		img.Headers, img.Operations = headers, operations
+	}
+
+	return img, err
+}
+
+// overlayWatermarkImage composites the watermark image on the bottom right
+// corner of the image.
+func overlayWatermarkImage(img Image, watermark []byte, opacity float64, opts ImageOptions) (Image, error) {
+	mark, err := decodeRaster(watermark)
+	if err != nil {
+		return Image{}, NewError("Cannot decode the watermark image: "+err.Error(), InternalError)
+	}
+
+	opts.Type = bimg.DetermineImageTypeName(img.Body)
+	return overlayWatermark(img, mark, opacity, opts)
+}
+
+func overlayWatermark(img Image, mark *image.NRGBA, opacity float64, opts ImageOptions) (Image, error) {
+	base, err := decodeRaster(img.Body)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+
+	bounds := base.Bounds()
+	size := mark.Bounds().Size()
+	origin := image.Pt(bounds.Max.X-size.X-watermarkMargin, bounds.Max.Y-size.Y-watermarkMargin)
+	mask := image.NewUniform(colorAlpha(opacity))
+	draw.DrawMask(base, image.Rectangle{origin, origin.Add(size)}, mark, mark.Bounds().Min, mask, image.ZP, draw.Over)
+
+	return encodeRaster(base, opts)
+}
+
+// LoadWatermarkImage reads the named overlay image from the watermark
+// images directory.
+func LoadWatermarkImage(dir, name string) ([]byte, error) {
+	if dir == "" {
+		return nil, NewError("Watermark images are not enabled, see the -watermark-dir flag", NotAllowed)
+	}
+	if isResourceName(name) == false {
+		return nil, NewError("Invalid watermark image name: "+name, BadRequest)
+	}
+
+	for _, ext := range []string{".png", ".webp", ".jpg", ".jpeg"} {
+		if buf, err := ioutil.ReadFile(filepath.Join(dir, name+ext)); err == nil {
+			return buf, nil
+		}
+	}
+	return nil, NewError("Watermark image not found: "+name, NotFound)
+}
+
+// parseSprite parses the x,y,w,h region of a sprite atlas.
+func parseSprite(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.ZR, NewError("Invalid watermarksprite param: must be x,y,w,h", BadRequest)
+	}
+
+	values := make([]int, 4)
+	for i, part := range parts {
+		num, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || num < 0 {
+			return image.ZR, NewError("Invalid watermarksprite param: must be x,y,w,h", BadRequest)
+		}
+		values[i] = num
+	}
+	if values[2] == 0 || values[3] == 0 {
+		return image.ZR, NewError("Invalid watermarksprite param: empty region", BadRequest)
+	}
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// WatermarkImage composites an overlay image from the watermark images
+// directory, or a region of it if used as a sprite atlas, on the bottom
+// right corner of the image.
+func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
+	if o.WatermarkImage == "" {
+		return Image{}, NewError("Missing required param: watermarkimage", BadRequest)
+	}
+
+	watermark, err := LoadWatermarkImage(o.WatermarkDir, o.WatermarkImage)
+	if err != nil {
+		return Image{}, err
+	}
+
+	mark, err := decodeRaster(watermark)
+	if err != nil {
+		return Image{}, NewError("Cannot decode the watermark image: "+err.Error(), InternalError)
+	}
+
+	if o.WatermarkSprite != "" {
+		region, err := parseSprite(o.WatermarkSprite)
+		if err != nil {
+			return Image{}, err
+		}
+		if region.In(mark.Bounds()) == false {
+			return Image{}, NewError("Invalid watermarksprite param: region out of the watermark image bounds", BadRequest)
+		}
+		mark = mark.SubImage(region).(*image.NRGBA)
+	}
+
+	image := Image{Body: buf, Mime: GetImageMimeType(bimg.DetermineImageType(buf))}
+	return overlayWatermark(image, mark, float64(o.Opacity), keepImageType(buf, o))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// spriteAtlasDir writes a 40x20 atlas with a red and a blue 20x20 sprite.
+func spriteAtlasDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	atlas := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(atlas, image.Rect(0, 0, 20, 20), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+	draw.Draw(atlas, image.Rect(20, 0, 40, 20), image.NewUniform(color.NRGBA{0, 0, 255, 255}), image.ZP, draw.Src)
+	ioutil.WriteFile(path.Join(dir, "badges.png"), encodeTestPNG(t, atlas), 0644)
+	return dir
+}
+
+func TestWatermarkImageSprites(t *testing.T) {
+	dir := spriteAtlasDir(t)
+	defer os.RemoveAll(dir)
+
+	base := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(base, base.Bounds(), image.White, image.ZP, draw.Src)
+	buf := encodeTestPNG(t, base)
+
+	cases := []struct {
+		sprite   string
+		expected color.NRGBA
+	}{
+		{"0,0,20,20", color.NRGBA{255, 0, 0, 255}},
+		{"20,0,20,20", color.NRGBA{0, 0, 255, 255}},
+	}
+
+	for _, test := range cases {
+		image, err := WatermarkImage(buf, ImageOptions{WatermarkDir: dir, WatermarkImage: "badges", WatermarkSprite: test.sprite})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := decodeRaster(image.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The sprite is composited on the bottom right corner, within the margin
+		if c := img.NRGBAAt(80, 80); c != test.expected {
+			t.Errorf("Invalid sprite %s color: %v", test.sprite, c)
+		}
+		if c := img.NRGBAAt(60, 80); c != (color.NRGBA{255, 255, 255, 255}) {
+			t.Errorf("Only the sprite region must be composited: %v", c)
+		}
+	}
+}
+
+func TestWatermarkImageInvalidSprite(t *testing.T) {
+	dir := spriteAtlasDir(t)
+	defer os.RemoveAll(dir)
+
+	buf, _ := ioutil.ReadFile("fixtures/test.png")
+	for _, sprite := range []string{"30,0,20,20", "0,0,0,20", "0,0,20", "a,b,c,d", "-1,0,20,20"} {
+		if _, err := WatermarkImage(buf, ImageOptions{WatermarkDir: dir, WatermarkImage: "badges", WatermarkSprite: sprite}); err == nil {
+			t.Errorf("Invalid sprite region must be rejected: %s", sprite)
+		}
+	}
+
+	if _, err := WatermarkImage(buf, ImageOptions{WatermarkDir: dir, WatermarkImage: "../badges"}); err == nil {
+		t.Error("Invalid watermark image names must be rejected")
+	}
+	if _, err := WatermarkImage(buf, ImageOptions{WatermarkImage: "badges"}); err == nil {
+		t.Error("Watermark images must be disabled without directory")
+	}
+}